@@ -0,0 +1,127 @@
+package xform
+
+import "fmt"
+
+// fnApplyDeep is applyDeep(seq, ruleset?, unmatched?, mode?): apply() with
+// built-in rules that by default drop unmatched elements. For a document
+// or element without a rule its children are processed in turn; with
+// unmatched "copy" an element is kept, with its attributes, around the
+// processed children, as apply() does, while the default "text" drops the
+// element and keeps only what its children produce.
+func fnApplyDeep(args [][]any, ctx Context) []any {
+	if len(args) == 0 {
+		return []any{}
+	}
+	b := &builtinRules{ruleset: "main", ctx: ctx, originals: map[*Node]*Node{}}
+	if len(args) > 1 && len(args[1]) > 0 {
+		b.ruleset = ToString(args[1])
+	}
+	if len(args) > 2 {
+		switch mode := ToString(args[2]); mode {
+		case "text":
+		case "copy":
+			b.copyElements = true
+		default:
+			panic(fmt.Errorf("XFDY0002: unknown applyDeep() mode %q (want text or copy)", mode))
+		}
+	}
+	if len(args) > 3 {
+		b.mode = ToString(args[3])
+	}
+	return b.finish(b.apply(args[0]))
+}
+
+// builtinRules are the rules apply() and applyDeep() fall back to for the
+// items no rule of the set matches, like XSLT's built-in templates: the
+// children of a document or element are processed in turn with the same
+// rule set and mode, the element itself copied around them when
+// copyElements is set. Text and atomic items are kept as they are,
+// attributes as their values; comments and processing instructions are
+// dropped. With a profile, a whitespace-preserving element without a rule
+// is kept verbatim: copied whole, or its text when elements are dropped,
+// without rules applied to its content.
+type builtinRules struct {
+	ruleset, mode string
+	copyElements  bool
+	ctx           Context
+	// originals maps the copied elements to their sources, for finish.
+	originals map[*Node]*Node
+}
+
+func (b *builtinRules) apply(seq []any) []any {
+	return applyRules(seq, b.ruleset, b.mode, b.ctx, b.unmatched)
+}
+
+func (b *builtinRules) unmatched(item any) []any {
+	n, ok := item.(*Node)
+	if !ok {
+		return []any{item}
+	}
+	switch n.Kind {
+	case "document":
+		return b.apply(nodeItems(n.Children))
+	case "element":
+		if profileOf(b.ctx).IsPreserve(n.Name) {
+			return b.verbatim(n)
+		}
+		children := b.apply(nodeItems(n.Children))
+		if !b.copyElements {
+			return children
+		}
+		// Copies are made without namespace fixup, which only the
+		// outermost ones need: the others sit inside copies of their
+		// ancestors.
+		copied := deepCopy(n, false)
+		b.originals[copied] = n
+		b.ctx.Runtime.nodeCreated()
+		for _, item := range children {
+			var child *Node
+			if c, ok := item.(*Node); ok {
+				child = DeepCopy(c, true)
+				b.ctx.Runtime.chargeTree(child)
+			} else {
+				child = &Node{Kind: "text", Value: ToString([]any{item}), Attrs: map[string]string{}}
+				b.ctx.Runtime.charge(nodeBytes + int64(len(child.Value)))
+			}
+			child.Parent = copied
+			copied.Children = append(copied.Children, child)
+		}
+		return []any{copied}
+	case "attribute":
+		return []any{n.Value}
+	case "text":
+		return []any{n}
+	}
+	return []any{}
+}
+
+// verbatim is the built-in rule for whitespace-preserving elements.
+func (b *builtinRules) verbatim(n *Node) []any {
+	if !b.copyElements {
+		text := &Node{Kind: "text", Value: n.StringValue(), Attrs: map[string]string{}}
+		b.ctx.Runtime.charge(nodeBytes + int64(len(text.Value)))
+		return []any{text}
+	}
+	copied := deepCopy(n, true)
+	b.originals[copied] = n
+	b.ctx.Runtime.chargeTree(copied)
+	return []any{copied}
+}
+
+// finish fixes up the namespaces of the outermost copies in out.
+func (b *builtinRules) finish(out []any) []any {
+	for _, item := range out {
+		if n, ok := item.(*Node); ok && b.originals[n] != nil {
+			fixupNamespaces(n, b.originals[n])
+		}
+	}
+	return out
+}
+
+func nodeItems(nodes []*Node) []any {
+	out := make([]any, len(nodes))
+	for i, n := range nodes {
+		out[i] = n
+	}
+	return out
+}
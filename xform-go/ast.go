@@ -1,43 +1,154 @@
 package xform
 
+import "strings"
+
 type Module struct {
-	Functions  map[string]FunctionDef
-	Rules      map[string][]RuleDef
-	Vars       map[string]Expr
-	Namespaces map[string]string
-	Imports    [][2]*string
-	Expr       Expr
+	Functions map[string]FunctionDef
+	Rules     map[string][]RuleDef
+	Vars      map[string]Expr
+	// Params are the declared parameters, "param name;" or with a default
+	// "param name := expr;", in declaration order.
+	Params []Param
+	// VarPos holds the position of the name of each "var name := expr;",
+	// VarDoc the comments right above the declarations that have them.
+	VarPos      map[string]Position
+	VarDoc      map[string][]Comment
+	Namespaces  map[string]string
+	Imports     [][2]*string
+	Whitespace  string
+	Strict      bool
+	Output      *Output
+	Compat      Compat
+	Phases      []Phase
+	Validations []ValidationSet
+	Expr        Expr
+	// Comments are all comments of the module's source, in source order,
+	// including those also attached to declarations as Doc.
+	Comments []Comment
+}
+
+// Comment is a "# ..." comment; Text includes the "#". A Trailing comment
+// follows code on its line. The Doc of a declaration are the comments on
+// the lines directly above it, without a blank line in between.
+type Comment struct {
+	Text     string
+	Pos      Position
+	Trailing bool
+}
+
+// DocText returns the text of doc comments without the "#" and the space
+// after it, one line per comment.
+func DocText(doc []Comment) string {
+	lines := make([]string, len(doc))
+	for i, c := range doc {
+		lines[i] = strings.TrimPrefix(strings.TrimPrefix(c.Text, "#"), " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Whitespace policies for whitespace-only text in constructors, set per
+// module with a "whitespace <policy>;" declaration.
+const (
+	WhitespaceStrip    = "strip"
+	WhitespaceInline   = "inline"
+	WhitespacePreserve = "preserve"
+)
+
+// Output holds the serialization parameters of an output declaration such
+// as: output method "html", indent true, doctype-system "about:legacy-compat";
+type Output struct {
+	Method         string // "xml" (default), "html" or "text"
+	Indent         bool
+	DoctypeSystem  string
+	DoctypePublic  string
+	XMLDeclaration bool
+	SortAttributes bool
+	Encoding       string // canonical, see OutputEncoding; "" for UTF-8
+	BOM            bool
+	Newline        string // "\n", "\r\n" or "" to leave line ends alone
+}
+
+type Phase struct {
+	Name string
+	Expr Expr
+	Doc  []Comment
+}
+
+// ValidationSet groups the validate rules sharing a name, like a Schematron
+// pattern: each node is checked by the first matching rule of every set.
+type ValidationSet struct {
+	Name  string
+	Rules []RuleDef
 }
 
 type Expr interface{}
 
 type Literal struct{ Value any }
 
-type VarRef struct{ Name string }
+// VarRef is a variable reference. A bare name falls back to a function
+// reference or the child elements of that name when no variable is bound;
+// an Explicit reference, written $name, only ever names a variable.
+type VarRef struct {
+	Name     string
+	Explicit bool
+	Pos      Position
+}
+
+// Sequence is a parenthesized, comma-separated sequence (a, b, c); () is
+// the empty sequence.
+type Sequence struct {
+	Items []Expr
+}
 
 type IfExpr struct {
 	Cond     Expr
 	ThenExpr Expr
 	ElseExpr Expr
+	Pos      Position
 }
 
 type LetExpr struct {
 	Name  string
 	Value Expr
 	Body  Expr
+	Pos   Position
 }
 
 type ForExpr struct {
 	Name  string
 	Seq   Expr
 	Where Expr
-	Body  Expr
+	// GroupBy holds the keys of a group by clause; the body is then
+	// evaluated once per group.
+	GroupBy []GroupKey
+	// OrderBy holds the keys of an order by clause, which sorts the
+	// iterations, or the groups, before the body is evaluated.
+	OrderBy []OrderKey
+	Body    Expr
+	Pos     Position
+}
+
+// GroupKey is $Name := Expr in a group by clause; group by $x is
+// $x := $x.
+type GroupKey struct {
+	Name string
+	Expr Expr
+}
+
+// OrderKey is a key of an order by clause with its modifiers. Collation
+// is "" to compare numbers as numbers and other keys as strings, "numeric"
+// to compare all keys as numbers or "string" to compare them as strings.
+type OrderKey struct {
+	Expr       Expr
+	Descending bool
+	Collation  string
 }
 
 type MatchExpr struct {
 	Target  Expr
 	Cases   []MatchCase
 	Default Expr
+	Pos     Position
 }
 
 type MatchCase struct {
@@ -45,31 +156,55 @@ type MatchCase struct {
 	Expr    Expr
 }
 
+// TryExpr is try { Body } catch $Var { Catch }. Var is "" when the catch
+// clause binds no variable.
+type TryExpr struct {
+	Body  Expr
+	Var   string
+	Catch Expr
+	Pos   Position
+}
+
+// FunctionExpr is an inline function, fn($x) := body.
+type FunctionExpr struct {
+	Params []Param
+	Body   Expr
+	Pos    Position
+}
+
 type FuncCall struct {
 	Name string
 	Args []Expr
+	Pos  Position
 }
 
 type UnaryOp struct {
 	Op   string
 	Expr Expr
+	Pos  Position
 }
 
 type BinaryOp struct {
 	Op    string
 	Left  Expr
 	Right Expr
+	Pos   Position
 }
 
 type PathExpr struct {
 	Start PathStart
 	Steps []PathStep
+	Pos   Position
 }
 
 type Constructor struct {
 	Name     string
 	Attrs    []AttrConstructor
 	Contents []Expr
+	// Scope maps the prefixes declared with literal xmlns attributes by the
+	// constructors around this one, "" for the default namespace, to their
+	// URIs.
+	Scope map[string]string
 }
 
 type AttrConstructor struct {
@@ -77,21 +212,80 @@ type AttrConstructor struct {
 	Expr Expr
 }
 
+// TextJoin is textJoin(sep) { expr }: the string values of the items expr
+// produces, joined by sep (default "") without building the sequence.
+type TextJoin struct {
+	Sep  Expr
+	Expr Expr
+}
+
+// MapConstructor is map { key: value, ... }. Each key is a single item,
+// taken by its string value; each value is a whole sequence.
+type MapConstructor struct {
+	Entries []MapEntry
+	Pos     Position
+}
+
+type MapEntry struct {
+	Key   Expr
+	Value Expr
+}
+
+// ArrayConstructor is [expr, ...]: an array with the items of the
+// expressions as its members.
+type ArrayConstructor struct {
+	Items []Expr
+	Pos   Position
+}
+
+// Lookup is expr.name or expr[key]: the value of a key of the maps, or the
+// member at a position of the arrays, expr yields. When expr[key] yields
+// other items Bracket makes it a predicate filtering them instead.
+type Lookup struct {
+	Expr    Expr
+	Key     Expr
+	Bracket bool
+	Pos     Position
+}
+
 type TextConstructor struct{ Expr Expr }
 
+// CommentConstructor is comment { expr }: a comment holding the string
+// value of expr.
+type CommentConstructor struct{ Expr Expr }
+
+// PIConstructor is pi(name) { expr }: a processing instruction with the
+// target name and the string value of expr as its content.
+type PIConstructor struct {
+	Name Expr
+	Expr Expr
+	Pos  Position
+}
+
+// DocumentConstructor is document { expr }: a document node with copies
+// of the nodes expr yields as its children.
+type DocumentConstructor struct{ Expr Expr }
+
 type Text struct{ Value string }
 
 type Interp struct{ Expr Expr }
 
 type PathStart struct {
-	Kind string
-	Name *string
+	Kind     string
+	Name     *string
+	Explicit bool     // a "var" start written $name
+	Pos      Position // of a "var" start
 }
 
 type PathStep struct {
 	Axis       string
 	Test       StepTest
 	Predicates []Expr
+	// Siblings marks a // step: its predicates number the nodes among the
+	// matching children of their parent, as a//b[1] is
+	// a/descendant-or-self::node()/child::b[1], where descendant::b[1]
+	// numbers all of them.
+	Siblings bool
 }
 
 type StepTest struct {
@@ -117,14 +311,31 @@ type Param struct {
 	Name    string
 	TypeRef *string
 	Default Expr
+	Pos     Position
+	Doc     []Comment // of a module parameter declaration
 }
 
 type FunctionDef struct {
-	Params []Param
-	Body   Expr
+	Name       string
+	Params     []Param
+	Body       Expr
+	Deprecated *string
+	Line       int
+	NamePos    Position
+	Doc        []Comment
 }
 
 type RuleDef struct {
+	Name string
+	// Mode is the rule's mode within its rule set, "" for the default
+	// mode; apply() in a mode tries only that mode's rules.
+	Mode    string
 	Pattern Pattern
-	Body    Expr
+	// Priority orders the rules of a set: the matching rule of the highest
+	// priority fires, the first declared among equals. The default is 0.
+	Priority   float64
+	Body       Expr
+	Deprecated *string
+	Line       int
+	Doc        []Comment
 }
@@ -0,0 +1,175 @@
+package xform
+
+import (
+	"io"
+	"strings"
+)
+
+// Attribute-value normalization, as XML 1.0 section 3.3.3 requires: a tab,
+// line end or line feed written literally in an attribute value reads as a
+// space, while one written as a character reference such as &#10; is
+// kept. The decoder resolves references before values reach the tree, so
+// literal whitespace is replaced in the markup first. Values of attributes
+// the DTD declares with a type other than CDATA are then trimmed and their
+// runs of spaces collapsed, see normalizeTokenized.
+
+// attrNormalizer rewrites the literal whitespace in the attribute values
+// of markup, fed in chunks of any size. It only drops or replaces bytes,
+// so it can work in place.
+type attrNormalizer struct {
+	state  int
+	quote  byte
+	markup string // what follows < or <! while the kind of markup is open
+	tail   string // the last bytes of a comment, CDATA section or PI
+	cr     bool   // the last byte of a value was \r
+	depth  int    // of [ ] in a doctype
+}
+
+const (
+	normText  = iota
+	normOpen  // after <
+	normBang  // after <!, deciding between comment, CDATA and doctype
+	normTag   // in a start or end tag
+	normValue // in a quoted attribute value
+	normComment
+	normCDATA
+	normPI
+	normDirective
+)
+
+// normalize rewrites p in place and returns the rewritten part.
+func (n *attrNormalizer) normalize(p []byte) []byte {
+	out := p[:0]
+	for _, c := range p {
+		switch n.state {
+		case normText:
+			if c == '<' {
+				n.state = normOpen
+			}
+		case normOpen:
+			switch c {
+			case '!':
+				n.state, n.markup = normBang, ""
+			case '?':
+				n.state, n.tail = normPI, ""
+			default:
+				n.state = normTag
+			}
+		case normBang:
+			n.markup += string(c)
+			switch {
+			case n.markup == "--":
+				n.state, n.tail = normComment, ""
+			case n.markup == "[CDATA[":
+				n.state, n.tail = normCDATA, ""
+			case !strings.HasPrefix("--", n.markup) && !strings.HasPrefix("[CDATA[", n.markup):
+				n.state, n.depth, n.quote = normDirective, 0, 0
+				n.directive(c)
+			}
+		case normTag:
+			switch c {
+			case '"', '\'':
+				n.state, n.quote, n.cr = normValue, c, false
+			case '>':
+				n.state = normText
+			}
+		case normValue:
+			cr := n.cr
+			n.cr = c == '\r'
+			switch {
+			case c == n.quote:
+				n.state = normTag
+			case c == '\n' && cr:
+				continue
+			case c == '\n' || c == '\r' || c == '\t':
+				c = ' '
+			}
+		case normComment:
+			n.state = n.closes(c, "-->", normComment)
+		case normCDATA:
+			n.state = n.closes(c, "]]>", normCDATA)
+		case normPI:
+			n.state = n.closes(c, "?>", normPI)
+		case normDirective:
+			n.directive(c)
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// closes returns normText once the bytes seen end with end, else state.
+func (n *attrNormalizer) closes(c byte, end string, state int) int {
+	n.tail += string(c)
+	if len(n.tail) > len(end) {
+		n.tail = n.tail[1:]
+	}
+	if n.tail == end {
+		return normText
+	}
+	return state
+}
+
+// directive follows a <!DOCTYPE ...> to its end, past the quoted strings
+// and the internal subset.
+func (n *attrNormalizer) directive(c byte) {
+	switch {
+	case n.quote != 0:
+		if c == n.quote {
+			n.quote = 0
+		}
+	case c == '"' || c == '\'':
+		n.quote = c
+	case c == '[':
+		n.depth++
+	case c == ']':
+		n.depth--
+	case c == '>' && n.depth <= 0:
+		n.state = normText
+	}
+}
+
+// normalizeAttributeText normalizes the attribute values of a whole
+// document.
+func normalizeAttributeText(text string) string {
+	if !strings.ContainsAny(text, "\t\n\r") {
+		return text
+	}
+	n := &attrNormalizer{}
+	return string(n.normalize([]byte(text)))
+}
+
+// attrNormalizingReader normalizes the attribute values of a document
+// read incrementally.
+type attrNormalizingReader struct {
+	r io.Reader
+	n attrNormalizer
+}
+
+func (r *attrNormalizingReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.r.Read(p)
+		out := r.n.normalize(p[:n])
+		// A chunk of only a dropped \n reads as nothing; read on rather
+		// than return 0 bytes without error.
+		if len(out) > 0 || err != nil {
+			return len(out), err
+		}
+	}
+}
+
+// normalizeTokenized trims the value of an attribute the DTD declares with
+// a type other than CDATA and collapses its runs of spaces to one.
+func normalizeTokenized(value string) string {
+	var b strings.Builder
+	for _, field := range strings.Split(value, " ") {
+		if field == "" {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(field)
+	}
+	return b.String()
+}
@@ -0,0 +1,76 @@
+package xform
+
+// reverseAxes lists the axes whose nodes are numbered from the context node
+// outwards in predicates, so ancestor::x[1] is the nearest x. ApplyStep
+// still returns them in document order.
+var reverseAxes = map[string]bool{
+	"parent":            true,
+	"ancestor":          true,
+	"ancestor_or_self":  true,
+	"preceding_sibling": true,
+	"preceding":         true,
+}
+
+// axisNodes returns the nodes on axis from n: forward axes in document
+// order, reverse axes nearest first. Attributes have no siblings; their
+// ancestors, following and preceding nodes are those of their element,
+// whose descendants follow them.
+func axisNodes(axis string, n *Node) []*Node {
+	out := []*Node{}
+	switch axis {
+	case "ancestor_or_self":
+		out = append(out, n)
+		fallthrough
+	case "ancestor":
+		for p := n.Parent; p != nil; p = p.Parent {
+			out = append(out, p)
+		}
+	case "following_sibling", "preceding_sibling":
+		if n.Kind == "attribute" || n.Parent == nil {
+			return out
+		}
+		siblings := n.Parent.Children
+		i := childIndex(n)
+		if axis == "following_sibling" {
+			return append(out, siblings[i+1:]...)
+		}
+		for j := i - 1; j >= 0; j-- {
+			out = append(out, siblings[j])
+		}
+	case "following":
+		if n.Kind == "attribute" && n.Parent != nil {
+			n = n.Parent
+			out = append(out, IterDescendants(n)...)
+		}
+		for ; n.Parent != nil; n = n.Parent {
+			for _, s := range n.Parent.Children[childIndex(n)+1:] {
+				out = append(out, s)
+				out = append(out, IterDescendants(s)...)
+			}
+		}
+	case "preceding":
+		if n.Kind == "attribute" && n.Parent != nil {
+			n = n.Parent
+		}
+		for ; n.Parent != nil; n = n.Parent {
+			siblings := n.Parent.Children
+			for j := childIndex(n) - 1; j >= 0; j-- {
+				desc := IterDescendants(siblings[j])
+				for k := len(desc) - 1; k >= 0; k-- {
+					out = append(out, desc[k])
+				}
+				out = append(out, siblings[j])
+			}
+		}
+	}
+	return out
+}
+
+func childIndex(n *Node) int {
+	for i, c := range n.Parent.Children {
+		if c == n {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,217 @@
+package xform
+
+import (
+	"sort"
+	"strings"
+)
+
+// BuiltinDoc describes a function a transform can call without defining
+// it, for documentation and editors. A parameter name ending in "?" is
+// optional and one ending in "..." takes any number of arguments, as in
+// the Params of pack functions. Pack is the pack of a pack function, whose
+// Name then has the pack prefix.
+type BuiltinDoc struct {
+	Name   string
+	Pack   string
+	Params []string
+	Doc    string
+}
+
+// Signature is the call of d as the documentation writes it, such as
+// "substring(s, start, length?)".
+func (d BuiltinDoc) Signature() string {
+	return d.Name + "(" + strings.Join(d.Params, ", ") + ")"
+}
+
+// builtinDocs are the parameters and descriptions of the builtins, by name.
+var builtinDocs = map[string]BuiltinDoc{
+	"string":       {Params: []string{"value?"}, Doc: "The string value of value."},
+	"number":       {Params: []string{"value?"}, Doc: "The numeric value of value, NaN when it is not a number."},
+	"boolean":      {Params: []string{"value?"}, Doc: "The effective boolean value of value."},
+	"typeOf":       {Params: []string{"value"}, Doc: "The type of the first item: node, string, number, boolean, map, array, function, or null when there is none."},
+	"name":         {Params: []string{"node?"}, Doc: "The qualified name of the node or the context item."},
+	"localName":    {Params: []string{"node?"}, Doc: "The name of the node or the context item without its prefix."},
+	"namespaceUri": {Params: []string{"node?"}, Doc: "The namespace of an element, or of an attribute as bound on its element."},
+	"attr":         {Params: []string{"node", "name"}, Doc: "The value of the named attribute of node, or empty."},
+	"text":         {Params: []string{"node", "deep?"}, Doc: "The text of node's children, or with deep of all its descendants."},
+	"children":     {Params: []string{"node"}, Doc: "The child nodes of node."},
+	"elements":     {Params: []string{"node", "name?"}, Doc: "The child elements of node, or those matching the name test."},
+	"copy":         {Params: []string{"node", "recurse?"}, Doc: "A copy of node, without its children when recurse is false."},
+	"count":        {Params: []string{"seq"}, Doc: "The number of items in seq."},
+	"deepEqual":    {Params: []string{"a", "b"}, Doc: "Whether both sequences have the same length and pairwise equal items, comparing nodes by their content."},
+	"empty":        {Params: []string{"seq"}, Doc: "Whether seq has no items."},
+	"distinct":     {Params: []string{"seq", "key?"}, Doc: "The first item of seq for each string value, or for each key."},
+	"docOrder":     {Params: []string{"seq"}, Doc: "The nodes of seq in document order, without duplicates."},
+	"unordered":    {Params: []string{"seq"}, Doc: "seq, marked as a sequence whose order does not matter."},
+	"sort":         {Params: []string{"seq", "key?"}, Doc: "The items of seq sorted by their string value, or by key."},
+	"concat":       {Params: []string{"seq..."}, Doc: "The items of all arguments as one sequence."},
+	"index":        {Params: []string{"seq", "key..."}, Doc: "An index of the items of seq by their string value, or one level per key."},
+	"lookup":       {Params: []string{"map", "key..."}, Doc: "The items of an index, map or array at the key path."},
+	"lookupAll":    {Params: []string{"index", "key..."}, Doc: "All items below the key path of an index, in input order."},
+	"keys":         {Params: []string{"map"}, Doc: "The keys of an index level in first-occurrence order, or the sorted keys of a map."},
+	"groupBy":      {Params: []string{"seq", "key"}, Doc: "A group element for each key of the items of seq, in first-occurrence order."},
+	"call":         {Params: []string{"f", "arg..."}, Doc: "The result of calling the function item f with the arguments."},
+	"map":          {Params: []string{"seq", "f"}, Doc: "The concatenated results of f called with each item of seq."},
+	"filter":       {Params: []string{"seq", "f"}, Doc: "The items of seq for which f returns true."},
+	"fold":         {Params: []string{"seq", "init", "f"}, Doc: "f called with init and the first item, then with each result and the next item; init for an empty seq."},
+	"seq":          {Params: []string{"seq..."}, Doc: "The items of all arguments as one sequence."},
+	"sum":          {Params: []string{"seq"}, Doc: "The sum of the numeric values of seq, 0 for an empty sequence."},
+	"sumBy":        {Params: []string{"seq", "f"}, Doc: "The sum of number(f(item)) over seq."},
+	"countBy":      {Params: []string{"seq", "f"}, Doc: "A map from string(f(item)) to the number of items with that key."},
+	"product":      {Params: []string{"seq"}, Doc: "The product of the numeric values of seq, 1 for an empty sequence."},
+	"slugify":      {Params: []string{"s"}, Doc: "A lowercase ASCII id of letters, digits and single hyphens, with Latin diacritics folded."},
+	"levenshtein":  {Params: []string{"a", "b"}, Doc: "The edit distance between a and b in characters."},
+	"soundex":      {Params: []string{"s"}, Doc: "The American Soundex code of s."},
+	"soundsLike":   {Params: []string{"a", "b"}, Doc: "Whether a and b have the same non-empty Soundex code."},
+	"lang":         {Params: []string{"node?", "lang?"}, Doc: "The inherited language of the node or context item, or whether it is lang or one of its subtags."},
+	"upperCase":    {Params: []string{"s", "locale?"}, Doc: "s in upper case, mapped for the locale."},
+	"lowerCase":    {Params: []string{"s", "locale?"}, Doc: "s in lower case, mapped for the locale."},
+	"matches":      {Params: []string{"s", "pattern", "flags?"}, Doc: "Whether the regular expression pattern matches anywhere in s."},
+	"replace":      {Params: []string{"s", "pattern", "replacement", "flags?"}, Doc: "s with the matches of pattern replaced; $0 to $9 insert the match and its groups."},
+	"tokenize":     {Params: []string{"s", "pattern?", "flags?"}, Doc: "The parts of s between the matches of pattern, or between whitespace runs."},
+	"formatDate":   {Params: []string{"date", "picture?", "locale?"}, Doc: "A date, or an ISO date or dateTime string, formatted with an XPath-style picture."},
+	"formatNumber": {Params: []string{"n", "picture", "locale?"}, Doc: "n formatted with an XSLT format-number picture such as #,##0.00, in the separators of locale or a map of symbols."},
+	"id":           {Params: []string{"values", "node?"}, Doc: "The elements whose ID is one of the whitespace-separated values, in document order."},
+	"checkIds":     {Params: []string{"doc?", "refAttrs?"}, Doc: "A report of duplicate IDs and dangling references in the document."},
+	"head":         {Params: []string{"seq"}, Doc: "The first item of seq."},
+	"tail":         {Params: []string{"seq"}, Doc: "The items of seq after the first."},
+	"last":         {Params: []string{"seq?"}, Doc: "The last item of seq, or without an argument the size of the context sequence."},
+	"position":     {Doc: "The position of the context item in the context sequence."},
+	"apply":        {Params: []string{"seq", "ruleset?", "mode?"}, Doc: "The results of the best matching rule of the ruleset for each item of seq."},
+	"applyDeep":    {Params: []string{"seq", "ruleset?", "unmatched?", "mode?"}, Doc: "apply() with built-in rules that process the children of unmatched elements, dropping or copying the elements."},
+	"doc":          {Params: []string{"uri"}, Doc: "The document at uri, relative to the transform's directory, parsed once per evaluation."},
+	"collection":   {Params: []string{"dir-or-glob"}, Doc: "The documents in a directory, or matching a glob, in name order."},
+	"isInline":     {Params: []string{"node"}, Doc: "Whether node is an inline element of the vocabulary profile."},
+	"isBlock":      {Params: []string{"node"}, Doc: "Whether node is a block element of the vocabulary profile."},
+	"diff":         {Params: []string{"a", "b"}, Doc: "A diff element listing the changes from node a to node b."},
+	"patch":        {Params: []string{"doc", "changes"}, Doc: "A copy of doc with the change list applied."},
+	"assert":       {Params: []string{"cond", "message"}, Doc: "A failed-assert element when cond is false, in validate rules."},
+	"report":       {Params: []string{"cond", "message"}, Doc: "A successful-report element when cond is true, in validate rules."},
+
+	"substring":      {Params: []string{"s", "start", "length?"}, Doc: "The characters of s from position start (1-based), length of them or up to the end."},
+	"stringLength":   {Params: []string{"s?"}, Doc: "The number of characters of s or of the context item."},
+	"contains":       {Params: []string{"s", "t"}, Doc: "Whether t occurs in s."},
+	"startsWith":     {Params: []string{"s", "t"}, Doc: "Whether s starts with t."},
+	"endsWith":       {Params: []string{"s", "t"}, Doc: "Whether s ends with t."},
+	"normalizeSpace": {Params: []string{"s?"}, Doc: "s trimmed, with runs of whitespace replaced by one space."},
+	"trim":           {Params: []string{"s"}, Doc: "s without leading and trailing whitespace."},
+	"split":          {Params: []string{"s", "sep"}, Doc: "The parts of s between occurrences of the literal sep; its characters for an empty sep."},
+	"join":           {Params: []string{"seq", "sep?"}, Doc: "The string values of the items of seq, separated by sep."},
+	"padLeft":        {Params: []string{"s", "width", "pad?"}, Doc: "s padded on the left with pad, a space by default, to width characters."},
+	"padRight":       {Params: []string{"s", "width", "pad?"}, Doc: "s padded on the right with pad, a space by default, to width characters."},
+
+	"decimal": {Params: []string{"x"}, Doc: "x as an exact decimal; doubles convert by their shortest representation."},
+
+	"resultDocument": {Params: []string{"href", "content"}, Doc: "Writes content as the separate output document href and returns the empty sequence."},
+	"functions":      {Params: []string{"name?"}, Doc: "A map describing each function a transform can call without defining it, or the named one."},
+
+	"mapKeys":   {Params: []string{"map"}, Doc: "The keys of map, sorted."},
+	"mapPut":    {Params: []string{"map", "key", "value"}, Doc: "A copy of map with key set to value."},
+	"mapMerge":  {Params: []string{"map..."}, Doc: "One map with the entries of all maps; the last one wins for a key in several."},
+	"mapRemove": {Params: []string{"map", "key..."}, Doc: "A copy of map without the keys."},
+	"arraySize": {Params: []string{"array"}, Doc: "The number of members of array."},
+	"arrayGet":  {Params: []string{"array", "i"}, Doc: "The member of array at the 1-based position i, which must exist."},
+
+	"currentDate":     {Doc: "Today's date; the same throughout an evaluation."},
+	"currentDateTime": {Doc: "The current date and time; the same throughout an evaluation."},
+	"parseDate":       {Params: []string{"s", "picture?", "locale?"}, Doc: "The date or dateTime in s, read with a formatDate picture or in ISO form."},
+	"addDuration":     {Params: []string{"date", "duration"}, Doc: "date plus an ISO 8601 duration such as P1M or -PT30M."},
+	"dateDiff":        {Params: []string{"from", "to", "unit?"}, Doc: "The whole years, months, weeks, days (default), hours, minutes or seconds from from to to."},
+}
+
+// Builtins describes the builtin functions, sorted by name.
+func Builtins() []BuiltinDoc {
+	out := make([]BuiltinDoc, 0, len(builtins))
+	for name := range builtins {
+		d := builtinDocs[name]
+		d.Name = name
+		out = append(out, d)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// LookupBuiltin describes the builtin or registered pack function called
+// name, such as "substring" or "table:rows", for example for the hover of
+// an editor.
+func LookupBuiltin(name string) (BuiltinDoc, bool) {
+	return lookupFunctionDoc(name, RegisteredPacks())
+}
+
+func lookupFunctionDoc(name string, packs []*BuiltinPack) (BuiltinDoc, bool) {
+	if _, ok := builtins[name]; ok {
+		d := builtinDocs[name]
+		d.Name = name
+		return d, true
+	}
+	prefix, local, ok := strings.Cut(name, ":")
+	if !ok {
+		return BuiltinDoc{}, false
+	}
+	// The last pack of a name wins, as in packFunctions.
+	for i := len(packs) - 1; i >= 0; i-- {
+		if p := packs[i]; p.Name == prefix {
+			if fn, ok := p.Functions[local]; ok {
+				return BuiltinDoc{Name: name, Pack: p.Name, Params: fn.Params, Doc: fn.Doc}, true
+			}
+		}
+	}
+	return BuiltinDoc{}, false
+}
+
+// fnFunctions is functions(name?): a map with the name, pack, params,
+// signature and doc of each builtin, pack and host function the
+// evaluation may call, in name order, or of the named one.
+func fnFunctions(args [][]any, ctx Context) []any {
+	rt := ctx.Runtime
+	var packs []*BuiltinPack
+	names := map[string]bool{}
+	for name := range builtins {
+		names[name] = true
+	}
+	if rt != nil {
+		packs = append(RegisteredPacks(), rt.Options.Packs...)
+		for name := range rt.packs {
+			names[name] = true
+		}
+	}
+	if len(args) > 0 && len(args[0]) > 0 {
+		name := ToString(args[0])
+		if !names[name] {
+			return []any{}
+		}
+		names = map[string]bool{name: true}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		if rt == nil || rt.allowed == nil || rt.allowed[name] {
+			sorted = append(sorted, name)
+		}
+	}
+	sort.Strings(sorted)
+	out := []any{}
+	for _, name := range sorted {
+		d, ok := lookupFunctionDoc(name, packs)
+		if !ok {
+			// A host function, which has no description.
+			d = BuiltinDoc{Name: name}
+		}
+		out = append(out, d.item())
+	}
+	return out
+}
+
+// item is d as the map functions() returns.
+func (d BuiltinDoc) item() map[string][]any {
+	params := make([]any, len(d.Params))
+	for i, p := range d.Params {
+		params[i] = p
+	}
+	return map[string][]any{
+		"name":      {d.Name},
+		"pack":      {d.Pack},
+		"params":    params,
+		"signature": {d.Signature()},
+		"doc":       {d.Doc},
+	}
+}
@@ -0,0 +1,197 @@
+package xform
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const bundleManifestName = "xfpkg.json"
+
+type BundleManifest struct {
+	Version   int      `json:"version"`
+	Main      string   `json:"main"`
+	Modules   []string `json:"modules"`
+	Resources []string `json:"resources,omitempty"`
+}
+
+type Bundle struct {
+	FS       fs.FS
+	Manifest BundleManifest
+}
+
+func IsBundle(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("PK\x03\x04"))
+}
+
+// WriteBundle packages mainPath, every module it imports (transitively) and
+// the given resource files into a zip archive. Paths inside the archive are
+// relative to the deepest directory containing all of them, so relative
+// imports and doc() references keep working when run from the bundle.
+func WriteBundle(w io.Writer, mainPath string, resources []string) error {
+	modules, err := collectModuleFiles(mainPath)
+	if err != nil {
+		return err
+	}
+	all := append([]string{}, modules...)
+	for _, r := range resources {
+		abs, err := filepath.Abs(r)
+		if err != nil {
+			return err
+		}
+		all = append(all, abs)
+	}
+	root := commonDir(all)
+	rel := func(p string) string {
+		r, _ := filepath.Rel(root, p)
+		return filepath.ToSlash(r)
+	}
+	manifest := BundleManifest{Version: 1, Main: rel(modules[0])}
+	zw := zip.NewWriter(w)
+	for i, p := range all {
+		name := rel(p)
+		if i < len(modules) {
+			manifest.Modules = append(manifest.Modules, name)
+		} else {
+			manifest.Resources = append(manifest.Resources, name)
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		fw, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(data); err != nil {
+			return err
+		}
+	}
+	fw, err := zw.Create(bundleManifestName)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(fw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func collectModuleFiles(mainPath string) ([]string, error) {
+	abs, err := filepath.Abs(mainPath)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	out := []string{}
+	var visit func(p string) error
+	visit = func(p string) error {
+		if seen[p] {
+			return nil
+		}
+		seen[p] = true
+		out = append(out, p)
+		src, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		module, err := parseModuleSafe(string(src))
+		if err != nil {
+			return fmt.Errorf("%s: %v", p, err)
+		}
+		for _, imp := range module.Imports {
+			iri := *imp[0]
+			if URIScheme(iri) != "" {
+				return fmt.Errorf("%s: cannot bundle remote import %s", p, iri)
+			}
+			if err := visit(filepath.Join(filepath.Dir(p), filepath.FromSlash(iri))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := visit(abs); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func parseModuleSafe(src string) (module *Module, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return NewParser(src).ParseModule(), nil
+}
+
+func commonDir(paths []string) string {
+	dirs := make([]string, len(paths))
+	for i, p := range paths {
+		dirs[i] = filepath.Dir(p)
+	}
+	sort.Strings(dirs)
+	root := dirs[0]
+	for _, d := range dirs[1:] {
+		for root != d && !strings.HasPrefix(d, root+string(filepath.Separator)) {
+			parent := filepath.Dir(root)
+			if parent == root {
+				break
+			}
+			root = parent
+		}
+	}
+	return root
+}
+
+func OpenBundle(p string) (*Bundle, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	return ReadBundle(data)
+}
+
+func ReadBundle(data []byte) (*Bundle, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	raw, err := fs.ReadFile(zr, bundleManifestName)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bundle: %v", err)
+	}
+	b := &Bundle{FS: zr}
+	if err := json.Unmarshal(raw, &b.Manifest); err != nil {
+		return nil, fmt.Errorf("invalid bundle manifest: %v", err)
+	}
+	if b.Manifest.Version != 1 {
+		return nil, fmt.Errorf("unsupported bundle version %d", b.Manifest.Version)
+	}
+	return b, nil
+}
+
+func (b *Bundle) Source() (string, error) {
+	data, err := fs.ReadFile(b.FS, b.Manifest.Main)
+	return string(data), err
+}
+
+func (b *Bundle) Program() (*Program, error) {
+	return CompileFS(b.FS, b.Manifest.Main)
+}
+
+// Resolver serves relative doc() references from the bundle and delegates
+// everything else to next (DefaultResolvers when nil).
+func (b *Bundle) Resolver(next Resolver) Resolver {
+	return FSResolver{FS: b.FS, Dir: path.Dir(b.Manifest.Main), Next: next}
+}
@@ -0,0 +1,214 @@
+package xform
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Catalog rewrites system identifiers, public identifiers and URIs to local
+// resources. It understands OASIS XML catalogs as well as a plain mapping
+// file with one "from to" (or "from = to") pair per line, where a trailing
+// "*" on the left-hand side turns the entry into a prefix rewrite.
+type Catalog struct {
+	uris          map[string]string
+	systems       map[string]string
+	publics       map[string]string
+	rewriteURI    [][2]string
+	rewriteSystem [][2]string
+	uriSuffix     [][2]string
+	systemSuffix  [][2]string
+	next          []*Catalog
+}
+
+func NewCatalog() *Catalog {
+	return &Catalog{uris: map[string]string{}, systems: map[string]string{}, publics: map[string]string{}}
+}
+
+func LoadCatalog(path string) (*Catalog, error) {
+	return loadCatalog(path, map[string]bool{})
+}
+
+func loadCatalog(path string, seen map[string]bool) (*Catalog, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if seen[abs] {
+		return NewCatalog(), nil
+	}
+	seen[abs] = true
+	data, err := os.ReadFile(abs)
+	if err != nil {
+		return nil, err
+	}
+	cat := NewCatalog()
+	base := filepath.Dir(abs)
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("<")) {
+		doc, err := ParseXMLBytes(data)
+		if err != nil {
+			return nil, fmt.Errorf("catalog %s: %v", path, err)
+		}
+		for _, n := range IterDescendants(doc) {
+			if n.Kind != "element" {
+				continue
+			}
+			if err := cat.addEntry(n, base, seen); err != nil {
+				return nil, fmt.Errorf("catalog %s: %v", path, err)
+			}
+		}
+		return cat, nil
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.Replace(line, "=", " ", 1)
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("catalog %s: invalid mapping %q", path, scanner.Text())
+		}
+		target := ResolveURI(base, fields[1])
+		if strings.HasSuffix(fields[0], "*") {
+			cat.rewriteURI = append(cat.rewriteURI, [2]string{strings.TrimSuffix(fields[0], "*"), target})
+			continue
+		}
+		cat.uris[fields[0]] = target
+	}
+	return cat, scanner.Err()
+}
+
+func (c *Catalog) addEntry(n *Node, base string, seen map[string]bool) error {
+	target := func(attr string) string { return ResolveURI(base, n.Attrs[attr]) }
+	switch n.Name {
+	case "uri":
+		c.uris[n.Attrs["name"]] = target("uri")
+	case "system":
+		c.systems[n.Attrs["systemId"]] = target("uri")
+	case "public":
+		c.publics[normalizePublicID(n.Attrs["publicId"])] = target("uri")
+	case "rewriteURI":
+		c.rewriteURI = append(c.rewriteURI, [2]string{n.Attrs["uriStartString"], target("rewritePrefix")})
+	case "rewriteSystem":
+		c.rewriteSystem = append(c.rewriteSystem, [2]string{n.Attrs["systemIdStartString"], target("rewritePrefix")})
+	case "uriSuffix":
+		c.uriSuffix = append(c.uriSuffix, [2]string{n.Attrs["uriSuffix"], target("uri")})
+	case "systemSuffix":
+		c.systemSuffix = append(c.systemSuffix, [2]string{n.Attrs["systemIdSuffix"], target("uri")})
+	case "nextCatalog":
+		next, err := loadCatalog(target("catalog"), seen)
+		if err != nil {
+			return err
+		}
+		c.next = append(c.next, next)
+	}
+	return nil
+}
+
+func (c *Catalog) Merge(other *Catalog) {
+	c.next = append(c.next, other)
+}
+
+func (c *Catalog) LookupURI(uri string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	if v, ok := c.uris[uri]; ok {
+		return v, true
+	}
+	if v, ok := rewritePrefix(c.rewriteURI, uri); ok {
+		return v, true
+	}
+	if v, ok := matchSuffix(c.uriSuffix, uri); ok {
+		return v, true
+	}
+	if v, ok := c.lookupSystemLocal(uri); ok {
+		return v, true
+	}
+	for _, n := range c.next {
+		if v, ok := n.LookupURI(uri); ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func (c *Catalog) LookupSystem(systemID string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	if v, ok := c.lookupSystemLocal(systemID); ok {
+		return v, true
+	}
+	for _, n := range c.next {
+		if v, ok := n.LookupSystem(systemID); ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func (c *Catalog) LookupPublic(publicID string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	if v, ok := c.publics[normalizePublicID(publicID)]; ok {
+		return v, true
+	}
+	for _, n := range c.next {
+		if v, ok := n.LookupPublic(publicID); ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func (c *Catalog) lookupSystemLocal(systemID string) (string, bool) {
+	if v, ok := c.systems[systemID]; ok {
+		return v, true
+	}
+	if v, ok := rewritePrefix(c.rewriteSystem, systemID); ok {
+		return v, true
+	}
+	return matchSuffix(c.systemSuffix, systemID)
+}
+
+func rewritePrefix(entries [][2]string, s string) (string, bool) {
+	best := -1
+	for i, e := range entries {
+		if e[0] != "" && strings.HasPrefix(s, e[0]) && (best < 0 || len(e[0]) > len(entries[best][0])) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return "", false
+	}
+	prefix := entries[best][1]
+	rest := strings.TrimPrefix(s, entries[best][0])
+	if URIScheme(prefix) != "" {
+		return strings.TrimSuffix(prefix, "/") + "/" + strings.TrimPrefix(rest, "/"), true
+	}
+	return filepath.Join(prefix, filepath.FromSlash(rest)), true
+}
+
+func matchSuffix(entries [][2]string, s string) (string, bool) {
+	best := -1
+	for i, e := range entries {
+		if e[0] != "" && strings.HasSuffix(s, e[0]) && (best < 0 || len(e[0]) > len(entries[best][0])) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return "", false
+	}
+	return entries[best][1], true
+}
+
+func normalizePublicID(id string) string {
+	return strings.Join(strings.Fields(id), " ")
+}
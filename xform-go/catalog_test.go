@@ -0,0 +1,96 @@
+package xform
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFiles writes files, by path relative to dir, into dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testCatalog(t *testing.T) (string, *Catalog) {
+	t.Helper()
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"catalog.xml": `<catalog xmlns="urn:oasis:names:tc:entity:xmlns:xml:catalog">
+  <uri name="https://example.com/lib.xform" uri="local/lib.xform"/>
+  <system systemId="http://example.com/doc.dtd" uri="local/doc.dtd"/>
+  <public publicId="-//Example//DTD Doc//EN" uri="local/doc.dtd"/>
+</catalog>`,
+		"local/lib.xform": "def hello($x) := concat(\"hi \", $x);\n()",
+		"local/doc.dtd":   `<!ATTLIST sec key ID #REQUIRED kind NMTOKENS #IMPLIED>`,
+		"main.xform":      "import \"https://example.com/lib.xform\";\nhello(\"there\")",
+	})
+	catalog, err := LoadCatalog(filepath.Join(dir, "catalog.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, catalog
+}
+
+func TestCatalogImports(t *testing.T) {
+	dir, catalog := testCatalog(t)
+	main := filepath.Join(dir, "main.xform")
+	if _, err := CompileFile(main); err == nil {
+		t.Fatal("remote import without a catalog compiled")
+	}
+	prog, err := CompileFileWith(main, catalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := prog.Eval(&Node{Kind: "document", Attrs: map[string]string{}}, EvalOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := SerializeResult(result, SerializeOptions{}); got != "hi there" {
+		t.Errorf("got %q, want %q", got, "hi there")
+	}
+}
+
+func TestCatalogDoctype(t *testing.T) {
+	_, catalog := testCatalog(t)
+	body := `<doc><sec key="s1"/><sec key="s2" kind="  a   b "/></doc>`
+	for _, doctype := range []string{
+		`<!DOCTYPE doc SYSTEM "http://example.com/doc.dtd">`,
+		`<!DOCTYPE doc PUBLIC "-//Example//DTD Doc//EN" "unmapped.dtd">`,
+	} {
+		doc, err := ParseXMLBytesWith([]byte(doctype+body), ParseOptions{Catalog: catalog})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := doc.DTD.IDs["sec"]; len(ids) != 1 || ids[0] != "key" {
+			t.Errorf("%s: ID attributes %v, want [key]", doctype, ids)
+		}
+		if got := doc.Children[0].Children[1].Attrs["kind"]; got != "a b" {
+			t.Errorf("%s: kind = %q, want %q", doctype, got, "a b")
+		}
+	}
+	doc, err := ParseXMLBytesWith([]byte(`<!DOCTYPE doc SYSTEM "http://example.com/doc.dtd">`+body), ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.DTD.IDs) != 0 {
+		t.Errorf("external subset read without a catalog: %v", doc.DTD.IDs)
+	}
+}
+
+func TestCatalogMissingSubset(t *testing.T) {
+	catalog := NewCatalog()
+	catalog.systems["http://example.com/doc.dtd"] = filepath.Join(t.TempDir(), "missing.dtd")
+	_, err := ParseXMLBytesWith([]byte(`<!DOCTYPE doc SYSTEM "http://example.com/doc.dtd"><doc/>`), ParseOptions{Catalog: catalog})
+	if err == nil {
+		t.Fatal("missing external subset parsed without an error")
+	}
+}
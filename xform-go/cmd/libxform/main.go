@@ -0,0 +1,166 @@
+// Command libxform is the engine as a C shared library, for calling it
+// in-process from Python, Node and other languages with a C FFI:
+//
+//	go build -buildmode=c-shared -o libxform.so ./cmd/libxform
+//
+// The build also writes libxform.h. Transforms are compiled once and
+// referred to by handle:
+//
+//	long long xform_compile(char* source, char** error);
+//	long long xform_compile_file(char* path, char** error);
+//	char*     xform_run(long long handle, char* input, char* options, char** error);
+//	void      xform_release(long long handle);
+//	void      xform_free(char* s);
+//	char*     xform_version(void);
+//
+// xform_run parses input, evaluates the transform and serializes the
+// result as its output declarations say. options is NULL or a JSON object
+// {"inputFormat", "inputName", "baseDir", "params": {name: value}}. On
+// failure the compile functions return 0 and xform_run NULL, and *error is
+// set to the message, such as "XFDY0002: number conversion (line 2, column
+// 10)". Returned strings belong to the caller, who frees them with
+// xform_free. All functions may be called from several threads.
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"unsafe"
+
+	xform "xform-go"
+	_ "xform-go/packs/cryptopack"
+)
+
+// abiVersion is reported by xform_version and changes only with
+// incompatible changes to the functions above.
+const abiVersion = "1"
+
+var (
+	mu         sync.Mutex
+	programs              = map[C.longlong]*xform.Program{}
+	nextHandle C.longlong = 1
+)
+
+type runOptions struct {
+	InputFormat string            `json:"inputFormat"`
+	InputName   string            `json:"inputName"`
+	BaseDir     string            `json:"baseDir"`
+	Params      map[string]string `json:"params"`
+}
+
+func main() {}
+
+//export xform_compile
+func xform_compile(source *C.char, errOut **C.char) C.longlong {
+	if source == nil {
+		return fail(errOut, errors.New("xform_compile: source is NULL"))
+	}
+	prog, err := xform.Compile(C.GoString(source))
+	if err != nil {
+		return fail(errOut, err)
+	}
+	return register(prog)
+}
+
+//export xform_compile_file
+func xform_compile_file(path *C.char, errOut **C.char) C.longlong {
+	if path == nil {
+		return fail(errOut, errors.New("xform_compile_file: path is NULL"))
+	}
+	prog, err := xform.CompileFile(C.GoString(path))
+	if err != nil {
+		return fail(errOut, err)
+	}
+	return register(prog)
+}
+
+func register(prog *xform.Program) C.longlong {
+	mu.Lock()
+	defer mu.Unlock()
+	handle := nextHandle
+	nextHandle++
+	programs[handle] = prog
+	return handle
+}
+
+//export xform_run
+func xform_run(handle C.longlong, input *C.char, options *C.char, errOut **C.char) *C.char {
+	mu.Lock()
+	prog, ok := programs[handle]
+	mu.Unlock()
+	if !ok {
+		fail(errOut, errors.New("xform_run: unknown or released handle"))
+		return nil
+	}
+	if input == nil {
+		fail(errOut, errors.New("xform_run: input is NULL"))
+		return nil
+	}
+	var o runOptions
+	if options != nil {
+		if err := json.Unmarshal([]byte(C.GoString(options)), &o); err != nil {
+			fail(errOut, errors.New("xform_run: invalid options: "+err.Error()))
+			return nil
+		}
+	}
+	output, err := run(prog, C.GoString(input), o)
+	if err != nil {
+		fail(errOut, err)
+		return nil
+	}
+	return C.CString(output)
+}
+
+func run(prog *xform.Program, input string, o runOptions) (string, error) {
+	format, err := xform.ParseInputFormat(o.InputFormat)
+	if err != nil {
+		return "", err
+	}
+	name := o.InputName
+	if name == "" {
+		name = "input"
+	}
+	item, err := xform.ParseInputItem(name, []byte(input), format)
+	if err != nil {
+		return "", err
+	}
+	opts := xform.EvalOptions{BaseDir: o.BaseDir, Params: map[string][]any{}}
+	for k, v := range o.Params {
+		opts.Params[k] = []any{v}
+	}
+	result, err := prog.EvalItem(item, opts)
+	if err != nil {
+		return "", err
+	}
+	return xform.SerializeResult(result, prog.Module.SerializeOptions()), nil
+}
+
+//export xform_release
+func xform_release(handle C.longlong) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(programs, handle)
+}
+
+//export xform_free
+func xform_free(s *C.char) {
+	C.free(unsafe.Pointer(s))
+}
+
+//export xform_version
+func xform_version() *C.char {
+	return C.CString(abiVersion)
+}
+
+func fail(errOut **C.char, err error) C.longlong {
+	if errOut != nil {
+		*errOut = C.CString(err.Error())
+	}
+	return 0
+}
@@ -0,0 +1,15 @@
+//go:build go1.24
+
+package main
+
+import "net/http"
+
+// enableCleartextHTTP2 lets srv accept HTTP/2 without TLS, as gRPC clients
+// connecting to a plaintext address expect.
+func enableCleartextHTTP2(srv *http.Server) error {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	srv.Protocols = &protocols
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !go1.24
+
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+func enableCleartextHTTP2(srv *http.Server) error {
+	return errors.New("serving gRPC without TLS needs a build with Go 1.24 or later; pass -tls-cert and -tls-key")
+}
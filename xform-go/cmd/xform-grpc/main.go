@@ -0,0 +1,300 @@
+// Command xform-grpc serves the engine over gRPC, for deploying it as a
+// transformation sidecar shared by services in other languages:
+//
+//	xform-grpc [-addr :50051] [-tls-cert cert.pem -tls-key key.pem]
+//
+// The service, xform.v1.Transformer, is defined in xform.proto next to
+// this file; generate typed clients from it. CompileTransform compiles a
+// transform and returns its id, and ApplyTransform streams inputs through
+// compiled transforms. Compile and evaluation errors come back in the
+// responses' error fields; gRPC statuses report only protocol failures.
+//
+// Without TLS the server speaks HTTP/2 in cleartext (h2c), which needs Go
+// 1.24 or later to build.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing/fstest"
+
+	xform "xform-go"
+	_ "xform-go/packs/cryptopack"
+)
+
+const mainFile = "main.xform"
+
+func main() {
+	fs := flag.NewFlagSet("xform-grpc", flag.ContinueOnError)
+	addr := fs.String("addr", ":50051", "listen address")
+	certFile := fs.String("tls-cert", "", "TLS certificate file")
+	keyFile := fs.String("tls-key", "", "TLS key file")
+	maxTransforms := fs.Int("max-transforms", 256, "compiled transforms kept; the oldest are released beyond this")
+	maxMessage := fs.Int("max-message", 16, "MiB a single request message may have")
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		os.Exit(2)
+	}
+	if (*certFile == "") != (*keyFile == "") {
+		fmt.Fprintln(os.Stderr, "xform-grpc: -tls-cert and -tls-key go together")
+		os.Exit(2)
+	}
+	s := &server{programs: map[string]*xform.Program{}, maxPrograms: *maxTransforms, maxMessage: *maxMessage << 20}
+	srv := &http.Server{Addr: *addr, Handler: s}
+	var err error
+	if *certFile != "" {
+		fmt.Fprintf(os.Stderr, "xform-grpc serving on %s (TLS)\n", *addr)
+		err = srv.ListenAndServeTLS(*certFile, *keyFile)
+	} else if err = enableCleartextHTTP2(srv); err == nil {
+		fmt.Fprintf(os.Stderr, "xform-grpc serving on %s\n", *addr)
+		err = srv.ListenAndServe()
+	}
+	fmt.Fprintln(os.Stderr, "xform-grpc:", err)
+	os.Exit(1)
+}
+
+// server implements xform.v1.Transformer. Compiled programs are keyed by
+// a hash of their sources, so clients compiling the same transform share
+// one program.
+type server struct {
+	mu          sync.Mutex
+	programs    map[string]*xform.Program
+	order       []string
+	maxPrograms int
+	maxMessage  int
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "xform-grpc serves gRPC only", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	var err error
+	switch r.URL.Path {
+	case "/xform.v1.Transformer/CompileTransform":
+		err = s.compileTransform(w, r)
+	case "/xform.v1.Transformer/ApplyTransform":
+		err = s.applyTransform(w, r)
+	default:
+		err = &status{codeUnimplemented, "unknown method " + r.URL.Path}
+	}
+	st := statusOf(err)
+	w.Header().Set("Grpc-Status", strconv.Itoa(st.code))
+	if st.message != "" {
+		w.Header().Set("Grpc-Message", grpcMessage(st.message))
+	}
+}
+
+func (s *server) compileTransform(w http.ResponseWriter, r *http.Request) error {
+	msg, err := readMessage(r.Body, s.maxMessage)
+	if err == io.EOF {
+		return &status{codeInvalidArgument, "missing CompileRequest"}
+	}
+	if err != nil {
+		return err
+	}
+	var source string
+	files := fstest.MapFS{}
+	var entryErr error
+	err = decodeFields(msg, func(num int, data []byte) {
+		switch num {
+		case 1:
+			source = string(data)
+		case 2:
+			name, content, err := decodeMapEntry(data)
+			if err != nil {
+				entryErr = err
+			} else if name != mainFile {
+				files[name] = &fstest.MapFile{Data: []byte(content)}
+			}
+		}
+	})
+	if err == nil {
+		err = entryErr
+	}
+	if err != nil {
+		return err
+	}
+	files[mainFile] = &fstest.MapFile{Data: []byte(source)}
+
+	var resp protoBuffer
+	id := transformID(files)
+	if _, ok := s.program(id); !ok {
+		prog, err := xform.CompileFS(files, mainFile)
+		if err != nil {
+			resp.message(2, encodeError(err))
+			return writeResponse(w, resp)
+		}
+		s.add(id, prog)
+	}
+	resp.string(1, id)
+	return writeResponse(w, resp)
+}
+
+func (s *server) applyTransform(w http.ResponseWriter, r *http.Request) error {
+	for {
+		msg, err := readMessage(r.Body, s.maxMessage)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var req applyRequest
+		if err := req.decode(msg); err != nil {
+			return err
+		}
+		if err := writeResponse(w, s.apply(req)); err != nil {
+			return err
+		}
+	}
+}
+
+type applyRequest struct {
+	transformID string
+	input       []byte
+	inputFormat string
+	inputName   string
+	params      map[string][]any
+}
+
+func (req *applyRequest) decode(msg []byte) error {
+	req.params = map[string][]any{}
+	var entryErr error
+	err := decodeFields(msg, func(num int, data []byte) {
+		switch num {
+		case 1:
+			req.transformID = string(data)
+		case 2:
+			req.input = data
+		case 3:
+			req.inputFormat = string(data)
+		case 4:
+			req.inputName = string(data)
+		case 5:
+			key, value, err := decodeMapEntry(data)
+			if err != nil {
+				entryErr = err
+			}
+			req.params[key] = []any{value}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return entryErr
+}
+
+// apply evaluates one ApplyRequest and encodes its ApplyResponse.
+func (s *server) apply(req applyRequest) protoBuffer {
+	var resp protoBuffer
+	prog, ok := s.program(req.transformID)
+	if !ok {
+		resp.message(2, encodeError(errors.New("unknown transform id "+strconv.Quote(req.transformID)+"; compile the transform again")))
+		return resp
+	}
+	format, err := xform.ParseInputFormat(req.inputFormat)
+	if err != nil {
+		resp.message(2, encodeError(err))
+		return resp
+	}
+	name := req.inputName
+	if name == "" {
+		name = "input"
+	}
+	input, err := xform.ParseInputItem(name, req.input, format)
+	if err != nil {
+		resp.message(2, encodeError(err))
+		return resp
+	}
+	var warnings []string
+	result, err := prog.EvalItem(input, xform.EvalOptions{Params: req.params, Diagnostics: func(d xform.Diagnostic) {
+		warnings = append(warnings, d.String())
+	}})
+	if err != nil {
+		resp.message(2, encodeError(err))
+	} else {
+		resp.string(1, xform.SerializeResult(result, prog.Module.SerializeOptions()))
+	}
+	for _, warning := range warnings {
+		resp.string(3, warning)
+	}
+	return resp
+}
+
+func (s *server) program(id string) (*xform.Program, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prog, ok := s.programs[id]
+	return prog, ok
+}
+
+func (s *server) add(id string, prog *xform.Program) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.programs[id]; ok {
+		return
+	}
+	s.programs[id] = prog
+	s.order = append(s.order, id)
+	for len(s.order) > s.maxPrograms && len(s.order) > 1 {
+		delete(s.programs, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+// transformID hashes the transform's files in name order.
+func transformID(files fstest.MapFS) string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%d:%s%d:", len(name), name, len(files[name].Data))
+		h.Write(files[name].Data)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// encodeError encodes err as an xform.v1.Error message.
+func encodeError(err error) protoBuffer {
+	var e protoBuffer
+	code, message := "", err.Error()
+	if c := xform.ErrorCode(err); c != "unknown" {
+		code = c
+	}
+	var xe *xform.XFormError
+	if errors.As(err, &xe) {
+		code, message = xe.Code, xe.Message
+		if xe.Pos.IsValid() {
+			e.int32(3, xe.Pos.Line)
+			e.int32(4, xe.Pos.Column)
+		}
+	}
+	var out protoBuffer
+	out.string(1, code)
+	out.string(2, message)
+	return append(out, e...)
+}
+
+func writeResponse(w http.ResponseWriter, resp protoBuffer) error {
+	if err := writeMessage(w, resp); err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// gRPC status codes used by the server.
+const (
+	codeOK                = 0
+	codeInvalidArgument   = 3
+	codeResourceExhausted = 8
+	codeUnimplemented     = 12
+	codeInternal          = 13
+)
+
+// status is a gRPC status, sent as the grpc-status and grpc-message
+// trailers.
+type status struct {
+	code    int
+	message string
+}
+
+func (s *status) Error() string { return s.message }
+
+func statusOf(err error) *status {
+	if err == nil {
+		return &status{code: codeOK}
+	}
+	var st *status
+	if errors.As(err, &st) {
+		return st
+	}
+	return &status{code: codeInternal, message: err.Error()}
+}
+
+// grpcMessage percent-encodes s for the grpc-message trailer.
+func grpcMessage(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// readMessage reads one length-prefixed gRPC message. It returns io.EOF
+// when the stream ends between messages.
+func readMessage(r io.Reader, limit int) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, &status{codeInvalidArgument, "truncated message header"}
+		}
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, &status{codeUnimplemented, "compressed messages are not supported"}
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if int64(n) > int64(limit) {
+		return nil, &status{codeResourceExhausted, fmt.Sprintf("message of %d bytes exceeds the limit of %d", n, limit)}
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, &status{codeInvalidArgument, "truncated message"}
+	}
+	return msg, nil
+}
+
+func writeMessage(w io.Writer, msg []byte) error {
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[1:], uint32(len(msg)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+// Protocol buffer wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// decodeFields calls fn for each length-delimited field of the protocol
+// buffer message b; the server's messages have no others, and fields of
+// other types are skipped.
+func decodeFields(b []byte, fn func(num int, data []byte)) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errMalformed
+		}
+		b = b[n:]
+		num, typ := int(key>>3), int(key&7)
+		switch typ {
+		case wireVarint:
+			_, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errMalformed
+			}
+			b = b[n:]
+		case wireFixed64, wireFixed32:
+			size := 8
+			if typ == wireFixed32 {
+				size = 4
+			}
+			if len(b) < size {
+				return errMalformed
+			}
+			b = b[size:]
+		case wireBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return errMalformed
+			}
+			fn(num, b[n:n+int(size)])
+			b = b[n+int(size):]
+		default:
+			return errMalformed
+		}
+	}
+	return nil
+}
+
+var errMalformed = &status{codeInvalidArgument, "malformed protocol buffer message"}
+
+// decodeMapEntry decodes an entry of a map<string, string> field.
+func decodeMapEntry(b []byte) (key, value string, err error) {
+	err = decodeFields(b, func(num int, data []byte) {
+		switch num {
+		case 1:
+			key = string(data)
+		case 2:
+			value = string(data)
+		}
+	})
+	return key, value, err
+}
+
+// protoBuffer encodes a protocol buffer message. Zero values are left out,
+// as proto3 does.
+type protoBuffer []byte
+
+func (p *protoBuffer) key(num, typ int) {
+	*p = binary.AppendUvarint(*p, uint64(num)<<3|uint64(typ))
+}
+
+func (p *protoBuffer) bytes(num int, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	p.key(num, wireBytes)
+	*p = binary.AppendUvarint(*p, uint64(len(b)))
+	*p = append(*p, b...)
+}
+
+func (p *protoBuffer) string(num int, s string) {
+	p.bytes(num, []byte(s))
+}
+
+func (p *protoBuffer) int32(num int, v int) {
+	if v == 0 {
+		return
+	}
+	p.key(num, wireVarint)
+	*p = binary.AppendUvarint(*p, uint64(int64(v)))
+}
+
+// message encodes a nested message, which unlike other fields is sent even
+// when empty.
+func (p *protoBuffer) message(num int, m protoBuffer) {
+	p.key(num, wireBytes)
+	*p = binary.AppendUvarint(*p, uint64(len(m)))
+	*p = append(*p, m...)
+}
@@ -0,0 +1,144 @@
+//go:build js && wasm
+
+// Command xform-wasm is the engine built for WebAssembly. It installs a
+// global xform object for xform.js, the JavaScript wrapper next to it:
+//
+//	xform.compile(source, files?)          -> {handle} or {error}
+//	xform.run(handle, input, options?)     -> {output, warnings} or {error}
+//	xform.release(handle)
+//
+// files maps paths to contents; the transform is files["main.xform"] when it
+// imports modules, and doc() reads the other files relative to it. options
+// are {inputFormat, inputName, params}. Errors are {code, message, line,
+// column}.
+package main
+
+import (
+	"errors"
+	"syscall/js"
+	"testing/fstest"
+
+	xform "xform-go"
+	_ "xform-go/packs/cryptopack"
+)
+
+const mainFile = "main.xform"
+
+var (
+	programs   = map[int]*xform.Program{}
+	nextHandle = 1
+)
+
+func main() {
+	js.Global().Set("xform", js.ValueOf(map[string]any{
+		"compile": js.FuncOf(compile),
+		"run":     js.FuncOf(run),
+		"release": js.FuncOf(release),
+	}))
+	select {}
+}
+
+func compile(_ js.Value, args []js.Value) any {
+	if len(args) == 0 || args[0].Type() != js.TypeString {
+		return failure(errors.New("compile expects the transform source"))
+	}
+	files := fstest.MapFS{mainFile: &fstest.MapFile{Data: []byte(args[0].String())}}
+	if len(args) > 1 && args[1].Type() == js.TypeObject {
+		names := js.Global().Get("Object").Call("keys", args[1])
+		for i := 0; i < names.Length(); i++ {
+			name := names.Index(i).String()
+			if name != mainFile {
+				files[name] = &fstest.MapFile{Data: []byte(args[1].Get(name).String())}
+			}
+		}
+	}
+	prog, err := xform.CompileFS(files, mainFile)
+	if err != nil {
+		return failure(err)
+	}
+	handle := nextHandle
+	nextHandle++
+	programs[handle] = prog
+	return map[string]any{"handle": handle}
+}
+
+func run(_ js.Value, args []js.Value) any {
+	if len(args) < 2 {
+		return failure(errors.New("run expects a handle and the input"))
+	}
+	prog, ok := programs[args[0].Int()]
+	if !ok {
+		return failure(errors.New("unknown or released transform handle"))
+	}
+	options := js.Undefined()
+	if len(args) > 2 {
+		options = args[2]
+	}
+	format, err := xform.ParseInputFormat(stringOption(options, "inputFormat"))
+	if err != nil {
+		return failure(err)
+	}
+	name := stringOption(options, "inputName")
+	if name == "" {
+		name = "input"
+	}
+	input, err := xform.ParseInputItem(name, []byte(args[1].String()), format)
+	if err != nil {
+		return failure(err)
+	}
+	warnings := []any{}
+	opts := xform.EvalOptions{Params: map[string][]any{}, Diagnostics: func(d xform.Diagnostic) {
+		warnings = append(warnings, d.String())
+	}}
+	if params := option(options, "params"); params.Type() == js.TypeObject {
+		names := js.Global().Get("Object").Call("keys", params)
+		for i := 0; i < names.Length(); i++ {
+			key := names.Index(i).String()
+			opts.Params[key] = []any{params.Get(key).String()}
+		}
+	}
+	result, err := prog.EvalItem(input, opts)
+	if err != nil {
+		return failure(err)
+	}
+	return map[string]any{
+		"output":   xform.SerializeResult(result, prog.Module.SerializeOptions()),
+		"warnings": warnings,
+	}
+}
+
+func release(_ js.Value, args []js.Value) any {
+	if len(args) > 0 {
+		delete(programs, args[0].Int())
+	}
+	return nil
+}
+
+func option(options js.Value, name string) js.Value {
+	if options.Type() != js.TypeObject {
+		return js.Undefined()
+	}
+	return options.Get(name)
+}
+
+func stringOption(options js.Value, name string) string {
+	if v := option(options, name); v.Type() == js.TypeString {
+		return v.String()
+	}
+	return ""
+}
+
+func failure(err error) any {
+	e := map[string]any{"code": "", "message": err.Error()}
+	if code := xform.ErrorCode(err); code != "unknown" {
+		e["code"] = code
+	}
+	var xe *xform.XFormError
+	if errors.As(err, &xe) {
+		e["code"], e["message"] = xe.Code, xe.Message
+		if xe.Pos.IsValid() {
+			e["line"], e["column"] = xe.Pos.Line, xe.Pos.Column
+		}
+	}
+	return map[string]any{"error": e}
+}
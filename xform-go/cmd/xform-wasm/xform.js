@@ -0,0 +1,61 @@
+// xform.js wraps xform.wasm, the engine built with `make build-wasm`, for
+// browser playgrounds. Load the Go runtime's wasm_exec.js first (the build
+// copies it next to xform.wasm), then:
+//
+//   const xform = await loadXform("xform.wasm");
+//   const transform = xform.compile('<out>{count(//item)}</out>');
+//   const { output, warnings } = transform.run("<list><item/></list>");
+//   transform.release();
+//
+// compile takes an optional map of further files, for imports and doc();
+// run takes {inputFormat, inputName, params}. Failures throw XformError.
+
+export class XformError extends Error {
+  constructor({ code, message, line, column }) {
+    super(code ? `${code}: ${message}` : message);
+    this.name = "XformError";
+    this.code = code;
+    this.line = line;
+    this.column = column;
+  }
+}
+
+class Transform {
+  constructor(api, handle) {
+    this.api = api;
+    this.handle = handle;
+  }
+
+  run(input, options = {}) {
+    const result = this.api.run(this.handle, input, options);
+    if (result.error) {
+      throw new XformError(result.error);
+    }
+    return { output: result.output, warnings: Array.from(result.warnings) };
+  }
+
+  release() {
+    this.api.release(this.handle);
+  }
+}
+
+// loadXform instantiates the engine from a URL or from the bytes of
+// xform.wasm. The engine installs itself as globalThis.xform.
+export async function loadXform(wasm = "xform.wasm") {
+  const go = new Go();
+  const { instance } =
+    typeof wasm === "string" || wasm instanceof URL
+      ? await WebAssembly.instantiateStreaming(fetch(wasm), go.importObject)
+      : await WebAssembly.instantiate(wasm, go.importObject);
+  go.run(instance);
+  const api = globalThis.xform;
+  return {
+    compile(source, files = {}) {
+      const result = api.compile(source, files);
+      if (result.error) {
+        throw new XformError(result.error);
+      }
+      return new Transform(api, result.handle);
+    },
+  };
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	xform "xform-go"
+)
+
+func runBundle(args []string) int {
+	fs := flag.NewFlagSet("bundle", flag.ContinueOnError)
+	output := fs.String("o", "", "output bundle path (default: <main>.xfpkg)")
+	var resources stringList
+	fs.Var(&resources, "resource", "additional file to embed, e.g. a doc() lookup table (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: xform bundle [-o bundle.xfpkg] [-resource file]... <main.xform>")
+		return 1
+	}
+	mainPath := fs.Arg(0)
+	out := *output
+	if out == "" {
+		out = strings.TrimSuffix(mainPath, ".xform") + ".xfpkg"
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := xform.WriteBundle(f, mainPath, resources); err != nil {
+		f.Close()
+		os.Remove(out)
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := f.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
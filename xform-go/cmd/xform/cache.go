@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	xform "xform-go"
+)
+
+// cacheManifestName is the file in each output directory in which -cache
+// records how the outputs there were made.
+const cacheManifestName = ".xform-cache.json"
+
+// buildCache skips the jobs of xform run whose output was made from the
+// same inputs, transform and parameters: the manifest of the output's
+// directory maps its file name to the key of what it was made from and
+// the hash of what was written. An output changed since, by hand or by
+// another tool, no longer matches and is made again.
+type buildCache struct {
+	mu        sync.Mutex
+	manifests map[string]*cacheManifest
+	changed   map[string]bool
+}
+
+type cacheManifest struct {
+	Version int                   `json:"version"`
+	Outputs map[string]cacheEntry `json:"outputs"`
+}
+
+type cacheEntry struct {
+	Key    string `json:"key"`
+	Output string `json:"output"`
+}
+
+func newBuildCache() *buildCache {
+	return &buildCache{manifests: map[string]*cacheManifest{}, changed: map[string]bool{}}
+}
+
+// manifest returns the manifest of dir, read on first use; an unreadable
+// or foreign manifest counts as empty. c.mu is held.
+func (c *buildCache) manifest(dir string) *cacheManifest {
+	if m := c.manifests[dir]; m != nil {
+		return m
+	}
+	m := &cacheManifest{}
+	if data, err := os.ReadFile(filepath.Join(dir, cacheManifestName)); err == nil {
+		json.Unmarshal(data, m)
+	}
+	if m.Version != 1 || m.Outputs == nil {
+		m = &cacheManifest{Version: 1, Outputs: map[string]cacheEntry{}}
+	}
+	c.manifests[dir] = m
+	return m
+}
+
+// valid reports whether output was made from key and is unchanged since.
+func (c *buildCache) valid(output, key string) bool {
+	c.mu.Lock()
+	e, ok := c.manifest(filepath.Dir(output)).Outputs[filepath.Base(output)]
+	c.mu.Unlock()
+	if !ok || e.Key != key {
+		return false
+	}
+	data, err := os.ReadFile(output)
+	return err == nil && hashBytes(data) == e.Output
+}
+
+// record notes that data, made from key, was written to output.
+func (c *buildCache) record(output, key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dir := filepath.Dir(output)
+	c.manifest(dir).Outputs[filepath.Base(output)] = cacheEntry{Key: key, Output: hashBytes(data)}
+	c.changed[dir] = true
+}
+
+// save writes the manifests with new entries, each replacing the old one
+// at once so that an interrupted save leaves a manifest that can be read.
+func (c *buildCache) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dirs := make([]string, 0, len(c.changed))
+	for dir := range c.changed {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		data, err := json.MarshalIndent(c.manifests[dir], "", "  ")
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, cacheManifestName)
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return err
+		}
+		delete(c.changed, dir)
+	}
+	return nil
+}
+
+// cacheKey hashes what the output of a job depends on: the transform with
+// the modules it imports (or the bundle), the parameters, the step's
+// input format and indentation, and the names and contents of the
+// inputs. Documents loaded with doc() are not part of it.
+func (r *pipelineRunner) cacheKey(s *pipelineStep, inputs []string) (string, error) {
+	digest, err := r.transformDigest(r.path(s.Transform))
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "xform-cache 1\ntransform %s\nformat %q\nindent %t\n", digest, s.InputFormat, s.Indent)
+	params := r.stepParams(s)
+	names := make([]string, 0, len(params))
+	for k := range params {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		fmt.Fprintf(h, "param %q %q\n", k, params[k])
+	}
+	for _, in := range inputs {
+		f, err := os.Open(in)
+		if err != nil {
+			return "", err
+		}
+		ih := sha256.New()
+		_, err = io.Copy(ih, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "input %q %x\n", r.rel(in), ih.Sum(nil))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// transformDigest returns the hash of the transform at path: the bundle,
+// or the source of the main module and of every module it imports.
+func (r *pipelineRunner) transformDigest(path string) (string, error) {
+	prog, err := r.program(path)
+	if err != nil {
+		return "", err
+	}
+	r.mu.Lock()
+	e := r.programs[path]
+	r.mu.Unlock()
+	e.digestOnce.Do(func() { e.digest, e.digestErr = programDigest(path, prog) })
+	return e.digest, e.digestErr
+}
+
+func programDigest(path string, prog *xform.Program) (string, error) {
+	if prog.FS != nil {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return hashBytes(data), nil
+	}
+	names := make([]string, 0, len(prog.Modules))
+	for name := range prog.Modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.FromSlash(name))
+		if err != nil {
+			return "", err
+		}
+		// Named relative to the main module, so that the key does not
+		// depend on the directory xform runs in.
+		rel, err := filepath.Rel(filepath.Dir(path), filepath.FromSlash(name))
+		if err != nil {
+			rel = name
+		}
+		fmt.Fprintf(h, "module %q %d\n", filepath.ToSlash(rel), len(data))
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// withoutManifests drops cache manifests from glob matches, which a
+// pattern such as build/* would otherwise pick up as inputs.
+func withoutManifests(paths []string) []string {
+	out := paths[:0]
+	for _, p := range paths {
+		if filepath.Base(p) != cacheManifestName {
+			out = append(out, p)
+		}
+	}
+	return out
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	xform "xform-go"
+)
+
+// runCompile checks a transform and its imports and writes a Go source file
+// embedding them, meant to be driven from a //go:generate directive:
+//
+//	//go:generate xform compile -o transform_xform.go main.xform
+func runCompile(args []string) int {
+	fs := flag.NewFlagSet("compile", flag.ContinueOnError)
+	output := fs.String("o", "", "generated Go file (default: <main>_xform.go)")
+	pkg := fs.String("pkg", os.Getenv("GOPACKAGE"), "package name of the generated file")
+	varName := fs.String("var", "Transform", "name of the generated *xform.Program variable")
+	importPath := fs.String("import", "xform-go", "import path of the xform package")
+	var resources stringList
+	fs.Var(&resources, "resource", "additional file or pattern to embed for doc() (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: xform compile [-o file.go] [-pkg name] [-var Transform] [-resource file]... <main.xform>")
+		return 1
+	}
+	mainPath := filepath.Clean(fs.Arg(0))
+	if filepath.IsAbs(mainPath) || strings.HasPrefix(mainPath, "..") {
+		fmt.Fprintln(os.Stderr, "compile: main module must be inside the package directory")
+		return 1
+	}
+	prog, err := xform.CompileFS(os.DirFS("."), filepath.ToSlash(mainPath))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	files := make([]string, 0, len(prog.Modules))
+	for name := range prog.Modules {
+		if strings.HasPrefix(name, "..") {
+			fmt.Fprintf(os.Stderr, "compile: import %s is outside the package directory\n", name)
+			return 1
+		}
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	files = append(files, resources...)
+	if *pkg == "" {
+		*pkg = "main"
+	}
+	out := *output
+	if out == "" {
+		out = strings.TrimSuffix(mainPath, ".xform") + "_xform.go"
+	}
+	fsVar := lowerFirst(*varName) + "FS"
+
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "// Code generated by xform compile; DO NOT EDIT.")
+	fmt.Fprintln(&b)
+	fmt.Fprintf(&b, "package %s\n\n", *pkg)
+	fmt.Fprintf(&b, "import (\n\t\"embed\"\n\n\txform %q\n)\n\n", *importPath)
+	fmt.Fprintf(&b, "//go:embed %s\n", strings.Join(files, " "))
+	fmt.Fprintf(&b, "var %s embed.FS\n\n", fsVar)
+	fmt.Fprintf(&b, "var %s = xform.MustCompileFS(%s, %q)\n", *varName, fsVar, path.Clean(filepath.ToSlash(mainPath)))
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := os.WriteFile(out, src, 0o644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
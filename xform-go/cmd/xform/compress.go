@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+func writeCompressed(w io.Writer, data []byte, method string) error {
+	switch method {
+	case "", "none":
+		_, err := w.Write(data)
+		return err
+	case "gzip", "gz":
+		zw := gzip.NewWriter(w)
+		if _, err := zw.Write(data); err != nil {
+			return err
+		}
+		return zw.Close()
+	case "zstd", "zst":
+		// Only decoding is built into the library; compressing needs the
+		// zstd executable.
+		if _, err := exec.LookPath("zstd"); err != nil {
+			return fmt.Errorf("-compress zstd needs the zstd executable on PATH: %v", err)
+		}
+		cmd := exec.Command("zstd", "-c", "-q")
+		cmd.Stdin = bytes.NewReader(data)
+		cmd.Stdout = w
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+	return fmt.Errorf("unknown compression %q", method)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	xform "xform-go"
+)
+
+// runXML2JSON converts an XML (or HTML) document to JSON.
+func runXML2JSON(args []string) int {
+	return runConvert("xml2json", args, func(name string, data []byte, mapping string, indent bool) ([]byte, error) {
+		doc, err := xform.ParseInput(name, data, xform.FormatAuto)
+		if err != nil {
+			return nil, err
+		}
+		ind := ""
+		if indent {
+			ind = "  "
+		}
+		return xform.XMLToJSON(doc, mapping, ind)
+	})
+}
+
+// runJSON2XML converts a JSON document to XML.
+func runJSON2XML(args []string) int {
+	return runConvert("json2xml", args, func(name string, data []byte, mapping string, indent bool) ([]byte, error) {
+		doc, err := xform.JSONToXML(data, mapping)
+		if err != nil {
+			return nil, err
+		}
+		opts := xform.SerializeOptions{}
+		if indent {
+			opts.Indent = "  "
+		}
+		return []byte(xform.SerializeWith(doc, opts)), nil
+	})
+}
+
+type converter func(name string, data []byte, mapping string, indent bool) ([]byte, error)
+
+func runConvert(cmd string, args []string, convert converter) int {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	mapping := fs.String("mapping", "auto", "mapping: auto, vocabulary (XPath json-to-xml) or jsonml")
+	indent := fs.Bool("indent", false, "pretty-print the output")
+	output := fs.String("o", "", "output file (default: stdout)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "Usage: xform %s [-mapping m] [-indent] [-o file] [input|-]\n", cmd)
+		return 2
+	}
+	m, err := xform.ParseMapping(*mapping)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	name := fs.Arg(0)
+	var data []byte
+	if name == "" || name == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(name)
+	}
+	if err == nil {
+		data, err = convert(name, data, m, *indent)
+	}
+	if err == nil {
+		data = append(data, '\n')
+		if *output != "" {
+			err = os.WriteFile(*output, data, 0o644)
+		} else {
+			_, err = os.Stdout.Write(data)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
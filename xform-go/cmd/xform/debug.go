@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	xform "xform-go"
+)
+
+const debugHelp = `Commands:
+  s, step                 stop at the next rule or function
+  n, next                 stop at the next rule or function at this depth or above
+  f, finish               run until the current frame returns and show its result
+  c, continue             run until a breakpoint
+  b, break SPEC           add a breakpoint: rule:NAME, func:NAME or a line number
+  d, delete N             delete breakpoint N
+  i, info                 list breakpoints
+  bt, where               show the call stack
+  ctx, context            show the context item
+  vars                    list variables in scope
+  p, print EXPR           evaluate EXPR in the current frame
+  l, list                 show the source around the current frame
+  q, quit                 abort the evaluation`
+
+type breakpoint struct {
+	kind, name string
+	line       int
+}
+
+func (b breakpoint) String() string {
+	if b.kind == "line" {
+		return "line " + strconv.Itoa(b.line)
+	}
+	return b.kind + ":" + b.name
+}
+
+func parseBreakpoint(spec string) (breakpoint, error) {
+	spec = strings.TrimSpace(spec)
+	if n, err := strconv.Atoi(strings.TrimPrefix(spec, "line:")); err == nil {
+		return breakpoint{kind: "line", line: n}, nil
+	}
+	kind, name, ok := strings.Cut(spec, ":")
+	if kind == "function" {
+		kind = "func"
+	}
+	if !ok || name == "" || (kind != "rule" && kind != "func") {
+		return breakpoint{}, fmt.Errorf("invalid breakpoint %q (want rule:NAME, func:NAME or a line number)", spec)
+	}
+	return breakpoint{kind: kind, name: name}, nil
+}
+
+func (b breakpoint) matches(f *xform.Frame) bool {
+	switch b.kind {
+	case "line":
+		return f.Line == b.line
+	case "rule":
+		return f.Kind == "rule" && f.Name == b.name
+	default:
+		return f.Kind == "function" && f.Name == b.name
+	}
+}
+
+var errDebugQuit = errors.New("debugging aborted")
+
+// debugger is an xform.Tracer that pauses evaluation and reads commands.
+type debugger struct {
+	in          *bufio.Scanner
+	out         io.Writer
+	source      []string
+	breakpoints []*breakpoint
+	mode        string // "step", "next", "finish" or "continue"
+	depth       int
+	interactive bool
+}
+
+func (d *debugger) Enter(stack []*xform.Frame) {
+	if !d.interactive {
+		return
+	}
+	top := stack[len(stack)-1]
+	for i, b := range d.breakpoints {
+		if b != nil && b.matches(top) {
+			fmt.Fprintf(d.out, "Breakpoint %d, %s\n", i+1, top)
+			d.pause(stack)
+			return
+		}
+	}
+	if d.mode == "step" || (d.mode == "next" && len(stack) <= d.depth) {
+		fmt.Fprintln(d.out, top)
+		d.pause(stack)
+	}
+}
+
+func (d *debugger) Leave(stack []*xform.Frame, result []any) {
+	if d.interactive && d.mode == "finish" && len(stack) == d.depth {
+		fmt.Fprintf(d.out, "Finished %s\nResult: %s\n", stack[len(stack)-1], formatItems(result))
+		d.pause(stack)
+	}
+}
+
+func (d *debugger) pause(stack []*xform.Frame) {
+	top := stack[len(stack)-1]
+	for {
+		fmt.Fprint(d.out, "(xdb) ")
+		if !d.in.Scan() {
+			// End of input: run the rest of the evaluation undisturbed.
+			fmt.Fprintln(d.out)
+			d.interactive = false
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimSpace(d.in.Text()), " ")
+		arg = strings.TrimSpace(arg)
+		switch cmd {
+		case "s", "step":
+			d.mode = "step"
+			return
+		case "n", "next":
+			d.mode, d.depth = "next", len(stack)
+			return
+		case "f", "finish":
+			d.mode, d.depth = "finish", len(stack)
+			return
+		case "c", "continue":
+			d.mode = "continue"
+			return
+		case "q", "quit":
+			panic(errDebugQuit)
+		case "b", "break":
+			b, err := parseBreakpoint(arg)
+			if err != nil {
+				fmt.Fprintln(d.out, err)
+				continue
+			}
+			d.breakpoints = append(d.breakpoints, &b)
+			fmt.Fprintf(d.out, "Breakpoint %d at %s\n", len(d.breakpoints), b)
+		case "d", "delete":
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 1 || n > len(d.breakpoints) || d.breakpoints[n-1] == nil {
+				fmt.Fprintf(d.out, "no breakpoint %q\n", arg)
+				continue
+			}
+			d.breakpoints[n-1] = nil
+		case "i", "info":
+			for i, b := range d.breakpoints {
+				if b != nil {
+					fmt.Fprintf(d.out, "%d  %s\n", i+1, b)
+				}
+			}
+		case "bt", "where":
+			for i := len(stack) - 1; i >= 0; i-- {
+				fmt.Fprintf(d.out, "#%d  %s on %s\n", len(stack)-1-i, stack[i], itemLocation(stack[i].Context.ContextItem))
+			}
+		case "ctx", "context":
+			fmt.Fprintf(d.out, "%s = %s\n", itemLocation(top.Context.ContextItem), formatItems([]any{top.Context.ContextItem}))
+		case "vars":
+			names := make([]string, 0, len(top.Context.Variables))
+			for name := range top.Context.Variables {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				fmt.Fprintf(d.out, "%s = %s\n", name, formatItems(top.Context.Variables[name]))
+			}
+		case "p", "print":
+			result, err := xform.EvalIn(arg, top.Context)
+			if err != nil {
+				fmt.Fprintln(d.out, err)
+				continue
+			}
+			fmt.Fprintln(d.out, formatItems(result))
+		case "l", "list":
+			d.list(top.Line)
+		case "h", "help", "":
+			fmt.Fprintln(d.out, debugHelp)
+		default:
+			fmt.Fprintf(d.out, "unknown command %q; try help\n", cmd)
+		}
+	}
+}
+
+func (d *debugger) list(line int) {
+	if len(d.source) == 0 {
+		fmt.Fprintln(d.out, "no source available")
+		return
+	}
+	from, to := line-3, line+3
+	if from < 1 {
+		from = 1
+	}
+	if to > len(d.source) {
+		to = len(d.source)
+	}
+	for i := from; i <= to; i++ {
+		marker := " "
+		if i == line {
+			marker = ">"
+		}
+		fmt.Fprintf(d.out, "%s%4d  %s\n", marker, i, d.source[i-1])
+	}
+}
+
+func itemLocation(item any) string {
+	if n, ok := item.(*xform.Node); ok {
+		return xform.NodePath(n)
+	}
+	return "(atomic)"
+}
+
+// formatItems shows a sequence compactly, truncating long serializations.
+func formatItems(seq []any) string {
+	parts := make([]string, len(seq))
+	for i, item := range seq {
+		s := xform.SerializeItem(item)
+		if _, ok := item.(string); ok {
+			s = strconv.Quote(s)
+		}
+		parts[i] = clip(s, 200)
+	}
+	return "(" + strings.Join(parts, ", ") + ")"
+}
+
+// runDebug evaluates a transform under the debugger. Commands are read from
+// stdin, so sessions can also be scripted.
+func runDebug(args []string) int {
+	fs := flag.NewFlagSet("debug", flag.ContinueOnError)
+	inputFormat := fs.String("input-format", "auto", "input format: auto, xml, html or json")
+	var breaks stringList
+	fs.Var(&breaks, "b", "breakpoint: rule:NAME, func:NAME or a line number (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: xform debug [-b spec]... <input.xml> <transform.xform>")
+		return 2
+	}
+	d := &debugger{in: bufio.NewScanner(os.Stdin), out: os.Stdout, mode: "continue", interactive: true}
+	for _, spec := range breaks {
+		b, err := parseBreakpoint(spec)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		d.breakpoints = append(d.breakpoints, &b)
+	}
+	if len(d.breakpoints) == 0 {
+		d.mode = "step"
+	}
+	format, err := xform.ParseInputFormat(*inputFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	inputPath, xformPath := fs.Arg(0), fs.Arg(1)
+	data, err := os.ReadFile(inputPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	doc, err := xform.ParseInput(inputPath, data, format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	prog, err := loadProgram(xformPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if src, err := os.ReadFile(xformPath); err == nil && !xform.IsBundle(src) {
+		d.source = strings.Split(string(src), "\n")
+	}
+	opts := xform.EvalOptions{BaseDir: filepath.Dir(xformPath), Diagnostics: printDiagnostic, Tracer: d}
+	if prog.FS != nil {
+		opts.BaseDir = ""
+	}
+	result, err := evalSafe(prog, doc, opts)
+	if errors.Is(err, errDebugQuit) {
+		err = errDebugQuit
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, item := range result {
+		fmt.Print(xform.SerializeItem(item))
+	}
+	fmt.Println()
+	return 0
+}
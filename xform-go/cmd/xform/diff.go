@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	xform "xform-go"
+)
+
+// runDiff prints the tree diff of two documents and exits like diff(1):
+// 0 when they are equal, 1 when they differ and 2 on errors.
+func runDiff(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	inputFormat := fs.String("input-format", "auto", "input format: auto, xml, html or json")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: xform diff [-input-format fmt] <a.xml> <b.xml>")
+		return 2
+	}
+	format, err := xform.ParseInputFormat(*inputFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	docs := make([]*xform.Node, 2)
+	for i, p := range fs.Args() {
+		data, err := os.ReadFile(p)
+		if err == nil {
+			docs[i], err = xform.ParseInput(p, data, format)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	diff := xform.Diff(docs[0], docs[1])
+	fmt.Println(xform.SerializeWith(diff, xform.SerializeOptions{Indent: "  "}))
+	if len(diff.Children) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	xform "xform-go"
+)
+
+// runDoc lists the registered builtin packs, with -builtins the builtin
+// functions, or with a transform the parameters, variables, functions and
+// rules of its module with the comments above their declarations.
+func runDoc(args []string) int {
+	fs := flag.NewFlagSet("doc", flag.ContinueOnError)
+	pack := fs.String("pack", "", "only document the named builtin pack")
+	builtins := fs.Bool("builtins", false, "document the builtin functions")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 1 || (fs.NArg() > 0 || *builtins) && *pack != "" || *builtins && fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: xform doc [-pack name] | xform doc -builtins | xform doc <transform.xform>")
+		return 2
+	}
+	if *builtins {
+		for _, fn := range xform.Builtins() {
+			fmt.Printf("  %s\n", fn.Signature())
+			if fn.Doc != "" {
+				fmt.Printf("      %s\n", fn.Doc)
+			}
+		}
+		return 0
+	}
+	if fs.NArg() == 1 {
+		return moduleDoc(fs.Arg(0))
+	}
+	found := false
+	for _, p := range xform.RegisteredPacks() {
+		if *pack != "" && p.Name != *pack {
+			continue
+		}
+		found = true
+		fmt.Printf("pack %s\n", p.Name)
+		if p.Doc != "" {
+			fmt.Printf("    %s\n", p.Doc)
+		}
+		fmt.Println()
+		for _, name := range p.FunctionNames() {
+			fn := p.Functions[name]
+			fmt.Printf("  %s:%s(%s)\n", p.Name, name, strings.Join(fn.Params, ", "))
+			if fn.Doc != "" {
+				fmt.Printf("      %s\n", fn.Doc)
+			}
+		}
+		fmt.Println()
+	}
+	if *pack != "" && !found {
+		fmt.Fprintf(os.Stderr, "unknown builtin pack %q\n", *pack)
+		return 1
+	}
+	return 0
+}
+
+func moduleDoc(path string) int {
+	prog, err := loadProgram(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	module := prog.Module
+	fmt.Printf("module %s\n\n", path)
+	for _, p := range module.Params {
+		printDoc("param $"+p.Name, p.Doc)
+	}
+	vars := make([]string, 0, len(module.Vars))
+	for name := range module.Vars {
+		vars = append(vars, name)
+	}
+	sort.Slice(vars, func(i, j int) bool { return module.VarPos[vars[i]].Line < module.VarPos[vars[j]].Line })
+	for _, name := range vars {
+		printDoc("var $"+name, module.VarDoc[name])
+	}
+	fns := make([]xform.FunctionDef, 0, len(module.Functions))
+	for _, fn := range module.Functions {
+		fns = append(fns, fn)
+	}
+	sort.Slice(fns, func(i, j int) bool { return fns[i].Line < fns[j].Line })
+	for _, fn := range fns {
+		params := make([]string, len(fn.Params))
+		for i, p := range fn.Params {
+			params[i] = "$" + p.Name
+			if p.TypeRef != nil {
+				params[i] += ": " + *p.TypeRef
+			}
+		}
+		printDoc(deprecatedLabel(fmt.Sprintf("%s(%s)", fn.Name, strings.Join(params, ", ")), fn.Deprecated), fn.Doc)
+	}
+	var rules []xform.RuleDef
+	for _, set := range module.Rules {
+		rules = append(rules, set...)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Line < rules[j].Line })
+	for _, r := range rules {
+		label := "rule " + r.Name
+		if r.Mode != "" {
+			label += " mode " + r.Mode
+		}
+		printDoc(deprecatedLabel(fmt.Sprintf("%s (line %d)", label, r.Line), r.Deprecated), r.Doc)
+	}
+	return 0
+}
+
+func deprecatedLabel(label string, deprecated *string) string {
+	if deprecated == nil {
+		return label
+	}
+	return label + " [deprecated]"
+}
+
+func printDoc(label string, doc []xform.Comment) {
+	fmt.Printf("  %s\n", label)
+	if text := xform.DocText(doc); text != "" {
+		for _, line := range strings.Split(text, "\n") {
+			fmt.Printf("      %s\n", line)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	xform "xform-go"
+)
+
+// lintConfigName is the per-project lint configuration, looked up from
+// the directory of each transform upwards:
+//
+//	max-depth: 4
+//	checks:
+//	  broad-scan: off
+//	  shadowed-variable: error
+const lintConfigName = ".xform-lint.yaml"
+
+// runLint reports the findings of xform.Lint for the transforms and the
+// modules they import, or the syntax errors of a transform that does not
+// parse. It exits 0 when nothing of severity error was found, 1 when
+// something was and 2 when a transform could not be loaded otherwise.
+func runLint(args []string) int {
+	flags := flag.NewFlagSet("lint", flag.ContinueOnError)
+	configPath := flags.String("config", "", "lint configuration (default: "+lintConfigName+" in the transform's directory or above)")
+	list := flags.Bool("list", false, "list the checks and exit")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *list {
+		names := make([]string, 0, len(xform.LintChecks))
+		for name := range xform.LintChecks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%-18s %s\n", name, xform.LintChecks[name])
+		}
+		return 0
+	}
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: xform lint [-config file] [-list] <transform.xform|bundle.xfpkg>...")
+		return 2
+	}
+	code := 0
+	for _, path := range flags.Args() {
+		cfgFile := *configPath
+		if cfgFile == "" {
+			cfgFile = findLintConfig(filepath.Dir(path))
+		}
+		cfg, err := loadLintConfig(cfgFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		failed, err := lintProgram(path, cfg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if failed {
+			code = 1
+		}
+	}
+	return code
+}
+
+// lintProgram lints the transform at path and the modules it imports,
+// printing the issues as file:line: severity: check: message, and syntax
+// errors as file:line:column: error: code: message. It reports whether any
+// was an error.
+func lintProgram(path string, cfg xform.LintConfig) (bool, error) {
+	prog, err := loadProgram(path)
+	if err != nil {
+		if diags := syntaxErrors(path); len(diags) > 0 {
+			for _, d := range diags {
+				fmt.Printf("%s:%d:%d: %s: %s: %s\n", path, d.Pos.Line, d.Pos.Column, d.Severity, d.Code, d.Message)
+			}
+			return true, nil
+		}
+		return false, err
+	}
+	names := make([]string, 0, len(prog.Modules))
+	for name := range prog.Modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	failed := false
+	for _, name := range names {
+		var src []byte
+		file := name
+		if prog.FS != nil {
+			src, err = fs.ReadFile(prog.FS, name)
+			file = path + ":" + name
+		} else {
+			src, err = os.ReadFile(filepath.FromSlash(name))
+		}
+		if err != nil {
+			return false, err
+		}
+		issues, err := xform.Lint(string(src), cfg)
+		if err != nil {
+			return false, fmt.Errorf("%s: %v", file, err)
+		}
+		for _, issue := range issues {
+			fmt.Printf("%s:%d: %s: %s: %s\n", file, issue.Line, issue.Severity, issue.Check, issue.Message)
+			if issue.Severity == xform.SeverityError {
+				failed = true
+			}
+		}
+	}
+	return failed, nil
+}
+
+// syntaxErrors returns all syntax errors of the transform source at path,
+// found by a tolerant parse, rather than only the first.
+func syntaxErrors(path string) []xform.Diagnostic {
+	data, err := os.ReadFile(path)
+	if err != nil || xform.IsBundle(data) {
+		return nil
+	}
+	_, diags := xform.ParseModuleTolerant(string(data))
+	return diags
+}
+
+// findLintConfig returns the closest lintConfigName in dir or above, or ""
+// if there is none.
+func findLintConfig(dir string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	for {
+		path := filepath.Join(dir, lintConfigName)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// loadLintConfig reads a lint configuration; path "" is the default one.
+func loadLintConfig(path string) (xform.LintConfig, error) {
+	cfg := xform.LintConfig{Disabled: map[string]bool{}, Severity: map[string]xform.Severity{}}
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	raw, err := parseYAML(string(data))
+	if err != nil {
+		return cfg, fmt.Errorf("%s: %v", path, err)
+	}
+	top, ok := raw.(map[string]any)
+	if !ok {
+		return cfg, fmt.Errorf("%s: configuration must be a mapping", path)
+	}
+	for key, v := range top {
+		switch key {
+		case "max-depth":
+			cfg.MaxDepth, err = yamlInt(key, v)
+		case "checks":
+			var checks map[string]string
+			if checks, err = yamlStringMap(key, v); err != nil {
+				break
+			}
+			for check, level := range checks {
+				if _, ok := xform.LintChecks[check]; !ok {
+					err = fmt.Errorf("unknown check %q (see xform lint -list)", check)
+					break
+				}
+				switch level {
+				case "off":
+					cfg.Disabled[check] = true
+				case "warning":
+					cfg.Severity[check] = xform.SeverityWarning
+				case "error":
+					cfg.Severity[check] = xform.SeverityError
+				default:
+					err = fmt.Errorf("checks.%s must be off, warning or error", check)
+				}
+			}
+		default:
+			err = fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return cfg, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return cfg, nil
+}
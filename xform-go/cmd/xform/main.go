@@ -1,41 +1,473 @@
 package main
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	xform "xform-go"
+	_ "xform-go/packs/cryptopack"
 )
 
+const usage = `Usage: xform [options] [input.xml|-] <transform.xform|bundle.xfpkg>
+       xform [options] -e expression [input.xml|-]
+       xform -version
+       xform serve [-addr :8080] [-doc-cache MiB] [-accept-transforms] [transform.xform]
+       xform stream [-framing lines|ndjson] [-out lines|ndjson] [-workers N] <transform.xform>
+       xform run [-j N] [-dry-run] [-keep-going] [-resume] [-cache] [-progress] [-progress-format text|ndjson] [-quiet] <pipeline.yaml>
+       xform diff <a.xml> <b.xml>
+       xform validate <input.xml> <rules.xform>
+       xform playground [-max-memory size] [-timeout d] [-max-firings N] [-param name=value]... [-doc uri=file]... [input.xml|-] <transform.xform>
+       xform lint [-config file] [-list] <transform.xform|bundle.xfpkg>...
+       xform refactor rename [-w] <main.xform> <old> <new>
+       xform refactor extract-function [-w] <file.xform> <line:col-line:col> <name>
+       xform debug [-b rule:NAME|func:NAME|LINE]... <input.xml> <transform.xform>
+       xform replay [-find fragment] [-rule name] [-input path] [-v] <run.log>
+       xform xml2json|json2xml [-mapping auto|vocabulary|jsonml] [-indent] [input]
+       xform bundle [-o bundle.xfpkg] [-resource file]... <main.xform>
+       xform compile [-o file.go] [-pkg name] [-var Transform] <main.xform>
+       xform doc [-pack name]
+       xform doc -builtins
+       xform doc <transform.xform>`
+
+// version is the release of the CLI, set with
+// -ldflags "-X main.version=..." when building a release.
+var version = "0.1.0"
+
+var subcommands = map[string]func(args []string) int{
+	"serve":      runServe,
+	"run":        runPipeline,
+	"stream":     runStream,
+	"diff":       runDiff,
+	"validate":   runValidate,
+	"lint":       runLint,
+	"playground": runPlayground,
+	"refactor":   runRefactor,
+	"debug":      runDebug,
+	"replay":     runReplay,
+	"xml2json":   runXML2JSON,
+	"json2xml":   runJSON2XML,
+	"bundle":     runBundle,
+	"compile":    runCompile,
+	"doc":        runDoc,
+}
+
 func main() {
-	if len(os.Args) < 3 {
-		fmt.Fprintln(os.Stderr, "Usage: xform <input.xml> <transform.xform>")
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+	fs := flag.NewFlagSet("xform", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, usage)
+		fs.PrintDefaults()
+	}
+	inputFormat := fs.String("input-format", "auto", "input format: auto, xml, html, json or json-items")
+	lenient := fs.Bool("lenient", false, "repair common well-formedness errors in XML input, reporting each fix to stderr")
+	fidelity := fs.Bool("fidelity", false, "keep attribute values of XML input as written instead of normalizing their whitespace")
+	compress := fs.String("compress", "", "compress output: gzip or zstd")
+	profileName := fs.String("profile", "", "vocabulary profile: docbook, dita, xhtml or a JSON profile file")
+	indent := fs.Bool("indent", false, "indent element-only content of the output")
+	sortAttrs := fs.Bool("sort-attrs", false, "write attributes in canonical (sorted) order")
+	bom := fs.Bool("bom", false, "start UTF-8 output with a byte order mark")
+	newline := fs.String("newline", "", "write line ends, text nodes included, as lf or crlf (default: as they are)")
+	encoding := fs.String("encoding", "", "output encoding: UTF-8, ISO-8859-1, windows-1252 or US-ASCII (default: the output declaration's, else UTF-8)")
+	selectPath := fs.String("select", "", "transform only the subtrees matching this path and copy the rest unchanged")
+	stream := fs.Bool("stream", false, "with -select, decode the input incrementally and build only the selected subtrees")
+	provenance := fs.String("provenance", "", "annotate output elements with the source path and rule: attr or comment")
+	stripProvenance := fs.Bool("strip-provenance", false, "remove provenance annotations from the input first")
+	legacyEquality := fs.Bool("legacy-equality", false, "compare only the first items' string values in = and !=")
+	strict := fs.Bool("strict", false, "reject references to undefined variables")
+	compat := fs.String("compat", "", "legacy behaviors for transforms without a compat declaration: 1.x")
+	record := fs.String("record", "", "log every rule firing with its input and output to this file (see xform replay)")
+	stats := fs.Bool("stats", false, "print the nodes created, approximate memory and time of the evaluation to stderr")
+	var maxMemory byteSize
+	fs.Var(&maxMemory, "max-memory", "stop the evaluation once it has allocated about this much for nodes and sequences, e.g. 256MiB")
+	maxDepth := fs.Int("max-depth", 0, "stop the evaluation when function calls and rule firings nest deeper (default 10000)")
+	var maxOutput byteSize
+	fs.Var(&maxOutput, "max-output", "fail when the output, or a result document, would be larger, e.g. 16MiB")
+	maxOutputNodes := fs.Int("max-output-nodes", 0, "fail when the output, or a result document, would have more nodes")
+	truncate := fs.Bool("truncate", false, "cut output over -max-output or -max-output-nodes and mark it as truncated instead of failing")
+	var catalogs, idAttrs, params stringList
+	fs.Var(&catalogs, "catalog", "XML catalog or mapping file for URI resolution (repeatable)")
+	fs.Var(&idAttrs, "id-attr", "attribute holding element ids for id() and checkIds() (repeatable, default: id)")
+	fs.Var(&params, "param", "bind the transform parameter name to a string value, as name=value (repeatable)")
+	expr := fs.String("e", "", "transform given inline instead of as a file, e.g. -e '//title'")
+	output := fs.String("o", "", "write the result to this file instead of stdout")
+	resultDir := fs.String("result-dir", "", "write the documents of resultDocument() below this directory (default: the directory of -o, or the current one)")
+	showVersion := fs.Bool("version", false, "print the version and exit")
+	fs.Parse(os.Args[1:])
+	if *showVersion {
+		fmt.Printf("xform %s (XForm 2.0, %s)\n", version, runtime.Version())
+		return
+	}
+	// The input is read from stdin when it is "-" or left out.
+	inputPath, xformPath := "-", ""
+	switch {
+	case *expr != "" && fs.NArg() <= 1:
+		if fs.NArg() == 1 {
+			inputPath = fs.Arg(0)
+		}
+	case *expr == "" && fs.NArg() == 1:
+		xformPath = fs.Arg(0)
+	case *expr == "" && fs.NArg() == 2:
+		inputPath, xformPath = fs.Arg(0), fs.Arg(1)
+	default:
+		fs.Usage()
 		os.Exit(1)
 	}
-	inputPath := os.Args[1]
-	xformPath := os.Args[2]
-
-	xmlBytes, err := os.ReadFile(inputPath)
+	format, err := xform.ParseInputFormat(*inputFormat)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-	xformText, err := os.ReadFile(xformPath)
+	catalog, err := loadCatalogs(catalogs)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-
-	doc, err := xform.ParseXMLBytes(xmlBytes)
+	var doc *xform.Node
+	var input any
+	if format == xform.FormatJSONItems && (*selectPath != "" || *profileName != "" || *provenance != "" || *stripProvenance) {
+		fmt.Fprintln(os.Stderr, "-input-format json-items cannot be combined with -select, -profile, -provenance or -strip-provenance")
+		os.Exit(1)
+	}
+	if *lenient && *fidelity {
+		fmt.Fprintln(os.Stderr, "-lenient cannot be combined with -fidelity")
+		os.Exit(1)
+	}
+	parseOpts := xform.ParseOptions{Fidelity: *fidelity, Catalog: catalog}
+	if *stream {
+		if *selectPath == "" || (format != xform.FormatAuto && format != xform.FormatXML) || *compress != "" || *profileName != "" || *provenance != "" || *stripProvenance || *lenient {
+			fmt.Fprintln(os.Stderr, "-stream needs -select and XML input, and cannot be combined with -compress, -profile, -provenance, -strip-provenance or -lenient")
+			os.Exit(1)
+		}
+	} else {
+		inputBytes, err := readInput(inputPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if *lenient && format != xform.FormatJSONItems {
+			var repairs []xform.Repair
+			doc, repairs, err = xform.ParseInputLenient(inputPath, inputBytes, format)
+			for _, r := range repairs {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", inputPath, r)
+			}
+			input = doc
+		} else if format != xform.FormatJSONItems {
+			// -select copies what it does not transform, the prolog
+			// included.
+			inputOpts := parseOpts
+			inputOpts.Prolog = *selectPath != ""
+			doc, err = xform.ParseInputWith(inputPath, inputBytes, format, inputOpts)
+			input = doc
+		} else {
+			input, err = xform.ParseInputItem(inputPath, inputBytes, format)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		doc, _ = input.(*xform.Node)
+		if *stripProvenance {
+			xform.StripProvenance(doc)
+		}
+	}
+	var prog *xform.Program
+	if *expr != "" {
+		prog, err = xform.Compile(*expr)
+	} else {
+		prog, err = loadProgramWith(xformPath, catalog)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// Flags override the transform's output declaration.
+	serOpts := prog.Module.SerializeOptions()
+	if *sortAttrs {
+		serOpts.SortAttributes = true
+	}
+	if *indent {
+		serOpts.Indent = "  "
+	}
+	if *encoding != "" {
+		if serOpts.Encoding, err = xform.OutputEncoding(*encoding); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if *bom {
+		serOpts.BOM = true
+	}
+	if *newline != "" {
+		if serOpts.Newline, err = xform.ParseNewline(*newline); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	opts := xform.EvalOptions{BaseDir: filepath.Dir(xformPath), Catalog: catalog, Diagnostics: printDiagnostic, IDAttributes: idAttrs}
+	switch *provenance {
+	case "":
+	case "attr", "comment":
+		opts.Provenance = true
+		serOpts.ProvenanceComments = *provenance == "comment"
+	default:
+		fmt.Fprintf(os.Stderr, "unknown provenance style %q (want attr or comment)\n", *provenance)
+		os.Exit(1)
+	}
+	if *profileName != "" {
+		profile, err := xform.LoadProfile(*profileName)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		opts.Profile = profile
+		serOpts.Profile = profile
+	}
+	if prog.FS != nil {
+		opts.BaseDir = ""
+	}
+	opts.Strict = *strict
+	opts.Parse = parseOpts
+	if opts.Params, err = parseParams(params); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *resultDir == "" && *output != "" && *output != "-" {
+		*resultDir = filepath.Dir(*output)
+	}
+	// Like the main result, each document ends with a newline.
+	results := xform.DirResultWriter{Dir: *resultDir}
+	opts.ResultDocuments = xform.ResultWriterFunc(func(href string, data []byte) error {
+		return results.WriteResult(href, append(data, '\n'))
+	})
+	opts.LegacyEquality = *legacyEquality
+	opts.MaxMemory = int64(maxMemory)
+	opts.MaxCallDepth = *maxDepth
+	opts.OutputLimit = xform.OutputLimit{MaxBytes: int64(maxOutput), MaxNodes: *maxOutputNodes, Truncate: *truncate}
+	serOpts.Limit = opts.OutputLimit
+	if *stats {
+		opts.Stats = &xform.EvalStats{}
+		defer printStats(opts.Stats)
+	}
+	if *compat != "" {
+		if opts.Compat, err = xform.ParseCompat(*compat); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	finishRecording := func() error { return nil }
+	if *record != "" {
+		recorder, finish, err := startRecording(*record)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		// Deferred too, so a log is kept when evaluation panics.
+		defer finish()
+		opts.Tracer, finishRecording = recorder, finish
+	}
+	if *stream {
+		if err := streamInput(prog, inputPath, *output, *selectPath, opts, serOpts); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err := finishRecording(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	var result []any
+	if *selectPath != "" {
+		selected, err := prog.EvalSelected(doc, *selectPath, opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if len(selected.Children) > 0 && selected.Children[0].Kind == "pi" && selected.Children[0].Name == "xml" {
+			serOpts.XMLDeclaration = false
+		}
+		result = []any{selected}
+	} else {
+		result, err = prog.EvalItem(input, opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if err := finishRecording(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	out, err := xform.SerializeResultLimited(result, serOpts)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-	module := xform.NewParser(string(xformText)).ParseModule()
-	result := xform.EvalModule(module, doc)
-	out := ""
-	for _, item := range result {
-		out += xform.SerializeItem(item)
+	if err := writeOutput(*output, xform.EncodeOutput(out+lineEnd(serOpts), serOpts.Encoding), *compress); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// lineEnd ends the output with the newline of opts.
+func lineEnd(opts xform.SerializeOptions) string {
+	if opts.Newline != "" {
+		return opts.Newline
+	}
+	return "\n"
+}
+
+// parseParams turns name=value flags into EvalOptions.Params.
+func parseParams(flags []string) (map[string][]any, error) {
+	if len(flags) == 0 {
+		return nil, nil
+	}
+	params := map[string][]any{}
+	for _, f := range flags {
+		name, value, ok := strings.Cut(f, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("-param %q: want name=value", f)
+		}
+		params[strings.TrimPrefix(name, "$")] = []any{value}
+	}
+	return params, nil
+}
+
+// readInput reads the input file, or stdin for "-".
+func readInput(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+// writeOutput writes the result to the file -o names, or to stdout when
+// it names none or "-". The file is written only once the result is
+// complete, so a failed run does not leave a truncated output behind.
+func writeOutput(path string, data []byte, compress string) error {
+	if path == "" || path == "-" {
+		return writeCompressed(os.Stdout, data, compress)
+	}
+	var buf bytes.Buffer
+	if err := writeCompressed(&buf, data, compress); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0o644)
+}
+
+// streamInput transforms the subtrees of the input file (stdin for "-")
+// selected by path without reading the whole file into memory, writing
+// to output or stdout.
+func streamInput(prog *xform.Program, inputPath, output, path string, opts xform.EvalOptions, serOpts xform.SerializeOptions) (err error) {
+	in := os.Stdin
+	if inputPath != "-" {
+		f, err := os.Open(inputPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	out := os.Stdout
+	if output != "" && output != "-" {
+		f, cerr := os.Create(output)
+		if cerr != nil {
+			return cerr
+		}
+		defer func() {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(output)
+			}
+		}()
+		out = f
+	}
+	if err := prog.EvalStreaming(in, out, path, opts, serOpts); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out)
+	return err
+}
+
+func printStats(s *xform.EvalStats) {
+	fmt.Fprintf(os.Stderr, "evaluations:   %d\nnodes created: %d\nmemory:        about %s\ntime:          %s\n", s.Evaluations, s.NodesCreated, byteSize(s.Memory), s.Duration.Round(time.Microsecond))
+}
+
+// byteSize is a flag holding a number of bytes, written with an optional
+// binary unit: 512K, 64MiB, 2G.
+type byteSize int64
+
+var byteUnits = []string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+func (b byteSize) String() string {
+	v, unit := float64(b), 0
+	for v >= 1024 && unit < len(byteUnits)-1 {
+		v /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", int64(b))
+	}
+	return fmt.Sprintf("%.1f %s", v, byteUnits[unit])
+}
+
+func (b *byteSize) Set(s string) error {
+	num := strings.TrimRight(s, "BKMGTibkmgt ")
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q (want e.g. 512K, 64MiB or 2G)", s)
+	}
+	shift := map[string]uint{"": 0, "b": 0, "k": 10, "kb": 10, "kib": 10, "m": 20, "mb": 20, "mib": 20, "g": 30, "gb": 30, "gib": 30, "t": 40, "tb": 40, "tib": 40}
+	unit, ok := shift[strings.ToLower(strings.TrimSpace(s[len(num):]))]
+	if !ok {
+		return fmt.Errorf("invalid size %q (want e.g. 512K, 64MiB or 2G)", s)
+	}
+	if n > math.MaxInt64>>unit {
+		return fmt.Errorf("size %q is too large", s)
 	}
-	fmt.Println(out)
+	*b = byteSize(n << unit)
+	return nil
+}
+
+type stringList []string
+
+func (s *stringList) String() string { return strings.Join(*s, ",") }
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func loadCatalogs(paths []string) (*xform.Catalog, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	catalog := xform.NewCatalog()
+	for _, p := range paths {
+		c, err := xform.LoadCatalog(p)
+		if err != nil {
+			return nil, err
+		}
+		catalog.Merge(c)
+	}
+	return catalog, nil
+}
+
+func printDiagnostic(d xform.Diagnostic) {
+	fmt.Fprintln(os.Stderr, d)
 }
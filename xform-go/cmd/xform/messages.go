@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	xform "xform-go"
+)
+
+// runStream applies one compiled transform to every message read from
+// stdin, for event pipelines: one message per line, or NDJSON records
+// whose -field holds the message, as `kcat -J` prints Kafka records.
+func runStream(args []string) int {
+	fs := flag.NewFlagSet("stream", flag.ContinueOnError)
+	framing := fs.String("framing", "lines", "input framing: lines (one message per line) or ndjson (one JSON record per line)")
+	field := fs.String("field", "value", "with -framing ndjson, the record field holding the message")
+	outFormat := fs.String("out", "", "output: lines (one result per line, errors on stderr) or ndjson (the input record with output or error); default: as -framing")
+	inputFormat := fs.String("input-format", "auto", "message format: auto, xml, html, json or json-items")
+	workers := fs.Int("workers", 1, "messages evaluated at once; results stay in input order")
+	metricsAddr := fs.String("metrics", "", "serve Prometheus metrics at this address's /metrics while streaming")
+	failFast := fs.Bool("fail-fast", false, "stop at the first failing message")
+	var maxMemory byteSize
+	fs.Var(&maxMemory, "max-memory", "fail messages whose evaluation allocates about this much for nodes and sequences, e.g. 64MiB")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "Usage: xform stream [-framing lines|ndjson] [-field value] [-out lines|ndjson] [-workers N] <transform.xform>")
+		return 1
+	}
+	if *outFormat == "" {
+		*outFormat = *framing
+	}
+	if (*framing != "lines" && *framing != "ndjson") || (*outFormat != "lines" && *outFormat != "ndjson") {
+		fmt.Fprintln(os.Stderr, "-framing and -out are lines or ndjson")
+		return 1
+	}
+	format, err := xform.ParseInputFormat(*inputFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	prog, err := loadProgram(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	metrics := xform.NewMetricsRegistry()
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			metrics.WritePrometheus(w)
+		})
+		go func() {
+			fmt.Fprintln(os.Stderr, http.ListenAndServe(*metricsAddr, mux))
+			os.Exit(1)
+		}()
+	}
+	opts := xform.MessageOptions{
+		Eval:        xform.EvalOptions{BaseDir: filepath.Dir(fs.Arg(0)), Diagnostics: printDiagnostic, Metrics: metrics, MaxMemory: int64(maxMemory)},
+		InputFormat: format,
+		Workers:     *workers,
+	}
+	if prog.FS != nil {
+		opts.Eval.BaseDir = ""
+	}
+
+	var messages, failed int64
+	in := make(chan xform.Message, *workers)
+	out := make(chan xform.MessageResult, *workers)
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- readMessages(os.Stdin, *framing, *field, in, func(line int64, err error) {
+			atomic.AddInt64(&messages, 1)
+			atomic.AddInt64(&failed, 1)
+			metrics.Error("parse")
+			fmt.Fprintf(os.Stderr, "xform stream: line %d: %v\n", line, err)
+		})
+		close(in)
+	}()
+	go prog.TransformMessages(in, out, opts)
+
+	w := bufio.NewWriter(os.Stdout)
+	status := 0
+	for res := range out {
+		atomic.AddInt64(&messages, 1)
+		if res.Err != nil {
+			atomic.AddInt64(&failed, 1)
+		}
+		if err := writeMessageResult(w, res, *outFormat); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if res.Err != nil && *failFast {
+			status = 1
+			break
+		}
+	}
+	if status == 0 {
+		if err := <-readErr; err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		}
+	}
+	fmt.Fprintf(os.Stderr, "xform stream: %d messages, %d failed\n", atomic.LoadInt64(&messages), atomic.LoadInt64(&failed))
+	return status
+}
+
+// readMessages sends the messages framed in r to in. Lines that hold no
+// message, such as an NDJSON record without the field, are passed to
+// invalid and skipped.
+func readMessages(r io.Reader, framing, field string, in chan<- xform.Message, invalid func(line int64, err error)) error {
+	br := bufio.NewReaderSize(r, 1<<16)
+	var line int64
+	for {
+		data, err := br.ReadBytes('\n')
+		if len(data) > 0 {
+			line++
+			data = bytes.TrimRight(data, "\r\n")
+			if len(bytes.TrimSpace(data)) > 0 {
+				if framing == "lines" {
+					in <- xform.Message{Value: data}
+				} else if msg, err := recordMessage(data, field); err != nil {
+					invalid(line, err)
+				} else {
+					in <- msg
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// recordMessage takes the message from an NDJSON record. A string field
+// is the message itself; other JSON values are passed on as JSON text. The
+// rest of the record is kept for the output.
+func recordMessage(data []byte, field string) (xform.Message, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var record map[string]any
+	if err := dec.Decode(&record); err != nil {
+		return xform.Message{}, fmt.Errorf("invalid JSON record: %v", err)
+	}
+	value, ok := record[field]
+	if !ok || value == nil {
+		return xform.Message{}, fmt.Errorf("record has no %q field", field)
+	}
+	delete(record, field)
+	if s, ok := value.(string); ok {
+		return xform.Message{Value: []byte(s), Meta: record}, nil
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return xform.Message{}, err
+	}
+	return xform.Message{Value: raw, Meta: record}, nil
+}
+
+func writeMessageResult(w *bufio.Writer, res xform.MessageResult, format string) error {
+	if format == "lines" {
+		if res.Err != nil {
+			fmt.Fprintf(os.Stderr, "xform stream: message %d: %v\n", res.Seq, res.Err)
+			return nil
+		}
+		w.WriteString(res.Output)
+		w.WriteByte('\n')
+		return w.Flush()
+	}
+	record := map[string]any{}
+	if meta, ok := res.Message.Meta.(map[string]any); ok {
+		for k, v := range meta {
+			record[k] = v
+		}
+	}
+	record["seq"] = res.Seq
+	if res.Err != nil {
+		record["error"] = errorRecord(res.Err)
+	} else {
+		record["output"] = res.Output
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(record); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func errorRecord(err error) map[string]any {
+	e := map[string]any{"message": err.Error()}
+	if code := xform.ErrorCode(err); code != "unknown" {
+		e["code"] = code
+	}
+	var xe *xform.XFormError
+	if errors.As(err, &xe) {
+		e["code"], e["message"] = xe.Code, xe.Message
+		if xe.Pos.IsValid() {
+			e["line"], e["column"] = xe.Pos.Line, xe.Pos.Column
+		}
+	}
+	return e
+}
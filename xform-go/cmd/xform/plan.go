@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// plan writes what a run would do to w without running a transform: for
+// each step, in an order the needs allow, its transform and parameters
+// and the outputs its inputs would go to. Globs match the files on disk
+// and the outputs of the steps before, which need not exist yet. It loads
+// every transform, so that a plan reporting no problems would start. It
+// reports whether no problems were found.
+func (r *pipelineRunner) plan(w io.Writer) bool {
+	ok := true
+	// planned are the outputs of the steps so far, written marks those
+	// the run would write rather than leave up to date.
+	planned := map[string]bool{}
+	written := map[string]bool{}
+	for _, s := range stepOrder(r.p.Steps) {
+		fmt.Fprintf(w, "[%s] %s%s\n", s.Name, s.Transform, r.describeStep(s))
+		if _, err := r.program(r.path(s.Transform)); err != nil {
+			fmt.Fprintf(w, "  error: %v\n", err)
+			ok = false
+		}
+		pattern := s.Input
+		if s.Collect != "" {
+			pattern = s.Collect
+		}
+		inputs, err := planGlob(r.path(pattern), planned)
+		if err == nil && len(inputs) == 0 {
+			err = fmt.Errorf("no files match %s", pattern)
+		}
+		if err == nil && s.Collect == "" && len(inputs) > 1 && !strings.Contains(s.Output, "{") {
+			err = fmt.Errorf("output %s needs a {name} or {file} placeholder for %d inputs", s.Output, len(inputs))
+		}
+		if err != nil {
+			fmt.Fprintf(w, "  error: %v\n", err)
+			ok = false
+			continue
+		}
+		var jobs [][]string
+		if s.Collect != "" {
+			jobs = [][]string{inputs}
+		} else {
+			for _, in := range inputs {
+				jobs = append(jobs, []string{in})
+			}
+		}
+		for _, job := range jobs {
+			label, output := r.rel(job[0]), r.path(expandOutput(s.Output, s, job[0]))
+			if s.Collect != "" {
+				label = fmt.Sprintf("%s (%d files)", s.Collect, len(job))
+				output = r.path(expandOutput(s.Output, s, ""))
+			}
+			note := ""
+			if !anyWritten(job, written) && r.planUpToDate(s, job, output) {
+				note = " (up to date)"
+			} else {
+				written[output] = true
+			}
+			planned[output] = true
+			fmt.Fprintf(w, "  %s -> %s%s\n", label, r.rel(output), note)
+		}
+	}
+	return ok
+}
+
+// planUpToDate reports whether -resume or -cache would skip the job over
+// inputs.
+func (r *pipelineRunner) planUpToDate(s *pipelineStep, inputs []string, output string) bool {
+	if r.resume && upToDate(output, append([]string{r.path(s.Transform)}, inputs...)) {
+		return true
+	}
+	if r.cache == nil {
+		return false
+	}
+	key, err := r.cacheKey(s, inputs)
+	return err == nil && r.cache.valid(output, key)
+}
+
+// describeStep returns the parameters and needs of s for plan.
+func (r *pipelineRunner) describeStep(s *pipelineStep) string {
+	params := r.stepParams(s)
+	out := ""
+	if len(params) > 0 {
+		names := make([]string, 0, len(params))
+		for k := range params {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for i, k := range names {
+			names[i] = k + "=" + params[k]
+		}
+		out += ", params " + strings.Join(names, " ")
+	}
+	if len(s.Needs) > 0 {
+		out += ", needs " + strings.Join(s.Needs, " ")
+	}
+	return out
+}
+
+// rel returns path relative to the pipeline's directory, as the file
+// names it was written with.
+func (r *pipelineRunner) rel(path string) string {
+	if rel, err := filepath.Rel(r.p.Dir, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return path
+}
+
+// planGlob returns the files matching pattern on disk and among planned,
+// sorted.
+func planGlob(pattern string, planned map[string]bool) ([]string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	matches = withoutManifests(matches)
+	seen := map[string]bool{}
+	for _, m := range matches {
+		seen[m] = true
+	}
+	for p := range planned {
+		if ok, _ := filepath.Match(pattern, p); ok && !seen[p] {
+			seen[p] = true
+			matches = append(matches, p)
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func anyWritten(inputs []string, written map[string]bool) bool {
+	for _, in := range inputs {
+		if written[in] {
+			return true
+		}
+	}
+	return false
+}
+
+// stepOrder returns steps with every step after the steps it needs,
+// otherwise in the order of the pipeline file.
+func stepOrder(steps []*pipelineStep) []*pipelineStep {
+	names := map[string]*pipelineStep{}
+	for _, s := range steps {
+		names[s.Name] = s
+	}
+	done := map[string]bool{}
+	out := []*pipelineStep{}
+	var visit func(s *pipelineStep)
+	visit = func(s *pipelineStep) {
+		if done[s.Name] {
+			return
+		}
+		done[s.Name] = true
+		for _, n := range s.Needs {
+			visit(names[n])
+		}
+		out = append(out, s)
+	}
+	for _, s := range steps {
+		visit(s)
+	}
+	return out
+}
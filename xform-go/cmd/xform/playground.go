@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	xform "xform-go"
+)
+
+// runPlayground evaluates a transform the way a web playground would, under
+// tight limits and without access to files or the network other than the
+// -doc documents, and prints the xform.PlaygroundResult as JSON. It exits 1
+// when the result reports an error.
+func runPlayground(args []string) int {
+	fs := flag.NewFlagSet("playground", flag.ContinueOnError)
+	maxMemory := byteSize(xform.DefaultPlaygroundMemory)
+	fs.Var(&maxMemory, "max-memory", "memory limit of the evaluation")
+	timeout := fs.Duration("timeout", xform.DefaultPlaygroundTimeout, "time limit of the evaluation")
+	maxFirings := fs.Int("max-firings", xform.DefaultPlaygroundFirings, "rule firings kept in the snapshot")
+	maxOutput := byteSize(xform.DefaultPlaygroundOutput)
+	fs.Var(&maxOutput, "max-output", "bytes of output kept")
+	var params, docs stringList
+	fs.Var(&params, "param", "set parameter name to value (repeatable)")
+	fs.Var(&docs, "doc", "make file available to doc() as uri, uri=file (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	inputPath, xformPath := "-", ""
+	switch fs.NArg() {
+	case 1:
+		xformPath = fs.Arg(0)
+	case 2:
+		inputPath, xformPath = fs.Arg(0), fs.Arg(1)
+	default:
+		fmt.Fprintln(os.Stderr, "Usage: xform playground [-max-memory size] [-timeout d] [-max-firings N] [-max-output size] [-param name=value]... [-doc uri=file]... [input.xml|-] <transform.xform>")
+		return 2
+	}
+	opts := xform.PlaygroundOptions{MaxMemory: int64(maxMemory), Timeout: *timeout, MaxFirings: *maxFirings, MaxOutput: int(maxOutput)}
+	var err error
+	if opts.Params, err = parseParams(params); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	opts.Documents = map[string]string{}
+	for _, d := range docs {
+		uri, file, ok := strings.Cut(d, "=")
+		if !ok || uri == "" {
+			fmt.Fprintf(os.Stderr, "-doc %q: want uri=file\n", d)
+			return 2
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		opts.Documents[uri] = string(data)
+	}
+	src, err := os.ReadFile(xformPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	input, err := readInput(inputPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	res := xform.Playground(string(src), string(input), opts)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(res); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if res.Error != nil {
+		return 1
+	}
+	return 0
+}
+
+// playgroundRequest is the JSON body of a POST to xform serve's
+// /playground; params are strings as with -param.
+type playgroundRequest struct {
+	Transform string            `json:"transform"`
+	Input     string            `json:"input"`
+	Params    map[string]string `json:"params"`
+	Documents map[string]string `json:"documents"`
+}
+
+// servePlayground handles /playground: it runs xform.Playground on the
+// request under opts and answers with the result as JSON, also when the
+// transform fails.
+func servePlayground(w http.ResponseWriter, r *http.Request, opts xform.PlaygroundOptions, maxInput int64) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if maxInput > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxInput)
+	}
+	var req playgroundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "playground request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Params) > 0 {
+		opts.Params = map[string][]any{}
+		for name, value := range req.Params {
+			opts.Params[name] = []any{value}
+		}
+	}
+	opts.Documents = req.Documents
+	res := xform.Playground(req.Transform, req.Input, opts)
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(res)
+}
+
+// playgroundOptions are the limits of /playground: the playground's own,
+// or the server's where they are tighter.
+func playgroundOptions(server xform.EvalOptions) xform.PlaygroundOptions {
+	opts := xform.PlaygroundOptions{AllowFunctions: server.AllowFunctions}
+	if server.MaxMemory > 0 && server.MaxMemory < xform.DefaultPlaygroundMemory {
+		opts.MaxMemory = server.MaxMemory
+	}
+	if server.Timeout > 0 && server.Timeout < xform.DefaultPlaygroundTimeout {
+		opts.Timeout = server.Timeout
+	}
+	return opts
+}
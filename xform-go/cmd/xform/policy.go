@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	xform "xform-go"
+)
+
+// servePolicy is what xform serve -policy allows requests, read from a
+// YAML file such as:
+//
+//	max-input: 4MiB
+//	max-memory: 64MiB
+//	max-output: 16MiB
+//	max-output-nodes: 100000
+//	timeout: 5s
+//	files: false
+//	dirs: [lookups]
+//	hosts: [api.example.com, "*.cdn.example.com"]
+//	functions: [count, string, concat, doc]
+type servePolicy struct {
+	MaxInput       int64
+	MaxMemory      int64
+	MaxOutput      int64
+	MaxOutputNodes int
+	Timeout        time.Duration
+	// Files allows doc() and collection() to read local files.
+	Files bool
+	// Dirs, when not nil, are the directories those files must be in.
+	Dirs []string
+	// Hosts, when not nil, are the hosts doc() may fetch from; "*.x"
+	// matches the subdomains of x.
+	Hosts []string
+	// Functions, when not nil, are the built-in functions transforms may
+	// call.
+	Functions []string
+}
+
+// defaultPolicy is the policy before the keys of a policy file apply. With
+// transforms sent by clients it denies doc() and collection() everything:
+// no local files and no hosts.
+func defaultPolicy(acceptTransforms bool) servePolicy {
+	if acceptTransforms {
+		return servePolicy{Files: false, Hosts: []string{}}
+	}
+	return servePolicy{Files: true}
+}
+
+// loadPolicy reads a policy file, whose keys override those of base.
+func loadPolicy(path string, base servePolicy) (*servePolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := parseYAML(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	p, err := decodePolicy(raw, base)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return p, nil
+}
+
+func decodePolicy(raw any, base servePolicy) (*servePolicy, error) {
+	p := &base
+	if raw == nil {
+		return p, nil
+	}
+	top, ok := raw.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("policy must be a mapping")
+	}
+	for key, v := range top {
+		var err error
+		switch key {
+		case "max-input", "max-memory", "max-output":
+			var s string
+			var size byteSize
+			if s, err = yamlString(key, v); err == nil {
+				if err = size.Set(s); err != nil {
+					err = fmt.Errorf("%s: %v", key, err)
+				}
+			}
+			switch key {
+			case "max-input":
+				p.MaxInput = int64(size)
+			case "max-memory":
+				p.MaxMemory = int64(size)
+			default:
+				p.MaxOutput = int64(size)
+			}
+		case "max-output-nodes":
+			var s string
+			if s, err = yamlString(key, v); err == nil {
+				if p.MaxOutputNodes, err = strconv.Atoi(s); err != nil || p.MaxOutputNodes < 0 {
+					err = fmt.Errorf("max-output-nodes must be a number of nodes")
+				}
+			}
+		case "timeout":
+			var s string
+			if s, err = yamlString(key, v); err == nil {
+				if p.Timeout, err = time.ParseDuration(s); err != nil {
+					err = fmt.Errorf("timeout must be a duration such as 5s")
+				}
+			}
+		case "files":
+			var s string
+			if s, err = yamlString(key, v); err == nil {
+				switch s {
+				case "true":
+					p.Files = true
+				case "false":
+					p.Files = false
+				default:
+					err = fmt.Errorf("files must be true or false")
+				}
+			}
+		case "dirs":
+			p.Dirs, err = yamlStrings(key, v)
+		case "hosts":
+			p.Hosts, err = yamlStrings(key, v)
+		case "functions":
+			p.Functions, err = yamlStrings(key, v)
+		default:
+			err = fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// apply sets the policy's limits in opts.
+func (p *servePolicy) apply(opts *xform.EvalOptions) {
+	if p.MaxMemory > 0 {
+		opts.MaxMemory = p.MaxMemory
+	}
+	if p.MaxOutput > 0 {
+		opts.OutputLimit.MaxBytes = p.MaxOutput
+	}
+	if p.MaxOutputNodes > 0 {
+		opts.OutputLimit.MaxNodes = p.MaxOutputNodes
+	}
+	opts.Timeout = p.Timeout
+	opts.AllowFunctions = p.Functions
+	if !p.Files || p.Dirs != nil || p.Hosts != nil {
+		opts.Resolver = xform.RestrictedResolver{Next: opts.Resolver, Files: p.Files, Dirs: p.Dirs, Hosts: p.Hosts}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progress reports what xform run does: by default a line per file
+// written and per failure; with quiet only the failures; with bar a
+// status line of files done, ETA and the current file, redrawn in place;
+// with ndjson one JSON event per line on events, for build orchestrators.
+// Failures always go to log, and are listed again at the end of a run in
+// which some files failed: in a long run the first ones have scrolled
+// away. The total grows as steps find their input
+// files, since a step's inputs may be the outputs of the steps it needs.
+type progress struct {
+	mu        sync.Mutex
+	log       io.Writer
+	events    *json.Encoder
+	quiet     bool
+	bar       bool
+	start     time.Time
+	total     int
+	done      int
+	failed    int
+	fresh     int
+	failures  []string
+	current   string
+	barLength int
+}
+
+// progressEvent is a line of -progress-format ndjson output.
+type progressEvent struct {
+	Event     string         `json:"event"`
+	Step      string         `json:"step,omitempty"`
+	Input     string         `json:"input,omitempty"`
+	Output    string         `json:"output,omitempty"`
+	Error     map[string]any `json:"error,omitempty"`
+	Files     int            `json:"files,omitempty"`
+	Done      int            `json:"done"`
+	Total     int            `json:"total"`
+	Failed    int            `json:"failed"`
+	ElapsedMS int64          `json:"elapsed_ms"`
+	ETAMS     int64          `json:"eta_ms,omitempty"`
+}
+
+func newProgress(log, events io.Writer, quiet, bar bool) *progress {
+	p := &progress{log: log, quiet: quiet, bar: bar, start: time.Now()}
+	if events != nil {
+		p.events = json.NewEncoder(events)
+		p.events.SetEscapeHTML(false)
+	}
+	return p
+}
+
+// files records that step runs over n files.
+func (p *progress) files(step string, n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total += n
+	p.emit(progressEvent{Event: "step", Step: step, Files: n})
+	p.redraw()
+}
+
+func (p *progress) started(step, input string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current = step + ": " + input
+	p.emit(progressEvent{Event: "start", Step: step, Input: input})
+	p.redraw()
+}
+
+func (p *progress) finished(step, input, output string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	p.emit(progressEvent{Event: "done", Step: step, Input: input, Output: output})
+	if !p.quiet && !p.bar && p.events == nil {
+		fmt.Fprintf(p.log, "[%s] %s -> %s\n", step, input, output)
+	}
+	p.redraw()
+}
+
+// upToDate records a file skipped by -resume or -cache.
+func (p *progress) upToDate(step, input, output string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	p.fresh++
+	p.emit(progressEvent{Event: "up-to-date", Step: step, Input: input, Output: output})
+	p.redraw()
+}
+
+// failure reports err for a file of step, or for the step itself when
+// input is "".
+func (p *progress) failure(step, input string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if input != "" {
+		p.done++
+		p.failed++
+	}
+	p.emit(progressEvent{Event: "error", Step: step, Input: input, Error: errorRecord(err)})
+	p.clearBar()
+	msg := fmt.Sprintf("[%s] %v", step, err)
+	if input != "" {
+		msg = fmt.Sprintf("[%s] %s: %v", step, input, err)
+		p.failures = append(p.failures, msg)
+	}
+	fmt.Fprintln(p.log, msg)
+	p.redraw()
+}
+
+func (p *progress) skipped(step string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.emit(progressEvent{Event: "skip", Step: step})
+	p.clearBar()
+	fmt.Fprintf(p.log, "[%s] skipped: a needed step failed\n", step)
+	p.redraw()
+}
+
+// finish ends the status line with a summary and lists the failed files.
+func (p *progress) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.emit(progressEvent{Event: "end"})
+	if p.bar {
+		p.clearBar()
+		fmt.Fprintf(p.log, "%d files in %s, %d up to date, %d failed\n", p.done, time.Since(p.start).Round(time.Millisecond), p.fresh, p.failed)
+	}
+	if len(p.failures) > 0 && p.done > 1 {
+		sort.Strings(p.failures)
+		fmt.Fprintf(p.log, "%d of %d files failed:\n", len(p.failures), p.done)
+		for _, f := range p.failures {
+			fmt.Fprintln(p.log, "  "+f)
+		}
+	}
+}
+
+// eta estimates the time left from the average time per file so far; p.mu
+// is held.
+func (p *progress) eta() time.Duration {
+	if p.done == 0 || p.done >= p.total {
+		return 0
+	}
+	return time.Since(p.start) / time.Duration(p.done) * time.Duration(p.total-p.done)
+}
+
+// emit writes e with the counters filled in; p.mu is held.
+func (p *progress) emit(e progressEvent) {
+	if p.events == nil {
+		return
+	}
+	e.Done, e.Total, e.Failed = p.done, p.total, p.failed
+	e.ElapsedMS = time.Since(p.start).Milliseconds()
+	e.ETAMS = p.eta().Milliseconds()
+	p.events.Encode(e)
+}
+
+// redraw rewrites the status line; p.mu is held.
+func (p *progress) redraw() {
+	if !p.bar {
+		return
+	}
+	line := fmt.Sprintf("[%d/%d]", p.done, p.total)
+	if p.total > 0 {
+		line += fmt.Sprintf(" %3d%%", p.done*100/p.total)
+	}
+	if eta := p.eta(); eta > 0 {
+		line += " ETA " + eta.Round(time.Second).String()
+	}
+	if p.current != "" {
+		line += " " + p.current
+	}
+	pad := ""
+	if n := p.barLength - len(line); n > 0 {
+		pad = strings.Repeat(" ", n)
+	}
+	fmt.Fprint(p.log, "\r"+line+pad)
+	p.barLength = len(line)
+}
+
+// clearBar blanks the status line, so that a message can take its place;
+// p.mu is held.
+func (p *progress) clearBar() {
+	if p.bar && p.barLength > 0 {
+		fmt.Fprint(p.log, "\r"+strings.Repeat(" ", p.barLength)+"\r")
+		p.barLength = 0
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	xform "xform-go"
+)
+
+const refactorUsage = `Usage: xform refactor rename [-w] <main.xform> <old> <new>
+       xform refactor extract-function [-w] <file.xform> <line:col-line:col> <name>`
+
+// runRefactor rewrites transform sources: rename renames a function,
+// variable or parameter across the module tree of main.xform, and
+// extract-function moves the selected expression of file.xform (the end
+// column is exclusive) into a new function. The changed files are printed,
+// each after a "==> path <==" line, or with -w written in place.
+func runRefactor(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, refactorUsage)
+		return 2
+	}
+	flags := flag.NewFlagSet("refactor "+args[0], flag.ContinueOnError)
+	write := flags.Bool("w", false, "write the changes to the files instead of printing them")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	var changed map[string]string
+	var err error
+	switch {
+	case args[0] == "rename" && flags.NArg() == 3:
+		changed, err = refactorRename(flags.Arg(0), flags.Arg(1), flags.Arg(2))
+	case args[0] == "extract-function" && flags.NArg() == 3:
+		changed, err = refactorExtract(flags.Arg(0), flags.Arg(1), flags.Arg(2))
+	default:
+		fmt.Fprintln(os.Stderr, refactorUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	paths := make([]string, 0, len(changed))
+	for path := range changed {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if !*write {
+			fmt.Printf("==> %s <==\n%s", path, changed[path])
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if err := os.WriteFile(path, []byte(changed[path]), info.Mode().Perm()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func refactorRename(main, old, new string) (map[string]string, error) {
+	prog, err := compileSources(main)
+	if err != nil {
+		return nil, err
+	}
+	sources, err := prog.Rename(old, new)
+	if err != nil {
+		return nil, err
+	}
+	changed := map[string]string{}
+	for name, src := range sources {
+		changed[filepath.FromSlash(name)] = src
+	}
+	return changed, nil
+}
+
+func refactorExtract(path, selection, name string) (map[string]string, error) {
+	from, to, err := parseSelection(selection)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := compileSources(path)
+	if err != nil {
+		return nil, err
+	}
+	// Functions imported under name would be hidden by the new one.
+	if _, ok := prog.Module.Functions[name]; ok {
+		return nil, fmt.Errorf("function %s is already defined", name)
+	}
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	out, err := xform.ExtractFunction(string(src), from, to, name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return map[string]string{path: out}, nil
+}
+
+// compileSources loads a transform for refactoring, which rewrites source
+// files and so cannot work on a bundle.
+func compileSources(path string) (*xform.Program, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if xform.IsBundle(data) {
+		return nil, fmt.Errorf("%s: cannot refactor a bundle; refactor its sources", path)
+	}
+	return xform.CompileFile(path)
+}
+
+// parseSelection reads line:col-line:col.
+func parseSelection(s string) (xform.Position, xform.Position, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return xform.Position{}, xform.Position{}, fmt.Errorf("selection %q must be line:col-line:col", s)
+	}
+	start, err := parsePosition(from)
+	if err != nil {
+		return xform.Position{}, xform.Position{}, err
+	}
+	end, err := parsePosition(to)
+	if err != nil {
+		return xform.Position{}, xform.Position{}, err
+	}
+	return start, end, nil
+}
+
+func parsePosition(s string) (xform.Position, error) {
+	line, col, ok := strings.Cut(s, ":")
+	l, err := strconv.Atoi(line)
+	if !ok || err != nil || l < 1 {
+		return xform.Position{}, fmt.Errorf("position %q must be line:col", s)
+	}
+	c, err := strconv.Atoi(col)
+	if err != nil || c < 1 {
+		return xform.Position{}, fmt.Errorf("position %q must be line:col", s)
+	}
+	return xform.Position{Line: l, Column: c}, nil
+}
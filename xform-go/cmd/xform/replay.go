@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	xform "xform-go"
+)
+
+// startRecording opens a rule-firing log at path. The returned function
+// flushes and closes it; it may be called more than once.
+func startRecording(path string) (*xform.Recorder, func() error, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	rec, err := xform.NewRecorder(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	done := false
+	return rec, func() error {
+		if done {
+			return nil
+		}
+		done = true
+		err := rec.Close()
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}, nil
+}
+
+// runReplay lists the rule firings of a log written with -record, or with
+// -find the rules that produced an output fragment.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	find := fs.String("find", "", "show the rules whose output produced this fragment")
+	rule := fs.String("rule", "", "only firings of this rule")
+	input := fs.String("input", "", "only firings on input paths starting with this prefix")
+	verbose := fs.Bool("v", false, "print input and output fragments in full")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: xform replay [-find fragment] [-rule name] [-input path] [-v] <run.log>")
+		return 2
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer f.Close()
+	records, err := xform.ReadRecording(f)
+	if err != nil {
+		// A log cut short by a crash still holds the firings before it.
+		fmt.Fprintln(os.Stderr, err)
+		if len(records) == 0 {
+			return 2
+		}
+	}
+	keep := func(r xform.Record) bool {
+		return (*rule == "" || r.Rule == *rule) && strings.HasPrefix(r.Input, *input)
+	}
+	if *find == "" {
+		for _, r := range sortedBySeq(records) {
+			if keep(r) {
+				printRecord(r, "", *verbose)
+			}
+		}
+		return 0
+	}
+	found := 0
+	for _, chain := range xform.Producers(records, *find) {
+		if !keep(chain[0]) {
+			continue
+		}
+		found++
+		printRecord(chain[0], "produced by ", *verbose)
+		for _, r := range chain[1:] {
+			printRecord(r, "  inside ", false)
+		}
+	}
+	if found == 0 {
+		fmt.Fprintf(os.Stderr, "no recorded rule produced %q\n", *find)
+		return 1
+	}
+	return 0
+}
+
+func sortedBySeq(records []xform.Record) []xform.Record {
+	out := make([]xform.Record, len(records))
+	for _, r := range records {
+		if r.Seq >= 1 && r.Seq <= len(out) {
+			out[r.Seq-1] = r
+		}
+	}
+	kept := out[:0]
+	for _, r := range out {
+		if r.Seq != 0 {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+func printRecord(r xform.Record, prefix string, verbose bool) {
+	fmt.Printf("%s#%d rule %s match %s (line %d) on %s\n", prefix, r.Seq, r.Rule, r.Pattern, r.Line, r.Input)
+	if verbose {
+		fmt.Printf("    input:  %s\n    output: %s\n", r.Source, r.Output)
+		return
+	}
+	if prefix == "" || strings.HasPrefix(prefix, "produced") {
+		fmt.Printf("    -> %s\n", clip(strings.Join(strings.Fields(r.Output), " "), 120))
+	}
+}
+
+// clip shortens s to n characters, marking the cut with "...".
+func clip(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n]) + "..."
+}
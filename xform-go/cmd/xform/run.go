@@ -0,0 +1,666 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	xform "xform-go"
+)
+
+// A pipeline file describes a set of steps, each running one transform over
+// one input, over every file matched by a glob (fan-out) or over all matched
+// files at once, wrapped in a <collection> element (fan-in):
+//
+//	parallel: 4
+//	params: {locale: en}
+//	steps:
+//	  - name: normalize
+//	    transform: normalize.xform
+//	    input: src/*.xml
+//	    output: build/{name}.xml
+//	  - name: index
+//	    needs: [normalize]
+//	    transform: index.xform
+//	    collect: build/*.xml
+//	    output: site/index.html
+//	    params: {title: Manual}
+//
+// Relative paths are resolved against the pipeline file's directory. Steps
+// run as soon as the steps they need have finished; independent steps and
+// the files of a fan-out step are processed in parallel.
+type pipeline struct {
+	Dir      string
+	Parallel int
+	Params   map[string]string
+	Steps    []*pipelineStep
+}
+
+type pipelineStep struct {
+	Name        string
+	Transform   string
+	Input       string
+	Collect     string
+	Output      string
+	Needs       []string
+	Params      map[string]string
+	InputFormat xform.InputFormat
+	Indent      bool
+}
+
+func runPipeline(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	jobs := fs.Int("j", 0, "number of parallel jobs (default: the pipeline's parallel setting or the number of CPUs)")
+	showProgress := fs.Bool("progress", false, "show files done, ETA and the current file on a status line instead of a line per file")
+	progressFormat := fs.String("progress-format", "text", "progress output: text, or ndjson for one JSON event per line on stdout")
+	quiet := fs.Bool("quiet", false, "report only failures")
+	keepGoing := fs.Bool("keep-going", false, "run the steps needing a step of which only some files failed, over the files it wrote")
+	dryRun := fs.Bool("dry-run", false, "print the inputs, transforms, parameters and outputs of each step without running them")
+	resume := fs.Bool("resume", false, "skip files whose output is newer than their input and transform, as make does")
+	cache := fs.Bool("cache", false, "skip files whose output was made from the same input, transform and parameters, recorded in a manifest in the output directory")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: xform run [-j N] [-dry-run] [-keep-going] [-resume] [-cache] [-progress] [-progress-format text|ndjson] [-quiet] <pipeline.yaml>")
+		return 1
+	}
+	if *progressFormat != "text" && *progressFormat != "ndjson" {
+		fmt.Fprintln(os.Stderr, "-progress-format is text or ndjson")
+		return 1
+	}
+	p, err := loadPipeline(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *jobs > 0 {
+		p.Parallel = *jobs
+	}
+	if p.Parallel <= 0 {
+		p.Parallel = runtime.NumCPU()
+	}
+	var events io.Writer
+	if *progressFormat == "ndjson" {
+		events = os.Stdout
+	}
+	report := newProgress(os.Stderr, events, *quiet, *showProgress && events == nil && !*quiet)
+	r := &pipelineRunner{p: p, sem: make(chan struct{}, p.Parallel), programs: map[string]*programEntry{}, docs: map[string]*docEntry{}, documents: xform.NewDocumentCache(64 << 20), progress: report, keepGoing: *keepGoing, resume: *resume}
+	if *cache {
+		r.cache = newBuildCache()
+	}
+	if *dryRun {
+		if !r.plan(os.Stdout) {
+			return 1
+		}
+		return 0
+	}
+	ok := r.run()
+	if r.cache != nil {
+		if err := r.cache.save(); err != nil {
+			report.failure("cache", "", err)
+			ok = false
+		}
+	}
+	report.finish()
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
+func loadPipeline(path string) (*pipeline, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := parseYAML(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	p, err := decodePipeline(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	p.Dir = filepath.Dir(path)
+	return p, nil
+}
+
+func decodePipeline(raw any) (*pipeline, error) {
+	top, ok := raw.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("pipeline must be a mapping")
+	}
+	p := &pipeline{}
+	for key, v := range top {
+		var err error
+		switch key {
+		case "parallel":
+			p.Parallel, err = yamlInt(key, v)
+		case "params":
+			p.Params, err = yamlStringMap(key, v)
+		case "steps":
+			list, ok := v.([]any)
+			if !ok {
+				return nil, fmt.Errorf("steps must be a list")
+			}
+			for i, item := range list {
+				step, err := decodeStep(item)
+				if err != nil {
+					return nil, fmt.Errorf("step %d: %v", i+1, err)
+				}
+				p.Steps = append(p.Steps, step)
+			}
+		default:
+			err = fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(p.Steps) == 0 {
+		return nil, fmt.Errorf("pipeline has no steps")
+	}
+	names := map[string]*pipelineStep{}
+	for _, s := range p.Steps {
+		if names[s.Name] != nil {
+			return nil, fmt.Errorf("duplicate step %q", s.Name)
+		}
+		names[s.Name] = s
+	}
+	for _, s := range p.Steps {
+		for _, n := range s.Needs {
+			if names[n] == nil {
+				return nil, fmt.Errorf("step %q needs unknown step %q", s.Name, n)
+			}
+		}
+	}
+	if cycle := findCycle(p.Steps, names); cycle != "" {
+		return nil, fmt.Errorf("dependency cycle: %s", cycle)
+	}
+	return p, nil
+}
+
+func decodeStep(raw any) (*pipelineStep, error) {
+	m, ok := raw.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("must be a mapping")
+	}
+	s := &pipelineStep{}
+	for key, v := range m {
+		var err error
+		switch key {
+		case "name":
+			s.Name, err = yamlString(key, v)
+		case "transform":
+			s.Transform, err = yamlString(key, v)
+		case "input":
+			s.Input, err = yamlString(key, v)
+		case "collect":
+			s.Collect, err = yamlString(key, v)
+		case "output":
+			s.Output, err = yamlString(key, v)
+		case "needs":
+			s.Needs, err = yamlStrings(key, v)
+		case "params":
+			s.Params, err = yamlStringMap(key, v)
+		case "input-format":
+			var f string
+			if f, err = yamlString(key, v); err == nil {
+				s.InputFormat, err = xform.ParseInputFormat(f)
+			}
+		case "indent":
+			var b string
+			if b, err = yamlString(key, v); err == nil {
+				s.Indent, err = strconv.ParseBool(b)
+			}
+		default:
+			err = fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case s.Name == "":
+		return nil, fmt.Errorf("missing name")
+	case s.Transform == "":
+		return nil, fmt.Errorf("%s: missing transform", s.Name)
+	case s.Output == "":
+		return nil, fmt.Errorf("%s: missing output", s.Name)
+	case (s.Input == "") == (s.Collect == ""):
+		return nil, fmt.Errorf("%s: exactly one of input and collect is required", s.Name)
+	}
+	return s, nil
+}
+
+func findCycle(steps []*pipelineStep, names map[string]*pipelineStep) string {
+	state := map[string]int{}
+	var path []string
+	var visit func(s *pipelineStep) bool
+	visit = func(s *pipelineStep) bool {
+		switch state[s.Name] {
+		case 1:
+			path = append(path, s.Name)
+			return true
+		case 2:
+			return false
+		}
+		state[s.Name] = 1
+		path = append(path, s.Name)
+		for _, n := range s.Needs {
+			if visit(names[n]) {
+				return true
+			}
+		}
+		path = path[:len(path)-1]
+		state[s.Name] = 2
+		return false
+	}
+	for _, s := range steps {
+		if visit(s) {
+			return strings.Join(path, " -> ")
+		}
+	}
+	return ""
+}
+
+func yamlString(key string, v any) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("%s must be a string", key)
+	}
+	return s, nil
+}
+
+func yamlInt(key string, v any) (int, error) {
+	s, err := yamlString(key, v)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be an integer", key)
+	}
+	return n, nil
+}
+
+func yamlStrings(key string, v any) ([]string, error) {
+	if s, ok := v.(string); ok {
+		return []string{s}, nil
+	}
+	list, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a list", key)
+	}
+	out := []string{}
+	for _, item := range list {
+		s, err := yamlString(key, item)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+func yamlStringMap(key string, v any) (map[string]string, error) {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a mapping", key)
+	}
+	out := map[string]string{}
+	for k, item := range m {
+		s, err := yamlString(key+"."+k, item)
+		if err != nil {
+			return nil, err
+		}
+		out[k] = s
+	}
+	return out, nil
+}
+
+type programEntry struct {
+	once sync.Once
+	prog *xform.Program
+	err  error
+	// digest is the transform's hash for -cache, see transformDigest.
+	digestOnce sync.Once
+	digest     string
+	digestErr  error
+}
+
+type docEntry struct {
+	once sync.Once
+	doc  *xform.Node
+	err  error
+}
+
+// pipelineRunner caches compiled transforms and parsed input documents for
+// the duration of a run, so a transform used by several steps is compiled
+// once and an intermediate result read by several steps is parsed once.
+// Evaluation never modifies its input, which makes the cached documents safe
+// to share between concurrent jobs.
+type pipelineRunner struct {
+	p        *pipeline
+	sem      chan struct{}
+	mu       sync.Mutex
+	programs map[string]*programEntry
+	docs     map[string]*docEntry
+	// documents caches what doc() loads, shared by all steps.
+	documents *xform.DocumentCache
+	progress  *progress
+	// keepGoing runs the steps needing a step of which only some files
+	// failed, over the files it wrote; resume skips the files whose output
+	// is newer than their input and transform; cache, if set, skips those
+	// made from the same inputs, transform and parameters before.
+	keepGoing bool
+	resume    bool
+	cache     *buildCache
+	failed    bool
+}
+
+func (r *pipelineRunner) path(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(r.p.Dir, p)
+}
+
+// stepStatus is how a step ended: with all of its files written, some of
+// them, or none.
+type stepStatus int
+
+const (
+	stepFailed stepStatus = iota
+	stepPartial
+	stepDone
+)
+
+func (r *pipelineRunner) run() bool {
+	done := map[string]chan stepStatus{}
+	for _, s := range r.p.Steps {
+		done[s.Name] = make(chan stepStatus, 1)
+	}
+	var wg sync.WaitGroup
+	for _, s := range r.p.Steps {
+		wg.Add(1)
+		go func(s *pipelineStep) {
+			defer wg.Done()
+			status := stepDone
+			for _, n := range s.Needs {
+				res := <-done[n]
+				done[n] <- res
+				if res < status {
+					status = res
+				}
+			}
+			if status == stepDone || status == stepPartial && r.keepGoing {
+				status = r.runStep(s)
+			} else {
+				r.progress.skipped(s.Name)
+				status = stepFailed
+			}
+			done[s.Name] <- status
+		}(s)
+	}
+	wg.Wait()
+	return !r.failed
+}
+
+func (r *pipelineRunner) fail(s *pipelineStep, input string, err error) {
+	r.mu.Lock()
+	r.failed = true
+	r.mu.Unlock()
+	r.progress.failure(s.Name, input, err)
+}
+
+func (r *pipelineRunner) runStep(s *pipelineStep) stepStatus {
+	if _, err := r.program(r.path(s.Transform)); err != nil {
+		r.fail(s, "", err)
+		return stepFailed
+	}
+	pattern := s.Input
+	if s.Collect != "" {
+		pattern = s.Collect
+	}
+	inputs, err := filepath.Glob(r.path(pattern))
+	inputs = withoutManifests(inputs)
+	if err == nil && len(inputs) == 0 {
+		err = fmt.Errorf("no files match %s", pattern)
+	}
+	if err != nil {
+		r.fail(s, "", err)
+		return stepFailed
+	}
+	sort.Strings(inputs)
+	if s.Collect != "" {
+		r.progress.files(s.Name, 1)
+		if !r.runJob(s, inputs, r.path(expandOutput(s.Output, s, ""))) {
+			return stepFailed
+		}
+		return stepDone
+	}
+	if len(inputs) > 1 && !strings.Contains(s.Output, "{") {
+		r.fail(s, "", fmt.Errorf("output %s needs a {name} or {file} placeholder for %d inputs", s.Output, len(inputs)))
+		return stepFailed
+	}
+	r.progress.files(s.Name, len(inputs))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := 0
+	for _, in := range inputs {
+		wg.Add(1)
+		go func(in string) {
+			defer wg.Done()
+			if !r.runJob(s, []string{in}, r.path(expandOutput(s.Output, s, in))) {
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			}
+		}(in)
+	}
+	wg.Wait()
+	switch failed {
+	case 0:
+		return stepDone
+	case len(inputs):
+		return stepFailed
+	}
+	return stepPartial
+}
+
+func expandOutput(tmpl string, s *pipelineStep, input string) string {
+	file := filepath.Base(input)
+	name := strings.TrimSuffix(file, filepath.Ext(file))
+	if input == "" {
+		file, name = s.Name, s.Name
+	}
+	return strings.NewReplacer("{name}", name, "{file}", file, "{step}", s.Name).Replace(tmpl)
+}
+
+func (r *pipelineRunner) runJob(s *pipelineStep, inputs []string, output string) bool {
+	r.sem <- struct{}{}
+	defer func() { <-r.sem }()
+	label := inputs[0]
+	if s.Collect != "" {
+		label = s.Collect
+	}
+	if r.resume && upToDate(output, append([]string{r.path(s.Transform)}, inputs...)) {
+		r.progress.upToDate(s.Name, label, output)
+		return true
+	}
+	var key string
+	if r.cache != nil {
+		var err error
+		if key, err = r.cacheKey(s, inputs); err != nil {
+			r.fail(s, label, err)
+			return false
+		}
+		if r.cache.valid(output, key) {
+			r.progress.upToDate(s.Name, label, output)
+			return true
+		}
+	}
+	r.progress.started(s.Name, label)
+	prog, err := r.program(r.path(s.Transform))
+	if err != nil {
+		r.fail(s, label, err)
+		return false
+	}
+	doc, err := r.input(s, inputs)
+	if err != nil {
+		r.fail(s, label, err)
+		return false
+	}
+	params := map[string][]any{}
+	for k, v := range r.stepParams(s) {
+		params[k] = []any{v}
+	}
+	opts := xform.EvalOptions{BaseDir: filepath.Dir(r.path(s.Transform)), Params: params, Diagnostics: printDiagnostic, Documents: r.documents}
+	if prog.FS != nil {
+		opts.BaseDir = ""
+	}
+	result, err := evalSafe(prog, doc, opts)
+	if err != nil {
+		r.fail(s, label, err)
+		return false
+	}
+	serOpts := prog.Module.SerializeOptions()
+	if s.Indent {
+		serOpts.Indent = "  "
+	}
+	out := xform.EncodeOutput(xform.SerializeResult(result, serOpts)+lineEnd(serOpts), serOpts.Encoding)
+	if err := os.MkdirAll(filepath.Dir(output), 0o755); err == nil {
+		err = os.WriteFile(output, out, 0o644)
+	}
+	if err != nil {
+		r.fail(s, label, err)
+		return false
+	}
+	if r.cache != nil {
+		r.cache.record(output, key, out)
+	}
+	r.mu.Lock()
+	delete(r.docs, output)
+	r.mu.Unlock()
+	r.progress.finished(s.Name, label, output)
+	return true
+}
+
+// stepParams returns the parameters of s: the pipeline's, overridden by
+// the step's own.
+func (r *pipelineRunner) stepParams(s *pipelineStep) map[string]string {
+	params := map[string]string{}
+	for k, v := range r.p.Params {
+		params[k] = v
+	}
+	for k, v := range s.Params {
+		params[k] = v
+	}
+	return params
+}
+
+// upToDate reports whether output exists and none of inputs is newer, as
+// make decides.
+func upToDate(output string, inputs []string) bool {
+	out, err := os.Stat(output)
+	if err != nil {
+		return false
+	}
+	for _, in := range inputs {
+		info, err := os.Stat(in)
+		if err != nil || info.ModTime().After(out.ModTime()) {
+			return false
+		}
+	}
+	return true
+}
+
+func evalSafe(prog *xform.Program, doc *xform.Node, opts xform.EvalOptions) (result []any, err error) {
+	return prog.Eval(doc, opts)
+}
+
+func (r *pipelineRunner) program(path string) (*xform.Program, error) {
+	r.mu.Lock()
+	e := r.programs[path]
+	if e == nil {
+		e = &programEntry{}
+		r.programs[path] = e
+	}
+	r.mu.Unlock()
+	e.once.Do(func() { e.prog, e.err = loadProgram(path) })
+	return e.prog, e.err
+}
+
+func (r *pipelineRunner) document(path string, format xform.InputFormat) (*xform.Node, error) {
+	r.mu.Lock()
+	e := r.docs[path]
+	if e == nil {
+		e = &docEntry{}
+		r.docs[path] = e
+	}
+	r.mu.Unlock()
+	e.once.Do(func() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			e.err = err
+			return
+		}
+		e.doc, e.err = xform.ParseInput(path, data, format)
+	})
+	return e.doc, e.err
+}
+
+func (r *pipelineRunner) input(s *pipelineStep, inputs []string) (*xform.Node, error) {
+	if s.Collect == "" {
+		return r.document(inputs[0], s.InputFormat)
+	}
+	coll := &xform.Node{Kind: "element", Name: "collection", Attrs: map[string]string{}}
+	for _, in := range inputs {
+		doc, err := r.document(in, s.InputFormat)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", in, err)
+		}
+		for _, c := range doc.Children {
+			if c.Kind != "element" {
+				continue
+			}
+			cp := xform.DeepCopy(c, true)
+			cp.Parent = coll
+			coll.Children = append(coll.Children, cp)
+		}
+	}
+	root := &xform.Node{Kind: "document", Attrs: map[string]string{}, Children: []*xform.Node{coll}}
+	coll.Parent = root
+	return root, nil
+}
+
+// loadProgram compiles a transform file or opens a bundle.
+func loadProgram(path string) (*xform.Program, error) {
+	return loadProgramWith(path, nil)
+}
+
+// loadProgramWith is loadProgram with the imports of a transform file
+// rewritten by catalog.
+func loadProgramWith(path string, catalog *xform.Catalog) (*xform.Program, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if xform.IsBundle(data) {
+		bundle, err := xform.ReadBundle(data)
+		if err != nil {
+			return nil, err
+		}
+		return bundle.Program()
+	}
+	return xform.CompileFileWith(path, catalog)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	xform "xform-go"
+)
+
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := fs.String("addr", ":8080", "listen address")
+	docCache := fs.Int64("doc-cache", 64, "MiB of doc() and collection() sources cached across requests (0: no cache)")
+	var maxMemory byteSize
+	fs.Var(&maxMemory, "max-memory", "fail requests whose evaluation allocates about this much for nodes and sequences, e.g. 64MiB")
+	var maxOutput byteSize
+	fs.Var(&maxOutput, "max-output", "fail requests whose output would be larger, e.g. 16MiB")
+	maxOutputNodes := fs.Int("max-output-nodes", 0, "fail requests whose output would have more nodes")
+	acceptTransforms := fs.Bool("accept-transforms", false, "also accept transforms sent with the requests (required without a transform file)")
+	transformCache := fs.Int("transform-cache", 128, "compiled request transforms kept, least recently used dropped first")
+	policyFile := fs.String("policy", "", "YAML file limiting input size, memory, time, doc() access and functions")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 && !*acceptTransforms {
+		fmt.Fprintln(os.Stderr, "xform serve needs a transform file, or -accept-transforms to take transforms from the requests")
+		return 2
+	}
+	policy := defaultPolicy(*acceptTransforms)
+	if *policyFile != "" {
+		loaded, err := loadPolicy(*policyFile, policy)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		policy = *loaded
+	}
+	var module *xform.Module
+	if fs.NArg() > 0 {
+		var err error
+		if module, err = xform.LoadModule(fs.Arg(0)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	var programs *xform.ProgramCache
+	if *acceptTransforms {
+		programs = xform.NewProgramCache(*transformCache)
+	}
+	metrics := xform.NewMetricsRegistry()
+	var docs *xform.DocumentCache
+	if *docCache > 0 {
+		docs = xform.NewDocumentCache(*docCache << 20)
+	}
+	evalOpts := xform.EvalOptions{Metrics: metrics, Documents: docs, MaxMemory: int64(maxMemory)}
+	evalOpts.OutputLimit = xform.OutputLimit{MaxBytes: int64(maxOutput), MaxNodes: *maxOutputNodes}
+	policy.apply(&evalOpts)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/transform", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if policy.MaxInput > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, policy.MaxInput)
+		}
+		body, source, err := readServeRequest(r, programs != nil)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("request larger than %s", byteSize(tooLarge.Limit)), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		module := module
+		if id := r.Header.Get("X-Xform-Transform-Id"); programs != nil && source == "" && id != "" {
+			prog, ok := programs.Get(id)
+			if !ok {
+				http.Error(w, "unknown transform id "+id+"; send the transform", http.StatusNotFound)
+				return
+			}
+			module = prog.Module
+			w.Header().Set("X-Xform-Transform-Id", id)
+		} else if source != "" {
+			prog, id, err := programs.Compile(source)
+			if err != nil {
+				metrics.Error("compile")
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			module = prog.Module
+			w.Header().Set("X-Xform-Transform-Id", id)
+		}
+		if module == nil {
+			http.Error(w, "no transform: send one in the X-Xform-Transform header or a multipart transform part", http.StatusBadRequest)
+			return
+		}
+		doc, err := xform.ParseXMLBytes(body)
+		if err != nil {
+			metrics.Error("parse")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		out, err := serveEval(module, doc, evalOpts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		serOpts := module.SerializeOptions()
+		contentType := contentTypes[serOpts.Method]
+		if serOpts.Encoding != "" {
+			contentType = strings.TrimSuffix(contentType, "utf-8") + serOpts.Encoding
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Write(xform.EncodeOutput(out, serOpts.Encoding))
+	})
+	if programs != nil {
+		playground := playgroundOptions(evalOpts)
+		mux.HandleFunc("/playground", func(w http.ResponseWriter, r *http.Request) {
+			servePlayground(w, r, playground, policy.MaxInput)
+		})
+	}
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.WritePrometheus(w)
+	})
+	fmt.Fprintf(os.Stderr, "xform serving on %s\n", *addr)
+	if err := http.ListenAndServe(*addr, mux); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// readServeRequest returns the input document of a /transform request
+// and, when accepted, the transform sent with it: the "transform" and
+// "input" parts of a multipart/form-data body, or the base64 source in the
+// X-Xform-Transform header with the input as the body.
+func readServeRequest(r *http.Request, acceptTransforms bool) (input []byte, source string, err error) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if !acceptTransforms {
+			return nil, "", errors.New("this server does not accept transforms with requests")
+		}
+		reader, err := r.MultipartReader()
+		if err != nil {
+			return nil, "", err
+		}
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, "", err
+			}
+			data, err := io.ReadAll(part)
+			if err != nil {
+				return nil, "", err
+			}
+			switch part.FormName() {
+			case "transform":
+				source = string(data)
+			case "input":
+				input = data
+			}
+		}
+		if input == nil {
+			return nil, "", errors.New("multipart request without an input part")
+		}
+		return input, source, nil
+	}
+	if h := r.Header.Get("X-Xform-Transform"); h != "" {
+		if !acceptTransforms {
+			return nil, "", errors.New("this server does not accept transforms with requests")
+		}
+		data, err := base64.StdEncoding.DecodeString(h)
+		if err != nil {
+			return nil, "", fmt.Errorf("X-Xform-Transform: %v", err)
+		}
+		source = string(data)
+	}
+	input, err = io.ReadAll(r.Body)
+	return input, source, err
+}
+
+var contentTypes = map[string]string{
+	"xml":  "application/xml; charset=utf-8",
+	"html": "text/html; charset=utf-8",
+	"text": "text/plain; charset=utf-8",
+}
+
+func serveEval(module *xform.Module, doc *xform.Node, opts xform.EvalOptions) (string, error) {
+	result, err := xform.EvalModuleWithOptions(module, doc, opts)
+	if err != nil {
+		return "", err
+	}
+	serOpts := module.SerializeOptions()
+	serOpts.Limit = opts.OutputLimit
+	return xform.SerializeResultLimited(result, serOpts)
+}
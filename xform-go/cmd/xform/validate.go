@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	xform "xform-go"
+)
+
+// runValidate checks a document against the validate rules of a transform
+// and prints the SVRL report. It exits 0 when no assertion failed, 1 when
+// some did and 2 on errors.
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	inputFormat := fs.String("input-format", "auto", "input format: auto, xml, html or json")
+	var idAttrs stringList
+	fs.Var(&idAttrs, "id-attr", "attribute holding element ids when no DTD declares one (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: xform validate [-input-format fmt] <input.xml> <rules.xform>")
+		return 2
+	}
+	format, err := xform.ParseInputFormat(*inputFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	inputPath, xformPath := fs.Arg(0), fs.Arg(1)
+	data, err := os.ReadFile(inputPath)
+	if err == nil {
+		var doc *xform.Node
+		doc, err = xform.ParseInput(inputPath, data, format)
+		if err == nil {
+			var prog *xform.Program
+			prog, err = loadProgram(xformPath)
+			if err == nil {
+				return printValidation(prog, doc, filepath.Dir(xformPath), idAttrs)
+			}
+		}
+	}
+	fmt.Fprintln(os.Stderr, err)
+	return 2
+}
+
+func printValidation(prog *xform.Program, doc *xform.Node, baseDir string, idAttrs []string) (code int) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			fmt.Fprintln(os.Stderr, rec)
+			code = 2
+		}
+	}()
+	opts := xform.EvalOptions{BaseDir: baseDir, Diagnostics: printDiagnostic, IDAttributes: idAttrs}
+	if prog.FS != nil {
+		opts.BaseDir = ""
+	}
+	report := prog.Validate(doc, opts)
+	fmt.Println(xform.SerializeWith(report, xform.SerializeOptions{Indent: "  "}))
+	if xform.FailedAsserts(report) > 0 {
+		return 1
+	}
+	return 0
+}
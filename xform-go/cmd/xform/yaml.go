@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseYAML reads the small YAML subset used by pipeline files and lint
+// configurations: block mappings and sequences, flow lists and maps
+// ([a, b], {k: v}), quoted and plain scalars and # comments. Anchors, tags
+// and multi-line scalars are not supported. Scalars are returned as strings, mappings as map[string]any and
+// sequences as []any.
+func parseYAML(src string) (any, error) {
+	y := &yamlParser{}
+	for i, raw := range strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n") {
+		text := stripYAMLComment(raw)
+		if strings.TrimSpace(text) == "" || strings.TrimSpace(text) == "---" {
+			continue
+		}
+		if strings.HasPrefix(strings.TrimLeft(text, " "), "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+		trimmed := strings.TrimLeft(text, " ")
+		y.lines = append(y.lines, yamlLine{num: i + 1, indent: len(text) - len(trimmed), text: strings.TrimRight(trimmed, " \t")})
+	}
+	if len(y.lines) == 0 {
+		return map[string]any{}, nil
+	}
+	v, err := y.block(y.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if y.pos < len(y.lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", y.lines[y.pos].num)
+	}
+	return v, nil
+}
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func (y *yamlParser) block(indent int) (any, error) {
+	if isSeqItem(y.lines[y.pos].text) {
+		return y.sequence(indent)
+	}
+	return y.mapping(indent)
+}
+
+func isSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func (y *yamlParser) sequence(indent int) (any, error) {
+	out := []any{}
+	for y.pos < len(y.lines) {
+		line := y.lines[y.pos]
+		if line.indent != indent || !isSeqItem(line.text) {
+			break
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+		if rest == "" {
+			y.pos++
+			v, err := y.nested(indent)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+			continue
+		}
+		if _, _, ok := splitYAMLKey(rest); ok {
+			// "- key: value" starts a mapping indented at the key column.
+			y.lines[y.pos] = yamlLine{num: line.num, indent: indent + len(line.text) - len(rest), text: rest}
+			v, err := y.mapping(y.lines[y.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+			continue
+		}
+		v, err := parseYAMLScalar(rest, line.num)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+		y.pos++
+	}
+	return out, nil
+}
+
+func (y *yamlParser) mapping(indent int) (any, error) {
+	out := map[string]any{}
+	for y.pos < len(y.lines) {
+		line := y.lines[y.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", line.num)
+		}
+		if isSeqItem(line.text) {
+			break
+		}
+		key, value, ok := splitYAMLKey(line.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", line.num)
+		}
+		if _, dup := out[key]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key %q", line.num, key)
+		}
+		y.pos++
+		if value != "" {
+			v, err := parseYAMLScalar(value, line.num)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = v
+			continue
+		}
+		// Block sequences may sit at the same indentation as their key.
+		if y.pos < len(y.lines) && y.lines[y.pos].indent == indent && isSeqItem(y.lines[y.pos].text) {
+			v, err := y.sequence(indent)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = v
+			continue
+		}
+		v, err := y.nested(indent)
+		if err != nil {
+			return nil, err
+		}
+		out[key] = v
+	}
+	return out, nil
+}
+
+func (y *yamlParser) nested(parent int) (any, error) {
+	if y.pos >= len(y.lines) || y.lines[y.pos].indent <= parent {
+		return nil, nil
+	}
+	return y.block(y.lines[y.pos].indent)
+}
+
+func splitYAMLKey(text string) (string, string, bool) {
+	if strings.HasPrefix(text, "\"") || strings.HasPrefix(text, "'") {
+		end := strings.IndexByte(text[1:], text[0])
+		if end < 0 {
+			return "", "", false
+		}
+		key, rest := text[1:end+1], text[end+2:]
+		if rest != ":" && !strings.HasPrefix(rest, ": ") {
+			return "", "", false
+		}
+		return key, strings.TrimSpace(strings.TrimPrefix(rest, ":")), true
+	}
+	if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") {
+		return "", "", false
+	}
+	i := strings.Index(text, ": ")
+	if strings.HasSuffix(text, ":") && (i < 0 || i == len(text)-1) {
+		i = len(text) - 1
+	}
+	if i <= 0 {
+		return "", "", false
+	}
+	return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), true
+}
+
+func stripYAMLComment(line string) string {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseYAMLScalar(text string, num int) (any, error) {
+	if !strings.ContainsAny(text[:1], "[{\"'") {
+		// Block context: plain scalars may contain , [ ] { } (globs, {name}).
+		return text, nil
+	}
+	v, rest, err := parseYAMLFlow(text, num)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(rest) != "" {
+		return nil, fmt.Errorf("line %d: unexpected %q", num, rest)
+	}
+	return v, nil
+}
+
+// parseYAMLFlow parses one flow value from the start of text and returns the
+// unconsumed remainder.
+func parseYAMLFlow(text string, num int) (any, string, error) {
+	text = strings.TrimLeft(text, " ")
+	switch {
+	case strings.HasPrefix(text, "["):
+		out := []any{}
+		rest := strings.TrimLeft(text[1:], " ")
+		for !strings.HasPrefix(rest, "]") {
+			v, r, err := parseYAMLFlow(rest, num)
+			if err != nil {
+				return nil, "", err
+			}
+			out = append(out, v)
+			rest = strings.TrimLeft(r, " ")
+			if strings.HasPrefix(rest, ",") {
+				rest = strings.TrimLeft(rest[1:], " ")
+			} else if !strings.HasPrefix(rest, "]") {
+				return nil, "", fmt.Errorf("line %d: unterminated flow sequence", num)
+			}
+		}
+		return out, rest[1:], nil
+	case strings.HasPrefix(text, "{"):
+		out := map[string]any{}
+		rest := strings.TrimLeft(text[1:], " ")
+		for !strings.HasPrefix(rest, "}") {
+			k, r, err := parseYAMLFlow(rest, num)
+			if err != nil {
+				return nil, "", err
+			}
+			key, ok := k.(string)
+			r = strings.TrimLeft(r, " ")
+			if !ok || !strings.HasPrefix(r, ":") {
+				return nil, "", fmt.Errorf("line %d: expected key: value in flow mapping", num)
+			}
+			v, r, err := parseYAMLFlow(r[1:], num)
+			if err != nil {
+				return nil, "", err
+			}
+			out[key] = v
+			rest = strings.TrimLeft(r, " ")
+			if strings.HasPrefix(rest, ",") {
+				rest = strings.TrimLeft(rest[1:], " ")
+			} else if !strings.HasPrefix(rest, "}") {
+				return nil, "", fmt.Errorf("line %d: unterminated flow mapping", num)
+			}
+		}
+		return out, rest[1:], nil
+	case strings.HasPrefix(text, "\""):
+		for i := 1; i < len(text); i++ {
+			if text[i] == '\\' {
+				i++
+				continue
+			}
+			if text[i] == '"' {
+				s, err := strconv.Unquote(text[:i+1])
+				if err != nil {
+					return nil, "", fmt.Errorf("line %d: %v", num, err)
+				}
+				return s, text[i+1:], nil
+			}
+		}
+		return nil, "", fmt.Errorf("line %d: unterminated string", num)
+	case strings.HasPrefix(text, "'"):
+		b := &strings.Builder{}
+		for i := 1; i < len(text); i++ {
+			if text[i] == '\'' {
+				if i+1 < len(text) && text[i+1] == '\'' {
+					b.WriteByte('\'')
+					i++
+					continue
+				}
+				return b.String(), text[i+1:], nil
+			}
+			b.WriteByte(text[i])
+		}
+		return nil, "", fmt.Errorf("line %d: unterminated string", num)
+	}
+	end := len(text)
+	if i := strings.IndexAny(text, ",]}"); i >= 0 {
+		end = i
+	}
+	if i := strings.Index(text, ": "); i >= 0 && i < end {
+		end = i
+	}
+	if strings.HasSuffix(text[:end], ":") {
+		end--
+	}
+	return strings.TrimSpace(text[:end]), text[end:], nil
+}
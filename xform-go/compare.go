@@ -0,0 +1,323 @@
+package xform
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// ValueEqual is the general comparison behind = : true when any item of
+// left equals any item of right, so an empty operand never matches. Two
+// items compare as numbers when either is a number, as booleans when either
+// is a boolean and by string value otherwise. != is true when any pair
+// differs. EvalOptions.LegacyEquality restores the comparison of the first
+// items' string values.
+func ValueEqual(left []any, right []any) bool {
+	return generalCompare(left, right, true)
+}
+
+func generalCompare(left, right []any, equal bool) bool {
+	for _, l := range left {
+		for _, r := range right {
+			if itemEqual(l, r) == equal {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func legacyEqual(left, right []any) bool {
+	return ToString(left) == ToString(right)
+}
+
+func itemEqual(l, r any) bool {
+	if isNumeric(l) || isNumeric(r) {
+		a, aok := itemNumber(l)
+		b, bok := itemNumber(r)
+		if !aok || !bok {
+			return false
+		}
+		c, ok := compareNumbers(a, b)
+		return ok && c == 0
+	}
+	_, lbool := l.(bool)
+	_, rbool := r.(bool)
+	if lbool || rbool {
+		return ToBoolean([]any{l}) == ToBoolean([]any{r})
+	}
+	if c, ok := compareDates(l, r); ok {
+		return c == 0
+	}
+	return ToString([]any{l}) == ToString([]any{r})
+}
+
+// itemNumber converts an item for numeric comparison; values that are not
+// numbers compare unequal instead of raising an error.
+func itemNumber(item any) (any, bool) {
+	switch v := item.(type) {
+	case float64:
+		return v, !math.IsNaN(v)
+	case int, int64, Decimal, bool:
+		return ToNumeric([]any{v}), true
+	}
+	return parseNumeric(strings.TrimSpace(ToString([]any{item})))
+}
+
+// DeepEqual is === and deepEqual(a, b): the sequences have the same length
+// and their items are pairwise deep-equal. Nodes are equal when they have
+// the same kind, name, namespace, value and attributes (in any order,
+// namespace declarations aside) and deep-equal children; atomic values are equal when they have the same type and value,
+// numbers when they have the same value. Nodes never equal atomic values.
+func DeepEqual(left, right []any) bool {
+	if len(left) != len(right) {
+		return false
+	}
+	for i := range left {
+		if !deepItemEqual(left[i], right[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func deepItemEqual(l, r any) bool {
+	switch a := l.(type) {
+	case *Node:
+		b, ok := r.(*Node)
+		return ok && deepNodeEqual(a, b)
+	case int, int64, float64, Decimal:
+		if !isNumeric(r) {
+			return false
+		}
+		c, ok := compareNumbers(ToNumeric([]any{a}), ToNumeric([]any{r}))
+		return ok && c == 0
+	case map[string][]any:
+		b, ok := r.(map[string][]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			w, ok := b[k]
+			if !ok || !DeepEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case Array:
+		b, ok := r.(Array)
+		return ok && DeepEqual(a, b)
+	case DateTime:
+		b, ok := r.(DateTime)
+		return ok && a.Date == b.Date && a.Time.Equal(b.Time)
+	}
+	return reflect.DeepEqual(l, r)
+}
+
+func deepNodeEqual(a, b *Node) bool {
+	if a == b {
+		return true
+	}
+	if a.Kind != b.Kind || a.Name != b.Name || a.Namespace != b.Namespace || attrCount(a) != attrCount(b) {
+		return false
+	}
+	if a.Kind != "element" && a.Kind != "document" && a.Value != b.Value {
+		return false
+	}
+	for k, v := range a.Attrs {
+		if isNamespaceDecl(k) {
+			continue
+		}
+		if w, ok := b.Attrs[k]; !ok || v != w {
+			return false
+		}
+	}
+	if len(a.Children) != len(b.Children) {
+		return false
+	}
+	for i := range a.Children {
+		if !deepNodeEqual(a.Children[i], b.Children[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// attrCount counts the attributes of n other than namespace declarations.
+func attrCount(n *Node) int {
+	count := 0
+	for k := range n.Attrs {
+		if !isNamespaceDecl(k) {
+			count++
+		}
+	}
+	return count
+}
+
+func fnDeepEqual(args [][]any, _ Context) []any {
+	var left, right []any
+	if len(args) > 0 {
+		left = args[0]
+	}
+	if len(args) > 1 {
+		right = args[1]
+	}
+	return []any{DeepEqual(left, right)}
+}
+
+// generalRelational is the general comparison behind < <= > >= : true when
+// some item of left and some item of right, compared as numbers or, when
+// one is a date, as dates, are in the relation op. CompatRelational restores the comparison of the first
+// items, with an empty operand counting as 0.
+func generalRelational(op string, left, right []any, rt *Runtime) bool {
+	for _, l := range left {
+		var a any
+		for _, r := range right {
+			if c, ok := compareDates(l, r); ok {
+				if relationHolds(op, c) {
+					return true
+				}
+				continue
+			}
+			if a == nil {
+				a = rt.number([]any{l})
+			}
+			c, ok := compareNumbers(a, rt.number([]any{r}))
+			if ok && relationHolds(op, c) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// relationHolds reports whether c, the result of comparing a with b, means
+// a op b for op one of < <= > >= or lt le gt ge.
+func relationHolds(op string, c int) bool {
+	switch op {
+	case "<", "lt":
+		return c < 0
+	case "<=", "le":
+		return c <= 0
+	case ">", "gt":
+		return c > 0
+	case ">=", "ge":
+		return c >= 0
+	}
+	return false
+}
+
+// isValueComparison reports whether op is one of the value comparisons.
+func isValueComparison(op string) bool {
+	switch op {
+	case "eq", "ne", "lt", "le", "gt", "ge":
+		return true
+	}
+	return false
+}
+
+// valueCompare is a eq b and the other value comparisons, which compare
+// single items by type: numbers numerically, strings by code point,
+// booleans with false before true. A node's string value takes the type of
+// the other operand, so @n eq 3 compares numbers and @a eq @b strings.
+// Either operand empty gives the empty sequence; more than one item, or
+// items of different types such as "3" eq 3, raise XFDY0002.
+func valueCompare(op string, left, right []any) []any {
+	if len(left) == 0 || len(right) == 0 {
+		return []any{}
+	}
+	if len(left) > 1 || len(right) > 1 {
+		panic(fmt.Errorf("XFDY0002: %s compares single items, got %d and %d (use a general comparison such as = for sequences)", op, len(left), len(right)))
+	}
+	l, r := left[0], right[0]
+	ln, lnode := l.(*Node)
+	rn, rnode := r.(*Node)
+	switch {
+	case lnode && rnode:
+		l, r = ln.StringValue(), rn.StringValue()
+	case lnode:
+		l = castUntyped(op, ln.StringValue(), r)
+	case rnode:
+		r = castUntyped(op, rn.StringValue(), l)
+	}
+	var c int
+	switch a := l.(type) {
+	case int, int64, float64, Decimal:
+		if !isNumeric(r) {
+			panic(incomparable(op, l, r))
+		}
+		var ok bool
+		if c, ok = compareNumbers(ToNumeric([]any{a}), ToNumeric([]any{r})); !ok {
+			// NaN is in no relation to anything, itself included.
+			return []any{op == "ne"}
+		}
+	case string:
+		b, ok := r.(string)
+		if !ok {
+			panic(incomparable(op, l, r))
+		}
+		c = strings.Compare(a, b)
+	case DateTime:
+		if _, ok := r.(DateTime); !ok {
+			panic(incomparable(op, l, r))
+		}
+		c, _ = compareDates(a, r)
+	case bool:
+		b, ok := r.(bool)
+		if !ok {
+			panic(incomparable(op, l, r))
+		}
+		switch {
+		case a == b:
+		case b:
+			c = -1
+		default:
+			c = 1
+		}
+	default:
+		panic(incomparable(op, l, r))
+	}
+	switch op {
+	case "eq":
+		return []any{c == 0}
+	case "ne":
+		return []any{c != 0}
+	}
+	return []any{relationHolds(op, c)}
+}
+
+// castUntyped converts s, the string value of a node compared with other,
+// to the type of other.
+func castUntyped(op, s string, other any) any {
+	switch other.(type) {
+	case int, int64, float64, Decimal:
+		if n, ok := parseNumeric(strings.TrimSpace(s)); ok {
+			return n
+		}
+		panic(fmt.Errorf("XFDY0002: %s cannot compare %q with a number", op, s))
+	case bool:
+		switch strings.TrimSpace(s) {
+		case "true", "1":
+			return true
+		case "false", "0":
+			return false
+		}
+		panic(fmt.Errorf("XFDY0002: %s cannot compare %q with a boolean", op, s))
+	case DateTime:
+		d, err := ParseDateTime(s)
+		if err != nil {
+			panic(fmt.Errorf("XFDY0002: %s cannot compare %q with a date", op, s))
+		}
+		return d
+	}
+	return s
+}
+
+func incomparable(op string, l, r any) error {
+	return fmt.Errorf("XFDY0002: %s cannot compare a %s with a %s", op, typeName(l), typeName(r))
+}
+
+func typeName(item any) string {
+	return ToString(fnTypeOf([][]any{{item}}, Context{}))
+}
@@ -0,0 +1,83 @@
+package xform
+
+import "fmt"
+
+// Compat is a set of legacy behaviors. Semantics fixes that change the
+// result of existing transforms add a flag here and to Compat1x, so that
+// modules declaring
+//
+//	compat "1.x";
+//
+// (or run with EvalOptions.Compat) keep their old results.
+type Compat uint
+
+const (
+	// CompatEquality makes = and != compare the string values of the first
+	// items only, instead of the general comparison.
+	CompatEquality Compat = 1 << iota
+	// CompatNameFallback keeps undefined names selecting child elements
+	// when EvalOptions.Strict is set; only the module's own "strict;"
+	// declaration rejects them.
+	CompatNameFallback
+	// CompatLocalNames matches unprefixed names against local names in any
+	// namespace and accepts prefixes the module does not declare, as before
+	// namespace support.
+	CompatLocalNames
+	// CompatDoubles computes with doubles only, as before integers and
+	// decimals were told apart: 1 div 3 is 0.3333333333333333 and 0.1 + 0.2
+	// is not 0.3.
+	CompatDoubles
+	// CompatNoMatch makes apply() raise XFDY0001 for an item no rule
+	// matches, instead of falling back to the built-in rules.
+	CompatNoMatch
+	// CompatPredicates tests numeric predicates for their boolean value
+	// instead of the position: item[1] keeps every item, item[0] none.
+	CompatPredicates
+	// CompatRelational makes < <= > >= compare the first items as numbers,
+	// an empty operand counting as 0, instead of the general comparison.
+	CompatRelational
+)
+
+// Compat1x is the behavior of transforms written before the 2.0 semantics
+// fixes.
+const Compat1x = CompatEquality | CompatNameFallback | CompatLocalNames | CompatDoubles | CompatNoMatch | CompatPredicates | CompatRelational
+
+// compatLevels maps the values of the compat declaration to flag sets.
+var compatLevels = map[string]Compat{
+	"1.x": Compat1x,
+	"2.0": 0,
+}
+
+// ParseCompat returns the flags of a compat level such as "1.x".
+func ParseCompat(level string) (Compat, error) {
+	c, ok := compatLevels[level]
+	if !ok {
+		return 0, fmt.Errorf("XFST0005: unsupported compat level %q (want 1.x or 2.0)", level)
+	}
+	return c, nil
+}
+
+// bindModule sets up the runtime for evaluating module: its compat flags,
+// namespace declarations and output declaration.
+func (rt *Runtime) bindModule(module *Module) {
+	rt.compat = module.Compat | rt.Options.Compat
+	if rt.Options.LegacyEquality {
+		rt.compat |= CompatEquality
+	}
+	rt.namespaces = module.Namespaces
+	rt.output = module.SerializeOptions()
+	rt.output.Limit = rt.Options.OutputLimit
+}
+
+// legacy reports whether the evaluated module opted into the behavior.
+func (rt *Runtime) legacy(flag Compat) bool {
+	return rt != nil && rt.compat&flag != 0
+}
+
+// strictEval reports whether module is checked for undefined variables.
+func strictEval(module *Module, opts EvalOptions) bool {
+	if module.Strict {
+		return true
+	}
+	return opts.Strict && (module.Compat|opts.Compat)&CompatNameFallback == 0
+}
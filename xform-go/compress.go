@@ -0,0 +1,86 @@
+package xform
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+)
+
+type Decompressor func(r io.Reader) (io.Reader, error)
+
+type compression struct {
+	name  string
+	ext   string
+	magic []byte
+	fn    Decompressor
+}
+
+var (
+	compressionsMu sync.RWMutex
+	compressions   = []compression{
+		{name: "gzip", ext: ".gz", magic: []byte{0x1f, 0x8b}, fn: gunzip},
+		{name: "zstd", ext: ".zst", magic: []byte{0x28, 0xb5, 0x2f, 0xfd}, fn: unzstd},
+	}
+)
+
+// RegisterDecompressor installs (or replaces) the decoder used for inputs
+// starting with magic. gzip and Zstandard (see zstd.go) are built in.
+func RegisterDecompressor(name, ext string, magic []byte, fn Decompressor) {
+	compressionsMu.Lock()
+	defer compressionsMu.Unlock()
+	for i, c := range compressions {
+		if c.name == name {
+			compressions[i] = compression{name: name, ext: ext, magic: magic, fn: fn}
+			return
+		}
+	}
+	compressions = append(compressions, compression{name: name, ext: ext, magic: magic, fn: fn})
+}
+
+func gunzip(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+// decompressInput unwraps compressed data and strips the matching extension
+// from name so format detection sees the inner file type.
+func decompressInput(name string, data []byte) ([]byte, string, error) {
+	for {
+		c, ok := detectCompression(data)
+		if !ok {
+			return data, name, nil
+		}
+		if c.fn == nil {
+			return nil, name, fmt.Errorf("%s compressed input %s requires a registered decompressor", c.name, name)
+		}
+		r, err := c.fn(bytes.NewReader(data))
+		if err != nil {
+			return nil, name, err
+		}
+		out, err := io.ReadAll(r)
+		if closer, ok := r.(io.Closer); ok {
+			closer.Close()
+		}
+		if err != nil {
+			return nil, name, err
+		}
+		data = out
+		if strings.EqualFold(path.Ext(name), c.ext) {
+			name = strings.TrimSuffix(name, path.Ext(name))
+		}
+	}
+}
+
+func detectCompression(data []byte) (compression, bool) {
+	compressionsMu.RLock()
+	defer compressionsMu.RUnlock()
+	for _, c := range compressions {
+		if len(c.magic) > 0 && bytes.HasPrefix(data, c.magic) {
+			return c, true
+		}
+	}
+	return compression{}, false
+}
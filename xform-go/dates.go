@@ -0,0 +1,384 @@
+package xform
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DateTime is a date or date-time item, as made by currentDate(),
+// parseDate() and addDuration(). A date (Date true) has no time of day and
+// no zone; it is kept as midnight UTC of its day. The string value is the
+// ISO form, 2024-03-01 or 2024-03-01T09:30:00+01:00. Date functions also
+// take ISO strings, and times without a zone are taken as UTC.
+type DateTime struct {
+	Time time.Time
+	Date bool
+}
+
+func (d DateTime) String() string {
+	if d.Date {
+		return d.Time.Format("2006-01-02")
+	}
+	return d.Time.Format(time.RFC3339Nano)
+}
+
+// NewDate is the date of t's day in t's zone.
+func NewDate(t time.Time) DateTime {
+	return DateTime{Time: time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), Date: true}
+}
+
+// ParseDateTime parses an ISO date (2024-03-01, or 2024-03 for its first
+// day) or date-time.
+func ParseDateTime(s string) (DateTime, error) {
+	t, err := parseDateValue(s)
+	if err != nil {
+		return DateTime{}, err
+	}
+	if !strings.Contains(s, "T") {
+		return NewDate(t), nil
+	}
+	return DateTime{Time: t}, nil
+}
+
+// dateItem converts a date argument: a DateTime, or a string or node
+// holding an ISO date or date-time.
+func dateItem(item any) (DateTime, error) {
+	if d, ok := item.(DateTime); ok {
+		return d, nil
+	}
+	return ParseDateTime(ToString([]any{item}))
+}
+
+func dateArg(args [][]any, i int, fn string) DateTime {
+	if i >= len(args) || len(args[i]) != 1 {
+		panic(fmt.Errorf("XFDY0002: %s() expects a date", fn))
+	}
+	d, err := dateItem(args[i][0])
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// compareDates compares l and r as dates when either is a DateTime; ok is
+// false when neither is or the other is no date.
+func compareDates(l, r any) (c int, ok bool) {
+	_, ldate := l.(DateTime)
+	_, rdate := r.(DateTime)
+	if !ldate && !rdate {
+		return 0, false
+	}
+	a, err := dateItem(l)
+	if err != nil {
+		return 0, false
+	}
+	b, err := dateItem(r)
+	if err != nil {
+		return 0, false
+	}
+	switch {
+	case a.Time.Before(b.Time):
+		return -1, true
+	case a.Time.After(b.Time):
+		return 1, true
+	}
+	return 0, true
+}
+
+// now is the time of currentDate() and currentDateTime(): EvalOptions.Now,
+// or the time of the first call, so that it stays the same during an
+// evaluation.
+func (rt *Runtime) now() time.Time {
+	if rt == nil {
+		return time.Now()
+	}
+	if rt.clock.IsZero() {
+		rt.clock = rt.Options.Now
+		if rt.clock.IsZero() {
+			rt.clock = time.Now()
+		}
+	}
+	return rt.clock
+}
+
+func fnCurrentDate(_ [][]any, ctx Context) []any {
+	return []any{NewDate(ctx.Runtime.now())}
+}
+
+func fnCurrentDateTime(_ [][]any, ctx Context) []any {
+	return []any{DateTime{Time: ctx.Runtime.now()}}
+}
+
+// fnParseDate is parseDate(s, picture?, locale?): s read with a picture as
+// formatDate() writes it, or in ISO form without one.
+func fnParseDate(args [][]any, ctx Context) []any {
+	if len(args) == 0 || len(args[0]) == 0 {
+		return []any{}
+	}
+	s := ToString(args[0])
+	if len(args) < 2 || len(args[1]) == 0 {
+		d, err := ParseDateTime(s)
+		if err != nil {
+			panic(err)
+		}
+		return []any{d}
+	}
+	d, err := ParseDate(s, ToString(args[1]), localeArg(args, 2, ctx))
+	if err != nil {
+		panic(err)
+	}
+	return []any{d}
+}
+
+// ParseDate reads s with a FormatDate picture, with month and weekday
+// names in the locale's language. Numeric components with a width, such
+// as [M01], take exactly that many digits, others all digits there are.
+// The result is a date unless the picture has an H, h, m or s component;
+// a day or month left out is the first.
+func ParseDate(s, picture, locale string) (DateTime, error) {
+	names := dateLocale(locale)
+	invalid := func() (DateTime, error) {
+		return DateTime{}, fmt.Errorf("XFDY0002: %q does not match the date picture %q", s, picture)
+	}
+	year, month, day, hour, minute, second := 0, 1, 1, 0, 0, 0
+	hasYear, hasTime, pm, twelve := false, false, false, false
+	pos := 0
+	for i := 0; i < len(picture); i++ {
+		c := picture[i]
+		escaped := (c == '[' || c == ']') && i+1 < len(picture) && picture[i+1] == c
+		if escaped {
+			i++
+		}
+		if c != '[' || escaped {
+			if pos >= len(s) || s[pos] != c {
+				return invalid()
+			}
+			pos++
+			continue
+		}
+		end := strings.IndexByte(picture[i:], ']')
+		if end < 0 {
+			return DateTime{}, fmt.Errorf("XFDY0002: unterminated component in picture %q", picture)
+		}
+		spec := strings.ReplaceAll(picture[i+1:i+end], " ", "")
+		i += end
+		if spec == "" {
+			return DateTime{}, fmt.Errorf("XFDY0002: empty component in picture %q", picture)
+		}
+		comp, mod := spec[0], spec[1:]
+		if comp == 'F' || comp == 'P' || comp == 'M' && (mod == "N" || mod == "n" || mod == "Nn") {
+			list := names.months
+			switch comp {
+			case 'F':
+				list = names.days
+			case 'P':
+				list = []string{"am", "pm"}
+			}
+			n := matchName(s[pos:], list)
+			if n < 0 {
+				return invalid()
+			}
+			pos += len(list[n])
+			switch comp {
+			case 'M':
+				month = n + 1
+			case 'P':
+				pm = n == 1
+			}
+			continue
+		}
+		width := 0
+		if strings.Trim(mod, "0123456789") != "" {
+			return DateTime{}, fmt.Errorf("XFDY0002: cannot parse the presentation modifier %q", mod)
+		}
+		if len(mod) > 1 {
+			width = len(mod)
+		}
+		start := pos
+		for pos < len(s) && s[pos] >= '0' && s[pos] <= '9' && (width == 0 || pos-start < width) {
+			pos++
+		}
+		if pos == start || width > 0 && pos-start < width {
+			return invalid()
+		}
+		value, _ := strconv.Atoi(s[start:pos])
+		switch comp {
+		case 'Y':
+			year, hasYear = value, true
+		case 'M':
+			month = value
+		case 'D':
+			day = value
+		case 'H':
+			hour, hasTime = value, true
+		case 'h':
+			hour, hasTime, twelve = value, true, true
+		case 'm':
+			minute, hasTime = value, true
+		case 's':
+			second, hasTime = value, true
+		default:
+			return DateTime{}, fmt.Errorf("XFDY0002: cannot parse the date component [%c]", comp)
+		}
+	}
+	if pos != len(s) || !hasYear {
+		return invalid()
+	}
+	if twelve {
+		if hour < 1 || hour > 12 {
+			return invalid()
+		}
+		hour %= 12
+		if pm {
+			hour += 12
+		}
+	}
+	t := time.Date(year, time.Month(month), day, hour, minute, second, 0, time.UTC)
+	if t.Year() != year || int(t.Month()) != month || t.Day() != day || t.Hour() != hour || t.Minute() != minute || t.Second() != second {
+		return invalid()
+	}
+	if !hasTime {
+		return DateTime{Time: t, Date: true}, nil
+	}
+	return DateTime{Time: t}, nil
+}
+
+// matchName returns the index of the longest name s starts with, ignoring
+// case, or -1.
+func matchName(s string, names []string) int {
+	best := -1
+	for i, name := range names {
+		if len(name) <= len(s) && strings.EqualFold(s[:len(name)], name) && (best < 0 || len(name) > len(names[best])) {
+			best = i
+		}
+	}
+	return best
+}
+
+// Duration is an ISO 8601 duration such as P1Y2M10DT2H30M: calendar
+// years, months and days, and a time part. Neg negates all of them.
+type Duration struct {
+	Years, Months, Days int
+	Time                time.Duration
+	Neg                 bool
+}
+
+var durationPattern = regexp.MustCompile(`^(-)?P(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// ParseDuration parses an ISO 8601 duration; weeks count as 7 days.
+func ParseDuration(s string) (Duration, error) {
+	m := durationPattern.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil || strings.HasSuffix(s, "P") || strings.HasSuffix(s, "T") {
+		return Duration{}, fmt.Errorf("XFDY0002: invalid duration %q", s)
+	}
+	num := func(i int) int {
+		n, _ := strconv.Atoi(m[i])
+		return n
+	}
+	d := Duration{Neg: m[1] == "-", Years: num(2), Months: num(3), Days: 7*num(4) + num(5)}
+	d.Time = time.Duration(num(6))*time.Hour + time.Duration(num(7))*time.Minute
+	if m[8] != "" {
+		secs, _ := strconv.ParseFloat(m[8], 64)
+		d.Time += time.Duration(math.Round(secs * float64(time.Second)))
+	}
+	return d, nil
+}
+
+// AddDuration adds dur to d. Adding months keeps the day within the
+// month, so 2024-01-31 plus P1M is 2024-02-29. A date stays a date unless
+// dur has a time part.
+func AddDuration(d DateTime, dur Duration) DateTime {
+	sign := 1
+	if dur.Neg {
+		sign = -1
+	}
+	t := d.Time
+	months := int(t.Month()) - 1 + sign*(12*dur.Years+dur.Months)
+	year := t.Year() + floorDiv(months, 12)
+	month := time.Month(months-12*floorDiv(months, 12)) + 1
+	day := t.Day()
+	if last := daysIn(year, month); day > last {
+		day = last
+	}
+	t = time.Date(year, month, day, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	t = t.AddDate(0, 0, sign*dur.Days).Add(time.Duration(sign) * dur.Time)
+	return DateTime{Time: t, Date: d.Date && dur.Time == 0}
+}
+
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+func daysIn(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// fnAddDuration is addDuration(d, duration): d plus an ISO 8601 duration,
+// such as P1M or -PT30M.
+func fnAddDuration(args [][]any, _ Context) []any {
+	d := dateArg(args, 0, "addDuration")
+	if len(args) < 2 || len(args[1]) != 1 {
+		panic(fmt.Errorf("XFDY0002: addDuration() expects a date and a duration"))
+	}
+	dur, err := ParseDuration(ToString(args[1]))
+	if err != nil {
+		panic(err)
+	}
+	return []any{AddDuration(d, dur)}
+}
+
+// DateDiff is the number of whole units from a to b, negative when b is
+// earlier. Units are years, months, weeks, days, hours, minutes and
+// seconds; years and months count calendar months.
+func DateDiff(a, b DateTime, unit string) (int64, error) {
+	seconds := b.Time.Unix() - a.Time.Unix()
+	switch unit {
+	case "years", "months":
+		sign := int64(1)
+		if b.Time.Before(a.Time) {
+			a, b, sign = b, a, -1
+		}
+		n := int64(b.Time.Year()-a.Time.Year())*12 + int64(b.Time.Month()-a.Time.Month())
+		if n > 0 && AddDuration(a, Duration{Months: int(n)}).Time.After(b.Time) {
+			n--
+		}
+		if unit == "years" {
+			n /= 12
+		}
+		return sign * n, nil
+	case "weeks":
+		return seconds / (7 * 86400), nil
+	case "days":
+		return seconds / 86400, nil
+	case "hours":
+		return seconds / 3600, nil
+	case "minutes":
+		return seconds / 60, nil
+	case "seconds":
+		return seconds, nil
+	}
+	return 0, fmt.Errorf("XFDY0002: unknown date unit %q (want years, months, weeks, days, hours, minutes or seconds)", unit)
+}
+
+// fnDateDiff is dateDiff(a, b, unit?): the whole units, days by default,
+// from a to b.
+func fnDateDiff(args [][]any, _ Context) []any {
+	a, b := dateArg(args, 0, "dateDiff"), dateArg(args, 1, "dateDiff")
+	unit := "days"
+	if len(args) > 2 && len(args[2]) > 0 {
+		unit = ToString(args[2])
+	}
+	n, err := DateDiff(a, b, unit)
+	if err != nil {
+		panic(err)
+	}
+	return []any{n}
+}
@@ -0,0 +1,63 @@
+package xform
+
+import "fmt"
+
+type Severity string
+
+const (
+	SeverityWarning Severity = "warning"
+	SeverityError   Severity = "error"
+)
+
+type Diagnostic struct {
+	Severity Severity
+	Code     string
+	Message  string
+	Pos      Position // in the transform source, when known
+}
+
+func (d Diagnostic) String() string {
+	s := fmt.Sprintf("%s: %s: %s", d.Severity, d.Code, d.Message)
+	if d.Pos.IsValid() {
+		s += " (" + d.Pos.String() + ")"
+	}
+	return s
+}
+
+type DiagnosticSink func(Diagnostic)
+
+// warnOnce reports a diagnostic at most once per key and evaluation, so a
+// deprecated function called in a loop yields a single warning.
+func (rt *Runtime) warnOnce(key string, d Diagnostic) {
+	if rt == nil || rt.Options.Diagnostics == nil {
+		return
+	}
+	if rt.warned == nil {
+		rt.warned = map[string]bool{}
+	}
+	if rt.warned[key] {
+		return
+	}
+	rt.warned[key] = true
+	rt.Options.Diagnostics(d)
+}
+
+func deprecationMessage(kind, name string, note *string) string {
+	msg := fmt.Sprintf("%s %s is deprecated", kind, name)
+	if *note != "" {
+		msg += ": " + *note
+	}
+	return msg
+}
+
+func (rt *Runtime) functionReferenced(name string, fn FunctionDef) {
+	if fn.Deprecated != nil {
+		rt.warnOnce("def:"+name, Diagnostic{Severity: SeverityWarning, Code: "XFWN0001", Message: deprecationMessage("function", name, fn.Deprecated)})
+	}
+}
+
+func (rt *Runtime) ruleFired(ruleset string, idx int, rule RuleDef) {
+	if rule.Deprecated != nil {
+		rt.warnOnce(fmt.Sprintf("rule:%s:%d", ruleset, idx), Diagnostic{Severity: SeverityWarning, Code: "XFWN0001", Message: deprecationMessage("rule", ruleset, rule.Deprecated)})
+	}
+}
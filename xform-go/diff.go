@@ -0,0 +1,242 @@
+package xform
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Diff compares two trees and returns a <diff> element listing the changes
+// needed to turn a into b, in document order:
+//
+//	<delete path="/doc[1]/p[2]">...removed node...</delete>
+//	<insert parent="/doc[1]" after="/doc[1]/p[1]" path="/doc[1]/p[2]">...new node...</insert>
+//	<change path="/doc[1]/p[1]/text()[1]"><old>..</old><new>..</new></change>
+//	<attribute path="/doc[1]" name="lang" old="en" new="de"/>
+//	<attribute path="/doc[1]" name="id" after="lang" new="d1"/>
+//
+// Paths of delete, change and attribute entries and the parent and after
+// anchors of insert entries address nodes of a; after names the retained
+// sibling the new node follows (absent when it goes first) and path is the
+// node's location in b. Consecutive inserts with the same anchor keep their
+// order. A missing old or new attribute marks an added or removed attribute;
+// an added one names in after the attribute it follows in b (empty when it
+// goes first). Attributes kept in a different order are not reported.
+// Children are aligned on element names and exact text, so moved content
+// shows up as a delete plus an insert. Whitespace-only text nodes are
+// ignored.
+func Diff(a, b *Node) *Node {
+	return diffNodes(a, b, nil)
+}
+
+func diffNodes(a, b *Node, rt *Runtime) *Node {
+	d := &differ{out: &Node{Kind: "element", Name: "diff", Attrs: map[string]string{}}, rt: rt}
+	rt.nodeCreated()
+	d.node(a, b)
+	return d.out
+}
+
+type differ struct {
+	out *Node
+	rt  *Runtime
+}
+
+func (d *differ) emit(name string, attrs [][2]string, children ...*Node) {
+	n := &Node{Kind: "element", Name: name, Attrs: map[string]string{}, Parent: d.out}
+	d.rt.nodeCreated()
+	for _, kv := range attrs {
+		n.Attrs[kv[0]] = kv[1]
+		n.AttrOrder = append(n.AttrOrder, kv[0])
+	}
+	for _, c := range children {
+		c.Parent = n
+		n.Children = append(n.Children, c)
+	}
+	d.out.Children = append(d.out.Children, n)
+}
+
+func (d *differ) textElem(name, value string) *Node {
+	n := &Node{Kind: "element", Name: name, Attrs: map[string]string{}}
+	t := &Node{Kind: "text", Value: value, Attrs: map[string]string{}, Parent: n}
+	n.Children = []*Node{t}
+	d.rt.nodeCreated()
+	d.rt.nodeCreated()
+	return n
+}
+
+func (d *differ) node(a, b *Node) {
+	if a.Kind != b.Kind || (a.Kind == "element" && a.Name != b.Name) {
+		d.emit("delete", [][2]string{{"path", NodePath(a)}}, DeepCopy(a, true))
+		var after *Node
+		if a.Parent != nil {
+			for _, c := range significantChildren(a.Parent) {
+				if c == a {
+					break
+				}
+				after = c
+			}
+		}
+		d.insert(a.Parent, after, b)
+		return
+	}
+	switch a.Kind {
+	case "element":
+		d.attrs(a, b)
+		d.children(a, b)
+	case "document":
+		d.children(a, b)
+	default:
+		if a.Value != b.Value {
+			d.emit("change", [][2]string{{"path", NodePath(a)}}, d.textElem("old", a.Value), d.textElem("new", b.Value))
+		}
+	}
+}
+
+func (d *differ) insert(parent, after, b *Node) {
+	attrs := [][2]string{{"parent", "/"}}
+	if parent != nil {
+		attrs[0][1] = NodePath(parent)
+	}
+	if after != nil {
+		attrs = append(attrs, [2]string{"after", NodePath(after)})
+	}
+	attrs = append(attrs, [2]string{"path", NodePath(b)})
+	d.emit("insert", attrs, DeepCopy(b, true))
+}
+
+func (d *differ) attrs(a, b *Node) {
+	path := NodePath(a)
+	for _, name := range a.AttrNames() {
+		old := a.Attrs[name]
+		if v, ok := b.Attrs[name]; !ok {
+			d.emit("attribute", [][2]string{{"path", path}, {"name", name}, {"old", old}})
+		} else if v != old {
+			d.emit("attribute", [][2]string{{"path", path}, {"name", name}, {"old", old}, {"new", v}})
+		}
+	}
+	after := ""
+	for _, name := range b.AttrNames() {
+		if _, ok := a.Attrs[name]; !ok {
+			d.emit("attribute", [][2]string{{"path", path}, {"name", name}, {"after", after}, {"new", b.Attrs[name]}})
+		}
+		after = name
+	}
+}
+
+func significantChildren(n *Node) []*Node {
+	out := []*Node{}
+	for _, c := range n.Children {
+		if c.Kind == "text" && isWhitespace(c.Value) {
+			continue
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func diffKey(n *Node) string {
+	switch n.Kind {
+	case "element":
+		return "e:" + n.Name
+	case "text":
+		return "t:" + n.Value
+	}
+	return n.Kind + ":" + n.Value
+}
+
+// children aligns the child lists with a longest common subsequence on
+// diffKey. Unmatched nodes of the same kind (and element name) between two
+// anchors are paired up and diffed; the rest become deletes and inserts.
+func (d *differ) children(a, b *Node) {
+	ac, bc := significantChildren(a), significantChildren(b)
+	lcs := make([][]int, len(ac)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bc)+1)
+	}
+	for i := len(ac) - 1; i >= 0; i-- {
+		for j := len(bc) - 1; j >= 0; j-- {
+			if diffKey(ac[i]) == diffKey(bc[j]) {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var gapA, gapB []*Node
+	var prev *Node
+	flush := func() {
+		for len(gapA) > 0 && len(gapB) > 0 && gapA[0].Kind == gapB[0].Kind && gapA[0].Kind != "element" {
+			d.node(gapA[0], gapB[0])
+			prev = gapA[0]
+			gapA, gapB = gapA[1:], gapB[1:]
+		}
+		for _, n := range gapA {
+			d.emit("delete", [][2]string{{"path", NodePath(n)}}, DeepCopy(n, true))
+		}
+		for _, n := range gapB {
+			d.insert(a, prev, n)
+		}
+		gapA, gapB = nil, nil
+	}
+	i, j := 0, 0
+	for i < len(ac) && j < len(bc) {
+		switch {
+		case diffKey(ac[i]) == diffKey(bc[j]):
+			flush()
+			d.node(ac[i], bc[j])
+			prev = ac[i]
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			gapA = append(gapA, ac[i])
+			i++
+		default:
+			gapB = append(gapB, bc[j])
+			j++
+		}
+	}
+	gapA = append(gapA, ac[i:]...)
+	gapB = append(gapB, bc[j:]...)
+	flush()
+}
+
+// NodePath returns an absolute path such as /doc[1]/p[2]/text()[1] that
+// locates n among its same-kind (and, for elements, same-name) siblings.
+func NodePath(n *Node) string {
+	steps := []string{}
+	for ; n != nil && n.Kind != "document"; n = n.Parent {
+		step := n.Kind + "()"
+		if n.Kind == "element" {
+			step = n.Name
+		}
+		pos := 1
+		if n.Parent != nil {
+			for _, s := range n.Parent.Children {
+				if s == n {
+					break
+				}
+				if s.Kind == n.Kind && s.Name == n.Name {
+					pos++
+				}
+			}
+		}
+		steps = append(steps, step+"["+strconv.Itoa(pos)+"]")
+	}
+	if len(steps) == 0 {
+		return "/"
+	}
+	for l, r := 0, len(steps)-1; l < r; l, r = l+1, r-1 {
+		steps[l], steps[r] = steps[r], steps[l]
+	}
+	return "/" + strings.Join(steps, "/")
+}
+
+func fnDiff(args [][]any, ctx Context) []any {
+	a, b := nodeArg(args, 0), nodeArg(args, 1)
+	if a == nil || b == nil {
+		panic(fmt.Errorf("XFDY0002: diff() expects two nodes"))
+	}
+	return []any{diffNodes(a, b, ctx.Runtime)}
+}
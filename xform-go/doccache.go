@@ -0,0 +1,217 @@
+package xform
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+// Versioner is implemented by resolvers that can tell cheaply whether a
+// resource has changed: Version returns a string that differs between
+// versions, such as a file's modification time or an HTTP ETag, or "" if
+// the resolver cannot tell.
+type Versioner interface {
+	Version(uri string) (string, error)
+}
+
+// DocumentCache holds the documents loaded by doc() and collection()
+// across evaluations, keyed by resolved URI. It is safe for concurrent
+// use: set the same cache in the EvalOptions of every request of a server.
+// A cached document is used again while its resolver reports the same
+// version; documents from resolvers that are not Versioners stay cached
+// until invalidated. The least recently used documents are dropped when
+// the sizes of their sources add up to more than the limit.
+type DocumentCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	entries  map[string]*cachedDocument
+	lru      *list.List
+}
+
+type cachedDocument struct {
+	uri, version string
+	elem         *list.Element
+	ready        chan struct{}
+	doc          *Node
+	size         int64
+	err          error
+}
+
+// NewDocumentCache returns a cache for documents whose sources add up to
+// at most maxBytes.
+func NewDocumentCache(maxBytes int64) *DocumentCache {
+	return &DocumentCache{maxBytes: maxBytes, entries: map[string]*cachedDocument{}, lru: list.New()}
+}
+
+// Invalidate drops the document loaded from uri, as resolved by doc():
+// relative to EvalOptions.BaseDir and mapped through the catalog.
+func (c *DocumentCache) Invalidate(uri string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[uri]; ok {
+		c.remove(e)
+	}
+}
+
+// Clear drops every document.
+func (c *DocumentCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]*cachedDocument{}
+	c.lru.Init()
+	c.size = 0
+}
+
+// Len returns the number of cached documents.
+func (c *DocumentCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// remove drops e if it is still the entry for its URI; c.mu is held.
+func (c *DocumentCache) remove(e *cachedDocument) {
+	if c.entries[e.uri] != e {
+		return
+	}
+	delete(c.entries, e.uri)
+	c.lru.Remove(e.elem)
+	c.size -= e.size
+}
+
+// load returns the document at uri, calling parse unless a current
+// version is cached. Concurrent loads of the same version share one parse;
+// failures are not cached.
+func (c *DocumentCache) load(uri string, res Resolver, parse func() (*Node, int64, error)) (*Node, error) {
+	version := ""
+	if v, ok := res.(Versioner); ok {
+		var err error
+		if version, err = v.Version(uri); err != nil {
+			doc, _, err := parse()
+			return doc, err
+		}
+	}
+	c.mu.Lock()
+	if e, ok := c.entries[uri]; ok && e.version == version {
+		c.lru.MoveToFront(e.elem)
+		c.mu.Unlock()
+		<-e.ready
+		return e.doc, e.err
+	} else if ok {
+		c.remove(e)
+	}
+	e := &cachedDocument{uri: uri, version: version, ready: make(chan struct{})}
+	e.elem = c.lru.PushFront(e)
+	c.entries[uri] = e
+	c.mu.Unlock()
+
+	doc, size, err := parse()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.doc, e.err = doc, err
+	close(e.ready)
+	if err != nil {
+		c.remove(e)
+		return nil, err
+	}
+	if c.entries[uri] == e {
+		e.size = size
+		c.size += size
+		for c.size > c.maxBytes && c.lru.Len() > 1 {
+			c.remove(c.lru.Back().Value.(*cachedDocument))
+		}
+	}
+	return doc, nil
+}
+
+func fileVersion(info fs.FileInfo) string {
+	return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+}
+
+func (FileResolver) Version(uri string) (string, error) {
+	p, err := filePath(uri)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	return fileVersion(info), nil
+}
+
+// Version asks the server for the ETag or, failing that, Last-Modified of
+// uri with a HEAD request.
+func (h HTTPResolver) Version(uri string) (string, error) {
+	resp, err := h.client().Head(uri)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("HEAD %s: %s", uri, resp.Status)
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		return etag, nil
+	}
+	return resp.Header.Get("Last-Modified"), nil
+}
+
+func (r *Resolvers) Version(uri string) (string, error) {
+	scheme := URIScheme(uri)
+	if scheme == "" {
+		scheme = "file"
+	}
+	r.mu.RLock()
+	res, ok := r.schemes[scheme]
+	r.mu.RUnlock()
+	if v, isVersioner := res.(Versioner); ok && isVersioner {
+		return v.Version(uri)
+	}
+	return "", nil
+}
+
+func (r FSResolver) Version(uri string) (string, error) {
+	if URIScheme(uri) == "" && !filepath.IsAbs(uri) {
+		name := path.Clean(path.Join(r.Dir, filepath.ToSlash(uri)))
+		if info, err := fs.Stat(r.FS, name); err == nil {
+			if !info.ModTime().IsZero() {
+				return fileVersion(info), nil
+			}
+			// Files of an embed.FS and the like have no modification
+			// time, so size alone would not tell edits apart.
+			data, err := fs.ReadFile(r.FS, name)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("sha256-%x", sha256.Sum256(data)), nil
+		}
+	}
+	next := r.Next
+	if next == nil {
+		next = DefaultResolvers
+	}
+	if v, ok := next.(Versioner); ok {
+		return v.Version(uri)
+	}
+	return "", nil
+}
+
+// Version passes on Next's versions for the URIs r allows.
+func (r RestrictedResolver) Version(uri string) (string, error) {
+	next, err := r.next(uri)
+	if err != nil {
+		return "", err
+	}
+	if v, ok := next.(Versioner); ok {
+		return v.Version(uri)
+	}
+	return "", nil
+}
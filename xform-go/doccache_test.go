@@ -0,0 +1,32 @@
+package xform
+
+import (
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestDocumentCacheFSVersions(t *testing.T) {
+	files := fstest.MapFS{"a.xml": {Data: []byte("<a>1</a>")}}
+	opts := EvalOptions{Resolver: FSResolver{FS: files}, Documents: NewDocumentCache(1 << 20)}
+	for _, content := range []string{"<a>1</a>", "<a>2</a>"} {
+		files["a.xml"].Data = []byte(content)
+		if got := runWith(t, `string(doc("a.xml"))`, "<r/>", opts); got != content[3:4] {
+			t.Errorf("without modification times: doc() = %s after writing %s", got, content)
+		}
+	}
+	if opts.Documents.Len() != 1 {
+		t.Errorf("cache holds %d documents, want 1", opts.Documents.Len())
+	}
+
+	modified := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	files["a.xml"] = &fstest.MapFile{Data: []byte("<a>3</a>"), ModTime: modified}
+	if got := runWith(t, `string(doc("a.xml"))`, "<r/>", opts); got != "3" {
+		t.Errorf("with a modification time: doc() = %s, want 3", got)
+	}
+	// Same size and time: the cached document is used.
+	files["a.xml"].Data = []byte("<a>4</a>")
+	if got := runWith(t, `string(doc("a.xml"))`, "<r/>", opts); got != "3" {
+		t.Errorf("unchanged version: doc() = %s, want the cached 3", got)
+	}
+}
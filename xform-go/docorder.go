@@ -0,0 +1,164 @@
+package xform
+
+import (
+	"fmt"
+	"sort"
+)
+
+type ordinalKey struct {
+	node *Node
+	attr string
+}
+
+// numberNodes numbers the nodes of a parsed document in document order, as
+// ordinals does, so that path results from it are put in document order
+// without building the map. Trees built or changed later are numbered by
+// ordinals instead.
+func numberNodes(root *Node) {
+	next := 0
+	var walk func(n *Node)
+	walk = func(n *Node) {
+		next++
+		n.ordinal = next
+		next += len(n.Attrs)
+		for _, c := range n.Children {
+			walk(c)
+		}
+	}
+	walk(root)
+}
+
+// ordinals numbers the nodes of the tree rooted at root in document order
+// from 1: an element, then its attributes in source order, then its
+// children.
+func (rt *Runtime) ordinals(root *Node) map[ordinalKey]int {
+	if rt != nil {
+		if ord, ok := rt.ordinalCache[root]; ok {
+			return ord
+		}
+	}
+	ord := map[ordinalKey]int{}
+	var walk func(n *Node)
+	walk = func(n *Node) {
+		ord[ordinalKey{node: n}] = len(ord) + 1
+		for _, a := range n.AttrNames() {
+			ord[ordinalKey{node: n, attr: a}] = len(ord) + 1
+		}
+		for _, c := range n.Children {
+			walk(c)
+		}
+	}
+	walk(root)
+	if rt != nil {
+		if rt.ordinalCache == nil {
+			rt.ordinalCache = map[*Node]map[ordinalKey]int{}
+		}
+		rt.ordinalCache[root] = ord
+	}
+	return ord
+}
+
+func ordinalKeyOf(n *Node) ordinalKey {
+	if n.Kind == "attribute" && n.Parent != nil {
+		return ordinalKey{node: n.Parent, attr: n.Name}
+	}
+	return ordinalKey{node: n}
+}
+
+// orderOf returns n's number in the document order of the tree rooted at
+// root.
+func (rt *Runtime) orderOf(n, root *Node) int {
+	key := ordinalKeyOf(n)
+	if root.ordinal > 0 && key.node.ordinal > 0 {
+		if key.attr == "" {
+			return key.node.ordinal
+		}
+		names := key.node.AttrOrder
+		if len(names) != len(key.node.Attrs) {
+			names = key.node.AttrNames()
+		}
+		for i, a := range names {
+			if a == key.attr {
+				return key.node.ordinal + 1 + i
+			}
+		}
+	}
+	return rt.ordinals(root)[key]
+}
+
+// DocumentOrder sorts the nodes of seq into document order and removes
+// duplicates. Nodes of different trees keep the order in which their trees
+// first appear in seq.
+func DocumentOrder(seq []any) []any {
+	return documentOrder(seq, nil)
+}
+
+func documentOrder(seq []any, rt *Runtime) []any {
+	type entry struct {
+		node      *Node
+		tree, pos int
+	}
+	trees := map[*Node]int{}
+	var parent, root *Node
+	// number returns the tree and position of n; consecutive nodes mostly
+	// share a parent, and so a root.
+	number := func(item any) (int, int) {
+		n, ok := item.(*Node)
+		if !ok {
+			panic(fmt.Errorf("XFDY0002: docOrder() expects nodes"))
+		}
+		if n.Parent == nil || n.Parent != parent {
+			parent, root = n.Parent, documentOf(n)
+		}
+		tree, ok := trees[root]
+		if !ok {
+			tree = len(trees)
+			trees[root] = tree
+		}
+		return tree, rt.orderOf(n, root)
+	}
+	// Most path results are in document order without duplicates already,
+	// and are returned as they are.
+	ordered := true
+	prevTree, prevPos := -1, 0
+	for _, item := range seq {
+		tree, pos := number(item)
+		if tree < prevTree || tree == prevTree && pos <= prevPos {
+			ordered = false
+			break
+		}
+		prevTree, prevPos = tree, pos
+	}
+	if ordered {
+		return seq
+	}
+	entries := make([]entry, len(seq))
+	for i, item := range seq {
+		tree, pos := number(item)
+		entries[i] = entry{node: item.(*Node), tree: tree, pos: pos}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].tree != entries[j].tree {
+			return entries[i].tree < entries[j].tree
+		}
+		return entries[i].pos < entries[j].pos
+	})
+	out := make([]any, 0, len(entries))
+	for i, e := range entries {
+		if i > 0 && e.tree == entries[i-1].tree && e.pos == entries[i-1].pos {
+			continue
+		}
+		out = append(out, e.node)
+	}
+	return out
+}
+
+func fnDocOrder(args [][]any, ctx Context) []any {
+	return documentOrder(firstOrEmpty(args), ctx.Runtime)
+}
+
+// fnUnordered marks a sequence whose order does not matter. The items are
+// returned as they are, which is the cheapest order available.
+func fnUnordered(args [][]any, _ Context) []any {
+	return firstOrEmpty(args)
+}
@@ -0,0 +1,145 @@
+package xform
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func resolvePath(uri string, ctx Context) string {
+	if ctx.Runtime == nil {
+		return uri
+	}
+	if mapped, ok := ctx.Runtime.Options.Catalog.LookupURI(uri); ok {
+		return mapped
+	}
+	resolved := ResolveURI(ctx.Runtime.Options.BaseDir, uri)
+	if mapped, ok := ctx.Runtime.Options.Catalog.LookupURI(resolved); ok {
+		return mapped
+	}
+	return resolved
+}
+
+func resolverFor(ctx Context) Resolver {
+	if ctx.Runtime != nil && ctx.Runtime.Options.Resolver != nil {
+		return ctx.Runtime.Options.Resolver
+	}
+	return DefaultResolvers
+}
+
+// loadDocument loads and parses uri once per evaluation: later calls for
+// the same resolved URI return the same document node.
+func loadDocument(uri string, ctx Context) *Node {
+	p := resolvePath(uri, ctx)
+	rt := ctx.Runtime
+	if doc, ok := rt.loadedDocument(p); ok {
+		return doc
+	}
+	res := resolverFor(ctx)
+	parse := func() (*Node, int64, error) {
+		r, err := res.Open(p)
+		if err != nil {
+			return nil, 0, fmt.Errorf("XFDY0005: cannot load document %s: %v", uri, err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, 0, fmt.Errorf("XFDY0005: cannot load document %s: %v", uri, err)
+		}
+		var opts ParseOptions
+		if rt != nil {
+			opts = rt.Options.Parse
+			if opts.Catalog == nil {
+				opts.Catalog = rt.Options.Catalog
+			}
+		}
+		doc, err := ParseInputWith(p, data, FormatAuto, opts)
+		if err != nil {
+			return nil, 0, fmt.Errorf("XFDY0005: cannot parse document %s: %v", uri, err)
+		}
+		return doc, int64(len(data)), nil
+	}
+	var doc *Node
+	var err error
+	if rt != nil && rt.Options.Documents != nil {
+		doc, err = rt.Options.Documents.load(p, res, parse)
+	} else {
+		doc, _, err = parse()
+	}
+	if err != nil {
+		panic(err)
+	}
+	if rt != nil {
+		if rt.loaded == nil {
+			rt.loaded = map[string]*Node{}
+		}
+		rt.loaded[p] = doc
+	}
+	return doc
+}
+
+func (rt *Runtime) loadedDocument(uri string) (*Node, bool) {
+	if rt == nil {
+		return nil, false
+	}
+	doc, ok := rt.loaded[uri]
+	return doc, ok
+}
+
+func fnDoc(args [][]any, ctx Context) []any {
+	if len(args) == 0 || len(args[0]) == 0 {
+		return []any{}
+	}
+	return []any{loadDocument(ToString(args[0]), ctx)}
+}
+
+func fnCollection(args [][]any, ctx Context) []any {
+	if len(args) == 0 || len(args[0]) == 0 {
+		return []any{}
+	}
+	pattern := resolvePath(ToString(args[0]), ctx)
+	if URIScheme(pattern) != "" {
+		panic(fmt.Errorf("XFDY0005: collection() only supports local paths: %s", ToString(args[0])))
+	}
+	// A resolver that restricts access is asked before the file system is
+	// looked at, so that the listing does not show what it denies.
+	allow := func(string) error { return nil }
+	if a, ok := resolverFor(ctx).(interface{ Allow(string) error }); ok {
+		allow = a.Allow
+	}
+	if err := allow(globBase(pattern)); err != nil {
+		panic(fmt.Errorf("XFDY0005: cannot read collection %s: %v", ToString(args[0]), err))
+	}
+	if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+		pattern = filepath.Join(pattern, "*")
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		panic(fmt.Errorf("XFDY0005: invalid collection %s: %v", ToString(args[0]), err))
+	}
+	sort.Strings(matches)
+	out := []any{}
+	for _, m := range matches {
+		if allow(m) != nil {
+			continue
+		}
+		if info, err := os.Stat(m); err != nil || info.IsDir() {
+			continue
+		}
+		out = append(out, loadDocument(m, ctx))
+	}
+	return out
+}
+
+// globBase is the directory of pattern above its first component with
+// wildcards, or pattern itself when it has none.
+func globBase(pattern string) string {
+	base := pattern
+	for strings.ContainsAny(base, "*?[") && filepath.Dir(base) != base {
+		base = filepath.Dir(base)
+	}
+	return base
+}
@@ -0,0 +1,108 @@
+package xform
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// outputEncodings maps the accepted names of the output encodings, in
+// lower case, to the canonical ones.
+var outputEncodings = map[string]string{
+	"utf-8":        "UTF-8",
+	"utf8":         "UTF-8",
+	"iso-8859-1":   "ISO-8859-1",
+	"iso8859-1":    "ISO-8859-1",
+	"latin1":       "ISO-8859-1",
+	"latin-1":      "ISO-8859-1",
+	"windows-1252": "windows-1252",
+	"cp1252":       "windows-1252",
+	"us-ascii":     "US-ASCII",
+	"ascii":        "US-ASCII",
+}
+
+// OutputEncoding returns the canonical name of an output encoding: UTF-8,
+// ISO-8859-1, windows-1252 or US-ASCII.
+func OutputEncoding(name string) (string, error) {
+	if enc, ok := outputEncodings[strings.ToLower(name)]; ok {
+		return enc, nil
+	}
+	return "", fmt.Errorf("unknown output encoding %q (want UTF-8, ISO-8859-1, windows-1252 or US-ASCII)", name)
+}
+
+// windows1252 holds the characters of the bytes 0x80 to 0x9F in
+// windows-1252, 0 for the five it leaves undefined. The other bytes are
+// those of ISO-8859-1.
+var windows1252 = [32]rune{
+	0x20AC, 0, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0, 0x017D, 0,
+	0, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0, 0x017E, 0x0178,
+}
+
+// encodeRune returns the byte of c in a single-byte encoding.
+func encodeRune(c rune, encoding string) (byte, bool) {
+	switch {
+	case c < 0x80:
+		return byte(c), true
+	case encoding == "US-ASCII":
+	case encoding == "windows-1252" && c >= 0x80 && c <= 0x9F:
+	case c <= 0xFF:
+		return byte(c), true
+	case encoding == "windows-1252":
+		for i, w := range windows1252 {
+			if w == c {
+				return byte(0x80 + i), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func isUTF8(encoding string) bool {
+	return encoding == "" || encoding == "UTF-8"
+}
+
+// encodable returns s with the characters the encoding lacks written as
+// character references, or as ? in text output, where references would
+// be read literally.
+func encodable(s, encoding string, text bool) string {
+	i := 0
+	for i < len(s) && s[i] < utf8.RuneSelf {
+		i++
+	}
+	if i == len(s) {
+		return s
+	}
+	b := &strings.Builder{}
+	b.WriteString(s[:i])
+	for _, c := range s[i:] {
+		if _, ok := encodeRune(c, encoding); ok {
+			b.WriteRune(c)
+		} else if text {
+			b.WriteByte('?')
+		} else {
+			b.WriteString("&#" + strconv.Itoa(int(c)) + ";")
+		}
+	}
+	return b.String()
+}
+
+// EncodeOutput converts serialized output to the bytes of its encoding.
+// Serializing with SerializeOptions.Encoding has already replaced the
+// characters the encoding lacks; any left are written as ?.
+func EncodeOutput(s, encoding string) []byte {
+	if isUTF8(encoding) {
+		return []byte(s)
+	}
+	out := make([]byte, 0, len(s))
+	for _, c := range s {
+		b, ok := encodeRune(c, encoding)
+		if !ok {
+			b = '?'
+		}
+		out = append(out, b)
+	}
+	return out
+}
@@ -0,0 +1,104 @@
+package xform
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Position is a location in transform source. Line and Column count from 1;
+// Column counts characters, not bytes. The zero Position is unknown.
+type Position struct {
+	Line   int
+	Column int
+}
+
+func (p Position) IsValid() bool { return p.Line > 0 }
+
+func (p Position) String() string {
+	return fmt.Sprintf("line %d, column %d", p.Line, p.Column)
+}
+
+// XFormError is the error EvalModule and EvalExpr return when evaluation
+// fails. Code is the error code such as XFDY0001, empty for failures
+// without one (e.g. an error from a Go extension function, kept in Err).
+// Pos is the function call, operator, path or match expression that was
+// being evaluated.
+type XFormError struct {
+	Code    string
+	Message string
+	Pos     Position
+	Err     error
+}
+
+func (e *XFormError) Error() string {
+	msg := e.Message
+	if e.Code != "" {
+		msg = e.Code + ": " + msg
+	}
+	if e.Pos.IsValid() {
+		msg += " (" + e.Pos.String() + ")"
+	}
+	return msg
+}
+
+func (e *XFormError) Unwrap() error { return e.Err }
+
+// newXFormError converts a recovered panic value into an *XFormError.
+// Errors raised as "CODE: message" are split into their parts.
+func newXFormError(r any, pos Position) *XFormError {
+	var xe *XFormError
+	if err, ok := r.(error); ok && errors.As(err, &xe) {
+		return xe
+	}
+	e := &XFormError{Message: fmt.Sprint(r), Pos: pos}
+	if err, ok := r.(error); ok {
+		e.Err = err
+		e.Message = err.Error()
+	}
+	if code := ErrorCode(r); code != "unknown" {
+		e.Code = code
+		e.Message = strings.TrimSpace(strings.TrimPrefix(e.Message, code+":"))
+	}
+	return e
+}
+
+// recoverError turns a panic of the evaluation into *err. Deferred by the
+// exported entry points; the evaluator itself raises errors by panicking.
+func recoverError(err *error, rt *Runtime) {
+	if r := recover(); r != nil {
+		var pos Position
+		if rt != nil {
+			pos = rt.pos
+		}
+		*err = newXFormError(r, pos)
+	}
+}
+
+// at records the position of the expression about to be evaluated, for
+// the XFormError of a failure.
+func (rt *Runtime) at(pos Position) {
+	if rt != nil && pos.IsValid() {
+		rt.pos = pos
+	}
+}
+
+// position converts a byte offset into the parser's text to a Position.
+func (p *Parser) position(offset int) Position {
+	if p.lineStarts == nil {
+		p.lineStarts = []int{0}
+		for i := 0; i < len(p.text); i++ {
+			if p.text[i] == '\n' {
+				p.lineStarts = append(p.lineStarts, i+1)
+			}
+		}
+	}
+	if offset > len(p.text) {
+		offset = len(p.text)
+	}
+	line := sort.SearchInts(p.lineStarts, offset+1) - 1
+	start := p.lineStarts[line]
+	return Position{Line: line + 1, Column: utf8.RuneCountInString(p.text[start:offset]) + 1}
+}
@@ -3,8 +3,12 @@ package xform
 import (
 	"fmt"
 	"math"
+	"regexp"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
+	"unicode"
 )
 
 type Context struct {
@@ -14,9 +18,215 @@ type Context struct {
 	Rules       map[string][]RuleDef
 	Position    *int
 	Last        *int
+	Runtime     *Runtime
 }
 
-func EvalModule(module *Module, doc *Node) []any {
+type EvalOptions struct {
+	Metrics  Metrics
+	BaseDir  string
+	Resolver Resolver
+	// Documents, when set, caches the documents loaded by doc() and
+	// collection(), possibly across evaluations.
+	Documents *DocumentCache
+	Catalog   *Catalog
+	Packs     []*BuiltinPack
+	// Parse is how doc(), collection() and streamed input parse XML.
+	Parse ParseOptions
+	// Functions adds host functions for this evaluation, see
+	// RegisterFunction.
+	Functions   map[string]Function
+	Diagnostics DiagnosticSink
+	// Profile classifies the elements of the input vocabulary (see
+	// LoadProfile). Evaluation reads a copy of the input document
+	// stripped as StripWhitespace does, leaving the caller's unchanged, and
+	// the built-in rules keep preserving elements verbatim.
+	Profile *Profile
+	Params  map[string][]any
+	// IDAttributes names the ID attributes of elements the DTD says nothing
+	// about (default: DefaultIDAttributes).
+	IDAttributes []string
+	// LegacyEquality makes = and != compare the string values of the first
+	// items only, as before general comparison was introduced. It is the
+	// same as CompatEquality.
+	LegacyEquality bool
+	// Compat adds legacy behaviors to those the module declares.
+	Compat Compat
+	// Strict rejects references to undefined variables, as the "strict;"
+	// module declaration does.
+	Strict bool
+	// Provenance annotates the elements produced by each rule with the
+	// source path and rule (see ProvenanceAttr).
+	Provenance bool
+	// Tracer, when set, is told about every rule firing and user function
+	// call (see xform debug).
+	Tracer Tracer
+	// MaxMemory, when positive, ends evaluation with XFDY0007 once it has
+	// allocated about as many bytes for nodes and sequences (see EvalStats).
+	MaxMemory int64
+	// Timeout, when positive, ends evaluation with XFDY0008 once it has
+	// run about this long.
+	Timeout time.Duration
+	// MaxCallDepth ends evaluation with XFDY0011 when user function calls
+	// and rule firings nest deeper (0: DefaultMaxCallDepth, negative: no
+	// limit). Calls in tail position do not nest.
+	MaxCallDepth int
+	// AllowFunctions, when not nil, lists the built-in, pack and host
+	// functions the transform may call; calling others is an XFST0007
+	// error. The module's own functions are always allowed.
+	AllowFunctions []string
+	// OutputLimit bounds the documents of resultDocument(), and the nodes
+	// of the result: without Truncate, evaluation ends with XFDY0013 when
+	// the result has more than MaxNodes nodes. Callers serializing the
+	// result apply it with SerializeResultLimited.
+	OutputLimit OutputLimit
+	// Now, when set, is the time of currentDate() and currentDateTime(),
+	// for reproducible output; otherwise it is read once per evaluation.
+	Now time.Time
+	// Stats, when set, has the cost of each evaluation added to it.
+	Stats *EvalStats
+	// ResultDocuments receives the documents written with resultDocument();
+	// calling it without one is an XFDY0010 error.
+	ResultDocuments ResultWriter
+}
+
+type Runtime struct {
+	Options      EvalOptions
+	NodesCreated int
+	packs        map[string]BuiltinFunc
+	warned       map[string]bool
+	refIndexes   map[*Node]map[string]*refIndex
+	tocIndexes   map[*Node]map[string]*tocIndex
+	ordinalCache map[*Node]map[ordinalKey]int
+	stack        []*Frame
+	pos          Position
+	compat       Compat
+	namespaces   map[string]string
+	input        any // the JSON input, if evaluation started from one
+	regexps      map[string]*regexp.Regexp
+	memory       int64 // bytes charged so far, see charge
+	ruleOrders   map[string][]int
+	deadline     time.Time // see checkTime
+	clock        time.Time // see now
+	depth        int       // nesting of calls and rule firings, see descend
+	ticks        int
+	allowed      map[string]bool
+	globals      map[string][]any // the module's variables, see moduleContext
+	loaded       map[string]*Node // documents loaded by doc(), by resolved URI
+	output       SerializeOptions // the module's, for resultDocument()
+	results      []resultDoc      // written by resultDocument(), see writeResults
+}
+
+func (rt *Runtime) nodeCreated() {
+	if rt != nil {
+		rt.NodesCreated++
+		rt.charge(nodeBytes)
+	}
+}
+
+// EvalModule evaluates module with doc as the context item. Evaluation
+// errors are returned as *XFormError.
+func EvalModule(module *Module, doc *Node) ([]any, error) {
+	return EvalModuleWithOptions(module, doc, EvalOptions{})
+}
+
+// EvalModuleWithParams is EvalModule with the module's parameters, and
+// variables of the same names, bound to params.
+func EvalModuleWithParams(module *Module, doc *Node, params map[string][]any) ([]any, error) {
+	return EvalModuleWithOptions(module, doc, EvalOptions{Params: params})
+}
+
+func EvalModuleWithOptions(module *Module, doc *Node, opts EvalOptions) (result []any, err error) {
+	return EvalModuleItem(module, doc, opts)
+}
+
+// EvalModuleItem is EvalModuleWithOptions with any item as the context
+// item, such as the result of ParseJSONBytes. / selects item when it is a
+// map or an array.
+func EvalModuleItem(module *Module, item any, opts EvalOptions) (result []any, err error) {
+	for _, p := range opts.Packs {
+		if err := validatePack(p); err != nil {
+			return nil, err
+		}
+	}
+	for name, fn := range opts.Functions {
+		if err := validateFunction(name, fn); err != nil {
+			return nil, err
+		}
+	}
+	if n, ok := item.(*Node); ok && opts.Profile != nil {
+		item = strippedCopy(n, opts.Profile)
+	}
+	rt := newRuntime(opts)
+	if opts.Metrics != nil {
+		start := time.Now()
+		defer func() {
+			opts.Metrics.ObserveEval(time.Since(start))
+			opts.Metrics.NodesCreated(rt.NodesCreated)
+			if err != nil {
+				opts.Metrics.Error(ErrorCode(err))
+				return
+			}
+			opts.Metrics.DocumentProcessed()
+		}()
+	}
+	if opts.Stats != nil {
+		defer rt.recordStats(time.Now())
+	}
+	defer recoverError(&err, rt)
+	if isJSONItem(item) {
+		rt.input = item
+	}
+	return evalModule(module, item, rt), nil
+}
+
+func newRuntime(opts EvalOptions) *Runtime {
+	for _, p := range opts.Packs {
+		if err := validatePack(p); err != nil {
+			panic(err)
+		}
+	}
+	rt := &Runtime{Options: opts, packs: packFunctions(opts.Packs)}
+	addFunctions(rt.packs, opts.Functions)
+	if opts.Timeout > 0 {
+		rt.deadline = time.Now().Add(opts.Timeout)
+	}
+	if opts.AllowFunctions != nil {
+		rt.allowed = map[string]bool{}
+		for _, name := range opts.AllowFunctions {
+			rt.allowed[name] = true
+		}
+	}
+	return rt
+}
+
+func evalModule(module *Module, doc any, rt *Runtime) []any {
+	rt.bindModule(module)
+	if strictEval(module, rt.Options) {
+		if err := CheckStrict(module, rt.Options.Params); err != nil {
+			panic(err)
+		}
+	}
+	ctx := moduleContext(module, doc, rt)
+	var result []any
+	for _, phase := range module.Phases {
+		result = evalExpr(phase.Expr, ctx)
+		phaseDoc := resultDocument(result, rt)
+		ctx.Variables[phase.Name] = []any{phaseDoc}
+		ctx.ContextItem = phaseDoc
+	}
+	if module.Expr != nil {
+		result = evalExpr(module.Expr, ctx)
+	} else if result == nil {
+		result = []any{}
+	}
+	rt.checkOutputNodes(result)
+	rt.writeResults()
+	return result
+}
+
+// moduleContext binds the functions, rules, parameters and variables of
+// module with doc as the context item.
+func moduleContext(module *Module, doc any, rt *Runtime) Context {
 	functions := map[string]FunctionDef{}
 	for k, v := range module.Functions {
 		functions[k] = v
@@ -26,51 +236,149 @@ func EvalModule(module *Module, doc *Node) []any {
 		rules[k] = v
 	}
 	variables := map[string][]any{}
-	ctx := Context{ContextItem: doc, Variables: variables, Functions: functions, Rules: rules}
+	rt.globals = variables
+	ctx := Context{ContextItem: doc, Variables: variables, Functions: functions, Rules: rules, Runtime: rt}
+	for name, value := range rt.Options.Params {
+		variables[name] = value
+	}
+	for _, param := range module.Params {
+		value, ok := rt.Options.Params[param.Name]
+		switch {
+		case ok:
+			variables[param.Name] = paramValue(param, value)
+		case param.Default != nil:
+			variables[param.Name] = evalExpr(param.Default, ctx)
+		default:
+			panic(fmt.Errorf("XFDY0009: required parameter $%s was not supplied", param.Name))
+		}
+	}
 	for name, expr := range module.Vars {
-		variables[name] = EvalExpr(expr, ctx)
+		if _, ok := rt.Options.Params[name]; ok {
+			continue
+		}
+		variables[name] = evalExpr(expr, ctx)
 	}
-	if module.Expr == nil {
-		return []any{}
+	return ctx
+}
+
+// paramValue converts a supplied value of param: a single string, as the
+// CLI and pipelines pass them, becomes a number or boolean for a param
+// declared with that type.
+func paramValue(param Param, value []any) []any {
+	if param.TypeRef == nil || len(value) != 1 {
+		return value
+	}
+	s, ok := value[0].(string)
+	if !ok {
+		return value
+	}
+	switch *param.TypeRef {
+	case "number":
+		if n, ok := parseNumeric(strings.TrimSpace(s)); ok {
+			return []any{n}
+		}
+		panic(fmt.Errorf("XFDY0002: parameter $%s expects a number, got %q", param.Name, s))
+	case "boolean":
+		switch strings.TrimSpace(s) {
+		case "true", "1":
+			return []any{true}
+		case "false", "0":
+			return []any{false}
+		}
+		panic(fmt.Errorf("XFDY0002: parameter $%s expects a boolean, got %q", param.Name, s))
 	}
-	return EvalExpr(module.Expr, ctx)
+	return value
 }
 
-func EvalExpr(expr Expr, ctx Context) []any {
+// resultDocument wraps a phase result in a fresh document node so the next
+// phase can navigate it with / and // like a parsed input.
+func resultDocument(seq []any, rt *Runtime) *Node {
+	doc := &Node{Kind: "document", Attrs: map[string]string{}}
+	for _, item := range seq {
+		var child *Node
+		if n, ok := item.(*Node); ok {
+			if n.Kind == "document" {
+				for _, c := range n.Children {
+					cp := DeepCopy(c, true)
+					rt.chargeTree(cp)
+					cp.Parent = doc
+					doc.Children = append(doc.Children, cp)
+				}
+				continue
+			}
+			child = DeepCopy(n, true)
+			rt.chargeTree(child)
+		} else {
+			child = &Node{Kind: "text", Value: ToString([]any{item}), Attrs: map[string]string{}}
+			rt.nodeCreated()
+		}
+		child.Parent = doc
+		doc.Children = append(doc.Children, child)
+	}
+	return doc
+}
+
+// EvalExpr evaluates expr in ctx. Evaluation errors are returned as
+// *XFormError.
+func EvalExpr(expr Expr, ctx Context) (result []any, err error) {
+	defer recoverError(&err, ctx.Runtime)
+	return evalExpr(expr, ctx), nil
+}
+
+func evalExpr(expr Expr, ctx Context) []any {
 	switch e := expr.(type) {
 	case Literal:
+		if isNumeric(e.Value) && ctx.Runtime.legacy(CompatDoubles) {
+			return []any{toFloat(e.Value)}
+		}
 		return []any{e.Value}
 	case VarRef:
-		if v, ok := ctx.Variables[e.Name]; ok {
+		if v, ok := lookupVariable(ctx, e.Name, e.Explicit); ok {
 			return v
 		}
-		if _, ok := ctx.Functions[e.Name]; ok {
+		if fn, ok := ctx.Functions[e.Name]; ok {
+			ctx.Runtime.functionReferenced(e.Name, fn)
 			return []any{FunctionRef{Name: e.Name}}
 		}
+		if e.Explicit {
+			panic(undefinedVariable(e.Name))
+		}
 		if node, ok := ctx.ContextItem.(*Node); ok {
 			out := []any{}
 			for _, child := range node.Children {
-				if child.Kind == "element" && child.Name == e.Name {
+				if child.Kind == "element" && ctx.Runtime.nameMatches(e.Name, child) {
 					out = append(out, child)
 				}
 			}
 			return out
 		}
+		if isJSONItem(ctx.ContextItem) {
+			name := e.Name
+			return jsonChildren(ctx.ContextItem, StepTest{Kind: "name", Name: &name})
+		}
 		return []any{}
 	case IfExpr:
-		cond := ToBoolean(EvalExpr(e.Cond, ctx))
+		cond := ToBoolean(evalExpr(e.Cond, ctx))
 		if cond {
-			return EvalExpr(e.ThenExpr, ctx)
+			return evalExpr(e.ThenExpr, ctx)
 		}
-		return EvalExpr(e.ElseExpr, ctx)
+		return evalExpr(e.ElseExpr, ctx)
 	case LetExpr:
-		value := EvalExpr(e.Value, ctx)
+		value := evalExpr(e.Value, ctx)
 		newVars := copyVars(ctx.Variables)
 		newVars[e.Name] = value
-		newCtx := Context{ContextItem: ctx.ContextItem, Variables: newVars, Functions: ctx.Functions, Rules: ctx.Rules, Position: ctx.Position, Last: ctx.Last}
-		return EvalExpr(e.Body, newCtx)
+		newCtx := Context{ContextItem: ctx.ContextItem, Variables: newVars, Functions: ctx.Functions, Rules: ctx.Rules, Position: ctx.Position, Last: ctx.Last, Runtime: ctx.Runtime}
+		return evalExpr(e.Body, newCtx)
+	case TryExpr:
+		return evalTry(e, ctx)
+	case FunctionExpr:
+		def := FunctionDef{Name: "fn", Params: e.Params, Body: e.Body, Line: e.Pos.Line}
+		return []any{&Closure{Def: def, Variables: ctx.Variables}}
 	case ForExpr:
-		seq := EvalExpr(e.Seq, ctx)
+		if len(e.GroupBy) > 0 || len(e.OrderBy) > 0 {
+			return evalForClauses(e, ctx)
+		}
+		seq := evalExpr(e.Seq, ctx)
 		out := []any{}
 		total := len(seq)
 		for idx, item := range seq {
@@ -78,91 +386,156 @@ func EvalExpr(expr Expr, ctx Context) []any {
 			newVars[e.Name] = []any{item}
 			pos := idx + 1
 			last := total
-			newCtx := Context{ContextItem: item, Variables: newVars, Functions: ctx.Functions, Rules: ctx.Rules, Position: &pos, Last: &last}
+			newCtx := Context{ContextItem: item, Variables: newVars, Functions: ctx.Functions, Rules: ctx.Rules, Position: &pos, Last: &last, Runtime: ctx.Runtime}
 			if e.Where != nil {
-				if !ToBoolean(EvalExpr(e.Where, newCtx)) {
+				if !ToBoolean(evalExpr(e.Where, newCtx)) {
 					continue
 				}
 			}
-			out = append(out, EvalExpr(e.Body, newCtx)...)
+			body := evalExpr(e.Body, newCtx)
+			ctx.Runtime.chargeItems(len(body))
+			out = append(out, body...)
 		}
 		return out
 	case MatchExpr:
-		targetSeq := EvalExpr(e.Target, ctx)
+		targetSeq := evalExpr(e.Target, ctx)
 		out := []any{}
 		for _, target := range targetSeq {
 			matchedAny := false
 			for _, c := range e.Cases {
-				matched, bindings := MatchPattern(c.Pattern, target)
+				matched, bindings := matchPattern(c.Pattern, target, ctx.Runtime)
 				if matched {
 					matchedAny = true
 					newVars := copyVars(ctx.Variables)
 					for k, v := range bindings {
 						newVars[k] = v
 					}
-					newCtx := Context{ContextItem: target, Variables: newVars, Functions: ctx.Functions, Rules: ctx.Rules, Position: ctx.Position, Last: ctx.Last}
-					out = append(out, EvalExpr(c.Expr, newCtx)...)
+					newCtx := Context{ContextItem: target, Variables: newVars, Functions: ctx.Functions, Rules: ctx.Rules, Position: ctx.Position, Last: ctx.Last, Runtime: ctx.Runtime}
+					out = append(out, evalExpr(c.Expr, newCtx)...)
 					break
 				}
 			}
 			if !matchedAny {
 				if e.Default == nil {
+					ctx.Runtime.at(e.Pos)
 					panic(fmt.Errorf("XFDY0001: no matching case"))
 				}
-				newCtx := Context{ContextItem: target, Variables: copyVars(ctx.Variables), Functions: ctx.Functions, Rules: ctx.Rules, Position: ctx.Position, Last: ctx.Last}
-				out = append(out, EvalExpr(e.Default, newCtx)...)
+				newCtx := Context{ContextItem: target, Variables: copyVars(ctx.Variables), Functions: ctx.Functions, Rules: ctx.Rules, Position: ctx.Position, Last: ctx.Last, Runtime: ctx.Runtime}
+				out = append(out, evalExpr(e.Default, newCtx)...)
 			}
 		}
 		return out
 	case FuncCall:
 		args := [][]any{}
 		for _, a := range e.Args {
-			args = append(args, EvalExpr(a, ctx))
+			args = append(args, evalExpr(a, ctx))
 		}
+		ctx.Runtime.at(e.Pos)
 		return CallFunction(e.Name, args, ctx)
 	case UnaryOp:
-		val := EvalExpr(e.Expr, ctx)
+		val := evalExpr(e.Expr, ctx)
+		ctx.Runtime.at(e.Pos)
 		if e.Op == "-" {
-			return []any{-ToNumber(val)}
+			return []any{negate(ctx.Runtime.number(val))}
 		}
 		if e.Op == "not" {
 			return []any{!ToBoolean(val)}
 		}
 	case BinaryOp:
 		if e.Op == "and" {
-			left := EvalExpr(e.Left, ctx)
+			left := evalExpr(e.Left, ctx)
 			if !ToBoolean(left) {
 				return []any{false}
 			}
-			right := EvalExpr(e.Right, ctx)
+			right := evalExpr(e.Right, ctx)
 			return []any{ToBoolean(right)}
 		}
 		if e.Op == "or" {
-			left := EvalExpr(e.Left, ctx)
+			left := evalExpr(e.Left, ctx)
 			if ToBoolean(left) {
 				return []any{true}
 			}
-			right := EvalExpr(e.Right, ctx)
+			right := evalExpr(e.Right, ctx)
 			return []any{ToBoolean(right)}
 		}
-		left := EvalExpr(e.Left, ctx)
-		right := EvalExpr(e.Right, ctx)
-		return []any{EvalBinary(e.Op, left, right)}
+		left := evalExpr(e.Left, ctx)
+		right := evalExpr(e.Right, ctx)
+		ctx.Runtime.at(e.Pos)
+		if e.Op == "to" {
+			return rangeItems(left, right, ctx.Runtime)
+		}
+		if isValueComparison(e.Op) {
+			return valueCompare(e.Op, left, right)
+		}
+		if (e.Op == "=" || e.Op == "!=") && ctx.Runtime.legacy(CompatEquality) {
+			return []any{legacyEqual(left, right) == (e.Op == "=")}
+		}
+		return []any{evalBinary(e.Op, left, right, ctx.Runtime)}
 	case PathExpr:
+		ctx.Runtime.at(e.Pos)
 		return EvalPath(e, ctx)
 	case Constructor:
 		return []any{EvalConstructor(e, ctx)}
+	case TextJoin:
+		return []any{evalTextJoin(e, ctx)}
+	case MapConstructor:
+		return evalMapConstructor(e, ctx)
+	case ArrayConstructor:
+		return evalArrayConstructor(e, ctx)
+	case Lookup:
+		return evalLookup(e, ctx)
 	case TextConstructor:
-		return []any{&Node{Kind: "text", Value: ToString(EvalExpr(e.Expr, ctx)), Attrs: map[string]string{}}}
+		ctx.Runtime.nodeCreated()
+		return []any{&Node{Kind: "text", Value: ToString(evalExpr(e.Expr, ctx)), Attrs: map[string]string{}}}
+	case CommentConstructor:
+		return []any{evalCommentConstructor(e, ctx)}
+	case PIConstructor:
+		return []any{evalPIConstructor(e, ctx)}
+	case DocumentConstructor:
+		return []any{evalDocumentConstructor(e, ctx)}
 	case Text:
 		return []any{e.Value}
 	case Interp:
-		return EvalExpr(e.Expr, ctx)
+		return evalExpr(e.Expr, ctx)
+	case Sequence:
+		out := []any{}
+		for _, item := range e.Items {
+			out = append(out, evalExpr(item, ctx)...)
+		}
+		ctx.Runtime.chargeItems(len(out))
+		return out
+	case BadExpr:
+		panic(fmt.Errorf("XFST0001: source that did not parse cannot be evaluated (%s)", e.Pos))
 	}
 	panic(fmt.Errorf("unknown expr"))
 }
 
+// rangeItems evaluates a to b: the integers from a to b, empty when either
+// operand is empty or a > b.
+func rangeItems(left, right []any, rt *Runtime) []any {
+	if len(left) == 0 || len(right) == 0 {
+		return []any{}
+	}
+	from, to := ToNumber(left), ToNumber(right)
+	if from != math.Trunc(from) || to != math.Trunc(to) {
+		panic(fmt.Errorf("XFDY0002: range bounds must be integers, got %s to %s", ToString([]any{from}), ToString([]any{to})))
+	}
+	if to >= from {
+		// Charged up front, so that a huge range fails before it is built.
+		rt.chargeItems(int(math.Min(to-from+1, 1<<40)))
+	}
+	out := []any{}
+	for i := from; i <= to; i++ {
+		out = append(out, int64(i))
+	}
+	return out
+}
+
 func EvalBinary(op string, left []any, right []any) any {
+	return evalBinary(op, left, right, nil)
+}
+
+func evalBinary(op string, left []any, right []any, rt *Runtime) any {
 	if op == "and" {
 		return ToBoolean(left) && ToBoolean(right)
 	}
@@ -173,29 +546,22 @@ func EvalBinary(op string, left []any, right []any) any {
 		return ValueEqual(left, right)
 	}
 	if op == "!=" {
-		return !ValueEqual(left, right)
+		return generalCompare(left, right, false)
+	}
+	if op == "===" {
+		return DeepEqual(left, right)
 	}
-	lnum := ToNumber(left)
-	rnum := ToNumber(right)
+	if (op == "<" || op == "<=" || op == ">" || op == ">=") && !rt.legacy(CompatRelational) {
+		return generalRelational(op, left, right, rt)
+	}
+	lnum := rt.number(left)
+	rnum := rt.number(right)
 	switch op {
-	case "+":
-		return lnum + rnum
-	case "-":
-		return lnum - rnum
-	case "*":
-		return lnum * rnum
-	case "div":
-		return lnum / rnum
-	case "mod":
-		return math.Mod(lnum, rnum)
-	case "<":
-		return lnum < rnum
-	case "<=":
-		return lnum <= rnum
-	case ">":
-		return lnum > rnum
-	case ">=":
-		return lnum >= rnum
+	case "+", "-", "*", "div", "mod":
+		return arithmetic(op, lnum, rnum)
+	case "<", "<=", ">", ">=":
+		c, ok := compareNumbers(lnum, rnum)
+		return ok && relationHolds(op, c)
 	}
 	panic(fmt.Errorf("unknown operator %s", op))
 }
@@ -209,17 +575,19 @@ func EvalPath(expr PathExpr, ctx Context) []any {
 			base = []any{ctx.ContextItem}
 		}
 	case "root":
-		base = rootOf(ctx.ContextItem)
+		base = pathRoot(ctx)
 	case "desc":
 		if ctx.ContextItem != nil {
 			base = []any{ctx.ContextItem}
 		}
 	case "desc_root":
-		base = rootOf(ctx.ContextItem)
+		base = pathRoot(ctx)
 	case "var":
 		if expr.Start.Name != nil {
-			if v, ok := ctx.Variables[*expr.Start.Name]; ok {
+			if v, ok := lookupVariable(ctx, *expr.Start.Name, expr.Start.Explicit); ok {
 				base = v
+			} else if expr.Start.Explicit {
+				panic(undefinedVariable(*expr.Start.Name))
 			} else {
 				if ctx.ContextItem != nil {
 					base = []any{ctx.ContextItem}
@@ -235,6 +603,15 @@ func EvalPath(expr PathExpr, ctx Context) []any {
 	return current
 }
 
+// pathRoot is where / and // start: the root of the context node's
+// document, or the JSON input for maps and arrays.
+func pathRoot(ctx Context) []any {
+	if ctx.Runtime != nil && ctx.Runtime.input != nil && isJSONItem(ctx.ContextItem) {
+		return []any{ctx.Runtime.input}
+	}
+	return rootOf(ctx.ContextItem)
+}
+
 func rootOf(item any) []any {
 	if node, ok := item.(*Node); ok {
 		cur := node
@@ -248,9 +625,14 @@ func rootOf(item any) []any {
 
 func ApplyStep(items []any, step PathStep, ctx Context) []any {
 	out := []any{}
+	jsonItems := false
 	for _, item := range items {
 		node, ok := item.(*Node)
 		if !ok {
+			if isJSONItem(item) {
+				out = append(out, jsonStep(item, step, ctx)...)
+				jsonItems = true
+			}
 			continue
 		}
 		candidates := []*Node{}
@@ -270,48 +652,86 @@ func ApplyStep(items []any, step PathStep, ctx Context) []any {
 			if node.Kind == "element" {
 				if step.Test.Kind == "name" && step.Test.Name != nil {
 					name := *step.Test.Name
-					if val, ok := node.Attrs[name]; ok {
-						candidates = []*Node{{Kind: "attribute", Name: name, Value: val, Attrs: map[string]string{}}}
+					for _, k := range node.AttrNames() {
+						if ctx.Runtime.attrMatches(name, k, node) {
+							candidates = append(candidates, &Node{Kind: "attribute", Name: k, Value: node.Attrs[k], Attrs: map[string]string{}, Parent: node})
+						}
 					}
 				} else if step.Test.Kind == "wildcard" {
-					for k, v := range node.Attrs {
-						candidates = append(candidates, &Node{Kind: "attribute", Name: k, Value: v, Attrs: map[string]string{}})
+					for _, k := range node.AttrNames() {
+						if isNamespaceDecl(k) {
+							continue
+						}
+						candidates = append(candidates, &Node{Kind: "attribute", Name: k, Value: node.Attrs[k], Attrs: map[string]string{}, Parent: node})
 					}
 				}
 			}
 		case "child":
 			candidates = append(candidates, node.Children...)
+		default:
+			candidates = axisNodes(step.Axis, node)
 		}
 
 		filtered := []*Node{}
 		for _, c := range candidates {
-			if matchesStepTest(step.Test, c) {
+			if matchesStepTest(step.Test, c, ctx.Runtime) {
 				filtered = append(filtered, c)
 			}
 		}
 		for _, pred := range step.Predicates {
 			predOut := []*Node{}
+			var counts, seen map[*Node]int
+			if step.Siblings {
+				counts, seen = map[*Node]int{}, map[*Node]int{}
+				for _, c := range filtered {
+					counts[c.Parent]++
+				}
+			}
 			for i, child := range filtered {
 				pos := i + 1
 				last := len(filtered)
-				predCtx := Context{ContextItem: child, Variables: ctx.Variables, Functions: ctx.Functions, Rules: ctx.Rules, Position: &pos, Last: &last}
-				if ToBoolean(EvalExpr(pred, predCtx)) {
+				if step.Siblings {
+					seen[child.Parent]++
+					pos, last = seen[child.Parent], counts[child.Parent]
+				}
+				predCtx := Context{ContextItem: child, Variables: ctx.Variables, Functions: ctx.Functions, Rules: ctx.Rules, Position: &pos, Last: &last, Runtime: ctx.Runtime}
+				if predicateHolds(evalExpr(pred, predCtx), pos, ctx.Runtime) {
 					predOut = append(predOut, child)
 				}
 			}
 			filtered = predOut
 		}
+		if reverseAxes[step.Axis] {
+			for i, j := 0, len(filtered)-1; i < j; i, j = i+1, j-1 {
+				filtered[i], filtered[j] = filtered[j], filtered[i]
+			}
+		}
 		for _, c := range filtered {
 			out = append(out, c)
 		}
 	}
+	if len(items) > 1 && !jsonItems {
+		// The nodes reached from different items may overlap and
+		// interleave, as the descendants of nested elements do.
+		return documentOrder(out, ctx.Runtime)
+	}
 	return out
 }
 
-func matchesStepTest(test StepTest, node *Node) bool {
+// predicateHolds reports whether a predicate with result keeps the item at
+// pos: a number tests the position, as in item[1] and row[last()],
+// anything else its boolean value.
+func predicateHolds(result []any, pos int, rt *Runtime) bool {
+	if len(result) == 1 && isNumeric(result[0]) && !rt.legacy(CompatPredicates) {
+		return toFloat(ToNumeric(result)) == float64(pos)
+	}
+	return ToBoolean(result)
+}
+
+func matchesStepTest(test StepTest, node *Node, rt *Runtime) bool {
 	switch test.Kind {
 	case "wildcard":
-		return node.Kind == "element"
+		return node.Kind == "element" || node.Kind == "attribute"
 	case "text":
 		return node.Kind == "text"
 	case "node":
@@ -324,32 +744,38 @@ func matchesStepTest(test StepTest, node *Node) bool {
 		if test.Name == nil {
 			return false
 		}
-		return node.Name == *test.Name
+		if node.Kind == "attribute" {
+			return rt.attrMatches(*test.Name, node.Name, node.Parent)
+		}
+		return node.Kind == "element" && rt.nameMatches(*test.Name, node)
 	}
 	return false
 }
 
 func EvalConstructor(expr Constructor, ctx Context) *Node {
-	order := make([]string, 0, len(expr.Attrs))
-	node := &Node{Kind: "element", Name: expr.Name, Attrs: map[string]string{}, AttrOrder: order}
+	node := &Node{Kind: "element", Name: expr.Name, Attrs: map[string]string{}, AttrOrder: make([]string, 0, len(expr.Attrs))}
+	ctx.Runtime.nodeCreated()
 	for _, attr := range expr.Attrs {
-		val := EvalExpr(attr.Expr, ctx)
-		node.Attrs[attr.Name] = ToString(val)
-		node.AttrOrder = append(node.AttrOrder, attr.Name)
+		setAttr(node, attr.Name, ToString(evalExpr(attr.Expr, ctx)))
 	}
+	ctx.Runtime.bindConstructed(node, expr.Scope)
 	children := []*Node{}
 	for _, content := range expr.Contents {
 		switch c := content.(type) {
 		case Text:
+			ctx.Runtime.charge(nodeBytes + int64(len(c.Value)))
 			children = append(children, &Node{Kind: "text", Value: c.Value, Attrs: map[string]string{}})
 		default:
-			seq := EvalExpr(content, ctx)
+			seq := evalExpr(content, ctx)
 			for _, item := range seq {
 				if n, ok := item.(*Node); ok {
 					child := DeepCopy(n, true)
+					ctx.Runtime.chargeTree(child)
 					children = append(children, child)
 				} else {
-					children = append(children, &Node{Kind: "text", Value: ToString([]any{item}), Attrs: map[string]string{}})
+					text := ToString([]any{item})
+					ctx.Runtime.charge(nodeBytes + int64(len(text)))
+					children = append(children, &Node{Kind: "text", Value: text, Attrs: map[string]string{}})
 				}
 			}
 		}
@@ -361,21 +787,126 @@ func EvalConstructor(expr Constructor, ctx Context) *Node {
 	return node
 }
 
+// evalCommentConstructor builds the comment of comment { expr }. -- and a
+// final -, which a comment cannot hold, get a space.
+func evalCommentConstructor(e CommentConstructor, ctx Context) *Node {
+	text := strings.ReplaceAll(ToString(evalExpr(e.Expr, ctx)), "--", "- -")
+	if strings.HasSuffix(text, "-") {
+		text += " "
+	}
+	ctx.Runtime.nodeCreated()
+	return &Node{Kind: "comment", Value: text, Attrs: map[string]string{}}
+}
+
+// evalPIConstructor builds the processing instruction of pi(name) { expr }.
+// The target must be a name without prefix other than xml; leading space
+// of the content is dropped and ?> gets a space.
+func evalPIConstructor(e PIConstructor, ctx Context) *Node {
+	name := strings.TrimSpace(ToString(evalExpr(e.Name, ctx)))
+	if !isNCName(name) || strings.EqualFold(name, "xml") {
+		ctx.Runtime.at(e.Pos)
+		panic(fmt.Errorf("XFDY0002: %q is not a processing instruction target", name))
+	}
+	text := strings.TrimLeft(ToString(evalExpr(e.Expr, ctx)), " \t\r\n")
+	ctx.Runtime.nodeCreated()
+	return &Node{Kind: "pi", Name: name, Value: strings.ReplaceAll(text, "?>", "? >"), Attrs: map[string]string{}}
+}
+
+// isNCName reports whether s is an XML name without prefix.
+func isNCName(s string) bool {
+	for i, r := range s {
+		if !(unicode.IsLetter(r) || r == '_' || i > 0 && (isNameRune(r) || r == '.')) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// evalDocumentConstructor builds the document of document { expr }: nodes
+// are copied, a document by its children, and other items become text.
+func evalDocumentConstructor(e DocumentConstructor, ctx Context) *Node {
+	doc := &Node{Kind: "document", Attrs: map[string]string{}}
+	ctx.Runtime.nodeCreated()
+	for _, item := range evalExpr(e.Expr, ctx) {
+		n, ok := item.(*Node)
+		if !ok {
+			text := ToString([]any{item})
+			ctx.Runtime.charge(nodeBytes + int64(len(text)))
+			doc.Children = append(doc.Children, &Node{Kind: "text", Value: text, Attrs: map[string]string{}, Parent: doc})
+			continue
+		}
+		nodes := []*Node{n}
+		switch n.Kind {
+		case "document":
+			nodes = n.Children
+		case "attribute":
+			panic(fmt.Errorf("XFDY0002: a document cannot hold the attribute %s", n.Name))
+		}
+		for _, c := range nodes {
+			child := DeepCopy(c, true)
+			ctx.Runtime.chargeTree(child)
+			child.Parent = doc
+			doc.Children = append(doc.Children, child)
+		}
+	}
+	return doc
+}
+
 type FunctionRef struct{ Name string }
 
 func CallFunction(name string, args [][]any, ctx Context) []any {
+	rt := ctx.Runtime
+	if rt != nil {
+		rt.checkTime()
+	}
 	if fn, ok := ctx.Functions[name]; ok {
+		rt.functionReferenced(name, fn)
 		return callUserFunction(fn, args, ctx)
 	}
 
+	if rt != nil && rt.allowed != nil && !rt.allowed[name] {
+		panic(fmt.Errorf("XFST0007: function %s is not allowed", name))
+	}
 	builtin, ok := builtins[name]
+	if !ok && rt != nil {
+		builtin, ok = rt.packs[name]
+	}
 	if !ok {
 		panic(fmt.Errorf("XFST0003: unknown function %s", name))
 	}
 	return builtin(args, ctx)
 }
 
+// callUserFunction calls fn, looping over the calls its body makes in tail
+// position, so that a tail-recursive function runs in constant Go stack.
+// With a Tracer every call is made, to show up as a frame.
 func callUserFunction(fn FunctionDef, args [][]any, ctx Context) []any {
+	rt := ctx.Runtime
+	rt.descend()
+	defer rt.ascend()
+	if rt.tracing() {
+		newCtx := bindArguments(fn, args, ctx)
+		rt.enter(&Frame{Kind: "function", Name: fn.Name, Line: fn.Line, Context: newCtx})
+		result := evalExpr(fn.Body, newCtx)
+		rt.leave(result)
+		return result
+	}
+	for {
+		result, call := evalTail(fn.Body, bindArguments(fn, args, ctx))
+		if call == nil {
+			return result
+		}
+		if rt != nil {
+			rt.checkTime()
+		}
+		rt.functionReferenced(call.fn.Name, call.fn)
+		fn, args, ctx = call.fn, call.args, call.ctx
+	}
+}
+
+// bindArguments returns the context of fn's body: ctx with the parameters
+// bound to args or their defaults.
+func bindArguments(fn FunctionDef, args [][]any, ctx Context) Context {
 	params := fn.Params
 	if len(args) > len(params) {
 		panic(fmt.Errorf("XFDY0002: wrong arity"))
@@ -390,11 +921,57 @@ func callUserFunction(fn FunctionDef, args [][]any, ctx Context) []any {
 			if param.Default == nil {
 				panic(fmt.Errorf("XFDY0002: wrong arity"))
 			}
-			newVars[param.Name] = EvalExpr(param.Default, ctx)
+			newVars[param.Name] = evalExpr(param.Default, ctx)
+		}
+	}
+	return Context{ContextItem: ctx.ContextItem, Variables: newVars, Functions: ctx.Functions, Rules: ctx.Rules, Position: ctx.Position, Last: ctx.Last, Runtime: ctx.Runtime}
+}
+
+// tailCall is a call of a user function in tail position, made by
+// callUserFunction in a loop rather than by recursion.
+type tailCall struct {
+	fn   FunctionDef
+	args [][]any
+	ctx  Context
+}
+
+// evalTail evaluates the body of a user function like evalExpr, except
+// that a call of a user function in tail position, through if, let and
+// parentheses, is returned with its arguments evaluated instead of made.
+func evalTail(expr Expr, ctx Context) ([]any, *tailCall) {
+	for {
+		switch e := expr.(type) {
+		case IfExpr:
+			if ToBoolean(evalExpr(e.Cond, ctx)) {
+				expr = e.ThenExpr
+			} else {
+				expr = e.ElseExpr
+			}
+			continue
+		case LetExpr:
+			value := evalExpr(e.Value, ctx)
+			newVars := copyVars(ctx.Variables)
+			newVars[e.Name] = value
+			ctx = Context{ContextItem: ctx.ContextItem, Variables: newVars, Functions: ctx.Functions, Rules: ctx.Rules, Position: ctx.Position, Last: ctx.Last, Runtime: ctx.Runtime}
+			expr = e.Body
+			continue
+		case Sequence:
+			if len(e.Items) == 1 {
+				expr = e.Items[0]
+				continue
+			}
+		case FuncCall:
+			if fn, ok := ctx.Functions[e.Name]; ok {
+				args := [][]any{}
+				for _, a := range e.Args {
+					args = append(args, evalExpr(a, ctx))
+				}
+				ctx.Runtime.at(e.Pos)
+				return nil, &tailCall{fn: fn, args: args, ctx: ctx}
+			}
 		}
+		return evalExpr(expr, ctx), nil
 	}
-	newCtx := Context{ContextItem: ctx.ContextItem, Variables: newVars, Functions: ctx.Functions, Rules: ctx.Rules, Position: ctx.Position, Last: ctx.Last}
-	return EvalExpr(fn.Body, newCtx)
 }
 
 func ToBoolean(seq []any) bool {
@@ -416,6 +993,14 @@ func ToBoolean(seq []any) bool {
 			if v != 0 {
 				return true
 			}
+		case int64:
+			if v != 0 {
+				return true
+			}
+		case Decimal:
+			if v.r().Sign() != 0 {
+				return true
+			}
 		case float64:
 			if v != 0.0 {
 				return true
@@ -424,6 +1009,7 @@ func ToBoolean(seq []any) bool {
 			if v != "" {
 				return true
 			}
+		case Null:
 		default:
 			if item != nil {
 				return true
@@ -457,6 +1043,14 @@ func ToString(seq []any) string {
 		return fmt.Sprintf("%v", v)
 	case int:
 		return fmt.Sprintf("%d", v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case Decimal:
+		return v.String()
+	case Null:
+		return ""
+	case map[string][]any, Array:
+		return valueText(v)
 	default:
 		return fmt.Sprintf("%v", v)
 	}
@@ -478,6 +1072,10 @@ func ToNumber(seq []any) float64 {
 		return 0.0
 	case int:
 		return float64(v)
+	case int64:
+		return float64(v)
+	case Decimal:
+		return v.Float64()
 	case float64:
 		return v
 	case string:
@@ -491,16 +1089,18 @@ func ToNumber(seq []any) float64 {
 	}
 }
 
-func ValueEqual(left []any, right []any) bool {
-	return ToString(left) == ToString(right)
+// MatchPattern matches without namespace resolution: element and attribute
+// names compare as written.
+func MatchPattern(pattern Pattern, item any) (bool, map[string][]any) {
+	return matchPattern(pattern, item, nil)
 }
 
-func MatchPattern(pattern Pattern, item any) (bool, map[string][]any) {
+func matchPattern(pattern Pattern, item any, rt *Runtime) (bool, map[string][]any) {
 	switch p := pattern.(type) {
 	case WildcardPattern:
 		return true, map[string][]any{}
 	case AttributePattern:
-		if node, ok := item.(*Node); ok && node.Kind == "attribute" && node.Name == p.Name {
+		if node, ok := item.(*Node); ok && node.Kind == "attribute" && rt.attrMatches(p.Name, node.Name, node.Parent) {
 			return true, map[string][]any{}
 		}
 		return false, map[string][]any{}
@@ -520,7 +1120,7 @@ func MatchPattern(pattern Pattern, item any) (bool, map[string][]any) {
 		}
 		return false, map[string][]any{}
 	case ElementPattern:
-		if node, ok := item.(*Node); ok && node.Kind == "element" && node.Name == p.Name {
+		if node, ok := item.(*Node); ok && node.Kind == "element" && rt.nameMatches(p.Name, node) {
 			bindings := map[string][]any{}
 			if p.Var != nil {
 				children := []any{}
@@ -532,7 +1132,7 @@ func MatchPattern(pattern Pattern, item any) (bool, map[string][]any) {
 			}
 			if p.Child != nil {
 				for _, child := range node.Children {
-					matched, childBindings := MatchPattern(p.Child, child)
+					matched, childBindings := matchPattern(p.Child, child, rt)
 					if matched {
 						for k, v := range childBindings {
 							bindings[k] = v
@@ -551,8 +1151,6 @@ func MatchPattern(pattern Pattern, item any) (bool, map[string][]any) {
 
 // Builtins
 
-type builtinFn func(args [][]any, ctx Context) []any
-
 func fnString(args [][]any, _ Context) []any  { return []any{ToString(firstOrEmpty(args))} }
 func fnNumber(args [][]any, _ Context) []any  { return []any{ToNumber(firstOrEmpty(args))} }
 func fnBoolean(args [][]any, _ Context) []any { return []any{ToBoolean(firstOrEmpty(args))} }
@@ -565,13 +1163,23 @@ func fnTypeOf(args [][]any, _ Context) []any {
 	if _, ok := item.(*Node); ok {
 		return []any{"node"}
 	}
-	if _, ok := item.(map[string][]any); ok {
-		return []any{"map"}
-	}
 	switch item.(type) {
+	case map[string][]any, *Index:
+		return []any{"map"}
+	case Array:
+		return []any{"array"}
+	case DateTime:
+		if item.(DateTime).Date {
+			return []any{"date"}
+		}
+		return []any{"dateTime"}
+	case FunctionRef, *Closure:
+		return []any{"function"}
+	case Null:
+		return []any{"null"}
 	case bool:
 		return []any{"boolean"}
-	case int, float64:
+	case int, int64, float64, Decimal:
 		return []any{"number"}
 	case nil:
 		return []any{"null"}
@@ -590,6 +1198,33 @@ func fnName(args [][]any, _ Context) []any {
 	return []any{""}
 }
 
+func fnLocalName(args [][]any, _ Context) []any {
+	if len(args) > 0 && len(args[0]) > 0 {
+		if node, ok := args[0][0].(*Node); ok {
+			return []any{node.LocalName()}
+		}
+	}
+	return []any{""}
+}
+
+// fnNamespaceURI returns the namespace of an element, or of an attribute
+// as bound on its element.
+func fnNamespaceURI(args [][]any, _ Context) []any {
+	if len(args) > 0 && len(args[0]) > 0 {
+		if node, ok := args[0][0].(*Node); ok {
+			if node.Kind == "attribute" && node.Parent != nil {
+				if prefix := node.Prefix(); prefix != "" {
+					uri, _ := node.Parent.LookupNamespace(prefix)
+					return []any{uri}
+				}
+				return []any{""}
+			}
+			return []any{node.Namespace}
+		}
+	}
+	return []any{""}
+}
+
 func fnAttr(args [][]any, _ Context) []any {
 	if len(args) == 0 || len(args[0]) == 0 {
 		return []any{""}
@@ -646,7 +1281,7 @@ func fnChildren(args [][]any, _ Context) []any {
 	return []any{}
 }
 
-func fnElements(args [][]any, _ Context) []any {
+func fnElements(args [][]any, ctx Context) []any {
 	if len(args) == 0 || len(args[0]) == 0 {
 		return []any{}
 	}
@@ -661,7 +1296,7 @@ func fnElements(args [][]any, _ Context) []any {
 	out := []any{}
 	for _, c := range node.Children {
 		if c.Kind == "element" {
-			if nameTest == "" || c.Name == nameTest {
+			if nameTest == "" || ctx.Runtime.nameMatches(nameTest, c) {
 				out = append(out, c)
 			}
 		}
@@ -669,7 +1304,7 @@ func fnElements(args [][]any, _ Context) []any {
 	return out
 }
 
-func fnCopy(args [][]any, _ Context) []any {
+func fnCopy(args [][]any, ctx Context) []any {
 	if len(args) == 0 || len(args[0]) == 0 {
 		return []any{}
 	}
@@ -681,14 +1316,16 @@ func fnCopy(args [][]any, _ Context) []any {
 	if len(args) > 1 {
 		recurse = ToBoolean(args[1])
 	}
-	return []any{DeepCopy(node, recurse)}
+	copied := DeepCopy(node, recurse)
+	ctx.Runtime.chargeTree(copied)
+	return []any{copied}
 }
 
 func fnCount(args [][]any, _ Context) []any {
 	if len(args) == 0 {
-		return []any{float64(0)}
+		return []any{int64(0)}
 	}
-	return []any{float64(len(args[0]))}
+	return []any{int64(len(args[0]))}
 }
 
 func fnEmpty(args [][]any, _ Context) []any {
@@ -698,14 +1335,20 @@ func fnEmpty(args [][]any, _ Context) []any {
 	return []any{len(args[0]) == 0}
 }
 
-func fnDistinct(args [][]any, _ Context) []any {
+// fnDistinct is distinct(seq, key?): the first item of seq for each string
+// value, or for each key.
+func fnDistinct(args [][]any, ctx Context) []any {
 	if len(args) == 0 {
 		return []any{}
 	}
+	keyOf := keyFunction(args, 1, ctx, "distinct")
 	seen := map[string]bool{}
 	out := []any{}
 	for _, item := range args[0] {
 		key := ToString([]any{item})
+		if keyOf != nil {
+			key = ToString(keyOf(item))
+		}
 		if seen[key] {
 			continue
 		}
@@ -720,19 +1363,11 @@ func fnSort(args [][]any, ctx Context) []any {
 		return []any{}
 	}
 	seq := args[0]
-	keyFn := ""
-	if len(args) > 1 && len(args[1]) > 0 {
-		if ref, ok := args[1][0].(FunctionRef); ok {
-			keyFn = ref.Name
-		}
-	}
+	keyOf := keyFunction(args, 1, ctx, "sort")
 	out := append([]any{}, seq...)
 	sort.Slice(out, func(i, j int) bool {
-		if keyFn != "" {
-			fn := ctx.Functions[keyFn]
-			ki := ToString(callUserFunction(fn, [][]any{{out[i]}}, ctx))
-			kj := ToString(callUserFunction(fn, [][]any{{out[j]}}, ctx))
-			return ki < kj
+		if keyOf != nil {
+			return ToString(keyOf(out[i])) < ToString(keyOf(out[j]))
 		}
 		return ToString([]any{out[i]}) < ToString([]any{out[j]})
 	})
@@ -766,7 +1401,7 @@ func fnLast(args [][]any, ctx Context) []any {
 		if ctx.Last == nil {
 			return []any{}
 		}
-		return []any{float64(*ctx.Last)}
+		return []any{int64(*ctx.Last)}
 	}
 	seq := args[0]
 	if len(seq) == 0 {
@@ -775,61 +1410,17 @@ func fnLast(args [][]any, ctx Context) []any {
 	return []any{seq[len(seq)-1]}
 }
 
-func fnIndex(args [][]any, ctx Context) []any {
-	if len(args) == 0 {
-		return []any{}
-	}
-	seq := args[0]
-	keyFn := ""
-	if len(args) > 1 && len(args[1]) > 0 {
-		if ref, ok := args[1][0].(FunctionRef); ok {
-			keyFn = ref.Name
-		}
-	}
-	index := map[string][]any{}
-	for _, item := range seq {
-		key := ToString([]any{item})
-		if keyFn != "" {
-			fn := ctx.Functions[keyFn]
-			key = ToString(callUserFunction(fn, [][]any{{item}}, ctx))
-		}
-		index[key] = append(index[key], item)
-	}
-	return []any{index}
-}
-
-func fnLookup(args [][]any, _ Context) []any {
-	if len(args) < 2 {
-		return []any{}
-	}
-	if len(args[0]) == 0 {
-		return []any{}
-	}
-	mapping, ok := args[0][0].(map[string][]any)
-	if !ok {
-		return []any{}
-	}
-	key := ToString(args[1])
-	return mapping[key]
-}
-
 func fnGroupBy(args [][]any, ctx Context) []any {
 	if len(args) < 2 {
 		return []any{}
 	}
 	seq := args[0]
-	keyFn := ""
-	if len(args[1]) > 0 {
-		if ref, ok := args[1][0].(FunctionRef); ok {
-			keyFn = ref.Name
-		}
-	}
+	keyOf := keyFunction(args, 1, ctx, "groupBy")
 	groups := map[string][]any{}
 	for _, item := range seq {
 		key := ToString([]any{item})
-		if keyFn != "" {
-			fn := ctx.Functions[keyFn]
-			key = ToString(callUserFunction(fn, [][]any{{item}}, ctx))
+		if keyOf != nil {
+			key = ToString(keyOf(item))
 		}
 		groups[key] = append(groups[key], item)
 	}
@@ -852,7 +1443,7 @@ func fnPosition(_ [][]any, ctx Context) []any {
 	if ctx.Position == nil {
 		return []any{}
 	}
-	return []any{float64(*ctx.Position)}
+	return []any{int64(*ctx.Position)}
 }
 
 func fnApply(args [][]any, ctx Context) []any {
@@ -860,74 +1451,328 @@ func fnApply(args [][]any, ctx Context) []any {
 		return []any{}
 	}
 	seq := args[0]
-	ruleset := "main"
+	ruleset, mode := "main", ""
 	if len(args) > 1 && len(args[1]) > 0 {
 		ruleset = ToString(args[1])
 	}
+	if len(args) > 2 {
+		mode = ToString(args[2])
+	}
+	if ctx.Runtime.legacy(CompatNoMatch) {
+		return applyRules(seq, ruleset, mode, ctx, func(any) []any {
+			panic(fmt.Errorf("XFDY0001: no matching rule"))
+		})
+	}
+	b := &builtinRules{ruleset: ruleset, mode: mode, copyElements: true, ctx: ctx, originals: map[*Node]*Node{}}
+	return b.finish(b.apply(seq))
+}
+
+// applyRules fires, for each item of seq, the rule of ruleset in mode
+// that matches it with the highest priority, and calls unmatched for the
+// items no rule matches.
+func applyRules(seq []any, ruleset, mode string, ctx Context, unmatched func(item any) []any) []any {
 	rules := ctx.Rules[ruleset]
+	order := ctx.Runtime.ruleOrder(ruleset, mode, rules)
 	out := []any{}
 	for _, item := range seq {
 		matched := false
-		for _, rule := range rules {
-			ok, bindings := MatchPattern(rule.Pattern, item)
+		for _, idx := range order {
+			rule := rules[idx]
+			ok, bindings := matchPattern(rule.Pattern, item, ctx.Runtime)
 			if ok {
 				matched = true
+				ctx.Runtime.ruleFired(ruleset, idx, rule)
 				newVars := copyVars(ctx.Variables)
 				for k, v := range bindings {
 					newVars[k] = v
 				}
-				newCtx := Context{ContextItem: item, Variables: newVars, Functions: ctx.Functions, Rules: ctx.Rules, Position: ctx.Position, Last: ctx.Last}
-				out = append(out, EvalExpr(rule.Body, newCtx)...)
+				bindRuleVariables(newVars, item, bindings)
+				newCtx := Context{ContextItem: item, Variables: newVars, Functions: ctx.Functions, Rules: ctx.Rules, Position: ctx.Position, Last: ctx.Last, Runtime: ctx.Runtime}
+				out = append(out, fireRule(ruleset, rule, newCtx)...)
 				break
 			}
 		}
 		if !matched {
-			panic(fmt.Errorf("XFDY0001: no matching rule"))
+			out = append(out, unmatched(item)...)
 		}
 	}
 	return out
 }
 
-func fnSum(args [][]any, _ Context) []any {
+// ruleOrder returns the indexes of the rules of a set in mode, by
+// descending priority and then in declaration order. It is computed once
+// per set and mode and evaluation.
+func (rt *Runtime) ruleOrder(ruleset, mode string, rules []RuleDef) []int {
+	key := ruleset + "\x00" + mode
+	if rt != nil {
+		if order, ok := rt.ruleOrders[key]; ok {
+			return order
+		}
+	}
+	order := []int{}
+	for idx, rule := range rules {
+		if rule.Mode == mode {
+			order = append(order, idx)
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return rules[order[i]].Priority > rules[order[j]].Priority
+	})
+	if rt != nil {
+		if rt.ruleOrders == nil {
+			rt.ruleOrders = map[string][]int{}
+		}
+		rt.ruleOrders[key] = order
+	}
+	return order
+}
+
+// ruleVariables are bound in rule bodies besides the pattern's captures:
+// the matched item, its name, its attributes as a map and the captures as
+// a map. They are stored under "$" keys, reachable only as $node etc., so
+// that node or name without $ still select child elements.
+var ruleVariables = []string{"node", "name", "attrs", "captures"}
+
+func bindRuleVariables(vars map[string][]any, item any, bindings map[string][]any) {
+	name := ""
+	attrs := map[string][]any{}
+	if n, ok := item.(*Node); ok {
+		if n.Kind == "element" || n.Kind == "attribute" {
+			name = n.Name
+		}
+		if n.Kind == "element" {
+			for _, k := range n.AttrNames() {
+				if !isNamespaceDecl(k) {
+					attrs[k] = []any{n.Attrs[k]}
+				}
+			}
+		}
+	}
+	captures := make(map[string][]any, len(bindings))
+	for k, v := range bindings {
+		captures[k] = v
+	}
+	vars["$node"] = []any{item}
+	vars["$name"] = []any{name}
+	vars["$attrs"] = []any{attrs}
+	vars["$captures"] = []any{captures}
+}
+
+// lookupVariable resolves a variable reference; $name also finds the
+// rule variables, which a binding of the same name shadows.
+func lookupVariable(ctx Context, name string, explicit bool) ([]any, bool) {
+	if v, ok := ctx.Variables[name]; ok {
+		return v, true
+	}
+	if explicit {
+		v, ok := ctx.Variables["$"+name]
+		return v, ok
+	}
+	return nil, false
+}
+
+// fireRule evaluates the body of a matching rule, reporting the firing to
+// the tracer and annotating its output with provenance when enabled.
+func fireRule(ruleset string, rule RuleDef, ctx Context) []any {
+	rt := ctx.Runtime
+	rt.descend()
+	defer rt.ascend()
+	if !rt.tracing() && !rt.annotating() {
+		return evalExpr(rule.Body, ctx)
+	}
+	if rt.tracing() {
+		rt.enter(&Frame{Kind: "rule", Name: ruleset, Line: rule.Line, Pattern: patternString(rule.Pattern), Context: ctx})
+	}
+	result := evalExpr(rule.Body, ctx)
+	if rt.annotating() {
+		annotateProvenance(result, ctx.ContextItem, ruleset, rule)
+	}
+	if rt.tracing() {
+		rt.leave(result)
+	}
+	return result
+}
+
+func fnSum(args [][]any, ctx Context) []any {
 	if len(args) == 0 {
-		return []any{0.0}
+		return []any{int64(0)}
 	}
-	total := 0.0
+	var total any = int64(0)
 	for _, item := range args[0] {
-		total += ToNumber([]any{item})
+		total = arithmetic("+", total, ctx.Runtime.number([]any{item}))
 	}
 	return []any{total}
 }
 
-var builtins map[string]builtinFn
+// keyFunction returns the key passed as args[i], if any: a function item
+// called with each item, or a string such as "@date" or "author/name"
+// parsed as a path and evaluated with each item as the context item. Key
+// paths see the module's functions but no variables, so "title" always
+// selects title children.
+func keyFunction(args [][]any, i int, ctx Context, caller string) func(item any) []any {
+	if i >= len(args) || len(args[i]) == 0 {
+		return nil
+	}
+	switch key := args[i][0].(type) {
+	case FunctionRef, *Closure:
+		return func(item any) []any { return callFunctionItem(key, [][]any{{item}}, ctx) }
+	case string:
+		expr, err := parseStandalone("key path", key)
+		if err != nil {
+			panic(err)
+		}
+		keyCtx := Context{Variables: map[string][]any{}, Functions: ctx.Functions, Rules: ctx.Rules, Runtime: ctx.Runtime}
+		return func(item any) []any {
+			keyCtx.ContextItem = item
+			return evalExpr(expr, keyCtx)
+		}
+	}
+	panic(fmt.Errorf("XFDY0002: %s() expects a function or a key path", caller))
+}
+
+func fnSumBy(args [][]any, ctx Context) []any {
+	if len(args) == 0 {
+		return []any{int64(0)}
+	}
+	key := keyFunction(args, 1, ctx, "sumBy")
+	var total any = int64(0)
+	for _, item := range args[0] {
+		value := []any{item}
+		if key != nil {
+			value = key(item)
+		}
+		total = arithmetic("+", total, ctx.Runtime.number(value))
+	}
+	return []any{total}
+}
+
+func fnCountBy(args [][]any, ctx Context) []any {
+	if len(args) == 0 {
+		return []any{map[string][]any{}}
+	}
+	keyOf := keyFunction(args, 1, ctx, "countBy")
+	counts := map[string]int64{}
+	for _, item := range args[0] {
+		key := ToString([]any{item})
+		if keyOf != nil {
+			key = ToString(keyOf(item))
+		}
+		counts[key]++
+	}
+	out := map[string][]any{}
+	for k, n := range counts {
+		out[k] = []any{n}
+	}
+	return []any{out}
+}
+
+func fnProduct(args [][]any, ctx Context) []any {
+	if len(args) == 0 {
+		return []any{int64(1)}
+	}
+	var total any = int64(1)
+	for _, item := range args[0] {
+		total = arithmetic("*", total, ctx.Runtime.number([]any{item}))
+	}
+	return []any{total}
+}
+
+var builtins map[string]BuiltinFunc
 
 func init() {
-	builtins = map[string]builtinFn{
-		"string":   fnString,
-		"number":   fnNumber,
-		"boolean":  fnBoolean,
-		"typeOf":   fnTypeOf,
-		"name":     fnName,
-		"attr":     fnAttr,
-		"text":     fnText,
-		"children": fnChildren,
-		"elements": fnElements,
-		"copy":     fnCopy,
-		"count":    fnCount,
-		"empty":    fnEmpty,
-		"distinct": fnDistinct,
-		"sort":     fnSort,
-		"concat":   fnConcat,
-		"index":    fnIndex,
-		"lookup":   fnLookup,
-		"groupBy":  fnGroupBy,
-		"seq":      fnSeq,
-		"sum":      fnSum,
-		"head":     fnHead,
-		"tail":     fnTail,
-		"last":     fnLast,
-		"position": fnPosition,
-		"apply":    fnApply,
+	builtins = map[string]BuiltinFunc{
+		"string":       fnString,
+		"number":       fnNumber,
+		"boolean":      fnBoolean,
+		"typeOf":       fnTypeOf,
+		"name":         fnName,
+		"localName":    fnLocalName,
+		"namespaceUri": fnNamespaceURI,
+		"attr":         fnAttr,
+		"text":         fnText,
+		"children":     fnChildren,
+		"elements":     fnElements,
+		"copy":         fnCopy,
+		"count":        fnCount,
+		"deepEqual":    fnDeepEqual,
+		"empty":        fnEmpty,
+		"distinct":     fnDistinct,
+		"docOrder":     fnDocOrder,
+		"unordered":    fnUnordered,
+		"sort":         fnSort,
+		"concat":       fnConcat,
+		"index":        fnIndex,
+		"lookup":       fnLookup,
+		"lookupAll":    fnLookupAll,
+		"keys":         fnKeys,
+		"groupBy":      fnGroupBy,
+		"call":         fnCall,
+		"map":          fnMap,
+		"filter":       fnFilter,
+		"fold":         fnFold,
+		"seq":          fnSeq,
+		"sum":          fnSum,
+		"sumBy":        fnSumBy,
+		"countBy":      fnCountBy,
+		"product":      fnProduct,
+		"slugify":      fnSlugify,
+		"levenshtein":  fnLevenshtein,
+		"soundex":      fnSoundex,
+		"soundsLike":   fnSoundsLike,
+		"lang":         fnLang,
+		"upperCase":    fnUpperCase,
+		"lowerCase":    fnLowerCase,
+		"matches":      fnMatches,
+		"replace":      fnReplace,
+		"tokenize":     fnTokenize,
+		"formatDate":   fnFormatDate,
+		"formatNumber": fnFormatNumber,
+		"id":           fnID,
+		"checkIds":     fnCheckIDs,
+		"head":         fnHead,
+		"tail":         fnTail,
+		"last":         fnLast,
+		"position":     fnPosition,
+		"apply":        fnApply,
+		"applyDeep":    fnApplyDeep,
+		"doc":          fnDoc,
+		"collection":   fnCollection,
+		"isInline":     fnIsInline,
+		"isBlock":      fnIsBlock,
+		"diff":         fnDiff,
+		"patch":        fnPatch,
+		"assert":       fnAssert,
+		"report":       fnReport,
+
+		"substring":      fnSubstring,
+		"stringLength":   fnStringLength,
+		"contains":       fnContains,
+		"startsWith":     fnStartsWith,
+		"endsWith":       fnEndsWith,
+		"normalizeSpace": fnNormalizeSpace,
+		"trim":           fnTrim,
+		"split":          fnSplit,
+		"join":           fnJoin,
+		"padLeft":        fnPadLeft,
+		"padRight":       fnPadRight,
+
+		"decimal": fnDecimal,
+
+		"resultDocument": fnResultDocument,
+		"functions":      fnFunctions,
+
+		"mapKeys":   fnMapKeys,
+		"mapPut":    fnMapPut,
+		"mapMerge":  fnMapMerge,
+		"mapRemove": fnMapRemove,
+		"arraySize": fnArraySize,
+		"arrayGet":  fnArrayGet,
+
+		"currentDate":     fnCurrentDate,
+		"currentDateTime": fnCurrentDateTime,
+		"parseDate":       fnParseDate,
+		"addDuration":     fnAddDuration,
+		"dateDiff":        fnDateDiff,
 	}
 }
 
@@ -952,3 +1797,10 @@ func SerializeItem(item any) string {
 	}
 	return ToString([]any{item})
 }
+
+func SerializeItemWith(item any, opts SerializeOptions) string {
+	if node, ok := item.(*Node); ok {
+		return SerializeWith(node, opts)
+	}
+	return ToString([]any{item})
+}
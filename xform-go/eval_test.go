@@ -0,0 +1,43 @@
+package xform
+
+import "testing"
+
+const ruleXML = `<r><item id="1" xmlns:p="urn:p" p:a="b"><name>N</name></item></r>`
+
+func TestRuleVariables(t *testing.T) {
+	tests := []struct{ rule, want string }{
+		{`match <item/> := string($node/@id)`, "1"},
+		{`match <item/> := $name`, "item"},
+		{`match <item/> := join(mapKeys($attrs), ",")`, "id,p:a"},
+		{`match <item/> := lookup($attrs, "p:a")`, "b"},
+		{`match <item>{body}</item> := (string($captures.body), "|", string(body))`, "N|N"},
+		{`match <item/> := count(mapKeys($captures))`, "0"},
+		{`match <item/> := let $name := "mine" in $name`, "mine"},
+		{`match <item/> := name`, "<name>N</name>"},
+		{`match <item/> := $node/name`, "<name>N</name>"},
+	}
+	for _, tt := range tests {
+		src := "rule main " + tt.rule + ";\n<out>{apply(/r/*)}</out>"
+		if got, want := run(t, src, ruleXML), "<out>"+tt.want+"</out>"; got != want {
+			t.Errorf("%s = %q, want %q", tt.rule, got, want)
+		}
+	}
+}
+
+func TestRuleVariablesOfText(t *testing.T) {
+	src := "rule main match text() := <t n={$name}>{$node}</t>;\n<out>{apply(/r/item/text())}</out>"
+	want := `<out><t n="">a</t><t n="">b</t><t n="">c</t></out>`
+	if got := run(t, src, itemsXML); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRuleVariablesStrict(t *testing.T) {
+	prog, err := Compile("rule main match <item/> := <x n={$name} a={$attrs.id}>{($node/name, count(mapKeys($captures)))}</x>;\napply(/r/*)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckStrict(prog.Module, nil); err != nil {
+		t.Fatalf("CheckStrict: %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package xform
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Select evaluates the path expression against doc and returns the selected
+// elements in document order. An element inside another selected element is
+// dropped, so the results are disjoint subtrees.
+func Select(doc *Node, path string) ([]*Node, error) {
+	expr, err := parsePathSafe(path)
+	if err != nil {
+		return nil, err
+	}
+	return selectNodes(doc, path, expr)
+}
+
+// Extract returns a copy of every subtree selected by path, each wrapped in
+// its own document node so that / and // navigate within the subtree.
+func Extract(doc *Node, path string) ([]*Node, error) {
+	nodes, err := Select(doc, path)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*Node, len(nodes))
+	for i, n := range nodes {
+		out[i] = resultDocument([]any{n}, nil)
+	}
+	return out, nil
+}
+
+// EvalSelected transforms only the subtrees of doc selected by path. Each
+// subtree is evaluated on its own, as the single child of a document, and
+// replaced by the result; everything else is copied unchanged, stripped as
+// opts.Profile asks. doc itself is not modified. Path and evaluation errors
+// are returned.
+func EvalSelected(module *Module, doc *Node, path string, opts EvalOptions) (*Node, error) {
+	return evalSelected(doc, path, opts.Profile, func(sub *Node) ([]any, error) { return EvalModuleWithOptions(module, sub, opts) })
+}
+
+// EvalSelected is EvalSelected for the program's main module.
+func (p *Program) EvalSelected(doc *Node, path string, opts EvalOptions) (*Node, error) {
+	return evalSelected(doc, path, opts.Profile, func(sub *Node) ([]any, error) { return p.Eval(sub, opts) })
+}
+
+func evalSelected(doc *Node, path string, profile *Profile, eval func(*Node) ([]any, error)) (*Node, error) {
+	expr, err := parsePathSafe(path)
+	if err != nil {
+		return nil, err
+	}
+	out := DeepCopy(doc, true)
+	if profile != nil {
+		StripWhitespace(out, profile)
+	}
+	nodes, err := selectNodes(out, path, expr)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
+		seq, err := eval(resultDocument([]any{n}, nil))
+		if err != nil {
+			return nil, err
+		}
+		result := resultDocument(seq, nil)
+		parent := n.Parent
+		children := []*Node{}
+		for _, c := range parent.Children {
+			if c != n {
+				children = append(children, c)
+				continue
+			}
+			for _, r := range result.Children {
+				r.Parent = parent
+				children = append(children, r)
+			}
+		}
+		parent.Children = children
+	}
+	return out, nil
+}
+
+func parsePathSafe(path string) (Expr, error) {
+	return parseStandalone("select path", path)
+}
+
+// parseStandalone parses src, a path or expression given outside a
+// module, such as a select path or a key path.
+func parseStandalone(what, src string) (expr Expr, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			code, msg := ErrorCode(r), fmt.Sprint(r)
+			if code == "unknown" {
+				code = "XFST0001"
+			} else {
+				msg = strings.TrimSpace(strings.TrimPrefix(msg, code+":"))
+			}
+			err = fmt.Errorf("%s: invalid %s %q: %s", code, what, src, msg)
+		}
+	}()
+	p := NewParser(src)
+	expr = p.parseExpr()
+	if tok := p.lexer.Peek(); tok.Kind != TokEOF {
+		return nil, fmt.Errorf("XFST0001: invalid %s %q: unexpected token at %d", what, src, tok.Pos)
+	}
+	return expr, nil
+}
+
+func selectNodes(doc *Node, path string, expr Expr) (nodes []*Node, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	rt := newRuntime(EvalOptions{})
+	ctx := Context{ContextItem: doc, Variables: map[string][]any{}, Functions: map[string]FunctionDef{}, Rules: map[string][]RuleDef{}, Runtime: rt}
+	selected := map[*Node]bool{}
+	for _, item := range evalExpr(expr, ctx) {
+		n, ok := item.(*Node)
+		if !ok || n.Kind != "element" {
+			return nil, fmt.Errorf("XFDY0002: select path %q must select elements", path)
+		}
+		selected[n] = true
+	}
+	for _, n := range IterDescendants(doc) {
+		if !selected[n] {
+			continue
+		}
+		nested := false
+		for p := n.Parent; p != nil; p = p.Parent {
+			if selected[p] {
+				nested = true
+				break
+			}
+		}
+		if !nested {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes, nil
+}
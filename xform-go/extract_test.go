@@ -0,0 +1,31 @@
+package xform
+
+import "testing"
+
+const prologXML = "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<!-- head -->\n<?style x?>\n<r>\n  <a>1</a>\n  <b>2</b>\n</r>\n<!-- tail -->\n"
+
+func TestEvalSelectedKeepsProlog(t *testing.T) {
+	doc, err := ParseXMLBytesWith([]byte(prologXML), ParseOptions{Prolog: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<!-- head -->\n<?style x?>\n<r>\n  <a>1</a>\n  <b>2</b>\n</r>\n<!-- tail -->"
+	if got := Serialize(doc); got != want {
+		t.Errorf("parsed with Prolog = %q, want %q", got, want)
+	}
+	prog, err := Compile(`<A>{string(/a)}</A>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := prog.EvalSelected(doc, "//a", EvalOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<!-- head -->\n<?style x?>\n<r>\n  <A>1</A>\n  <b>2</b>\n</r>\n<!-- tail -->"
+	if got := Serialize(out); got != want {
+		t.Errorf("selected = %q, want %q", got, want)
+	}
+	if got := run(t, `count(/node())`, prologXML); got != "1" {
+		t.Errorf("without Prolog count(/node()) = %s, want 1", got)
+	}
+}
@@ -0,0 +1,192 @@
+package xform
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// forTuple is one evaluation of a for body: its variables, its context
+// item and its position before sorting.
+type forTuple struct {
+	vars map[string][]any
+	item any
+	pos  int
+}
+
+// evalForClauses evaluates a for expression with group by or order by
+// clauses: for $x in seq where cond group by $k := key order by key
+// return body. With group by the body runs once per group, in the order
+// in which the groups first occur, with each $k bound to the group's key
+// and $x to all of its items; the context item is the group's first item,
+// and position() and last() count groups. order by then sorts the
+// iterations or groups, and position() follows the sorted order.
+func evalForClauses(e ForExpr, ctx Context) []any {
+	var tuples []forTuple
+	if len(e.GroupBy) > 0 {
+		tuples = groupTuples(e, ctx)
+	} else {
+		seq := evalExpr(e.Seq, ctx)
+		total := len(seq)
+		for idx, item := range seq {
+			newVars := copyVars(ctx.Variables)
+			newVars[e.Name] = []any{item}
+			pos := idx + 1
+			last := total
+			newCtx := Context{ContextItem: item, Variables: newVars, Functions: ctx.Functions, Rules: ctx.Rules, Position: &pos, Last: &last, Runtime: ctx.Runtime}
+			if e.Where != nil && !ToBoolean(evalExpr(e.Where, newCtx)) {
+				continue
+			}
+			tuples = append(tuples, forTuple{vars: newVars, item: item, pos: pos})
+		}
+	}
+	if len(e.OrderBy) > 0 {
+		orderTuples(tuples, e.OrderBy, ctx)
+	}
+	out := []any{}
+	for i, t := range tuples {
+		pos := i + 1
+		last := len(tuples)
+		newCtx := Context{ContextItem: t.item, Variables: t.vars, Functions: ctx.Functions, Rules: ctx.Rules, Position: &pos, Last: &last, Runtime: ctx.Runtime}
+		body := evalExpr(e.Body, newCtx)
+		ctx.Runtime.chargeItems(len(body))
+		out = append(out, body...)
+	}
+	return out
+}
+
+// groupTuples evaluates the where and group by clauses of e and returns
+// a tuple per group.
+func groupTuples(e ForExpr, ctx Context) []forTuple {
+	type group struct {
+		keys  [][]any
+		items []any
+	}
+	groups := []*group{}
+	byKey := map[string]*group{}
+	seq := evalExpr(e.Seq, ctx)
+	total := len(seq)
+	for idx, item := range seq {
+		newVars := copyVars(ctx.Variables)
+		newVars[e.Name] = []any{item}
+		pos := idx + 1
+		last := total
+		newCtx := Context{ContextItem: item, Variables: newVars, Functions: ctx.Functions, Rules: ctx.Rules, Position: &pos, Last: &last, Runtime: ctx.Runtime}
+		if e.Where != nil && !ToBoolean(evalExpr(e.Where, newCtx)) {
+			continue
+		}
+		keys := make([][]any, len(e.GroupBy))
+		id := &strings.Builder{}
+		for i, k := range e.GroupBy {
+			keys[i] = singleKey(evalExpr(k.Expr, newCtx), "group by key $"+k.Name)
+			// Keys compare by string value; an empty key is a group of its
+			// own, apart from "".
+			if len(keys[i]) == 0 {
+				id.WriteString("\x01")
+			} else {
+				id.WriteString("\x02" + ToString(keys[i]))
+			}
+			id.WriteString("\x00")
+		}
+		g := byKey[id.String()]
+		if g == nil {
+			g = &group{keys: keys}
+			byKey[id.String()] = g
+			groups = append(groups, g)
+		}
+		g.items = append(g.items, item)
+	}
+	tuples := make([]forTuple, len(groups))
+	for i, g := range groups {
+		newVars := copyVars(ctx.Variables)
+		newVars[e.Name] = g.items
+		for j, k := range e.GroupBy {
+			newVars[k.Name] = g.keys[j]
+		}
+		tuples[i] = forTuple{vars: newVars, item: g.items[0], pos: i + 1}
+	}
+	return tuples
+}
+
+// orderTuples sorts tuples by the keys of an order by clause, evaluated
+// once per tuple. The sort is stable, and empty keys, such as a missing
+// attribute, come first in ascending order and last in descending order,
+// as does NaN under numeric collation. Numeric collation converts keys as
+// number() does, so a key that is not a number is an error.
+func orderTuples(tuples []forTuple, keys []OrderKey, ctx Context) {
+	values := make([][][]any, len(tuples))
+	for i, t := range tuples {
+		pos := t.pos
+		last := len(tuples)
+		newCtx := Context{ContextItem: t.item, Variables: t.vars, Functions: ctx.Functions, Rules: ctx.Rules, Position: &pos, Last: &last, Runtime: ctx.Runtime}
+		values[i] = make([][]any, len(keys))
+		for j, k := range keys {
+			value := singleKey(evalExpr(k.Expr, newCtx), "order by key")
+			if k.Collation == "numeric" && len(value) == 1 {
+				n := ctx.Runtime.number(value)
+				if f, ok := n.(float64); ok && math.IsNaN(f) {
+					value = nil
+				} else {
+					value = []any{n}
+				}
+			}
+			values[i][j] = value
+		}
+	}
+	index := make([]int, len(tuples))
+	for i := range index {
+		index[i] = i
+	}
+	sort.SliceStable(index, func(a, b int) bool {
+		for j, k := range keys {
+			c := compareOrderKeys(values[index[a]][j], values[index[b]][j], k.Collation)
+			if k.Descending {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	sorted := make([]forTuple, len(tuples))
+	for i, idx := range index {
+		sorted[i] = tuples[idx]
+	}
+	copy(tuples, sorted)
+}
+
+// compareOrderKeys compares two atomized order by keys. Empty keys are
+// least; by default two numbers compare as numbers and anything else by
+// string value.
+func compareOrderKeys(a, b []any, collation string) int {
+	switch {
+	case len(a) == 0 && len(b) == 0:
+		return 0
+	case len(a) == 0:
+		return -1
+	case len(b) == 0:
+		return 1
+	}
+	if collation != "string" && isNumeric(a[0]) && isNumeric(b[0]) {
+		if c, ok := compareNumbers(a[0], b[0]); ok {
+			return c
+		}
+	}
+	return strings.Compare(ToString(a), ToString(b))
+}
+
+// singleKey atomizes the value of a grouping or ordering key: nodes become
+// their string value. A key of several items is an error.
+func singleKey(value []any, what string) []any {
+	if len(value) > 1 {
+		panic(fmt.Errorf("XFDY0002: %s must be a single item, got %d items", what, len(value)))
+	}
+	if len(value) == 1 {
+		if n, ok := value[0].(*Node); ok {
+			return []any{n.StringValue()}
+		}
+	}
+	return value
+}
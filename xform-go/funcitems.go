@@ -0,0 +1,75 @@
+package xform
+
+import "fmt"
+
+// Closure is the function item an inline function, fn($x) := body,
+// evaluates to: the function with the variables in scope where it was
+// written, which its body sees in place of the caller's.
+type Closure struct {
+	Def       FunctionDef
+	Variables map[string][]any
+}
+
+// callFunctionItem calls f, a FunctionRef or *Closure, with args. A
+// FunctionRef calls the function of that name as a call by name would.
+func callFunctionItem(f any, args [][]any, ctx Context) []any {
+	switch f := f.(type) {
+	case FunctionRef:
+		return CallFunction(f.Name, args, ctx)
+	case *Closure:
+		ctx.Variables = f.Variables
+		return callUserFunction(f.Def, args, ctx)
+	}
+	panic(fmt.Errorf("XFDY0002: %s is not a function", ToString([]any{f})))
+}
+
+// functionItem returns args[i] as a function item, for caller.
+func functionItem(args [][]any, i int, caller string) any {
+	if i < len(args) && len(args[i]) == 1 {
+		switch f := args[i][0].(type) {
+		case FunctionRef, *Closure:
+			return f
+		}
+	}
+	panic(fmt.Errorf("XFDY0002: %s() expects a function as argument %d", caller, i+1))
+}
+
+// fnCall is call(f, args...): f called with the remaining arguments.
+func fnCall(args [][]any, ctx Context) []any {
+	f := functionItem(args, 0, "call")
+	return callFunctionItem(f, args[1:], ctx)
+}
+
+// fnMap is map(seq, f): the concatenated results of f called with each
+// item of seq.
+func fnMap(args [][]any, ctx Context) []any {
+	f := functionItem(args, 1, "map")
+	out := []any{}
+	for _, item := range args[0] {
+		out = append(out, callFunctionItem(f, [][]any{{item}}, ctx)...)
+	}
+	return out
+}
+
+// fnFilter is filter(seq, f): the items of seq for which f returns true.
+func fnFilter(args [][]any, ctx Context) []any {
+	f := functionItem(args, 1, "filter")
+	out := []any{}
+	for _, item := range args[0] {
+		if ToBoolean(callFunctionItem(f, [][]any{{item}}, ctx)) {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// fnFold is fold(seq, init, f): f called with init and the first item of
+// seq, then with each result and the next item; init for an empty seq.
+func fnFold(args [][]any, ctx Context) []any {
+	f := functionItem(args, 2, "fold")
+	acc := args[1]
+	for _, item := range args[0] {
+		acc = callFunctionItem(f, [][]any{acc, {item}}, ctx)
+	}
+	return acc
+}
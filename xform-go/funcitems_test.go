@@ -0,0 +1,38 @@
+package xform
+
+import "testing"
+
+func TestSequenceFunctions(t *testing.T) {
+	tests := []struct{ src, want string }{
+		{`map((), fn($x) := $x * 2)`, ""},
+		{`filter((), fn($x) := 1 = 1)`, ""},
+		{`fold((), 42, fn($acc, $x) := $acc + $x)`, "42"},
+		{`count(map((), fn($x) := ($x, $x)))`, "0"},
+		{`map((1, 2, 3), fn($x) := $x * 2)`, "246"},
+		{`map((1, 2), fn($x) := ($x, $x))`, "1122"},
+		{`def twice($x) := $x * 2; map((1, 2), twice)`, "24"},
+		{`filter((1, 2, 3, 4), fn($x) := $x mod 2 = 0)`, "24"},
+		{`fold((1, 2, 3), 0, fn($acc, $x) := $acc + $x)`, "6"},
+		{`fold(("a", "b", "c"), (), fn($acc, $x) := ($x, $acc))`, "cba"},
+		{`map(//item, fn($i) := string($i/@id))`, "123"},
+		{`filter(//item, fn($i) := $i/@id != "2")`, `<item id="1">a</item><item id="3">c</item>`},
+		{`let $first := map(//item, fn($i) := $i)[1] in name($first/parent::*)`, "r"},
+		{`count(filter(//item, fn($i) := $i/@id = "9"))`, "0"},
+		{`fold(//item, 0, fn($sum, $i) := $sum + number($i/@id))`, "6"},
+	}
+	for _, tt := range tests {
+		if got := run(t, tt.src, itemsXML); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestSequenceFunctionErrors(t *testing.T) {
+	for _, src := range []string{
+		`map((1, 2), 3)`,
+		`filter(//item, "x")`,
+		`fold((1, 2), 0)`,
+	} {
+		wantErrorCode(t, runError(t, src, itemsXML), "XFDY0002")
+	}
+}
@@ -0,0 +1,90 @@
+package xform
+
+// resultHooks are the post-processing hooks of a Program, run on every
+// result of Eval, EvalItem, EvalSelected and EvalStreaming in the order they
+// were added.
+type resultHooks struct {
+	nodes    []func(*Node) *Node
+	warnings []DiagnosticSink
+	results  []func([]any) []any
+}
+
+// OnResultNode adds a hook called for every node of the result, parents
+// before their children. The hook may change the node in place or return
+// another one; returning nil drops the node and its subtree, e.g. to veto
+// elements holding personal data. Results that are nodes of the input are
+// copied first, so hooks never change the input document.
+func (p *Program) OnResultNode(fn func(n *Node) *Node) *Program {
+	p.hooks.nodes = append(p.hooks.nodes, fn)
+	return p
+}
+
+// OnWarning adds a hook receiving the diagnostics reported during
+// evaluation, besides EvalOptions.Diagnostics.
+func (p *Program) OnWarning(fn func(d Diagnostic)) *Program {
+	p.hooks.warnings = append(p.hooks.warnings, fn)
+	return p
+}
+
+// TransformResult adds a hook replacing the result sequence, run after the
+// OnResultNode hooks.
+func (p *Program) TransformResult(fn func(result []any) []any) *Program {
+	p.hooks.results = append(p.hooks.results, fn)
+	return p
+}
+
+// diagnostics returns sink extended with the OnWarning hooks.
+func (h *resultHooks) diagnostics(sink DiagnosticSink) DiagnosticSink {
+	if len(h.warnings) == 0 {
+		return sink
+	}
+	return func(d Diagnostic) {
+		if sink != nil {
+			sink(d)
+		}
+		for _, fn := range h.warnings {
+			fn(d)
+		}
+	}
+}
+
+func (h *resultHooks) apply(result []any) []any {
+	if len(h.nodes) > 0 {
+		out := make([]any, 0, len(result))
+		for _, item := range result {
+			n, ok := item.(*Node)
+			if !ok {
+				out = append(out, item)
+				continue
+			}
+			if n.Parent != nil {
+				n = DeepCopy(n, true)
+			}
+			if n = h.node(n); n != nil {
+				out = append(out, n)
+			}
+		}
+		result = out
+	}
+	for _, fn := range h.results {
+		result = fn(result)
+	}
+	return result
+}
+
+func (h *resultHooks) node(n *Node) *Node {
+	for _, fn := range h.nodes {
+		if n = fn(n); n == nil {
+			return nil
+		}
+	}
+	children := n.Children[:0]
+	for _, c := range n.Children {
+		if c = h.node(c); c != nil {
+			c.Parent = n
+			children = append(children, c)
+		}
+	}
+	n.Children = children
+	return n
+}
@@ -0,0 +1,354 @@
+package xform
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DTD holds the attribute types declared in a document's internal DTD
+// subset that matter for identity: per element name, the attributes of
+// type ID and of type IDREF or IDREFS. Tokenized has, per element name,
+// the attributes of any type but CDATA, whose values parsing normalizes.
+type DTD struct {
+	Name      string
+	IDs       map[string][]string
+	IDRefs    map[string][]string
+	Tokenized map[string][]string
+}
+
+// ParseDoctype reads <!ATTLIST> declarations from the body of a DOCTYPE
+// directive. Other declarations are ignored.
+func ParseDoctype(directive string) *DTD {
+	dtd := &DTD{IDs: map[string][]string{}, IDRefs: map[string][]string{}, Tokenized: map[string][]string{}}
+	fields := strings.Fields(strings.TrimPrefix(directive, "DOCTYPE"))
+	if len(fields) > 0 {
+		dtd.Name = strings.TrimSuffix(fields[0], "[")
+	}
+	rest := directive
+	for {
+		i := strings.Index(rest, "<!ATTLIST")
+		if i < 0 {
+			break
+		}
+		rest = rest[i+len("<!ATTLIST"):]
+		end := strings.IndexByte(rest, '>')
+		if end < 0 {
+			break
+		}
+		dtd.addAttlist(rest[:end])
+		rest = rest[end+1:]
+	}
+	return dtd
+}
+
+// externalID returns the public and system identifiers of a DOCTYPE
+// directive, "" for those it lacks.
+func externalID(directive string) (public, system string) {
+	head := strings.TrimPrefix(directive, "DOCTYPE")
+	if i := strings.IndexByte(head, '['); i >= 0 {
+		head = head[:i]
+	}
+	toks := dtdTokens(head)
+	literal := func(i int) string {
+		if i >= len(toks) || len(toks[i]) < 2 {
+			return ""
+		}
+		return toks[i][1 : len(toks[i])-1]
+	}
+	switch {
+	case len(toks) > 1 && toks[1] == "SYSTEM":
+		return "", literal(2)
+	case len(toks) > 1 && toks[1] == "PUBLIC":
+		return literal(2), literal(3)
+	}
+	return "", ""
+}
+
+// addExternalSubset adds the ATTLIST declarations of the external subset
+// that catalog maps the doctype's system or public identifier to. The
+// internal subset's declarations come first and so take precedence.
+// Without a mapping nothing is read.
+func (d *DTD) addExternalSubset(directive string, catalog *Catalog) error {
+	public, system := externalID(directive)
+	location, ok := "", false
+	if system != "" {
+		location, ok = catalog.LookupSystem(system)
+	}
+	if !ok && public != "" {
+		location, ok = catalog.LookupPublic(public)
+	}
+	if !ok {
+		return nil
+	}
+	r, err := DefaultResolvers.Open(location)
+	if err != nil {
+		return fmt.Errorf("external DTD subset %s: %v", location, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("external DTD subset %s: %v", location, err)
+	}
+	ext := ParseDoctype(string(data))
+	mergeAttrs(d.IDs, ext.IDs)
+	mergeAttrs(d.IDRefs, ext.IDRefs)
+	mergeAttrs(d.Tokenized, ext.Tokenized)
+	return nil
+}
+
+// mergeAttrs adds the attributes of from to those of the same element in
+// to that are not there yet.
+func mergeAttrs(to, from map[string][]string) {
+	for elem, names := range from {
+		for _, name := range names {
+			if !containsString(to[elem], name) {
+				to[elem] = append(to[elem], name)
+			}
+		}
+	}
+}
+
+func (d *DTD) addAttlist(decl string) {
+	toks := dtdTokens(decl)
+	if len(toks) == 0 {
+		return
+	}
+	elem := toks[0]
+	for i := 1; i+1 < len(toks); {
+		name, typ := localName(toks[i]), toks[i+1]
+		if typ != "CDATA" {
+			d.Tokenized[elem] = append(d.Tokenized[elem], toks[i])
+		}
+		i += 2
+		if typ == "NOTATION" && i < len(toks) {
+			i++
+		}
+		if i < len(toks) {
+			switch toks[i] {
+			case "#FIXED":
+				i += 2
+			case "#REQUIRED", "#IMPLIED":
+				i++
+			default:
+				if strings.HasPrefix(toks[i], "\"") || strings.HasPrefix(toks[i], "'") {
+					i++
+				}
+			}
+		}
+		switch typ {
+		case "ID":
+			d.IDs[elem] = append(d.IDs[elem], name)
+		case "IDREF", "IDREFS":
+			d.IDRefs[elem] = append(d.IDRefs[elem], name)
+		}
+	}
+}
+
+// dtdTokens splits an attribute-list declaration into names, keywords,
+// parenthesised enumerations and quoted defaults.
+func dtdTokens(s string) []string {
+	toks := []string{}
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			end := strings.IndexByte(s[i:], ')')
+			if end < 0 {
+				end = len(s) - i - 1
+			}
+			toks = append(toks, s[i:i+end+1])
+			i += end + 1
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(s[i+1:], c)
+			if end < 0 {
+				end = len(s) - i - 2
+			}
+			toks = append(toks, s[i:i+end+2])
+			i += end + 2
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t\r\n(\"'", rune(s[j])) {
+				j++
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		}
+	}
+	return toks
+}
+
+func localName(name string) string {
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+// DefaultIDAttributes are the ID attributes of elements without a DTD
+// declaration when EvalOptions.IDAttributes is empty.
+var DefaultIDAttributes = []string{"id", "xml:id"}
+
+func documentOf(n *Node) *Node {
+	for n != nil && n.Parent != nil {
+		n = n.Parent
+	}
+	return n
+}
+
+// idAttrs returns the names of the ID attributes of element n: those
+// declared in the DTD for its element type, else the configured list.
+func idAttrs(n *Node, dtd *DTD, rt *Runtime) []string {
+	if dtd != nil {
+		if attrs, ok := dtd.IDs[n.Name]; ok {
+			return attrs
+		}
+	}
+	if rt != nil && len(rt.Options.IDAttributes) > 0 {
+		return rt.Options.IDAttributes
+	}
+	return DefaultIDAttributes
+}
+
+func refAttrsFor(n *Node, dtd *DTD, explicit []string) []string {
+	if explicit != nil {
+		return explicit
+	}
+	if dtd != nil && len(dtd.IDRefs) > 0 {
+		return dtd.IDRefs[n.Name]
+	}
+	return defaultRefAttrs
+}
+
+func nodeIDs(n *Node, dtd *DTD, rt *Runtime) []string {
+	out := []string{}
+	for _, a := range idAttrs(n, dtd, rt) {
+		if v, ok := n.Attrs[a]; ok {
+			out = append(out, strings.TrimSpace(v))
+		}
+	}
+	return out
+}
+
+func fnID(args [][]any, ctx Context) []any {
+	root := contextRoot(ctx)
+	if n := nodeArg(args, 1); n != nil {
+		root = documentOf(n)
+	}
+	out := []any{}
+	if root == nil || len(args) == 0 {
+		return out
+	}
+	ids := idIndex(root, ctx.Runtime)
+	seen := map[*Node]bool{}
+	matched := []*Node{}
+	for _, item := range args[0] {
+		for _, id := range strings.Fields(ToString([]any{item})) {
+			if n, ok := ids[id]; ok && !seen[n] {
+				seen[n] = true
+				matched = append(matched, n)
+			}
+		}
+	}
+	order := map[*Node]int{}
+	for i, n := range IterDescendants(root) {
+		order[n] = i
+	}
+	sort.SliceStable(matched, func(i, j int) bool { return order[matched[i]] < order[matched[j]] })
+	for _, n := range matched {
+		out = append(out, n)
+	}
+	return out
+}
+
+// CheckIDs reports duplicate ids and references to ids that do not exist.
+// Reference attributes are the DTD's IDREF/IDREFS attributes, refAttrs
+// when given, or the refs pack defaults (linkend idref idrefs rid href
+// target; href only for #fragment values).
+func CheckIDs(doc *Node, refAttrs []string) *Node {
+	return checkIDs(doc, refAttrs, nil)
+}
+
+func checkIDs(doc *Node, refAttrs []string, rt *Runtime) *Node {
+	root := documentOf(doc)
+	dtd := root.DTD
+	elems := []*Node{}
+	for _, n := range IterDescendants(doc) {
+		if n.Kind == "element" {
+			elems = append(elems, n)
+		}
+	}
+	owners := map[string][]*Node{}
+	order := []string{}
+	for _, n := range elems {
+		for _, id := range nodeIDs(n, dtd, rt) {
+			if _, ok := owners[id]; !ok {
+				order = append(order, id)
+			}
+			owners[id] = append(owners[id], n)
+		}
+	}
+	report := &Node{Kind: "element", Name: "id-report", Attrs: map[string]string{}}
+	rt.nodeCreated()
+	add := func(name string, attrs [][2]string, parent *Node) *Node {
+		n := &Node{Kind: "element", Name: name, Attrs: map[string]string{}, Parent: parent}
+		rt.nodeCreated()
+		for _, kv := range attrs {
+			n.Attrs[kv[0]] = kv[1]
+			n.AttrOrder = append(n.AttrOrder, kv[0])
+		}
+		parent.Children = append(parent.Children, n)
+		return n
+	}
+	errors := 0
+	for _, id := range order {
+		if len(owners[id]) < 2 {
+			continue
+		}
+		errors++
+		dup := add("duplicate", [][2]string{{"id", id}, {"count", strconv.Itoa(len(owners[id]))}}, report)
+		for _, n := range owners[id] {
+			add("occurrence", [][2]string{{"element", n.Name}, {"path", NodePath(n)}}, dup)
+		}
+	}
+	refs := 0
+	for _, n := range elems {
+		for _, a := range refAttrsFor(n, dtd, refAttrs) {
+			v, ok := n.Attrs[a]
+			if !ok || (a == "href" && !strings.HasPrefix(v, "#")) {
+				continue
+			}
+			for _, ref := range refTargets(v) {
+				refs++
+				if _, ok := owners[ref]; !ok {
+					errors++
+					add("dangling", [][2]string{{"ref", ref}, {"attribute", a}, {"element", n.Name}, {"path", NodePath(n)}}, report)
+				}
+			}
+		}
+	}
+	report.Attrs["ids"] = strconv.Itoa(len(owners))
+	report.Attrs["refs"] = strconv.Itoa(refs)
+	report.Attrs["errors"] = strconv.Itoa(errors)
+	report.AttrOrder = []string{"ids", "refs", "errors"}
+	return report
+}
+
+func fnCheckIDs(args [][]any, ctx Context) []any {
+	doc := nodeArg(args, 0)
+	if len(args) == 0 {
+		doc = contextRoot(ctx)
+	}
+	if doc == nil {
+		panic(fmt.Errorf("XFDY0003: checkIds() expects a node"))
+	}
+	var attrs []string
+	if len(args) > 1 && len(args[1]) > 0 {
+		attrs = strings.Fields(ToString(args[1]))
+	}
+	return []any{checkIDs(doc, attrs, ctx.Runtime)}
+}
@@ -0,0 +1,177 @@
+package xform
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Index is the value built by index(): items grouped by key, with keys kept
+// in order of first occurrence. With several key functions every level but
+// the last maps a key to a nested Index, giving lookup tables such as
+// publisher -> year -> isbn without string-concatenated keys.
+type Index struct {
+	Keys    []string
+	Items   []any
+	entries map[string]*indexEntry
+}
+
+type indexEntry struct {
+	items []any
+	sub   *Index
+}
+
+func NewIndex() *Index {
+	return &Index{entries: map[string]*indexEntry{}}
+}
+
+// Add files item under the key path, creating nested levels as needed.
+func (ix *Index) Add(keys []string, item any) {
+	ix.Items = append(ix.Items, item)
+	if len(keys) == 0 {
+		return
+	}
+	e, ok := ix.entries[keys[0]]
+	if !ok {
+		e = &indexEntry{}
+		ix.entries[keys[0]] = e
+		ix.Keys = append(ix.Keys, keys[0])
+	}
+	if len(keys) == 1 {
+		e.items = append(e.items, item)
+		return
+	}
+	if e.sub == nil {
+		e.sub = NewIndex()
+	}
+	e.sub.Add(keys[1:], item)
+}
+
+// Lookup follows the key path and returns the items of a leaf level or the
+// nested Index of an inner one.
+func (ix *Index) Lookup(keys ...string) []any {
+	for i, k := range keys {
+		e, ok := ix.entries[k]
+		if !ok {
+			return []any{}
+		}
+		if i == len(keys)-1 {
+			if e.sub != nil {
+				return []any{e.sub}
+			}
+			return e.items
+		}
+		if e.sub == nil {
+			return []any{}
+		}
+		ix = e.sub
+	}
+	return []any{ix}
+}
+
+// LookupAll returns every item below the key path in input order.
+func (ix *Index) LookupAll(keys ...string) []any {
+	for _, k := range keys {
+		e, ok := ix.entries[k]
+		if !ok {
+			return []any{}
+		}
+		if e.sub == nil {
+			return e.items
+		}
+		ix = e.sub
+	}
+	return ix.Items
+}
+
+func (ix *Index) String() string {
+	return fmt.Sprintf("index(%d keys)", len(ix.Keys))
+}
+
+// fnIndex implements index(seq, key1?, key2?, ...). Without keys items are
+// keyed by their string value.
+func fnIndex(args [][]any, ctx Context) []any {
+	if len(args) == 0 {
+		return []any{}
+	}
+	fns := []func(any) []any{}
+	for i := 1; i < len(args); i++ {
+		if fn := keyFunction(args, i, ctx, "index"); fn != nil {
+			fns = append(fns, fn)
+		}
+	}
+	index := NewIndex()
+	for _, item := range args[0] {
+		keys := []string{ToString([]any{item})}
+		if len(fns) > 0 {
+			keys = keys[:0]
+			for _, fn := range fns {
+				keys = append(keys, ToString(fn(item)))
+			}
+		}
+		index.Add(keys, item)
+	}
+	return []any{index}
+}
+
+func indexKeys(args [][]any) []string {
+	keys := []string{}
+	for _, a := range args {
+		keys = append(keys, ToString(a))
+	}
+	return keys
+}
+
+// fnLookup implements lookup(map, key1, key2, ...) for indexes and plain
+// maps such as groupBy() entries.
+func fnLookup(args [][]any, _ Context) []any {
+	if len(args) < 2 || len(args[0]) == 0 {
+		return []any{}
+	}
+	switch m := args[0][0].(type) {
+	case *Index:
+		return m.Lookup(indexKeys(args[1:])...)
+	case map[string][]any:
+		return m[ToString(args[1])]
+	case Array:
+		if i := ToNumber(args[1]); i >= 1 && i <= float64(len(m)) && i == math.Trunc(i) {
+			return []any{m[int(i)-1]}
+		}
+	}
+	return []any{}
+}
+
+func fnLookupAll(args [][]any, _ Context) []any {
+	if len(args) == 0 || len(args[0]) == 0 {
+		return []any{}
+	}
+	if ix, ok := args[0][0].(*Index); ok {
+		return ix.LookupAll(indexKeys(args[1:])...)
+	}
+	return fnLookup(args, Context{})
+}
+
+// fnKeys returns the keys of an index in first-occurrence order, or the
+// sorted keys of a plain map.
+func fnKeys(args [][]any, _ Context) []any {
+	out := []any{}
+	if len(args) == 0 || len(args[0]) == 0 {
+		return out
+	}
+	switch m := args[0][0].(type) {
+	case *Index:
+		for _, k := range m.Keys {
+			out = append(out, k)
+		}
+	case map[string][]any:
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			out = append(out, k)
+		}
+	}
+	return out
+}
@@ -0,0 +1,202 @@
+package xform
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type InputFormat string
+
+const (
+	FormatAuto InputFormat = ""
+	FormatXML  InputFormat = "xml"
+	FormatHTML InputFormat = "html"
+	FormatJSON InputFormat = "json"
+	// FormatJSONItems reads JSON as maps and arrays; see ParseJSONBytes.
+	FormatJSONItems InputFormat = "json-items"
+)
+
+func ParseInputFormat(s string) (InputFormat, error) {
+	switch strings.ToLower(s) {
+	case "", "auto":
+		return FormatAuto, nil
+	case "xml":
+		return FormatXML, nil
+	case "html", "htm":
+		return FormatHTML, nil
+	case "json":
+		return FormatJSON, nil
+	case "json-items":
+		return FormatJSONItems, nil
+	}
+	return FormatAuto, fmt.Errorf("unknown input format %q", s)
+}
+
+// ParseInput turns raw input bytes into a document node. Compressed input is
+// unwrapped first; with FormatAuto the format is taken from the file
+// extension and, failing that, from the leading bytes of the content.
+func ParseInput(name string, data []byte, format InputFormat) (*Node, error) {
+	return ParseInputWith(name, data, format, ParseOptions{})
+}
+
+// ParseInputWith is ParseInput parsing XML with opts.
+func ParseInputWith(name string, data []byte, format InputFormat, opts ParseOptions) (*Node, error) {
+	data, name, err := decompressInput(name, data)
+	if err != nil {
+		return nil, err
+	}
+	if format == FormatAuto {
+		format = DetectFormat(name, data)
+	}
+	switch format {
+	case FormatHTML:
+		return ParseHTMLBytes(data)
+	case FormatJSON:
+		return ParseJSONBytesAsXML(data)
+	case FormatJSONItems:
+		return nil, fmt.Errorf("input format %s is not a document; use ParseInputItem", format)
+	default:
+		return ParseXMLBytesWith(data, opts)
+	}
+}
+
+// ParseInputItem is ParseInput returning the input as an item: a map or an
+// array for FormatJSONItems, else the document node.
+func ParseInputItem(name string, data []byte, format InputFormat) (any, error) {
+	if format != FormatJSONItems {
+		doc, err := ParseInput(name, data, format)
+		if err != nil {
+			return nil, err
+		}
+		return doc, nil
+	}
+	data, _, err := decompressInput(name, data)
+	if err != nil {
+		return nil, err
+	}
+	return ParseJSONBytes(data)
+}
+
+func DetectFormat(name string, data []byte) InputFormat {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".json":
+		return FormatJSON
+	case ".html", ".htm":
+		return FormatHTML
+	case ".xml", ".xhtml", ".xsl", ".svg":
+		return FormatXML
+	}
+	head := bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	head = bytes.TrimLeft(head, " \t\r\n")
+	if len(head) > 0 && (head[0] == '{' || head[0] == '[') {
+		return FormatJSON
+	}
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	lower := bytes.ToLower(head)
+	if bytes.HasPrefix(lower, []byte("<!doctype html")) || bytes.HasPrefix(lower, []byte("<html")) {
+		return FormatHTML
+	}
+	return FormatXML
+}
+
+func ParseHTMLBytes(data []byte) (*Node, error) {
+	decoder := xml.NewDecoder(strings.NewReader(string(data)))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+	doc, err := parseDecoder(decoder, ParseOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range IterDescendants(doc) {
+		if n.Namespace == XHTMLNamespace {
+			n.Namespace = ""
+		}
+	}
+	return doc, nil
+}
+
+// ParseJSONBytesAsXML maps JSON onto elements following the XPath 3.1
+// json-to-xml vocabulary: map, array, string, number, boolean and null, with
+// object members carrying their name in a key attribute. Members keep the
+// order they have in the document, duplicate keys included.
+func ParseJSONBytesAsXML(data []byte) (*Node, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	tok, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	root, err := jsonValueNode(decoder, tok)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("invalid JSON: data after the top-level value")
+	}
+	doc := &Node{Kind: "document", Attrs: map[string]string{}}
+	root.Parent = doc
+	doc.Children = []*Node{root}
+	numberNodes(doc)
+	return doc, nil
+}
+
+// jsonValueNode builds the element for the value starting with tok, reading
+// the rest of an object or array from decoder.
+func jsonValueNode(decoder *json.Decoder, tok json.Token) (*Node, error) {
+	n := &Node{Kind: "element", Attrs: map[string]string{}}
+	switch v := tok.(type) {
+	case json.Delim:
+		n.Name = "array"
+		if v == '{' {
+			n.Name = "map"
+		}
+		for decoder.More() {
+			var key string
+			if n.Name == "map" {
+				tok, err := decoder.Token()
+				if err != nil {
+					return nil, err
+				}
+				key, _ = tok.(string)
+			}
+			tok, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			child, err := jsonValueNode(decoder, tok)
+			if err != nil {
+				return nil, err
+			}
+			if n.Name == "map" {
+				child.Attrs["key"] = key
+				child.AttrOrder = []string{"key"}
+			}
+			child.Parent = n
+			n.Children = append(n.Children, child)
+		}
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+	case string:
+		n.Name = "string"
+		n.Children = []*Node{{Kind: "text", Value: v, Attrs: map[string]string{}, Parent: n}}
+	case json.Number:
+		n.Name = "number"
+		n.Children = []*Node{{Kind: "text", Value: v.String(), Attrs: map[string]string{}, Parent: n}}
+	case bool:
+		n.Name = "boolean"
+		n.Children = []*Node{{Kind: "text", Value: strconv.FormatBool(v), Attrs: map[string]string{}, Parent: n}}
+	default:
+		n.Name = "null"
+	}
+	return n, nil
+}
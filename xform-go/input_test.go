@@ -0,0 +1,29 @@
+package xform
+
+import "testing"
+
+func TestJSONAsXMLMemberOrder(t *testing.T) {
+	tests := []struct{ json, want string }{
+		{`{"b":1,"a":2}`, `<map><number key="b">1</number><number key="a">2</number></map>`},
+		{`{"z":{"y":"s","x":[true,null]},"a":{}}`, `<map><map key="z"><string key="y">s</string><array key="x"><boolean>true</boolean><null/></array></map><map key="a"/></map>`},
+		{`{"k":1,"k":2}`, `<map><number key="k">1</number><number key="k">2</number></map>`},
+		{`[]`, `<array/>`},
+	}
+	for _, tt := range tests {
+		doc, err := ParseJSONBytesAsXML([]byte(tt.json))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.json, err)
+		}
+		if got := Serialize(doc); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.json, got, tt.want)
+		}
+	}
+}
+
+func TestJSONAsXMLErrors(t *testing.T) {
+	for _, src := range []string{``, `{"a":1`, `{"a" 1}`, `[1,]`, `{} []`} {
+		if _, err := ParseJSONBytesAsXML([]byte(src)); err == nil {
+			t.Errorf("%q: no error", src)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package xform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Array is a JSON array item. Each member is a single item.
+type Array []any
+
+// Null is the JSON null item. Its string value is "" and it is false.
+type Null struct{}
+
+// ParseJSONBytes turns JSON into an item: objects become maps (as built by
+// groupBy and friends) holding one item per key, arrays become Array,
+// numbers int64, Decimal or float64 by their form (see ToNumeric), strings
+// and booleans themselves, and null Null.
+func ParseJSONBytes(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("invalid JSON: data after the top-level value")
+	}
+	return jsonItem(value)
+}
+
+func jsonItem(value any) (any, error) {
+	switch v := value.(type) {
+	case map[string]any:
+		m := make(map[string][]any, len(v))
+		for k, member := range v {
+			item, err := jsonItem(member)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = []any{item}
+		}
+		return m, nil
+	case []any:
+		a := make(Array, len(v))
+		for i, member := range v {
+			item, err := jsonItem(member)
+			if err != nil {
+				return nil, err
+			}
+			a[i] = item
+		}
+		return a, nil
+	case json.Number:
+		n, ok := parseNumeric(v.String())
+		if !ok {
+			return nil, fmt.Errorf("invalid JSON number %s", v)
+		}
+		return n, nil
+	case nil:
+		return Null{}, nil
+	}
+	return value, nil
+}
+
+// isJSONItem reports whether item is a map or an array that path steps
+// navigate.
+func isJSONItem(item any) bool {
+	switch item.(type) {
+	case map[string][]any, Array:
+		return true
+	}
+	return false
+}
+
+func isArray(item any) bool {
+	_, ok := item.(Array)
+	return ok
+}
+
+// jsonStep applies step to a map or array. A name step selects the value
+// of that key, * and node() the values of all keys in key order or the
+// members of an array; array values contribute their members, so that
+// /order/line visits every line. Steps on an array apply to each member.
+// Descendant steps walk values at any depth.
+func jsonStep(item any, step PathStep, ctx Context) []any {
+	var candidates []any
+	switch step.Axis {
+	case "child":
+		candidates = jsonChildren(item, step.Test)
+	case "self":
+		if step.Test.Kind == "node" || step.Test.Kind == "wildcard" {
+			candidates = []any{item}
+		}
+	case "desc_or_self", "desc":
+		// An array is not a value of its own here: its members are.
+		var within []any
+		if !isArray(item) {
+			within = []any{item}
+		}
+		within = jsonDescendants(item, within)
+		switch {
+		case step.Test.Kind != "node":
+			for _, c := range within {
+				candidates = append(candidates, jsonChildren(c, step.Test)...)
+			}
+		case step.Axis == "desc" && len(within) > 0 && !isArray(item):
+			candidates = within[1:]
+		default:
+			candidates = within
+		}
+	}
+	for _, pred := range step.Predicates {
+		kept := []any{}
+		for i, c := range candidates {
+			pos := i + 1
+			last := len(candidates)
+			predCtx := Context{ContextItem: c, Variables: ctx.Variables, Functions: ctx.Functions, Rules: ctx.Rules, Position: &pos, Last: &last, Runtime: ctx.Runtime}
+			if predicateHolds(evalExpr(pred, predCtx), pos, ctx.Runtime) {
+				kept = append(kept, c)
+			}
+		}
+		candidates = kept
+	}
+	return candidates
+}
+
+func jsonChildren(item any, test StepTest) []any {
+	out := []any{}
+	switch v := item.(type) {
+	case map[string][]any:
+		switch test.Kind {
+		case "name":
+			if test.Name != nil {
+				out = appendMembers(out, v[*test.Name])
+			}
+		case "wildcard", "node":
+			keys := make([]string, 0, len(v))
+			for k := range v {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				out = appendMembers(out, v[k])
+			}
+		}
+	case Array:
+		if test.Kind == "wildcard" || test.Kind == "node" {
+			return append(out, v...)
+		}
+		for _, member := range v {
+			out = append(out, jsonChildren(member, test)...)
+		}
+	}
+	return out
+}
+
+// appendMembers appends seq to out with arrays replaced by their members.
+func appendMembers(out, seq []any) []any {
+	for _, item := range seq {
+		if a, ok := item.(Array); ok {
+			out = append(out, a...)
+		} else {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// jsonDescendants appends the values below item, each map or array before
+// its contents and arrays replaced by their members.
+func jsonDescendants(item any, out []any) []any {
+	var members []any
+	switch v := item.(type) {
+	case map[string][]any:
+		members = jsonChildren(v, StepTest{Kind: "node"})
+	case Array:
+		members = v
+	}
+	for _, m := range members {
+		if !isArray(m) {
+			out = append(out, m)
+		}
+		out = jsonDescendants(m, out)
+	}
+	return out
+}
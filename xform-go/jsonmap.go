@@ -0,0 +1,290 @@
+package xform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Mappings between XML and JSON used by XMLToJSON and JSONToXML.
+//
+// MappingVocabulary is the XPath 3.1 json-to-xml vocabulary that JSON input
+// is parsed into (see ParseJSONBytesAsXML): map, array, string, number,
+// boolean and null elements, with object members named by a key attribute.
+// It round-trips any JSON value.
+//
+// MappingJsonML represents arbitrary XML as JsonML: an element is an array
+// of its name, an optional object of attributes and its children; text is a
+// string. It round-trips elements, attributes and text, in order.
+//
+// MappingAuto picks the vocabulary for JSON input and for XML whose root is
+// a vocabulary element, and JsonML for all other XML.
+const (
+	MappingAuto       = "auto"
+	MappingVocabulary = "vocabulary"
+	MappingJsonML     = "jsonml"
+)
+
+// ParseMapping validates a mapping name given on the command line.
+func ParseMapping(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case "", MappingAuto:
+		return MappingAuto, nil
+	case MappingVocabulary, "xpath":
+		return MappingVocabulary, nil
+	case MappingJsonML:
+		return MappingJsonML, nil
+	}
+	return "", fmt.Errorf("unknown mapping %q (want auto, vocabulary or jsonml)", s)
+}
+
+var vocabularyNames = map[string]bool{"map": true, "array": true, "string": true, "number": true, "boolean": true, "null": true}
+
+// XMLToJSON serializes doc as JSON under the given mapping. indent, when
+// not empty, pretty-prints the output with that indentation string.
+func XMLToJSON(doc *Node, mapping, indent string) ([]byte, error) {
+	root := doc
+	if doc.Kind == "document" {
+		root = nil
+		for _, c := range doc.Children {
+			if c.Kind == "element" {
+				root = c
+				break
+			}
+		}
+		if root == nil {
+			return nil, fmt.Errorf("XFDY0002: xml2json: document has no root element")
+		}
+	}
+	if mapping == MappingAuto {
+		mapping = MappingJsonML
+		if vocabularyNames[root.Name] {
+			mapping = MappingVocabulary
+		}
+	}
+	w := &jsonWriter{indent: indent}
+	var err error
+	if mapping == MappingVocabulary {
+		err = w.vocabulary(root, 0)
+	} else {
+		w.jsonML(root, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return w.b.Bytes(), nil
+}
+
+type jsonWriter struct {
+	b      bytes.Buffer
+	indent string
+}
+
+func (w *jsonWriter) newline(depth int) {
+	if w.indent == "" {
+		return
+	}
+	w.b.WriteByte('\n')
+	w.b.WriteString(strings.Repeat(w.indent, depth))
+}
+
+func (w *jsonWriter) str(s string) {
+	data, _ := json.Marshal(s)
+	w.b.Write(data)
+}
+
+// list writes n entries between open and close; item writes entry i after
+// its separator and line break.
+func (w *jsonWriter) list(open, close byte, n, depth int, item func(i int) error) error {
+	w.b.WriteByte(open)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			w.b.WriteByte(',')
+		}
+		w.newline(depth + 1)
+		if err := item(i); err != nil {
+			return err
+		}
+	}
+	if n > 0 {
+		w.newline(depth)
+	}
+	w.b.WriteByte(close)
+	return nil
+}
+
+func (w *jsonWriter) key(k string) {
+	w.str(k)
+	w.b.WriteByte(':')
+	if w.indent != "" {
+		w.b.WriteByte(' ')
+	}
+}
+
+func vocabularyChildren(n *Node) ([]*Node, error) {
+	out := []*Node{}
+	for _, c := range n.Children {
+		switch {
+		case c.Kind == "element":
+			out = append(out, c)
+		case c.Kind == "text" && !isWhitespace(c.Value):
+			return nil, fmt.Errorf("XFDY0002: xml2json: unexpected text in <%s> at %s", n.Name, NodePath(n))
+		}
+	}
+	return out, nil
+}
+
+func (w *jsonWriter) vocabulary(n *Node, depth int) error {
+	switch n.Name {
+	case "map", "array":
+		children, err := vocabularyChildren(n)
+		if err != nil {
+			return err
+		}
+		open, close := byte('['), byte(']')
+		if n.Name == "map" {
+			open, close = '{', '}'
+		}
+		return w.list(open, close, len(children), depth, func(i int) error {
+			c := children[i]
+			if n.Name == "map" {
+				k, ok := c.Attrs["key"]
+				if !ok {
+					return fmt.Errorf("XFDY0002: xml2json: map entry without key at %s", NodePath(c))
+				}
+				w.key(k)
+			}
+			return w.vocabulary(c, depth+1)
+		})
+	case "string":
+		w.str(n.StringValue())
+	case "number":
+		v := strings.TrimSpace(n.StringValue())
+		if _, err := strconv.ParseFloat(v, 64); err != nil || !json.Valid([]byte(v)) {
+			return fmt.Errorf("XFDY0002: xml2json: invalid number %q at %s", v, NodePath(n))
+		}
+		w.b.WriteString(v)
+	case "boolean":
+		v := strings.TrimSpace(n.StringValue())
+		if v != "true" && v != "false" {
+			return fmt.Errorf("XFDY0002: xml2json: invalid boolean %q at %s", v, NodePath(n))
+		}
+		w.b.WriteString(v)
+	case "null":
+		w.b.WriteString("null")
+	default:
+		return fmt.Errorf("XFDY0002: xml2json: <%s> is not a json-to-xml element at %s", n.Name, NodePath(n))
+	}
+	return nil
+}
+
+func (w *jsonWriter) jsonML(n *Node, depth int) {
+	items := []func(){func() { w.str(n.Name) }}
+	if names := n.AttrNames(); len(names) > 0 {
+		items = append(items, func() {
+			w.list('{', '}', len(names), depth+1, func(i int) error {
+				w.key(names[i])
+				w.str(n.Attrs[names[i]])
+				return nil
+			})
+		})
+	}
+	for _, c := range n.Children {
+		c := c
+		switch c.Kind {
+		case "element":
+			items = append(items, func() { w.jsonML(c, depth+1) })
+		case "text":
+			items = append(items, func() { w.str(c.Value) })
+		}
+	}
+	w.list('[', ']', len(items), depth, func(i int) error {
+		items[i]()
+		return nil
+	})
+}
+
+// JSONToXML parses JSON into a document under the given mapping; auto
+// means the vocabulary.
+func JSONToXML(data []byte, mapping string) (*Node, error) {
+	if mapping != MappingJsonML {
+		return ParseJSONBytesAsXML(data)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	doc := &Node{Kind: "document", Attrs: map[string]string{}}
+	root, err := jsonMLNode(value)
+	if err != nil {
+		return nil, err
+	}
+	if root.Kind != "element" {
+		return nil, fmt.Errorf("XFDY0002: json2xml: JsonML document must be an element array")
+	}
+	root.Parent = doc
+	doc.Children = []*Node{root}
+	return doc, nil
+}
+
+func jsonMLNode(value any) (*Node, error) {
+	switch v := value.(type) {
+	case string:
+		return &Node{Kind: "text", Value: v, Attrs: map[string]string{}}, nil
+	case []any:
+		if len(v) == 0 {
+			return nil, fmt.Errorf("XFDY0002: json2xml: empty JsonML element")
+		}
+		name, ok := v[0].(string)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("XFDY0002: json2xml: JsonML element name must be a string")
+		}
+		n := &Node{Kind: "element", Name: name, Attrs: map[string]string{}}
+		rest := v[1:]
+		if len(rest) > 0 {
+			if attrs, ok := rest[0].(map[string]any); ok {
+				keys := make([]string, 0, len(attrs))
+				for k := range attrs {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+				for _, k := range keys {
+					setAttr(n, k, jsonScalarString(attrs[k]))
+				}
+				rest = rest[1:]
+			}
+		}
+		for _, item := range rest {
+			child, err := jsonMLNode(item)
+			if err != nil {
+				return nil, err
+			}
+			child.Parent = n
+			n.Children = append(n.Children, child)
+		}
+		return n, nil
+	case json.Number, bool, nil:
+		return &Node{Kind: "text", Value: jsonScalarString(v), Attrs: map[string]string{}}, nil
+	}
+	return nil, fmt.Errorf("XFDY0002: json2xml: unexpected object in JsonML content")
+}
+
+func jsonScalarString(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return v.String()
+	case string:
+		return v
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
@@ -0,0 +1,442 @@
+package xform
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Repair is a fix lenient parsing made to the input, at a line of it.
+type Repair struct {
+	Line    int
+	Message string
+}
+
+func (r Repair) String() string {
+	return fmt.Sprintf("line %d: %s", r.Line, r.Message)
+}
+
+// ParseXMLLenient parses XML that encoding/xml would reject, for legacy
+// data: it repairs the input first and reports each fix. Bytes that are
+// not UTF-8 are read as Latin-1 and characters XML does not allow are
+// dropped; a stray & or < is escaped and an undeclared HTML entity
+// replaced by its character; attribute values are quoted and a repeated
+// attribute keeps its last value; an end tag differing in case from its
+// start tag is corrected, elements left open are closed, and elements
+// after the root element are kept beside it. The error is for input still
+// not well-formed.
+func ParseXMLLenient(data []byte) (*Node, []Repair, error) {
+	text, repairs := repairXML(normalizeXMLBytes(data))
+	text = normalizeAttributeText(text)
+	decoder := xml.NewDecoder(strings.NewReader(text))
+	// The text is UTF-8 now, whatever encoding it declares.
+	decoder.CharsetReader = func(_ string, r io.Reader) (io.Reader, error) { return r, nil }
+	doc, err := parseDecoder(decoder, ParseOptions{})
+	return doc, repairs, err
+}
+
+// ParseInputLenient is ParseInput with XML input parsed by
+// ParseXMLLenient; other formats are parsed as usual, without repairs.
+func ParseInputLenient(name string, data []byte, format InputFormat) (*Node, []Repair, error) {
+	data, name, err := decompressInput(name, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if format == FormatAuto {
+		format = DetectFormat(name, data)
+	}
+	if format != FormatXML {
+		doc, err := ParseInput(name, data, format)
+		return doc, nil, err
+	}
+	return ParseXMLLenient(data)
+}
+
+var declaredEncoding = regexp.MustCompile(`^\s*<\?xml[^>]*encoding\s*=\s*["']([^"']+)["']`)
+
+// xmlRepairer rewrites a document into well-formed XML: src is read from
+// pos and the repaired text written to out.
+type xmlRepairer struct {
+	src     string
+	pos     int
+	out     strings.Builder
+	lines   []int // offsets of the line starts of src
+	open    []string
+	repairs []Repair
+	root    bool // whether a root element has started
+}
+
+func repairXML(text string) (string, []Repair) {
+	text, repairs := repairChars(text)
+	r := &xmlRepairer{src: text, lines: []int{0}, repairs: repairs}
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\n' {
+			r.lines = append(r.lines, i+1)
+		}
+	}
+	if m := declaredEncoding.FindStringSubmatch(text); m != nil && !strings.EqualFold(m[1], "utf-8") {
+		r.report(0, "read the document, declared as "+m[1]+", as UTF-8")
+	}
+	r.document()
+	sort.SliceStable(r.repairs, func(i, j int) bool { return r.repairs[i].Line < r.repairs[j].Line })
+	return r.out.String(), r.repairs
+}
+
+// repairChars reads bytes that are not UTF-8 as Latin-1 and drops the
+// characters XML does not allow.
+func repairChars(text string) (string, []Repair) {
+	var repairs []Repair
+	var b strings.Builder
+	line := 1
+	for i := 0; i < len(text); {
+		c, size := utf8.DecodeRuneInString(text[i:])
+		switch {
+		case c == utf8.RuneError && size == 1:
+			c = rune(text[i])
+			repairs = append(repairs, Repair{line, fmt.Sprintf("read the byte 0x%X, which is not UTF-8, as Latin-1 %q", text[i], c)})
+			b.WriteRune(c)
+		case !isXMLChar(c):
+			repairs = append(repairs, Repair{line, fmt.Sprintf("removed the character %U, which XML does not allow", c)})
+		default:
+			if c == '\n' {
+				line++
+			}
+			b.WriteString(text[i : i+size])
+		}
+		i += size
+	}
+	return b.String(), repairs
+}
+
+func isXMLChar(c rune) bool {
+	return c == '\t' || c == '\n' || c == '\r' || c >= 0x20 && c <= 0xD7FF || c >= 0xE000 && c <= 0xFFFD || c >= 0x10000 && c <= 0x10FFFF
+}
+
+func (r *xmlRepairer) report(pos int, msg string) {
+	line := sort.Search(len(r.lines), func(i int) bool { return r.lines[i] > pos })
+	if n := len(r.repairs); n > 0 && r.repairs[n-1] == (Repair{line, msg}) {
+		return
+	}
+	r.repairs = append(r.repairs, Repair{line, msg})
+}
+
+func (r *xmlRepairer) rest() string { return r.src[r.pos:] }
+
+// copyThrough copies up to and including end, supplying end when the
+// input ends first.
+func (r *xmlRepairer) copyThrough(end, what string) {
+	i := strings.Index(r.rest(), end)
+	if i < 0 {
+		r.report(r.pos, "closed the unterminated "+what)
+		r.out.WriteString(r.rest())
+		r.out.WriteString(end)
+		r.pos = len(r.src)
+		return
+	}
+	r.out.WriteString(r.src[r.pos : r.pos+i+len(end)])
+	r.pos += i + len(end)
+}
+
+func (r *xmlRepairer) document() {
+	for r.pos < len(r.src) {
+		rest := r.rest()
+		switch {
+		case rest[0] == '&':
+			r.reference(false)
+		case rest[0] != '<':
+			i := strings.IndexAny(rest, "<&")
+			if i < 0 {
+				i = len(rest)
+			}
+			r.out.WriteString(rest[:i])
+			r.pos += i
+		case strings.HasPrefix(rest, "<!--"):
+			r.copyThrough("-->", "comment")
+		case strings.HasPrefix(rest, "<![CDATA["):
+			r.copyThrough("]]>", "CDATA section")
+		case strings.HasPrefix(rest, "<?"):
+			r.copyThrough("?>", "processing instruction")
+		case strings.HasPrefix(rest, "<!"):
+			r.directive()
+		case strings.HasPrefix(rest, "</"):
+			r.endTag()
+		case len(rest) > 1 && isNameStart(rest[1:]):
+			r.startTag()
+		default:
+			r.report(r.pos, "escaped a stray <")
+			r.out.WriteString("&lt;")
+			r.pos++
+		}
+	}
+	for len(r.open) > 0 {
+		name := r.open[len(r.open)-1]
+		r.report(len(r.src), "closed <"+name+">, still open at the end")
+		r.close()
+	}
+}
+
+// directive copies a <!DOCTYPE ...> or other declaration, with its
+// internal subset and quoted strings.
+func (r *xmlRepairer) directive() {
+	depth, quote := 0, byte(0)
+	for i := 2; i < len(r.rest()); i++ {
+		c := r.rest()[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case c == '>' && depth <= 0:
+			r.out.WriteString(r.rest()[:i+1])
+			r.pos += i + 1
+			return
+		}
+	}
+	r.copyThrough(">", "declaration")
+}
+
+// reference copies an entity or character reference at pos. A stray & is
+// escaped, an HTML entity XML does not predefine replaced by its text,
+// and a reference to a character XML does not allow dropped.
+func (r *xmlRepairer) reference(inAttr bool) {
+	rest := r.rest()
+	end := strings.IndexByte(rest, ';')
+	ref := ""
+	if end > 1 {
+		ref = rest[1:end]
+	}
+	switch {
+	case ref == "":
+	case ref[0] == '#':
+		var c rune
+		var err error
+		if strings.HasPrefix(ref, "#x") {
+			_, err = fmt.Sscanf(ref[2:], "%x", &c)
+		} else {
+			_, err = fmt.Sscanf(ref[1:], "%d", &c)
+		}
+		ok := err == nil && strings.Trim(strings.TrimPrefix(ref[1:], "x"), "0123456789abcdefABCDEF") == ""
+		if ok && isXMLChar(c) {
+			r.out.WriteString(rest[:end+1])
+			r.pos += end + 1
+			return
+		}
+		if ok {
+			r.report(r.pos, "removed the reference &"+ref+"; to a character XML does not allow")
+			r.pos += end + 1
+			return
+		}
+	case ref == "amp" || ref == "lt" || ref == "gt" || ref == "quot" || ref == "apos":
+		r.out.WriteString(rest[:end+1])
+		r.pos += end + 1
+		return
+	default:
+		if value, ok := xml.HTMLEntity[ref]; ok {
+			r.report(r.pos, "replaced the undeclared entity &"+ref+"; by its character")
+			if inAttr {
+				value = escapeAttr(value)
+			}
+			r.out.WriteString(value)
+			r.pos += end + 1
+			return
+		}
+	}
+	r.report(r.pos, "escaped a stray &")
+	r.out.WriteString("&amp;")
+	r.pos++
+}
+
+func isNameStart(s string) bool {
+	c, _ := utf8.DecodeRuneInString(s)
+	return c == '_' || c == ':' || unicode.IsLetter(c)
+}
+
+// name reads an XML name at pos.
+func (r *xmlRepairer) name() string {
+	rest := r.rest()
+	i := 0
+	for i < len(rest) {
+		c, size := utf8.DecodeRuneInString(rest[i:])
+		if !(c == '_' || c == ':' || c == '-' || c == '.' || unicode.IsLetter(c) || unicode.IsDigit(c) || c >= 0x80 && !unicode.IsSpace(c)) {
+			break
+		}
+		i += size
+	}
+	r.pos += i
+	return rest[:i]
+}
+
+func (r *xmlRepairer) skipSpace() {
+	for r.pos < len(r.src) && strings.IndexByte(" \t\r\n", r.src[r.pos]) >= 0 {
+		r.pos++
+	}
+}
+
+func (r *xmlRepairer) startTag() {
+	start := r.pos
+	r.pos++
+	name := r.name()
+	if len(r.open) == 0 {
+		if r.root {
+			r.report(start, "kept <"+name+">, an element after the root element, beside it")
+		}
+		r.root = true
+	}
+	r.out.WriteString("<" + name)
+	seen := map[string]bool{}
+	for {
+		r.skipSpace()
+		rest := r.rest()
+		switch {
+		case rest == "" || rest[0] == '<':
+			r.report(start, "closed the unterminated start tag <"+name+">")
+			r.out.WriteString(">")
+			r.open = append(r.open, name)
+			return
+		case strings.HasPrefix(rest, "/>"):
+			r.out.WriteString("/>")
+			r.pos += 2
+			return
+		case rest[0] == '>':
+			r.out.WriteString(">")
+			r.pos++
+			r.open = append(r.open, name)
+			return
+		case !isNameStart(rest):
+			r.report(r.pos, fmt.Sprintf("removed a stray %q from the start tag <%s>", rest[0], name))
+			r.pos++
+			continue
+		}
+		if attr := r.attribute(name); seen[attr] {
+			r.report(start, "kept the last value of the repeated attribute "+attr+" of <"+name+">")
+		} else {
+			seen[attr] = true
+		}
+	}
+}
+
+// attribute copies an attribute of the start tag of element, quoting a
+// value written without quotes and giving one without value its name, and
+// returns its name.
+func (r *xmlRepairer) attribute(element string) string {
+	attr := r.name()
+	r.out.WriteString(" " + attr + "=")
+	r.skipSpace()
+	if !strings.HasPrefix(r.rest(), "=") {
+		r.report(r.pos, "gave the attribute "+attr+" of <"+element+"> its name as value")
+		r.out.WriteString(`"` + attr + `"`)
+		return attr
+	}
+	r.pos++
+	r.skipSpace()
+	rest := r.rest()
+	if rest != "" && (rest[0] == '"' || rest[0] == '\'') {
+		quote := rest[0]
+		end := strings.IndexByte(rest[1:], quote)
+		if end < 0 {
+			r.report(r.pos, "closed the unterminated value of the attribute "+attr+" of <"+element+">")
+			end = strings.IndexAny(rest[1:], "<>")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			r.value(string(quote), rest[1:end+1])
+			r.pos += end + 1
+			return attr
+		}
+		r.value(string(quote), rest[1:end+1])
+		r.pos += end + 2
+		return attr
+	}
+	end := strings.IndexAny(rest, " \t\r\n>")
+	if end < 0 {
+		end = len(rest)
+	}
+	if strings.HasSuffix(rest[:end], "/") && end < len(rest) && rest[end] == '>' {
+		end--
+	}
+	r.report(r.pos, "quoted the value of the attribute "+attr+" of <"+element+">")
+	r.value(`"`, strings.ReplaceAll(rest[:end], `"`, "&quot;"))
+	r.pos += end
+	return attr
+}
+
+// value writes an attribute value in quotes, with references repaired as
+// in text and < escaped.
+func (r *xmlRepairer) value(quote, v string) {
+	r.out.WriteString(quote)
+	sub := &xmlRepairer{src: v, lines: r.lines}
+	for sub.pos < len(v) {
+		switch v[sub.pos] {
+		case '&':
+			sub.reference(true)
+		case '<':
+			sub.out.WriteString("&lt;")
+			sub.pos++
+		default:
+			sub.out.WriteByte(v[sub.pos])
+			sub.pos++
+		}
+	}
+	if strings.Contains(v, "<") {
+		r.report(r.pos, "escaped a < in an attribute value")
+	}
+	// Offsets in sub are within the value; report its repairs here.
+	for _, rep := range sub.repairs {
+		r.report(r.pos, rep.Message)
+	}
+	r.out.WriteString(sub.out.String())
+	r.out.WriteString(quote)
+}
+
+// endTag matches an end tag with the open elements: one differing only in
+// case from the innermost is corrected, elements left open inside the
+// one it closes are closed, and an end tag closing nothing is dropped.
+func (r *xmlRepairer) endTag() {
+	start := r.pos
+	r.pos += 2
+	name := r.name()
+	r.skipSpace()
+	if strings.HasPrefix(r.rest(), ">") {
+		r.pos++
+	} else {
+		r.report(start, "closed the unterminated end tag </"+name+">")
+	}
+	match := -1
+	for i := len(r.open) - 1; i >= 0; i-- {
+		if r.open[i] == name {
+			match = i
+			break
+		}
+	}
+	for i := len(r.open) - 1; match < 0 && i >= 0; i-- {
+		if strings.EqualFold(r.open[i], name) {
+			match = i
+			r.report(start, "changed the end tag </"+name+"> to </"+r.open[i]+"> to match its start tag")
+		}
+	}
+	if match < 0 {
+		r.report(start, "removed the end tag </"+name+">, which closes no element")
+		return
+	}
+	for len(r.open) > match+1 {
+		r.report(start, "closed <"+r.open[len(r.open)-1]+"> before </"+name+">")
+		r.close()
+	}
+	r.close()
+}
+
+func (r *xmlRepairer) close() {
+	r.out.WriteString("</" + r.open[len(r.open)-1] + ">")
+	r.open = r.open[:len(r.open)-1]
+}
@@ -0,0 +1,34 @@
+package xform
+
+import "testing"
+
+func TestLenientReportsRepairs(t *testing.T) {
+	tests := []struct {
+		input, want, repair string
+	}{
+		{`<a b="1" b="2"/>`, `<a b="2"/>`, `line 1: kept the last value of the repeated attribute b of <a>`},
+		{"<a/>\n<b/>", `<a/><b/>`, `line 2: kept <b>, an element after the root element, beside it`},
+	}
+	for _, tt := range tests {
+		doc, repairs, err := ParseXMLLenient([]byte(tt.input))
+		if err != nil {
+			t.Fatalf("%q: %v", tt.input, err)
+		}
+		if got := Serialize(doc); got != tt.want {
+			t.Errorf("%q parsed as %q, want %q", tt.input, got, tt.want)
+		}
+		if len(repairs) != 1 || repairs[0].String() != tt.repair {
+			t.Errorf("%q: repairs %v, want [%s]", tt.input, repairs, tt.repair)
+		}
+	}
+}
+
+func TestLenientLeavesDistinctAttributes(t *testing.T) {
+	_, repairs, err := ParseXMLLenient([]byte(`<a b="1" c="2"><b b="3"/></a>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repairs) != 0 {
+		t.Errorf("repairs %v, want none", repairs)
+	}
+}
@@ -2,8 +2,11 @@ package xform
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
 type TokenKind string
@@ -19,6 +22,18 @@ const (
 	TokDot    TokenKind = "DOT"
 	TokSlash  TokenKind = "SLASH"
 	TokAt     TokenKind = "AT"
+	TokVar    TokenKind = "VAR" // $name; Val is the name, which may be a keyword
+	// TokComment is a "# ..." comment, recorded in Lexer.Comments rather
+	// than returned by Next.
+	TokComment TokenKind = "COMMENT"
+
+	// Tokens of constructor content, read by NextContent.
+	TokText     TokenKind = "TEXT"     // character data
+	TokCData    TokenKind = "CDATA"    // contents of <![CDATA[...]]>
+	TokStartTag TokenKind = "STARTTAG" // '<' of a nested constructor, not consumed
+	TokEndTag   TokenKind = "ENDTAG"   // </name>; Val is the name
+	TokInterp   TokenKind = "INTERP"   // '{' or "{-" opening an interpolation
+	TokTextCtor TokenKind = "TEXTCTOR" // "text" before the '{' of text { expr }
 )
 
 type Token struct {
@@ -58,6 +73,8 @@ type Lexer struct {
 	Text   string
 	Pos    int
 	Buffer *Token
+	// Comments are the comments skipped so far, in source order.
+	Comments []Token
 }
 
 func NewLexer(text string) *Lexer {
@@ -84,7 +101,7 @@ func (l *Lexer) Next() Token {
 func (l *Lexer) Expect(kind TokenKind, value string) Token {
 	tok := l.Next()
 	if tok.Kind != kind || (value != "" && tok.Val != value) {
-		panic(fmt.Errorf("expected %s %s at %d", kind, value, tok.Pos))
+		panic(fmt.Errorf("XFST0001: expected %s %s at %d", kind, value, tok.Pos))
 	}
 	return tok
 }
@@ -96,14 +113,20 @@ func (l *Lexer) ClearBuffer() {
 func (l *Lexer) skipWsComments() {
 	for l.Pos < len(l.Text) {
 		ch := l.Text[l.Pos]
-		if unicode.IsSpace(rune(ch)) {
-			l.Pos++
+		if r, size := utf8.DecodeRuneInString(l.Text[l.Pos:]); unicode.IsSpace(r) {
+			l.Pos += size
 			continue
 		}
 		if ch == '#' {
+			start := l.Pos
 			for l.Pos < len(l.Text) && l.Text[l.Pos] != '\n' {
 				l.Pos++
 			}
+			// Text read again after backtracking is recorded once.
+			if n := len(l.Comments); n == 0 || l.Comments[n-1].Pos < start {
+				text := strings.TrimRight(l.Text[start:l.Pos], "\r")
+				l.Comments = append(l.Comments, Token{Kind: TokComment, Val: text, Pos: start})
+			}
 			continue
 		}
 		break
@@ -124,6 +147,13 @@ func (l *Lexer) nextToken() Token {
 		return Token{Kind: TokOp, Val: ":=", Pos: start}
 	}
 
+	// "-}" after whitespace closes a content interpolation and trims the
+	// whitespace that follows it, as in <p>{ x -} </p>.
+	if ch == '-' && l.Pos > 0 && l.Pos+1 < len(l.Text) && l.Text[l.Pos+1] == '}' && strings.IndexByte(" \t\r\n", l.Text[l.Pos-1]) >= 0 {
+		l.Pos += 2
+		return Token{Kind: TokPunct, Val: "-}", Pos: l.Pos - 2}
+	}
+
 	if strings.Contains("(){}[],:;", string(ch)) {
 		l.Pos++
 		return Token{Kind: TokPunct, Val: string(ch), Pos: l.Pos - 1}
@@ -153,6 +183,12 @@ func (l *Lexer) nextToken() Token {
 		return Token{Kind: TokSlash, Val: "/", Pos: start}
 	}
 
+	if strings.HasPrefix(l.Text[l.Pos:], "===") {
+		start := l.Pos
+		l.Pos += 3
+		return Token{Kind: TokOp, Val: "===", Pos: start}
+	}
+
 	if strings.Contains("<>=!+-*", string(ch)) {
 		start := l.Pos
 		l.Pos++
@@ -164,103 +200,318 @@ func (l *Lexer) nextToken() Token {
 	}
 
 	if ch == '\'' || ch == '"' {
-		quote := ch
+		return l.lexString()
+	}
+
+	if unicode.IsDigit(rune(ch)) {
+		return l.lexNumber()
+	}
+
+	if ch == '$' {
 		start := l.Pos
 		l.Pos++
-		out := make([]rune, 0)
-		for l.Pos < len(l.Text) {
-			c := l.Text[l.Pos]
-			if c == '\\' {
-				l.Pos++
-				if l.Pos >= len(l.Text) {
-					break
-				}
-				esc := l.Text[l.Pos]
-				switch esc {
-				case 'n':
-					out = append(out, '\n')
-				case 't':
-					out = append(out, '\t')
-				case 'r':
-					out = append(out, '\r')
-				case 'u':
-					if l.Pos+4 < len(l.Text) {
-						hex := l.Text[l.Pos+1 : l.Pos+5]
-						out = append(out, rune(parseHex(hex)))
-						l.Pos += 4
-					}
-				default:
-					out = append(out, rune(esc))
-				}
-				l.Pos++
-				continue
+		if r, _ := utf8.DecodeRuneInString(l.Text[l.Pos:]); !unicode.IsLetter(r) && r != '_' {
+			panic(fmt.Errorf("XFST0001: expected a variable name after $ at %d", start))
+		}
+		return Token{Kind: TokVar, Val: l.scanName(), Pos: start}
+	}
+
+	if r, _ := utf8.DecodeRuneInString(l.Text[l.Pos:]); unicode.IsLetter(r) || ch == '_' {
+		start := l.Pos
+		val := l.scanName()
+		if keywords[val] {
+			return Token{Kind: TokKW, Val: val, Pos: start}
+		}
+		return Token{Kind: TokIdent, Val: val, Pos: start}
+	}
+
+	if ch == '@' {
+		l.Pos++
+		return Token{Kind: TokAt, Val: "@", Pos: l.Pos - 1}
+	}
+
+	r, _ := utf8.DecodeRuneInString(l.Text[l.Pos:])
+	panic(fmt.Errorf("XFST0001: unexpected character %q at %d", r, l.Pos))
+}
+
+// NextContent reads the next token of element constructor content, where
+// the expression rules do not apply: text runs up to the next '<' or '{',
+// with <!-- comments --> dropped, CDATA sections, tags and the openings of
+// interpolations. A token buffered by Peek is discarded and re-read.
+func (l *Lexer) NextContent() Token {
+	if l.Buffer != nil {
+		l.Pos = l.Buffer.Pos
+		l.Buffer = nil
+	}
+	start := l.Pos
+	text := &strings.Builder{}
+	blank := true
+	for l.Pos < len(l.Text) {
+		rest := l.Text[l.Pos:]
+		switch {
+		case strings.HasPrefix(rest, "<!--"):
+			end := strings.Index(rest[4:], "-->")
+			if end < 0 {
+				panic(fmt.Errorf("XFST0001: unterminated comment at %d", l.Pos))
 			}
-			if c == quote {
-				l.Pos++
-				return Token{Kind: TokString, Val: string(out), Pos: start}
+			l.Pos += 4 + end + 3
+			continue
+		case strings.HasPrefix(rest, "<![CDATA["):
+			if text.Len() > 0 {
+				return Token{Kind: TokText, Val: text.String(), Pos: start}
 			}
-			out = append(out, rune(c))
+			end := strings.Index(rest[9:], "]]>")
+			if end < 0 {
+				panic(fmt.Errorf("XFST0001: unterminated CDATA section at %d", l.Pos))
+			}
+			l.Pos += 9 + end + 3
+			return Token{Kind: TokCData, Val: rest[9 : 9+end], Pos: start}
+		case rest[0] == '<' || rest[0] == '{':
+		case strings.HasPrefix(rest, "text") && blank && l.atTextCtor():
+		default:
+			blank = blank && strings.IndexByte(" \t\r\n", rest[0]) >= 0
+			text.WriteByte(rest[0])
+			l.Pos++
+			continue
+		}
+		break
+	}
+	if text.Len() > 0 {
+		return Token{Kind: TokText, Val: text.String(), Pos: start}
+	}
+	rest := l.Text[l.Pos:]
+	switch {
+	case rest == "":
+		return Token{Kind: TokEOF, Pos: l.Pos}
+	case strings.HasPrefix(rest, "</"):
+		return l.lexEndTag()
+	case rest[0] == '<':
+		return Token{Kind: TokStartTag, Val: "<", Pos: l.Pos}
+	case rest[0] == '{':
+		l.Pos++
+		// "{- expr}" also trims the whitespace before it; the '-' must be
+		// followed by whitespace, so {-1} is still a negative number.
+		if len(rest) > 2 && rest[1] == '-' && strings.IndexByte(" \t\r\n", rest[2]) >= 0 {
 			l.Pos++
+			return Token{Kind: TokInterp, Val: "{-", Pos: start}
 		}
-		panic(fmt.Errorf("unterminated string at %d", start))
+		return Token{Kind: TokInterp, Val: "{", Pos: start}
 	}
+	l.Pos += len("text")
+	return Token{Kind: TokTextCtor, Val: "text", Pos: start}
+}
 
-	if unicode.IsDigit(rune(ch)) {
-		start := l.Pos
-		for l.Pos < len(l.Text) {
-			c := l.Text[l.Pos]
-			if !unicode.IsDigit(rune(c)) && c != '.' {
-				break
+// atTextCtor reports whether the content at l.Pos is "text" followed by
+// optional whitespace and '{'.
+func (l *Lexer) atTextCtor() bool {
+	rest := strings.TrimLeft(l.Text[l.Pos+len("text"):], " \t\r\n")
+	return strings.HasPrefix(rest, "{")
+}
+
+func (l *Lexer) lexEndTag() Token {
+	start := l.Pos
+	pos := l.Pos + 2
+	for pos < len(l.Text) {
+		r, size := utf8.DecodeRuneInString(l.Text[pos:])
+		if !isNameRune(r) && r != ':' {
+			break
+		}
+		pos += size
+	}
+	name := l.Text[start+2 : pos]
+	for pos < len(l.Text) && strings.IndexByte(" \t\r\n", l.Text[pos]) >= 0 {
+		pos++
+	}
+	if pos >= len(l.Text) || l.Text[pos] != '>' {
+		panic(fmt.Errorf("XFST0001: unterminated end tag at %d", start))
+	}
+	l.Pos = pos + 1
+	return Token{Kind: TokEndTag, Val: name, Pos: start}
+}
+
+// SkipSpace skips XML whitespace in constructor content, after a "-}".
+func (l *Lexer) SkipSpace() {
+	for l.Pos < len(l.Text) && strings.IndexByte(" \t\r\n", l.Text[l.Pos]) >= 0 {
+		l.Pos++
+	}
+}
+
+// scanName reads an identifier from l.Pos. A ':' between name characters
+// belongs to it, so prefixed names such as x:item are one token.
+func (l *Lexer) scanName() string {
+	start := l.Pos
+	for l.Pos < len(l.Text) {
+		if l.Text[l.Pos] == ':' {
+			if next, _ := utf8.DecodeRuneInString(l.Text[l.Pos+1:]); isNameRune(next) {
+				l.Pos++
+				continue
 			}
-			l.Pos++
+			break
+		}
+		r, size := utf8.DecodeRuneInString(l.Text[l.Pos:])
+		if !isNameRune(r) {
+			break
 		}
-		return Token{Kind: TokNumber, Val: l.Text[start:l.Pos], Pos: start}
+		l.Pos += size
 	}
+	return l.Text[start:l.Pos]
+}
 
-	if unicode.IsLetter(rune(ch)) || ch == '_' {
-		start := l.Pos
+// isNameRune reports whether r may continue an identifier or element name:
+// a letter or digit of any script, '_' or '-'. Combining marks are allowed
+// so that decomposed text (e + U+0301) stays one name.
+func isNameRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r) || r == '_' || r == '-'
+}
+
+// lexNumber reads a decimal literal with optional fraction and exponent
+// (1.5e-3) or a hex literal (0xFF); digits may be grouped with underscores
+// (1_000_000). The token value is the number in a form ParseFloat accepts.
+func (l *Lexer) lexNumber() Token {
+	start := l.Pos
+	digits := func(isDigit func(byte) bool) {
 		for l.Pos < len(l.Text) {
 			c := l.Text[l.Pos]
-			if c == ':' {
-				if l.Pos+1 < len(l.Text) && (unicode.IsLetter(rune(l.Text[l.Pos+1])) || unicode.IsDigit(rune(l.Text[l.Pos+1])) || l.Text[l.Pos+1] == '_' || l.Text[l.Pos+1] == '-') {
-					l.Pos++
-					continue
-				}
-				break
+			if c == '_' && l.Pos > start && isDigit(l.Text[l.Pos-1]) && l.Pos+1 < len(l.Text) && isDigit(l.Text[l.Pos+1]) {
+				l.Pos++
+				continue
 			}
-			if !(unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)) || c == '_' || c == '-') {
-				break
+			if !isDigit(c) {
+				return
 			}
 			l.Pos++
 		}
-		val := l.Text[start:l.Pos]
-		if keywords[val] {
-			return Token{Kind: TokKW, Val: val, Pos: start}
+	}
+	isDec := func(c byte) bool { return c >= '0' && c <= '9' }
+	isHex := func(c byte) bool { return isDec(c) || (c|0x20) >= 'a' && (c|0x20) <= 'f' }
+	val := ""
+	if l.Text[l.Pos] == '0' && l.Pos+2 < len(l.Text) && (l.Text[l.Pos+1]|0x20) == 'x' && isHex(l.Text[l.Pos+2]) {
+		l.Pos += 2
+		digitsStart := l.Pos
+		digits(isHex)
+		n, err := strconv.ParseUint(strings.ReplaceAll(l.Text[digitsStart:l.Pos], "_", ""), 16, 64)
+		if err != nil {
+			panic(fmt.Errorf("XFST0001: hex literal %s out of range at %d", l.Text[start:l.Pos], start))
 		}
-		return Token{Kind: TokIdent, Val: val, Pos: start}
+		val = strconv.FormatUint(n, 10)
+	} else {
+		digits(isDec)
+		if l.Pos+1 < len(l.Text) && l.Text[l.Pos] == '.' && isDec(l.Text[l.Pos+1]) {
+			l.Pos++
+			digits(isDec)
+		}
+		if l.Pos < len(l.Text) && (l.Text[l.Pos]|0x20) == 'e' {
+			exp := l.Pos + 1
+			if exp < len(l.Text) && (l.Text[exp] == '+' || l.Text[exp] == '-') {
+				exp++
+			}
+			if exp < len(l.Text) && isDec(l.Text[exp]) {
+				l.Pos = exp
+				digits(isDec)
+			}
+		}
+		val = strings.ReplaceAll(l.Text[start:l.Pos], "_", "")
+	}
+	// A number running into a letter, underscore or another fraction, as in
+	// 1.2.3, 12px or 1__0, is malformed rather than two tokens.
+	end := l.Pos
+	for end < len(l.Text) {
+		r, size := utf8.DecodeRuneInString(l.Text[end:])
+		if r == '.' && !(end+1 < len(l.Text) && isDec(l.Text[end+1])) || r != '.' && (r == '-' || !isNameRune(r)) {
+			break
+		}
+		end += size
 	}
+	if end > l.Pos {
+		panic(fmt.Errorf("XFST0001: malformed number %q at %d", l.Text[start:end], start))
+	}
+	return Token{Kind: TokNumber, Val: val, Pos: start}
+}
 
-	if ch == '@' {
+// lexString reads a quoted string literal. Escapes are \n, \t, \r, \\,
+// \', \", \xHH, \uXXXX (a UTF-16 unit; a surrogate pair is combined) and
+// \u{X...} with up to six hex digits for any code point; anything else
+// after a backslash is a parse error.
+func (l *Lexer) lexString() Token {
+	quote := l.Text[l.Pos]
+	start := l.Pos
+	l.Pos++
+	out := []byte{}
+	for l.Pos < len(l.Text) {
+		c := l.Text[l.Pos]
+		if c == quote {
+			l.Pos++
+			return Token{Kind: TokString, Val: string(out), Pos: start}
+		}
+		if c != '\\' {
+			out = append(out, c)
+			l.Pos++
+			continue
+		}
+		escPos := l.Pos
 		l.Pos++
-		return Token{Kind: TokAt, Val: "@", Pos: l.Pos - 1}
+		if l.Pos >= len(l.Text) {
+			break
+		}
+		esc := l.Text[l.Pos]
+		l.Pos++
+		switch esc {
+		case 'n':
+			out = append(out, '\n')
+		case 't':
+			out = append(out, '\t')
+		case 'r':
+			out = append(out, '\r')
+		case '\\', '\'', '"':
+			out = append(out, esc)
+		case 'x':
+			out = utf8.AppendRune(out, l.escapeHex(2, escPos))
+		case 'u':
+			if l.Pos < len(l.Text) && l.Text[l.Pos] == '{' {
+				end := strings.IndexByte(l.Text[l.Pos:], '}')
+				if end < 2 || end > 7 {
+					panic(fmt.Errorf("XFST0001: invalid escape \\u{...} at %d: want 1 to 6 hex digits", escPos))
+				}
+				l.Pos++
+				r := l.escapeHex(end-1, escPos)
+				l.Pos++
+				if r > unicode.MaxRune || (r >= 0xD800 && r <= 0xDFFF) {
+					panic(fmt.Errorf("XFST0001: invalid escape %s at %d: not a Unicode scalar value", l.Text[escPos:l.Pos], escPos))
+				}
+				out = utf8.AppendRune(out, r)
+				continue
+			}
+			r := l.escapeHex(4, escPos)
+			if r >= 0xD800 && r <= 0xDBFF && strings.HasPrefix(l.Text[l.Pos:], "\\u") {
+				save := l.Pos
+				l.Pos += 2
+				if low := l.escapeHex(4, save); low >= 0xDC00 && low <= 0xDFFF {
+					r = utf16.DecodeRune(r, low)
+				} else {
+					l.Pos = save
+				}
+			}
+			if r >= 0xD800 && r <= 0xDFFF {
+				panic(fmt.Errorf("XFST0001: invalid escape %s at %d: unpaired surrogate", l.Text[escPos:l.Pos], escPos))
+			}
+			out = utf8.AppendRune(out, r)
+		default:
+			panic(fmt.Errorf("XFST0001: invalid escape \\%c at %d", esc, escPos))
+		}
 	}
-
-	panic(fmt.Errorf("unexpected character %q at %d", ch, l.Pos))
+	panic(fmt.Errorf("XFST0001: unterminated string at %d", start))
 }
 
-func parseHex(s string) int {
-	val := 0
-	for i := 0; i < len(s); i++ {
-		val <<= 4
-		c := s[i]
-		switch {
-		case c >= '0' && c <= '9':
-			val += int(c - '0')
-		case c >= 'a' && c <= 'f':
-			val += int(c-'a') + 10
-		case c >= 'A' && c <= 'F':
-			val += int(c-'A') + 10
-		}
+// escapeHex reads exactly n hex digits of an escape starting at escPos.
+func (l *Lexer) escapeHex(n, escPos int) rune {
+	var v uint64
+	err := fmt.Errorf("short")
+	if l.Pos+n <= len(l.Text) {
+		v, err = strconv.ParseUint(l.Text[l.Pos:l.Pos+n], 16, 32)
+	}
+	if err != nil {
+		panic(fmt.Errorf("XFST0001: invalid escape %s at %d: want %d hex digits", l.Text[escPos:l.Pos], escPos, n))
 	}
-	return val
+	l.Pos += n
+	return rune(v)
 }
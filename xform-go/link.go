@@ -0,0 +1,328 @@
+package xform
+
+import "sort"
+
+// link returns the module name with its imports merged in, each import
+// linked first. An import without alias contributes its functions,
+// variables, parameters and rules under their own names; the importing
+// module's definitions take precedence, and its rules of a shared rule set
+// come before the imported ones. "import ... as u" prefixes every name of the
+// imported module with u: (u:f(), u:v, apply(x, "u:set")). Namespace
+// declarations are merged for prefixes the importing module leaves free.
+func (p *Program) link(name string, linked map[string]*Module) *Module {
+	if m, ok := linked[name]; ok {
+		return m
+	}
+	module := p.Modules[name]
+	if len(module.Imports) == 0 {
+		linked[name] = module
+		return module
+	}
+	out := *module
+	out.Functions = copyFunctions(module.Functions)
+	out.Rules = map[string][]RuleDef{}
+	for k, v := range module.Rules {
+		out.Rules[k] = append([]RuleDef{}, v...)
+	}
+	out.Vars = map[string]Expr{}
+	for k, v := range module.Vars {
+		out.Vars[k] = v
+	}
+	out.Params = append([]Param{}, module.Params...)
+	out.Namespaces = map[string]string{}
+	for k, v := range module.Namespaces {
+		out.Namespaces[k] = v
+	}
+	for _, imp := range module.Imports {
+		lib := p.link(p.importPath(name, *imp[0]), linked)
+		if imp[1] != nil {
+			lib = aliased(lib, *imp[1])
+		}
+		for k, fn := range lib.Functions {
+			if _, ok := out.Functions[k]; !ok {
+				out.Functions[k] = fn
+			}
+		}
+		for k, v := range lib.Vars {
+			if _, ok := out.Vars[k]; !ok {
+				out.Vars[k] = v
+			}
+		}
+		for _, param := range lib.Params {
+			if !hasParam(out.Params, param.Name) {
+				out.Params = append(out.Params, param)
+			}
+		}
+		for _, k := range sortedRuleSets(lib.Rules) {
+			out.Rules[k] = append(out.Rules[k], lib.Rules[k]...)
+		}
+		for k, v := range lib.Namespaces {
+			if _, ok := out.Namespaces[k]; !ok {
+				out.Namespaces[k] = v
+			}
+		}
+	}
+	linked[name] = &out
+	return &out
+}
+
+func hasParam(params []Param, name string) bool {
+	for _, param := range params {
+		if param.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func copyFunctions(src map[string]FunctionDef) map[string]FunctionDef {
+	out := make(map[string]FunctionDef, len(src))
+	for k, v := range src {
+		out[k] = v
+	}
+	return out
+}
+
+func sortedRuleSets(rules map[string][]RuleDef) []string {
+	names := make([]string, 0, len(rules))
+	for k := range rules {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// aliased renames the functions, variables and rule sets of lib to
+// alias:name, rewriting the references between them.
+func aliased(lib *Module, alias string) *Module {
+	r := renamer{refs: map[string]string{}, rules: map[string]string{}}
+	for k := range lib.Functions {
+		r.refs[k] = alias + ":" + k
+	}
+	for k := range lib.Vars {
+		r.refs[k] = alias + ":" + k
+	}
+	for _, param := range lib.Params {
+		r.refs[param.Name] = alias + ":" + param.Name
+	}
+	for k := range lib.Rules {
+		r.rules[k] = alias + ":" + k
+	}
+	out := *lib
+	out.Functions = map[string]FunctionDef{}
+	for k, fn := range lib.Functions {
+		params := append([]Param{}, fn.Params...)
+		for i, param := range params {
+			if param.Default != nil {
+				params[i].Default = r.expr(param.Default, map[string]bool{})
+			}
+		}
+		bound := map[string]bool{}
+		for _, param := range params {
+			bound[param.Name] = true
+		}
+		fn.Params = params
+		fn.Name = r.refs[k]
+		fn.Body = r.expr(fn.Body, bound)
+		out.Functions[fn.Name] = fn
+	}
+	out.Vars = map[string]Expr{}
+	for k, v := range lib.Vars {
+		out.Vars[r.refs[k]] = r.expr(v, map[string]bool{})
+	}
+	out.Params = make([]Param, len(lib.Params))
+	for i, param := range lib.Params {
+		param.Name = r.refs[param.Name]
+		if param.Default != nil {
+			param.Default = r.expr(param.Default, map[string]bool{})
+		}
+		out.Params[i] = param
+	}
+	out.Rules = map[string][]RuleDef{}
+	for k, rules := range lib.Rules {
+		renamed := make([]RuleDef, len(rules))
+		for i, rule := range rules {
+			bound := map[string]bool{}
+			patternVars(rule.Pattern, bound)
+			rule.Name = r.rules[k]
+			rule.Body = r.expr(rule.Body, bound)
+			renamed[i] = rule
+		}
+		out.Rules[r.rules[k]] = renamed
+	}
+	return &out
+}
+
+// renamer rewrites references to renamed functions, variables (refs) and
+// rule sets named in apply() calls (rules). Local bindings shadow refs.
+type renamer struct {
+	refs  map[string]string
+	rules map[string]string
+}
+
+func (r renamer) name(name string, bound map[string]bool) string {
+	if to, ok := r.refs[name]; ok && !bound[name] {
+		return to
+	}
+	return name
+}
+
+func (r renamer) exprs(exprs []Expr, bound map[string]bool) []Expr {
+	out := make([]Expr, len(exprs))
+	for i, e := range exprs {
+		out[i] = r.expr(e, bound)
+	}
+	return out
+}
+
+func (r renamer) expr(expr Expr, bound map[string]bool) Expr {
+	switch e := expr.(type) {
+	case VarRef:
+		e.Name = r.name(e.Name, bound)
+		return e
+	case IfExpr:
+		e.Cond = r.expr(e.Cond, bound)
+		e.ThenExpr = r.expr(e.ThenExpr, bound)
+		e.ElseExpr = r.expr(e.ElseExpr, bound)
+		return e
+	case LetExpr:
+		e.Value = r.expr(e.Value, bound)
+		e.Body = r.expr(e.Body, extend(bound, e.Name))
+		return e
+	case ForExpr:
+		e.Seq = r.expr(e.Seq, bound)
+		inner := extend(bound, e.Name)
+		if e.Where != nil {
+			e.Where = r.expr(e.Where, inner)
+		}
+		if len(e.GroupBy) > 0 {
+			keys := make([]GroupKey, len(e.GroupBy))
+			for i, k := range e.GroupBy {
+				keys[i] = GroupKey{Name: k.Name, Expr: r.expr(k.Expr, inner)}
+			}
+			for _, k := range keys {
+				inner = extend(inner, k.Name)
+			}
+			e.GroupBy = keys
+		}
+		if len(e.OrderBy) > 0 {
+			keys := make([]OrderKey, len(e.OrderBy))
+			for i, k := range e.OrderBy {
+				k.Expr = r.expr(k.Expr, inner)
+				keys[i] = k
+			}
+			e.OrderBy = keys
+		}
+		e.Body = r.expr(e.Body, inner)
+		return e
+	case TryExpr:
+		e.Body = r.expr(e.Body, bound)
+		e.Catch = r.expr(e.Catch, extend(bound, e.Var))
+		return e
+	case MatchExpr:
+		e.Target = r.expr(e.Target, bound)
+		cases := make([]MatchCase, len(e.Cases))
+		for i, mc := range e.Cases {
+			inner := extend(bound)
+			patternVars(mc.Pattern, inner)
+			cases[i] = MatchCase{Pattern: mc.Pattern, Expr: r.expr(mc.Expr, inner)}
+		}
+		e.Cases = cases
+		if e.Default != nil {
+			e.Default = r.expr(e.Default, bound)
+		}
+		return e
+	case FunctionExpr:
+		inner := extend(bound)
+		params := make([]Param, len(e.Params))
+		for i, param := range e.Params {
+			if param.Default != nil {
+				param.Default = r.expr(param.Default, bound)
+			}
+			inner[param.Name] = true
+			params[i] = param
+		}
+		e.Params = params
+		e.Body = r.expr(e.Body, inner)
+		return e
+	case FuncCall:
+		e.Name = r.name(e.Name, bound)
+		e.Args = r.exprs(e.Args, bound)
+		if e.Name == "apply" && len(e.Args) > 1 {
+			if lit, ok := e.Args[1].(Literal); ok {
+				if set, ok := lit.Value.(string); ok && r.rules[set] != "" {
+					e.Args[1] = Literal{Value: r.rules[set]}
+				}
+			}
+		}
+		return e
+	case UnaryOp:
+		e.Expr = r.expr(e.Expr, bound)
+		return e
+	case BinaryOp:
+		e.Left = r.expr(e.Left, bound)
+		e.Right = r.expr(e.Right, bound)
+		return e
+	case PathExpr:
+		if e.Start.Kind == "var" && e.Start.Name != nil {
+			name := r.name(*e.Start.Name, bound)
+			e.Start.Name = &name
+		}
+		steps := make([]PathStep, len(e.Steps))
+		for i, step := range e.Steps {
+			step.Predicates = r.exprs(step.Predicates, bound)
+			steps[i] = step
+		}
+		e.Steps = steps
+		return e
+	case Constructor:
+		attrs := make([]AttrConstructor, len(e.Attrs))
+		for i, a := range e.Attrs {
+			a.Expr = r.expr(a.Expr, bound)
+			attrs[i] = a
+		}
+		e.Attrs = attrs
+		e.Contents = r.exprs(e.Contents, bound)
+		return e
+	case TextJoin:
+		if e.Sep != nil {
+			e.Sep = r.expr(e.Sep, bound)
+		}
+		e.Expr = r.expr(e.Expr, bound)
+		return e
+	case Sequence:
+		e.Items = r.exprs(e.Items, bound)
+		return e
+	case MapConstructor:
+		entries := make([]MapEntry, len(e.Entries))
+		for i, entry := range e.Entries {
+			entries[i] = MapEntry{Key: r.expr(entry.Key, bound), Value: r.expr(entry.Value, bound)}
+		}
+		e.Entries = entries
+		return e
+	case ArrayConstructor:
+		e.Items = r.exprs(e.Items, bound)
+		return e
+	case Lookup:
+		e.Expr = r.expr(e.Expr, bound)
+		e.Key = r.expr(e.Key, bound)
+		return e
+	case TextConstructor:
+		e.Expr = r.expr(e.Expr, bound)
+		return e
+	case CommentConstructor:
+		e.Expr = r.expr(e.Expr, bound)
+		return e
+	case PIConstructor:
+		e.Name = r.expr(e.Name, bound)
+		e.Expr = r.expr(e.Expr, bound)
+		return e
+	case DocumentConstructor:
+		e.Expr = r.expr(e.Expr, bound)
+		return e
+	case Interp:
+		e.Expr = r.expr(e.Expr, bound)
+		return e
+	}
+	return expr
+}
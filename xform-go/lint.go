@@ -0,0 +1,510 @@
+package xform
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// LintChecks are the checks of Lint, by name, with what they report.
+var LintChecks = map[string]string{
+	"deep-nesting":      "if, for, match, try and inline functions nested deeper than LintConfig.MaxDepth",
+	"broad-scan":        "//* and //node(), which visit every node below their start",
+	"shadowed-variable": "bindings that hide a variable or parameter of the same name in scope",
+	"unreachable-rule":  "rules that never fire because a rule before them, or of higher priority, matches everything they match",
+}
+
+// DefaultMaxDepth is the nesting depth deep-nesting allows when
+// LintConfig.MaxDepth is 0.
+const DefaultMaxDepth = 5
+
+// LintConfig selects the checks of Lint. Checks not in Severity report
+// warnings; Disabled checks report nothing.
+type LintConfig struct {
+	Disabled map[string]bool
+	Severity map[string]Severity
+	MaxDepth int
+}
+
+// LintIssue is a finding of Lint on a line of the module's source.
+type LintIssue struct {
+	Check    string
+	Severity Severity
+	Line     int
+	Message  string
+}
+
+func (i LintIssue) String() string {
+	return fmt.Sprintf("line %d: %s: %s: %s", i.Line, i.Severity, i.Check, i.Message)
+}
+
+// Lint parses src and reports what the checks of cfg find in it, by line.
+// Unlike CheckStrict it flags transforms that work but are likely slow,
+// hard to read or wrong. A comment
+//
+//	# lint:ignore broad-scan,shadowed-variable
+//
+// at the end of a line suppresses those checks on that line, on a line of
+// its own on the next line; "# lint:ignore-file check" anywhere does so for
+// the whole module.
+func Lint(src string, cfg LintConfig) ([]LintIssue, error) {
+	module, err := parseModuleSafe(src)
+	if err != nil {
+		return nil, err
+	}
+	l := &linter{cfg: cfg, ignored: lintSuppressions(src)}
+	if l.cfg.MaxDepth <= 0 {
+		l.cfg.MaxDepth = DefaultMaxDepth
+	}
+	l.module(module)
+	sort.SliceStable(l.issues, func(i, j int) bool {
+		if l.issues[i].Line != l.issues[j].Line {
+			return l.issues[i].Line < l.issues[j].Line
+		}
+		return l.issues[i].Check < l.issues[j].Check
+	})
+	return l.issues, nil
+}
+
+var lintComment = regexp.MustCompile(`#\s*lint:(ignore|ignore-file)\s+([\w,-]+)`)
+
+// lintSuppressions maps line numbers, 0 for the whole module, to the
+// checks suppressed there.
+func lintSuppressions(src string) map[int]map[string]bool {
+	ignored := map[int]map[string]bool{}
+	for i, text := range strings.Split(src, "\n") {
+		m := lintComment.FindStringSubmatch(text)
+		if m == nil {
+			continue
+		}
+		line := i + 1
+		switch {
+		case m[1] == "ignore-file":
+			line = 0
+		case strings.HasPrefix(strings.TrimSpace(text), "#"):
+			line++
+		}
+		if ignored[line] == nil {
+			ignored[line] = map[string]bool{}
+		}
+		for _, check := range strings.Split(m[2], ",") {
+			ignored[line][check] = true
+		}
+	}
+	return ignored
+}
+
+type linter struct {
+	cfg     LintConfig
+	ignored map[int]map[string]bool
+	issues  []LintIssue
+	// reported is set once deep-nesting has reported the definition being
+	// checked, so that each is reported once.
+	reported bool
+}
+
+func (l *linter) report(check string, line int, format string, args ...any) {
+	if l.cfg.Disabled[check] || l.ignored[0][check] || l.ignored[line][check] {
+		return
+	}
+	severity := SeverityWarning
+	if s, ok := l.cfg.Severity[check]; ok {
+		severity = s
+	}
+	l.issues = append(l.issues, LintIssue{Check: check, Severity: severity, Line: line, Message: fmt.Sprintf(format, args...)})
+}
+
+// lintScope maps the variables in scope to a description of where they
+// were bound, for shadowed-variable.
+type lintScope map[string]string
+
+func (s lintScope) with(name, where string) lintScope {
+	out := make(lintScope, len(s)+1)
+	for k, v := range s {
+		out[k] = v
+	}
+	out[name] = where
+	return out
+}
+
+func (l *linter) module(m *Module) {
+	globals := lintScope{}
+	for name := range m.Vars {
+		globals[name] = "the module variable $" + name
+	}
+	for _, param := range m.Params {
+		globals[param.Name] = "the module parameter $" + param.Name
+		l.expr(param.Default, globals, 0, firstLine(param.Default, 0))
+	}
+	names := make([]string, 0, len(m.Vars))
+	for name := range m.Vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		l.reported = false
+		l.expr(m.Vars[name], globals, 0, firstLine(m.Vars[name], 0))
+	}
+	names = names[:0]
+	for name := range m.Functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fn := m.Functions[name]
+		l.reported = false
+		scope := globals
+		for _, param := range fn.Params {
+			if param.Default != nil {
+				l.expr(param.Default, globals, 0, fn.Line)
+			}
+			scope = l.bind(scope, param.Name, fn.Line, "the parameter $"+param.Name+" of "+name)
+		}
+		l.expr(fn.Body, scope, 0, fn.Line)
+	}
+	names = names[:0]
+	for name := range m.Rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		l.rules("rule "+name, m.Rules[name], globals)
+	}
+	for _, set := range m.Validations {
+		l.rules("validate "+set.Name, set.Rules, globals)
+	}
+	for _, phase := range m.Phases {
+		l.reported = false
+		l.expr(phase.Expr, globals, 0, firstLine(phase.Expr, 0))
+	}
+	if m.Expr != nil {
+		l.reported = false
+		l.expr(m.Expr, globals, 0, firstLine(m.Expr, 0))
+	}
+}
+
+// rules checks the bodies of a rule set and whether each of its rules can
+// fire: the rule chosen for an item is the first matching one of the
+// highest priority in its mode, so a rule is unreachable when another of
+// its mode with a higher priority, or the same priority and declared
+// before it, matches every item it matches.
+func (l *linter) rules(set string, rules []RuleDef, globals lintScope) {
+	for i, rule := range rules {
+		for j, other := range rules {
+			if i == j || other.Mode != rule.Mode || other.Priority < rule.Priority || other.Priority == rule.Priority && j > i {
+				continue
+			}
+			if patternSubsumes(other.Pattern, rule.Pattern) {
+				l.report("unreachable-rule", rule.Line, "%s never fires: the rule on line %d matches everything it matches", set, other.Line)
+				break
+			}
+		}
+		l.reported = false
+		scope := globals
+		for _, v := range lintPatternVars(rule.Pattern, nil) {
+			scope = l.bind(scope, v, rule.Line, fmt.Sprintf("the capture $%s of the rule on line %d", v, rule.Line))
+		}
+		l.expr(rule.Body, scope, 0, rule.Line)
+	}
+}
+
+// patternSubsumes reports whether a matches every item b matches.
+func patternSubsumes(a, b Pattern) bool {
+	switch a := a.(type) {
+	case WildcardPattern:
+		return true
+	case TypedPattern:
+		switch b := b.(type) {
+		case TypedPattern:
+			return a.Kind == "node" || a.Kind == b.Kind
+		case ElementPattern, AttributePattern:
+			return a.Kind == "node"
+		}
+	case AttributePattern:
+		b, ok := b.(AttributePattern)
+		return ok && a.Name == b.Name
+	case ElementPattern:
+		b, ok := b.(ElementPattern)
+		if !ok || a.Name != b.Name {
+			return false
+		}
+		if a.Child == nil {
+			return true
+		}
+		return b.Child != nil && patternSubsumes(a.Child, b.Child)
+	}
+	return false
+}
+
+func lintPatternVars(p Pattern, out []string) []string {
+	if e, ok := p.(ElementPattern); ok {
+		if e.Var != nil {
+			out = append(out, *e.Var)
+		}
+		if e.Child != nil {
+			out = lintPatternVars(e.Child, out)
+		}
+	}
+	return out
+}
+
+// bind adds name to scope, reporting when it hides a binding there.
+func (l *linter) bind(scope lintScope, name string, line int, where string) lintScope {
+	if prev, ok := scope[name]; ok {
+		l.report("shadowed-variable", line, "$%s shadows %s", name, prev)
+	}
+	return scope.with(name, where)
+}
+
+// nest returns the depth inside a construct at depth, reporting the first
+// construct of each definition nested deeper than allowed.
+func (l *linter) nest(what string, depth, line int) int {
+	depth++
+	if depth > l.cfg.MaxDepth && !l.reported {
+		l.reported = true
+		l.report("deep-nesting", line, "%s nested %d deep (at most %d); move the inner part into a function", what, depth, l.cfg.MaxDepth)
+	}
+	return depth
+}
+
+// firstLine returns the line of the first position in expr, or line if it
+// has none: literals and constructors have no position of their own.
+func firstLine(expr Expr, line int) int {
+	found := 0
+	walkExpr(expr, func(e Expr) bool {
+		if found != 0 {
+			return false
+		}
+		if pos := exprPos(e); pos.IsValid() {
+			found = pos.Line
+			return false
+		}
+		return true
+	})
+	if found == 0 {
+		return line
+	}
+	return found
+}
+
+func exprPos(e Expr) Position {
+	switch e := e.(type) {
+	case IfExpr:
+		return e.Pos
+	case LetExpr:
+		return e.Pos
+	case ForExpr:
+		return e.Pos
+	case MatchExpr:
+		return e.Pos
+	case TryExpr:
+		return e.Pos
+	case FunctionExpr:
+		return e.Pos
+	case FuncCall:
+		return e.Pos
+	case UnaryOp:
+		return e.Pos
+	case BinaryOp:
+		return e.Pos
+	case PathExpr:
+		return e.Pos
+	case MapConstructor:
+		return e.Pos
+	case ArrayConstructor:
+		return e.Pos
+	case Lookup:
+		return e.Pos
+	case PIConstructor:
+		return e.Pos
+	}
+	return Position{}
+}
+
+// walkExpr calls visit for expr and, while visit returns true, for the
+// expressions in it.
+func walkExpr(expr Expr, visit func(Expr) bool) {
+	if expr == nil || !visit(expr) {
+		return
+	}
+	for _, sub := range subExprs(expr) {
+		walkExpr(sub, visit)
+	}
+}
+
+// subExprs returns the expressions directly in expr, in source order.
+func subExprs(expr Expr) []Expr {
+	switch e := expr.(type) {
+	case IfExpr:
+		return []Expr{e.Cond, e.ThenExpr, e.ElseExpr}
+	case LetExpr:
+		return []Expr{e.Value, e.Body}
+	case ForExpr:
+		out := []Expr{e.Seq, e.Where}
+		for _, k := range e.GroupBy {
+			out = append(out, k.Expr)
+		}
+		for _, k := range e.OrderBy {
+			out = append(out, k.Expr)
+		}
+		return append(out, e.Body)
+	case TryExpr:
+		return []Expr{e.Body, e.Catch}
+	case MatchExpr:
+		out := []Expr{e.Target}
+		for _, mc := range e.Cases {
+			out = append(out, mc.Expr)
+		}
+		return append(out, e.Default)
+	case FunctionExpr:
+		out := []Expr{}
+		for _, param := range e.Params {
+			out = append(out, param.Default)
+		}
+		return append(out, e.Body)
+	case FuncCall:
+		return e.Args
+	case UnaryOp:
+		return []Expr{e.Expr}
+	case BinaryOp:
+		return []Expr{e.Left, e.Right}
+	case PathExpr:
+		out := []Expr{}
+		for _, step := range e.Steps {
+			out = append(out, step.Predicates...)
+		}
+		return out
+	case Constructor:
+		out := []Expr{}
+		for _, a := range e.Attrs {
+			out = append(out, a.Expr)
+		}
+		return append(out, e.Contents...)
+	case TextJoin:
+		return []Expr{e.Sep, e.Expr}
+	case Sequence:
+		return e.Items
+	case MapConstructor:
+		out := []Expr{}
+		for _, entry := range e.Entries {
+			out = append(out, entry.Key, entry.Value)
+		}
+		return out
+	case ArrayConstructor:
+		return e.Items
+	case Lookup:
+		return []Expr{e.Expr, e.Key}
+	case TextConstructor:
+		return []Expr{e.Expr}
+	case CommentConstructor:
+		return []Expr{e.Expr}
+	case PIConstructor:
+		return []Expr{e.Name, e.Expr}
+	case DocumentConstructor:
+		return []Expr{e.Expr}
+	case Interp:
+		return []Expr{e.Expr}
+	}
+	return nil
+}
+
+// expr checks expr at nesting depth, line being the closest line known
+// for it.
+func (l *linter) expr(expr Expr, scope lintScope, depth, line int) {
+	if expr == nil {
+		return
+	}
+	if pos := exprPos(expr); pos.IsValid() {
+		line = pos.Line
+	}
+	switch e := expr.(type) {
+	case IfExpr:
+		l.ifExpr(e, scope, l.nest("if", depth, line), line)
+	case LetExpr:
+		at := line
+		l.expr(e.Value, scope, depth, line)
+		l.expr(e.Body, l.bind(scope, e.Name, at, fmt.Sprintf("the variable bound on line %d", at)), depth, line)
+	case ForExpr:
+		at := line
+		inner := l.nest("for", depth, at)
+		l.expr(e.Seq, scope, depth, line)
+		body := l.bind(scope, e.Name, at, fmt.Sprintf("the variable bound on line %d", at))
+		l.expr(e.Where, body, inner, line)
+		for _, k := range e.GroupBy {
+			l.expr(k.Expr, body, inner, line)
+		}
+		for _, k := range e.GroupBy {
+			// group by $x rebinds $x to the key on purpose.
+			body = body.with(k.Name, fmt.Sprintf("the group key bound on line %d", at))
+		}
+		for _, k := range e.OrderBy {
+			l.expr(k.Expr, body, inner, line)
+		}
+		l.expr(e.Body, body, inner, line)
+	case TryExpr:
+		inner := l.nest("try", depth, line)
+		l.expr(e.Body, scope, inner, line)
+		catch := scope
+		if e.Var != "" {
+			catch = l.bind(scope, e.Var, line, fmt.Sprintf("the error variable bound on line %d", line))
+		}
+		l.expr(e.Catch, catch, inner, line)
+	case MatchExpr:
+		inner := l.nest("match", depth, line)
+		l.expr(e.Target, scope, depth, line)
+		for _, mc := range e.Cases {
+			caseScope := scope
+			for _, v := range lintPatternVars(mc.Pattern, nil) {
+				caseScope = l.bind(caseScope, v, line, fmt.Sprintf("the capture $%s on line %d", v, line))
+			}
+			l.expr(mc.Expr, caseScope, inner, line)
+		}
+		l.expr(e.Default, scope, inner, line)
+	case FunctionExpr:
+		inner := l.nest("inline function", depth, line)
+		body := scope
+		for _, param := range e.Params {
+			l.expr(param.Default, scope, inner, line)
+			body = l.bind(body, param.Name, line, fmt.Sprintf("the parameter $%s on line %d", param.Name, line))
+		}
+		l.expr(e.Body, body, inner, line)
+	case PathExpr:
+		for i, step := range e.Steps {
+			if (step.Axis == "desc" || step.Axis == "desc_or_self") && (step.Test.Kind == "wildcard" || step.Test.Kind == "node" && i == len(e.Steps)-1) {
+				l.report("broad-scan", line, "%s visits every node below its start; name the elements wanted or start closer to them", describeScan(e, step))
+				break
+			}
+		}
+		for _, sub := range subExprs(e) {
+			l.expr(sub, scope, depth, line)
+		}
+	default:
+		for _, sub := range subExprs(e) {
+			l.expr(sub, scope, depth, line)
+		}
+	}
+}
+
+// ifExpr checks an if at depth; an if in its else branch continues the
+// chain, as else if, rather than nesting.
+func (l *linter) ifExpr(e IfExpr, scope lintScope, depth, line int) {
+	l.expr(e.Cond, scope, depth-1, line)
+	l.expr(e.ThenExpr, scope, depth, line)
+	if next, ok := e.ElseExpr.(IfExpr); ok {
+		l.ifExpr(next, scope, depth, line)
+		return
+	}
+	l.expr(e.ElseExpr, scope, depth, line)
+}
+
+func describeScan(e PathExpr, step PathStep) string {
+	test := "*"
+	if step.Test.Kind == "node" {
+		test = "node()"
+	}
+	if e.Start.Kind == "desc_root" || e.Start.Kind == "root" {
+		return "//" + test
+	}
+	return "the step //" + test
+}
@@ -0,0 +1,317 @@
+package xform
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Lang returns the language of n: the nearest xml:lang (or HTML lang)
+// attribute on n or an ancestor, or "" when none is set.
+func Lang(n *Node) string {
+	for ; n != nil; n = n.Parent {
+		if n.Kind != "element" {
+			continue
+		}
+		if v, ok := n.Attrs["xml:lang"]; ok {
+			return v
+		}
+		if v, ok := n.Attrs["lang"]; ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// LangMatches reports whether lang equals want or is a subtag of it, so
+// "en-GB" matches "en" (case-insensitive, as XPath lang()).
+func LangMatches(lang, want string) bool {
+	lang, want = strings.ToLower(lang), strings.ToLower(want)
+	return lang == want || strings.HasPrefix(lang, want+"-")
+}
+
+func primaryLanguage(locale string) string {
+	locale = strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+	if i := strings.IndexByte(locale, '-'); i >= 0 {
+		return locale[:i]
+	}
+	return locale
+}
+
+// UpperCase upper-cases s with the rules of locale: Turkish and Azeri map
+// i to İ, and ß becomes SS everywhere.
+func UpperCase(s, locale string) string {
+	switch primaryLanguage(locale) {
+	case "tr", "az":
+		s = strings.ToUpperSpecial(unicode.TurkishCase, s)
+	default:
+		s = strings.ToUpper(s)
+	}
+	return strings.ReplaceAll(s, "ß", "SS")
+}
+
+// LowerCase lower-cases s with the rules of locale: Turkish and Azeri map
+// I to ı, and a Greek capital sigma at the end of a word becomes ς.
+func LowerCase(s, locale string) string {
+	switch primaryLanguage(locale) {
+	case "tr", "az":
+		s = strings.ToLowerSpecial(unicode.TurkishCase, s)
+	default:
+		s = strings.ToLower(s)
+	}
+	if !strings.ContainsRune(s, 'σ') {
+		return s
+	}
+	runes := []rune(s)
+	for i, r := range runes {
+		if r == 'σ' && i > 0 && unicode.IsLetter(runes[i-1]) && (i+1 == len(runes) || !unicode.IsLetter(runes[i+1])) {
+			runes[i] = 'ς'
+		}
+	}
+	return string(runes)
+}
+
+type localeNames struct {
+	months, days []string
+	picture      string
+}
+
+// dateLocales holds month and weekday names (weeks start on Sunday, as
+// time.Weekday) and the default formatDate picture per language.
+var dateLocales = map[string]localeNames{
+	"en": {
+		months:  []string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+		days:    []string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"},
+		picture: "[MNn] [D], [Y]",
+	},
+	"de": {
+		months:  []string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+		days:    []string{"Sonntag", "Montag", "Dienstag", "Mittwoch", "Donnerstag", "Freitag", "Samstag"},
+		picture: "[D]. [MNn] [Y]",
+	},
+	"fr": {
+		months:  []string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+		days:    []string{"dimanche", "lundi", "mardi", "mercredi", "jeudi", "vendredi", "samedi"},
+		picture: "[D] [MNn] [Y]",
+	},
+	"es": {
+		months:  []string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+		days:    []string{"domingo", "lunes", "martes", "miércoles", "jueves", "viernes", "sábado"},
+		picture: "[D] de [MNn] de [Y]",
+	},
+	"it": {
+		months:  []string{"gennaio", "febbraio", "marzo", "aprile", "maggio", "giugno", "luglio", "agosto", "settembre", "ottobre", "novembre", "dicembre"},
+		days:    []string{"domenica", "lunedì", "martedì", "mercoledì", "giovedì", "venerdì", "sabato"},
+		picture: "[D] [MNn] [Y]",
+	},
+	"nl": {
+		months:  []string{"januari", "februari", "maart", "april", "mei", "juni", "juli", "augustus", "september", "oktober", "november", "december"},
+		days:    []string{"zondag", "maandag", "dinsdag", "woensdag", "donderdag", "vrijdag", "zaterdag"},
+		picture: "[D] [MNn] [Y]",
+	},
+	"pt": {
+		months:  []string{"janeiro", "fevereiro", "março", "abril", "maio", "junho", "julho", "agosto", "setembro", "outubro", "novembro", "dezembro"},
+		days:    []string{"domingo", "segunda-feira", "terça-feira", "quarta-feira", "quinta-feira", "sexta-feira", "sábado"},
+		picture: "[D] de [MNn] de [Y]",
+	},
+}
+
+func dateLocale(locale string) localeNames {
+	if l, ok := dateLocales[primaryLanguage(locale)]; ok {
+		return l
+	}
+	return dateLocales["en"]
+}
+
+var dateLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02", "2006-01"}
+
+func parseDateValue(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("XFDY0002: invalid date %q", s)
+}
+
+// FormatDate formats t with an XPath-style picture such as
+// "[D01].[M01].[Y0001]" or "[FNn], [D] [MNn] [Y]". Components are Y, M, D,
+// d (day of year), F (weekday), H, h, m, s and P (am/pm); presentation
+// modifiers are 1, 01 (zero-padded, width from the digits), N, n, Nn (names
+// in the locale's language, also for M and F), I and i (roman numerals).
+// An empty picture selects the locale's default long date.
+func FormatDate(t time.Time, picture, locale string) (string, error) {
+	names := dateLocale(locale)
+	if picture == "" {
+		picture = names.picture
+	}
+	b := &strings.Builder{}
+	for i := 0; i < len(picture); i++ {
+		c := picture[i]
+		if c == ']' && i+1 < len(picture) && picture[i+1] == ']' {
+			b.WriteByte(']')
+			i++
+			continue
+		}
+		if c != '[' {
+			b.WriteByte(c)
+			continue
+		}
+		if i+1 < len(picture) && picture[i+1] == '[' {
+			b.WriteByte('[')
+			i++
+			continue
+		}
+		end := strings.IndexByte(picture[i:], ']')
+		if end < 0 {
+			return "", fmt.Errorf("XFDY0002: unterminated component in picture %q", picture)
+		}
+		spec := strings.ReplaceAll(picture[i+1:i+end], " ", "")
+		i += end
+		if spec == "" {
+			return "", fmt.Errorf("XFDY0002: empty component in picture %q", picture)
+		}
+		out, err := formatDateComponent(t, spec[0], spec[1:], names)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(out)
+	}
+	return b.String(), nil
+}
+
+func formatDateComponent(t time.Time, comp byte, mod string, names localeNames) (string, error) {
+	var value int
+	var name string
+	switch comp {
+	case 'Y':
+		value = t.Year()
+	case 'M':
+		value = int(t.Month())
+		name = names.months[value-1]
+	case 'D':
+		value = t.Day()
+	case 'd':
+		value = t.YearDay()
+	case 'F':
+		value = int(t.Weekday())
+		name = names.days[value]
+		if mod == "" {
+			mod = "Nn"
+		}
+		if value == 0 {
+			value = 7
+		}
+	case 'H':
+		value = t.Hour()
+	case 'h':
+		value = t.Hour() % 12
+		if value == 0 {
+			value = 12
+		}
+	case 'm':
+		value = t.Minute()
+	case 's':
+		value = t.Second()
+	case 'P':
+		name = "am"
+		if t.Hour() >= 12 {
+			name = "pm"
+		}
+		if mod == "" {
+			mod = "n"
+		}
+	default:
+		return "", fmt.Errorf("XFDY0002: unknown date component [%c]", comp)
+	}
+	if comp == 'm' || comp == 's' {
+		if mod == "" {
+			mod = "01"
+		}
+	}
+	if (mod == "N" || mod == "n" || mod == "Nn") && name == "" {
+		return "", fmt.Errorf("XFDY0002: [%c] has no name form", comp)
+	}
+	switch mod {
+	case "N":
+		return strings.ToUpper(name), nil
+	case "n":
+		return strings.ToLower(name), nil
+	case "Nn":
+		r := []rune(name)
+		return strings.ToUpper(string(r[0])) + string(r[1:]), nil
+	case "I":
+		return toRoman(value), nil
+	case "i":
+		return strings.ToLower(toRoman(value)), nil
+	case "", "1":
+		return strconv.Itoa(value), nil
+	}
+	if strings.Trim(mod, "0123456789") != "" {
+		return "", fmt.Errorf("XFDY0002: unknown presentation modifier %q", mod)
+	}
+	s := strconv.Itoa(value)
+	for len(s) < len(mod) {
+		s = "0" + s
+	}
+	return s, nil
+}
+
+// localeArg returns args[i] as a locale, falling back to the language of
+// the first argument (when it is a node) and then of the context item.
+func localeArg(args [][]any, i int, ctx Context) string {
+	if i < len(args) && len(args[i]) > 0 {
+		return ToString(args[i])
+	}
+	if len(args) > 0 && len(args[0]) > 0 {
+		if n, ok := args[0][0].(*Node); ok {
+			return Lang(n)
+		}
+	}
+	if n, ok := ctx.ContextItem.(*Node); ok {
+		return Lang(n)
+	}
+	return ""
+}
+
+func fnLang(args [][]any, ctx Context) []any {
+	node, _ := ctx.ContextItem.(*Node)
+	if len(args) > 0 {
+		node = nodeArg(args, 0)
+	}
+	lang := Lang(node)
+	if len(args) > 1 {
+		return []any{lang != "" && LangMatches(lang, ToString(args[1]))}
+	}
+	return []any{lang}
+}
+
+func fnUpperCase(args [][]any, ctx Context) []any {
+	return []any{UpperCase(ToString(firstOrEmpty(args)), localeArg(args, 1, ctx))}
+}
+
+func fnLowerCase(args [][]any, ctx Context) []any {
+	return []any{LowerCase(ToString(firstOrEmpty(args)), localeArg(args, 1, ctx))}
+}
+
+func fnFormatDate(args [][]any, ctx Context) []any {
+	if len(args) == 0 || len(args[0]) == 0 {
+		return []any{}
+	}
+	d, err := dateItem(args[0][0])
+	if err != nil {
+		panic(err)
+	}
+	picture := ""
+	if len(args) > 1 {
+		picture = ToString(args[1])
+	}
+	out, err := FormatDate(d.Time, picture, localeArg(args, 2, ctx))
+	if err != nil {
+		panic(err)
+	}
+	return []any{out}
+}
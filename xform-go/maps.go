@@ -0,0 +1,252 @@
+package xform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// evalMapConstructor builds the map of map { key: value, ... }. A key must
+// be a single item and occur once.
+func evalMapConstructor(e MapConstructor, ctx Context) []any {
+	m := make(map[string][]any, len(e.Entries))
+	for _, entry := range e.Entries {
+		key := evalExpr(entry.Key, ctx)
+		if len(key) != 1 {
+			ctx.Runtime.at(e.Pos)
+			panic(fmt.Errorf("XFDY0012: a map key must be a single item, got %d items", len(key)))
+		}
+		k := ToString(key)
+		if _, ok := m[k]; ok {
+			ctx.Runtime.at(e.Pos)
+			panic(fmt.Errorf("XFDY0012: duplicate map key %s", k))
+		}
+		m[k] = evalExpr(entry.Value, ctx)
+		ctx.Runtime.chargeItems(len(m[k]) + 1)
+	}
+	return []any{m}
+}
+
+// evalArrayConstructor builds the array of [expr, ...], whose members are
+// the items of the expressions in turn.
+func evalArrayConstructor(e ArrayConstructor, ctx Context) []any {
+	a := Array{}
+	for _, item := range e.Items {
+		a = append(a, evalExpr(item, ctx)...)
+	}
+	ctx.Runtime.chargeItems(len(a))
+	return []any{a}
+}
+
+// evalLookup applies lookup() with the key to each item of the
+// expression. The key is evaluated once, with the context of the lookup.
+// Brackets after items that are not all maps or arrays hold a predicate,
+// as in (//item)[2] or $items[@id = "2"], see evalFilter.
+func evalLookup(e Lookup, ctx Context) []any {
+	items := evalExpr(e.Expr, ctx)
+	if e.Bracket && !lookupable(items) {
+		return evalFilter(items, e.Key, ctx)
+	}
+	key := evalExpr(e.Key, ctx)
+	out := []any{}
+	for _, item := range items {
+		out = append(out, fnLookup([][]any{{item}, key}, ctx)...)
+	}
+	return out
+}
+
+// lookupable reports whether items are maps and arrays only, the items a
+// [key] lookup applies to.
+func lookupable(items []any) bool {
+	for _, item := range items {
+		switch item.(type) {
+		case map[string][]any, *Index, Array:
+		default:
+			return false
+		}
+	}
+	return len(items) > 0
+}
+
+// evalFilter keeps the items the predicate holds for, evaluated with each
+// item as the context item, as a step predicate is.
+func evalFilter(items []any, pred Expr, ctx Context) []any {
+	out := []any{}
+	last := len(items)
+	for i, item := range items {
+		pos := i + 1
+		predCtx := Context{ContextItem: item, Variables: ctx.Variables, Functions: ctx.Functions, Rules: ctx.Rules, Position: &pos, Last: &last, Runtime: ctx.Runtime}
+		if predicateHolds(evalExpr(pred, predCtx), pos, ctx.Runtime) {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// valueText is the string value of a map or array: its JSON form, with
+// the keys of a map sorted. A map value of several items is written as a
+// JSON array and an empty one as null; nodes are written as their XML.
+func valueText(item any) string {
+	b := &strings.Builder{}
+	writeValueText(b, item)
+	return b.String()
+}
+
+func writeValueText(b *strings.Builder, item any) {
+	switch v := item.(type) {
+	case map[string][]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			writeJSONString(b, k)
+			b.WriteByte(':')
+			switch seq := v[k]; len(seq) {
+			case 0:
+				b.WriteString("null")
+			case 1:
+				writeValueText(b, seq[0])
+			default:
+				writeValueText(b, Array(seq))
+			}
+		}
+		b.WriteByte('}')
+	case Array:
+		b.WriteByte('[')
+		for i, member := range v {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			writeValueText(b, member)
+		}
+		b.WriteByte(']')
+	case *Node:
+		writeJSONString(b, Serialize(v))
+	case Null:
+		b.WriteString("null")
+	case bool, int, int64, float64, Decimal:
+		b.WriteString(ToString([]any{v}))
+	default:
+		writeJSONString(b, ToString([]any{v}))
+	}
+}
+
+func writeJSONString(b *strings.Builder, s string) {
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	e.SetEscapeHTML(false)
+	e.Encode(s)
+	b.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
+
+func mapArg(args [][]any, i int, fn string) map[string][]any {
+	if i < len(args) && len(args[i]) == 1 {
+		if m, ok := args[i][0].(map[string][]any); ok {
+			return m
+		}
+	}
+	panic(fmt.Errorf("XFDY0002: %s() expects a map", fn))
+}
+
+func arrayArg(args [][]any, i int, fn string) Array {
+	if i < len(args) && len(args[i]) == 1 {
+		if a, ok := args[i][0].(Array); ok {
+			return a
+		}
+	}
+	panic(fmt.Errorf("XFDY0002: %s() expects an array", fn))
+}
+
+func copyMap(m map[string][]any) map[string][]any {
+	out := make(map[string][]any, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// fnMapKeys is mapKeys(m): the keys of m, sorted.
+func fnMapKeys(args [][]any, _ Context) []any {
+	m := mapArg(args, 0, "mapKeys")
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]any, len(keys))
+	for i, k := range keys {
+		out[i] = k
+	}
+	return out
+}
+
+// fnMapPut is mapPut(m, key, value): a copy of m with key set to value.
+func fnMapPut(args [][]any, ctx Context) []any {
+	m := mapArg(args, 0, "mapPut")
+	if len(args) < 3 || len(args[1]) != 1 {
+		panic(fmt.Errorf("XFDY0002: mapPut() expects a map, a single key and a value"))
+	}
+	out := copyMap(m)
+	out[ToString(args[1])] = args[2]
+	ctx.Runtime.chargeItems(len(out))
+	return []any{out}
+}
+
+// fnMapMerge is mapMerge(maps...): one map with the entries of all maps;
+// for a key in several of them the last one wins.
+func fnMapMerge(args [][]any, ctx Context) []any {
+	out := map[string][]any{}
+	for _, seq := range args {
+		for _, item := range seq {
+			m, ok := item.(map[string][]any)
+			if !ok {
+				panic(fmt.Errorf("XFDY0002: mapMerge() expects maps, got %s", typeName(item)))
+			}
+			for k, v := range m {
+				out[k] = v
+			}
+		}
+	}
+	ctx.Runtime.chargeItems(len(out))
+	return []any{out}
+}
+
+// fnMapRemove is mapRemove(m, keys...): a copy of m without the keys.
+func fnMapRemove(args [][]any, ctx Context) []any {
+	out := copyMap(mapArg(args, 0, "mapRemove"))
+	for _, seq := range args[1:] {
+		for _, key := range seq {
+			delete(out, ToString([]any{key}))
+		}
+	}
+	ctx.Runtime.chargeItems(len(out))
+	return []any{out}
+}
+
+func fnArraySize(args [][]any, _ Context) []any {
+	return []any{int64(len(arrayArg(args, 0, "arraySize")))}
+}
+
+// fnArrayGet is arrayGet(a, i): the member of a at the 1-based position i,
+// which must exist.
+func fnArrayGet(args [][]any, _ Context) []any {
+	a := arrayArg(args, 0, "arrayGet")
+	if len(args) < 2 || len(args[1]) != 1 {
+		panic(fmt.Errorf("XFDY0002: arrayGet() expects an array and a position"))
+	}
+	i := ToNumber(args[1])
+	if i < 1 || i > float64(len(a)) || i != math.Trunc(i) {
+		panic(fmt.Errorf("XFDY0012: array position %s is not within 1 to %d", strconv.FormatFloat(i, 'f', -1, 64), len(a)))
+	}
+	return []any{a[int(i)-1]}
+}
@@ -0,0 +1,54 @@
+package xform
+
+import "testing"
+
+const itemsXML = `<r><item id="1">a</item><item id="2">b</item><item id="3">c</item></r>`
+
+func TestBracketLookup(t *testing.T) {
+	tests := []struct{ src, want string }{
+		{`let $m := map { "a": 1, "b": 2 } in $m["b"]`, "2"},
+		{`let $m := map { "a": 1 } in $m.a`, "1"},
+		{`[5, 6, 7][2]`, "6"},
+		{`let $a := [5, 6] in $a[3]`, ""},
+		{`(map { "a": 1 }, map { "a": 2 })["a"]`, "12"},
+	}
+	for _, tt := range tests {
+		if got := run(t, tt.src, itemsXML); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestBracketFilter(t *testing.T) {
+	tests := []struct{ src, want string }{
+		{`(//item)[2]`, `<item id="2">b</item>`},
+		{`let $a := //item in $a[2]`, `<item id="2">b</item>`},
+		{`let $a := (10, 20, 30) in $a[2]`, "20"},
+		{`let $x := //item in $x[@id = "3"]`, `<item id="3">c</item>`},
+		{`(10, 20, 30)[. > 15][1]`, "20"},
+		{`(10, 20, 30)[last()]`, "30"},
+		{`//item[2]`, `<item id="2">b</item>`},
+		{`()[1]`, ""},
+	}
+	for _, tt := range tests {
+		if got := run(t, tt.src, itemsXML); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestMapArrayText(t *testing.T) {
+	tests := []struct{ src, want string }{
+		{`map { "b": [1], "a": "x" }`, `{"a":"x","b":[1]}`},
+		{`[1, "two", 1 = 1]`, `[1,"two",true]`},
+		{`map { "seq": (1, 2), "none": () }`, `{"none":null,"seq":[1,2]}`},
+		{`string(map { "item": //item[1] })`, `{"item":"<item id=\"1\">a</item>"}`},
+		{`<a v={[1, 2]}/>`, `<a v="[1,2]"/>`},
+		{`try { decimal("x") } catch $e { $e }`, `{"code":"XFDY0002","column":7,"line":1,"message":"decimal() cannot convert \"x\""}`},
+	}
+	for _, tt := range tests {
+		if got := run(t, tt.src, itemsXML); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package xform
+
+import (
+	"fmt"
+	"time"
+)
+
+// EvalStats reports what evaluations cost. Set EvalOptions.Stats to have
+// the numbers of each evaluation added to it; for EvalSelected and
+// EvalStreaming it sums up the evaluated subtrees.
+type EvalStats struct {
+	Evaluations  int
+	NodesCreated int
+	// Memory approximates the bytes allocated for constructed and copied
+	// nodes and for sequences built by for, ranges and (a, b, ...). Memory
+	// that is released again is still counted.
+	Memory   int64
+	Duration time.Duration
+}
+
+// Approximate sizes, in bytes, of a node with its attribute map and of an
+// item in a sequence.
+const (
+	nodeBytes = 160
+	itemBytes = 16
+)
+
+// charge accounts for bytes allocated by the evaluation and enforces
+// EvalOptions.MaxMemory.
+func (rt *Runtime) charge(bytes int64) {
+	if rt == nil {
+		return
+	}
+	rt.checkTime()
+	rt.memory += bytes
+	if max := rt.Options.MaxMemory; max > 0 && rt.memory > max {
+		panic(fmt.Errorf("XFDY0007: memory limit of %d bytes exceeded", max))
+	}
+}
+
+// checkTime enforces EvalOptions.Timeout. It runs with every charge and
+// function call, and reads the clock on every 256th.
+func (rt *Runtime) checkTime() {
+	if rt.deadline.IsZero() {
+		return
+	}
+	rt.ticks++
+	if rt.ticks%256 == 0 && time.Now().After(rt.deadline) {
+		panic(fmt.Errorf("XFDY0008: time limit of %s exceeded", rt.Options.Timeout))
+	}
+}
+
+// chargeItems accounts for a sequence of n items; chargeTree for a copy of
+// the subtree at n.
+func (rt *Runtime) chargeItems(n int) {
+	rt.charge(int64(n) * itemBytes)
+}
+
+func (rt *Runtime) chargeTree(n *Node) {
+	if rt == nil {
+		return
+	}
+	var size int64
+	var walk func(n *Node)
+	walk = func(n *Node) {
+		size += nodeSize(n)
+		for _, c := range n.Children {
+			walk(c)
+		}
+	}
+	walk(n)
+	rt.charge(size)
+}
+
+func nodeSize(n *Node) int64 {
+	size := int64(nodeBytes + len(n.Name) + len(n.Value) + len(n.Children)*8)
+	for k, v := range n.Attrs {
+		size += int64(len(k) + len(v) + 2*itemBytes)
+	}
+	return size
+}
+
+// recordStats adds the cost of the evaluation that started at start to
+// EvalOptions.Stats.
+func (rt *Runtime) recordStats(start time.Time) {
+	stats := rt.Options.Stats
+	if stats == nil {
+		return
+	}
+	stats.Evaluations++
+	stats.NodesCreated += rt.NodesCreated
+	stats.Memory += rt.memory
+	stats.Duration += time.Since(start)
+}
+
+// DefaultMaxCallDepth is the nesting of user function calls and rule
+// firings allowed when EvalOptions.MaxCallDepth is 0, well below what
+// would exhaust the Go stack.
+const DefaultMaxCallDepth = 10000
+
+// descend enters a user function call or rule firing and enforces
+// EvalOptions.MaxCallDepth; ascend leaves it.
+func (rt *Runtime) descend() {
+	if rt == nil {
+		return
+	}
+	rt.depth++
+	max := rt.Options.MaxCallDepth
+	if max == 0 {
+		max = DefaultMaxCallDepth
+	}
+	if max > 0 && rt.depth > max {
+		panic(fmt.Errorf("XFDY0011: recursion deeper than %d calls", max))
+	}
+}
+
+func (rt *Runtime) ascend() {
+	if rt != nil {
+		rt.depth--
+	}
+}
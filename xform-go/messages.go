@@ -0,0 +1,86 @@
+package xform
+
+import "fmt"
+
+// Message is one message of an event stream, such as a Kafka record: the
+// payload to transform and, in Meta, whatever the source wants back with
+// its result, such as the record's key and offset.
+type Message struct {
+	Value []byte
+	Meta  any
+}
+
+// MessageResult is the outcome of one message: its serialized result, or
+// the error that failed it.
+type MessageResult struct {
+	Message Message
+	// Seq is the message's position in the stream, from 1.
+	Seq    int64
+	Output string
+	Err    error
+}
+
+// MessageOptions configure TransformMessages. The evaluation options are
+// shared by concurrent evaluations, so their Diagnostics, Metrics and
+// Tracer must be safe for concurrent use when Workers is above 1.
+type MessageOptions struct {
+	Eval        EvalOptions
+	InputFormat InputFormat
+	// Workers is how many messages are evaluated at once (default 1).
+	Workers int
+}
+
+// TransformMessages parses and transforms each message received from in
+// and sends its result to out, in the order of the messages. A message
+// that fails to parse or evaluate yields a result with Err set and the
+// stream goes on. It returns once in is closed and every result is sent,
+// and then closes out.
+func (p *Program) TransformMessages(in <-chan Message, out chan<- MessageResult, opts MessageOptions) {
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	// Each message gets a channel for its result; queuing them in order
+	// keeps the results in order while up to workers messages evaluate.
+	pending := make(chan chan MessageResult, workers-1)
+	go func() {
+		var seq int64
+		for msg := range in {
+			seq++
+			done := make(chan MessageResult, 1)
+			pending <- done
+			go func(msg Message, seq int64) {
+				done <- p.transformMessage(msg, seq, opts)
+			}(msg, seq)
+		}
+		close(pending)
+	}()
+	for done := range pending {
+		out <- <-done
+	}
+	close(out)
+}
+
+func (p *Program) transformMessage(msg Message, seq int64, opts MessageOptions) (res MessageResult) {
+	res = MessageResult{Message: msg, Seq: seq}
+	defer func() {
+		if r := recover(); r != nil {
+			res.Output, res.Err = "", fmt.Errorf("message %d: %v", seq, r)
+		}
+	}()
+	input, err := ParseInputItem(fmt.Sprintf("message-%d", seq), msg.Value, opts.InputFormat)
+	if err != nil {
+		if opts.Eval.Metrics != nil {
+			opts.Eval.Metrics.Error("parse")
+		}
+		res.Err = err
+		return res
+	}
+	result, err := p.EvalItem(input, opts.Eval)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	res.Output = SerializeResult(result, p.Module.SerializeOptions())
+	return res
+}
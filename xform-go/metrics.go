@@ -0,0 +1,140 @@
+package xform
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Metrics interface {
+	DocumentProcessed()
+	ObserveEval(d time.Duration)
+	NodesCreated(n int)
+	Error(code string)
+}
+
+var DefaultEvalBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+type MetricsRegistry struct {
+	mu        sync.Mutex
+	documents uint64
+	nodes     uint64
+	errors    map[string]uint64
+	buckets   []float64
+	counts    []uint64
+	sum       float64
+	count     uint64
+}
+
+type MetricsSnapshot struct {
+	DocumentsProcessed uint64
+	NodesCreated       uint64
+	ErrorsByCode       map[string]uint64
+	EvalBuckets        []float64
+	EvalBucketCounts   []uint64
+	EvalSeconds        float64
+	EvalCount          uint64
+}
+
+func NewMetricsRegistry() *MetricsRegistry {
+	buckets := append([]float64{}, DefaultEvalBuckets...)
+	return &MetricsRegistry{errors: map[string]uint64{}, buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (m *MetricsRegistry) DocumentProcessed() {
+	m.mu.Lock()
+	m.documents++
+	m.mu.Unlock()
+}
+
+func (m *MetricsRegistry) ObserveEval(d time.Duration) {
+	secs := d.Seconds()
+	m.mu.Lock()
+	for i, b := range m.buckets {
+		if secs <= b {
+			m.counts[i]++
+		}
+	}
+	m.sum += secs
+	m.count++
+	m.mu.Unlock()
+}
+
+func (m *MetricsRegistry) NodesCreated(n int) {
+	m.mu.Lock()
+	m.nodes += uint64(n)
+	m.mu.Unlock()
+}
+
+func (m *MetricsRegistry) Error(code string) {
+	m.mu.Lock()
+	m.errors[code]++
+	m.mu.Unlock()
+}
+
+// Snapshot exposes the raw values so embedders can feed them into their own
+// collectors (e.g. prometheus.NewCounterFunc) instead of the text endpoint.
+func (m *MetricsRegistry) Snapshot() MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	errs := map[string]uint64{}
+	for k, v := range m.errors {
+		errs[k] = v
+	}
+	return MetricsSnapshot{
+		DocumentsProcessed: m.documents,
+		NodesCreated:       m.nodes,
+		ErrorsByCode:       errs,
+		EvalBuckets:        append([]float64{}, m.buckets...),
+		EvalBucketCounts:   append([]uint64{}, m.counts...),
+		EvalSeconds:        m.sum,
+		EvalCount:          m.count,
+	}
+}
+
+func (m *MetricsRegistry) WritePrometheus(w io.Writer) error {
+	s := m.Snapshot()
+	b := &strings.Builder{}
+	fmt.Fprintln(b, "# HELP xform_documents_processed_total Documents evaluated.")
+	fmt.Fprintln(b, "# TYPE xform_documents_processed_total counter")
+	fmt.Fprintf(b, "xform_documents_processed_total %d\n", s.DocumentsProcessed)
+	fmt.Fprintln(b, "# HELP xform_nodes_created_total Nodes created by constructors.")
+	fmt.Fprintln(b, "# TYPE xform_nodes_created_total counter")
+	fmt.Fprintf(b, "xform_nodes_created_total %d\n", s.NodesCreated)
+	fmt.Fprintln(b, "# HELP xform_errors_total Evaluation errors by error code.")
+	fmt.Fprintln(b, "# TYPE xform_errors_total counter")
+	codes := make([]string, 0, len(s.ErrorsByCode))
+	for k := range s.ErrorsByCode {
+		codes = append(codes, k)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		fmt.Fprintf(b, "xform_errors_total{code=%q} %d\n", code, s.ErrorsByCode[code])
+	}
+	fmt.Fprintln(b, "# HELP xform_eval_duration_seconds Evaluation duration.")
+	fmt.Fprintln(b, "# TYPE xform_eval_duration_seconds histogram")
+	for i, le := range s.EvalBuckets {
+		fmt.Fprintf(b, "xform_eval_duration_seconds_bucket{le=\"%g\"} %d\n", le, s.EvalBucketCounts[i])
+	}
+	fmt.Fprintf(b, "xform_eval_duration_seconds_bucket{le=\"+Inf\"} %d\n", s.EvalCount)
+	fmt.Fprintf(b, "xform_eval_duration_seconds_sum %g\n", s.EvalSeconds)
+	fmt.Fprintf(b, "xform_eval_duration_seconds_count %d\n", s.EvalCount)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func ErrorCode(err any) string {
+	msg := fmt.Sprint(err)
+	if e, ok := err.(error); ok {
+		msg = e.Error()
+	}
+	if len(msg) >= 8 && strings.HasPrefix(msg, "XF") {
+		if idx := strings.Index(msg, ":"); idx > 0 {
+			return msg[:idx]
+		}
+	}
+	return "unknown"
+}
@@ -0,0 +1,308 @@
+package xform
+
+import (
+	"fmt"
+	"strings"
+)
+
+// XMLNamespace is the namespace bound to the xml prefix.
+const XMLNamespace = "http://www.w3.org/XML/1998/namespace"
+
+// XHTMLNamespace is dropped from HTML input, so that //p matches HTML
+// paragraphs without a namespace declaration.
+const XHTMLNamespace = "http://www.w3.org/1999/xhtml"
+
+func splitQName(name string) (prefix, local string) {
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
+
+// LocalName returns the name of n without its prefix.
+func (n *Node) LocalName() string {
+	return localName(n.Name)
+}
+
+// Prefix returns the prefix of n's name, "" when it has none.
+func (n *Node) Prefix() string {
+	prefix, _ := splitQName(n.Name)
+	return prefix
+}
+
+// LookupNamespace returns the namespace URI bound to prefix ("" for the
+// default namespace) by the xmlns attributes of n and its ancestors.
+func (n *Node) LookupNamespace(prefix string) (string, bool) {
+	if prefix == "xml" {
+		return XMLNamespace, true
+	}
+	decl := nsDeclName(prefix)
+	for ; n != nil; n = n.Parent {
+		if n.Kind != "element" {
+			continue
+		}
+		if uri, ok := n.Attrs[decl]; ok {
+			return uri, true
+		}
+	}
+	return "", prefix == ""
+}
+
+// nsDeclName is the attribute declaring prefix: xmlns or xmlns:prefix.
+func nsDeclName(prefix string) string {
+	if prefix == "" {
+		return "xmlns"
+	}
+	return "xmlns:" + prefix
+}
+
+// declaredPrefix is the prefix an xmlns attribute declares.
+func declaredPrefix(attr string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(attr, "xmlns"), ":")
+}
+
+// prefixFor finds the prefix bound to uri in scope at n, preferring the
+// nearest declaration. Attributes never use the default namespace.
+func prefixFor(n *Node, uri string, element bool) (string, bool) {
+	if uri == XMLNamespace {
+		return "xml", true
+	}
+	shadowed := map[string]bool{}
+	for ; n != nil; n = n.Parent {
+		for _, k := range n.AttrNames() {
+			if !isNamespaceDecl(k) {
+				continue
+			}
+			prefix := declaredPrefix(k)
+			if shadowed[prefix] || (prefix == "" && !element) {
+				continue
+			}
+			shadowed[prefix] = true
+			if n.Attrs[k] == uri {
+				return prefix, true
+			}
+		}
+	}
+	return "", false
+}
+
+// namespaceURI resolves a prefix of a name test, pattern or constructor
+// against the module's ns declarations.
+func (rt *Runtime) namespaceURI(prefix string) (string, bool) {
+	if prefix == "xml" {
+		return XMLNamespace, true
+	}
+	if rt == nil {
+		return "", prefix == ""
+	}
+	uri, ok := rt.namespaces[prefix]
+	return uri, ok || prefix == ""
+}
+
+func unboundPrefix(name string) error {
+	prefix, _ := splitQName(name)
+	return fmt.Errorf("XFST0002: unbound prefix %s in %s (declare it with ns %q = \"...\")", prefix, name, prefix)
+}
+
+// nameMatches reports whether element n has the expanded name of the
+// QName test. Unprefixed names are in the module's default namespace
+// (ns "" = "..."), else in no namespace; CompatLocalNames compares local
+// names only.
+func (rt *Runtime) nameMatches(name string, n *Node) bool {
+	if rt == nil {
+		return n.Name == name
+	}
+	prefix, local := splitQName(name)
+	if prefix == "" && rt.legacy(CompatLocalNames) {
+		return n.LocalName() == local
+	}
+	uri, ok := rt.namespaceURI(prefix)
+	if !ok {
+		if rt.legacy(CompatLocalNames) {
+			return n.Name == name
+		}
+		panic(unboundPrefix(name))
+	}
+	if uri == "" {
+		return n.Namespace == "" && n.Name == local
+	}
+	return n.Namespace == uri && n.LocalName() == local
+}
+
+// attrMatches reports whether attribute key of owner has the expanded name
+// of the QName test. Unprefixed attributes are in no namespace.
+func (rt *Runtime) attrMatches(name, key string, owner *Node) bool {
+	if isNamespaceDecl(key) {
+		return false
+	}
+	prefix, local := splitQName(name)
+	if rt == nil || (prefix == "" && !rt.legacy(CompatLocalNames)) {
+		return key == name
+	}
+	if prefix == "" {
+		return localName(key) == local
+	}
+	uri, ok := rt.namespaceURI(prefix)
+	if !ok {
+		if rt.legacy(CompatLocalNames) {
+			return key == name
+		}
+		panic(unboundPrefix(name))
+	}
+	keyPrefix, keyLocal := splitQName(key)
+	if keyPrefix == "" || keyLocal != local {
+		return false
+	}
+	keyURI, ok := owner.LookupNamespace(keyPrefix)
+	return ok && keyURI == uri
+}
+
+// declareNamespaces adds xmlns attributes for the prefixes to n, ahead of
+// its other attributes.
+func declareNamespaces(n *Node, prefixes, uris []string) {
+	names := []string{}
+	for i, prefix := range prefixes {
+		name := nsDeclName(prefix)
+		if _, ok := n.Attrs[name]; !ok {
+			names = append(names, name)
+		}
+		n.Attrs[name] = uris[i]
+	}
+	n.AttrOrder = append(names, n.AttrOrder...)
+}
+
+// bindConstructed sets the namespace of a constructed element from its own
+// xmlns attributes, those of the constructors around it in scope or the
+// module's ns declarations, and declares the prefixes of its attributes on
+// it.
+func (rt *Runtime) bindConstructed(n *Node, scope map[string]string) {
+	resolve := func(name string) (string, bool) {
+		prefix, _ := splitQName(name)
+		if uri, ok := n.Attrs[nsDeclName(prefix)]; ok {
+			return uri, true
+		}
+		if uri, ok := scope[prefix]; ok {
+			return uri, true
+		}
+		uri, ok := rt.namespaceURI(prefix)
+		if !ok && !rt.legacy(CompatLocalNames) {
+			panic(unboundPrefix(name))
+		}
+		return uri, ok
+	}
+	n.Namespace, _ = resolve(n.Name)
+	var prefixes, uris []string
+	for _, k := range n.AttrNames() {
+		prefix, _ := splitQName(k)
+		if prefix == "" || prefix == "xml" || isNamespaceDecl(k) {
+			continue
+		}
+		if _, declared := n.Attrs[nsDeclName(prefix)]; declared {
+			continue
+		}
+		if _, inScope := scope[prefix]; inScope {
+			continue
+		}
+		if uri, ok := resolve(k); ok {
+			prefixes, uris = append(prefixes, prefix), append(uris, uri)
+		}
+	}
+	declareNamespaces(n, prefixes, uris)
+}
+
+// fixupNamespaces declares on copy, a copy of orig, the prefixes its
+// subtree uses that were declared on ancestors of orig, so that the copy
+// serializes with the same namespaces on its own.
+func fixupNamespaces(copy, orig *Node) {
+	if orig.Parent == nil || copy.Kind != "element" {
+		return
+	}
+	var prefixes, uris []string
+	var visit func(n *Node, declared map[string]bool)
+	visit = func(n *Node, declared map[string]bool) {
+		if n.Kind != "element" {
+			return
+		}
+		names := n.AttrNames()
+		for _, k := range names {
+			if isNamespaceDecl(k) {
+				declared[declaredPrefix(k)] = true
+			}
+		}
+		used := []string{n.Prefix()}
+		for _, k := range names {
+			if !isNamespaceDecl(k) {
+				if prefix, _ := splitQName(k); prefix != "" {
+					used = append(used, prefix)
+				}
+			}
+		}
+		for _, prefix := range used {
+			if prefix == "" || prefix == "xml" || declared[prefix] {
+				continue
+			}
+			if uri, ok := orig.Parent.LookupNamespace(prefix); ok {
+				prefixes, uris = append(prefixes, prefix), append(uris, uri)
+			}
+			declared[prefix] = true
+		}
+		for _, c := range n.Children {
+			inner := make(map[string]bool, len(declared))
+			for k := range declared {
+				inner[k] = true
+			}
+			visit(c, inner)
+		}
+	}
+	visit(copy, map[string]bool{})
+	declareNamespaces(copy, prefixes, uris)
+}
+
+// nsScope is the chain of namespace bindings in effect while serializing.
+type nsScope struct {
+	prefix, uri string
+	next        *nsScope
+}
+
+func (s *nsScope) lookup(prefix string) (string, bool) {
+	for ; s != nil; s = s.next {
+		if s.prefix == prefix {
+			return s.uri, true
+		}
+	}
+	if prefix == "xml" {
+		return XMLNamespace, true
+	}
+	return "", prefix == ""
+}
+
+// namespaceFixup returns the declarations item needs beyond those in scope
+// and its own xmlns attributes, and the scope for its children.
+func namespaceFixup(item *Node, scope *nsScope) ([][2]string, *nsScope) {
+	for k, v := range item.Attrs {
+		if isNamespaceDecl(k) {
+			scope = &nsScope{prefix: declaredPrefix(k), uri: v, next: scope}
+		}
+	}
+	var decls [][2]string
+	need := func(prefix, uri string) {
+		if cur, ok := scope.lookup(prefix); ok && cur == uri {
+			return
+		}
+		decls = append(decls, [2]string{nsDeclName(prefix), uri})
+		scope = &nsScope{prefix: prefix, uri: uri, next: scope}
+	}
+	if prefix := item.Prefix(); prefix == "" || item.Namespace != "" {
+		need(prefix, item.Namespace)
+	}
+	for _, k := range item.AttrNames() {
+		prefix, _ := splitQName(k)
+		if prefix == "" || prefix == "xml" || isNamespaceDecl(k) {
+			continue
+		}
+		if uri, ok := item.LookupNamespace(prefix); ok {
+			need(prefix, uri)
+		}
+	}
+	return decls, scope
+}
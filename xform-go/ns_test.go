@@ -0,0 +1,94 @@
+package xform
+
+import "testing"
+
+// nsXML has XHTML in the default namespace, a prefixed element and
+// attribute, and an element whose local name is p in another namespace.
+const nsXML = `<html xmlns="http://www.w3.org/1999/xhtml" xmlns:m="urn:meta"><body><p m:id="a">one</p><m:note>two</m:note><x:p xmlns:x="urn:other">three</x:p></body></html>`
+
+// TestLocalNameMatching covers name tests before and after namespace
+// support: compat "1.x" (CompatLocalNames) compares local names in any
+// namespace, while the default compares expanded names.
+func TestLocalNameMatching(t *testing.T) {
+	tests := []struct{ body, old, new string }{
+		{`count(//p)`, "2", "0"},
+		{`join(for e in /*/*/* return name(e), ",")`, "p,m:note,x:p", "p,m:note,x:p"},
+		{`rule main match <p/> := "P"; rule main match <note/> := "N"; join(apply(/*/*/*), ",")`, "P,N,P", "one,two,three"},
+		{`string(//m:note)`, "two", "XFST0002"},
+		{`string(/*/*/*[1]/@id)`, "a", ""},
+	}
+	for _, tt := range tests {
+		if got := nsOutcome(`compat "1.x"; ` + tt.body); got != tt.old {
+			t.Errorf("compat 1.x: %s = %q, want %q", tt.body, got, tt.old)
+		}
+		if got := nsOutcome(tt.body); got != tt.new {
+			t.Errorf("%s = %q, want %q", tt.body, got, tt.new)
+		}
+	}
+}
+
+// TestNamespaceMigration checks the fixes "Migrating from local-name
+// matching" in the README suggests.
+func TestNamespaceMigration(t *testing.T) {
+	tests := []struct{ src, want string }{
+		{`ns "" = "http://www.w3.org/1999/xhtml"; count(//p)`, "1"},
+		{`ns "h" = "http://www.w3.org/1999/xhtml"; ns "m" = "urn:meta"; concat(string(//m:note), "|", string(//h:p/@m:id))`, "two|a"},
+		{`ns "x" = "urn:other"; string(//x:p)`, "three"},
+		{`join(for e in //*[localName(.) = "p"] return string(e), ",")`, "one,three"},
+	}
+	for _, tt := range tests {
+		if got := nsOutcome(tt.src); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+	got := runWith(t, `count(//p)`, nsXML, EvalOptions{Compat: CompatLocalNames})
+	if got != "2" {
+		t.Errorf("EvalOptions.Compat: count(//p) = %s, want 2", got)
+	}
+}
+
+// nsOutcome evaluates src against nsXML and returns the result, or the
+// error code it fails with.
+func nsOutcome(src string) string {
+	out, err := tryRun(src, nsXML, EvalOptions{})
+	if err != nil {
+		return ErrorCode(err)
+	}
+	return out
+}
+
+func TestConstructorNamespaceScope(t *testing.T) {
+	tests := []struct{ src, want string }{
+		{`<x xmlns="urn:n"><y/></x>`, `<x xmlns="urn:n"><y/></x>`},
+		{`<x xmlns="urn:n"><y><z/></y>{for i in 1 to 2 return <w/>}</x>`, `<x xmlns="urn:n"><y><z/></y><w/><w/></x>`},
+		{`let x := <x xmlns="urn:n"><y/></x> in namespaceUri(x/*)`, "urn:n"},
+		{`<x xmlns="urn:n"><y xmlns=""><z/></y></x>`, `<x xmlns="urn:n"><y xmlns=""><z/></y></x>`},
+		{`<x xmlns:p="urn:p"><p:y p:a="1"/></x>`, `<x xmlns:p="urn:p"><p:y p:a="1"/></x>`},
+		{`let x := <x xmlns:p="urn:p"><p:y p:a="1"/></x> in copy(x/*)`, `<p:y xmlns:p="urn:p" p:a="1"/>`},
+		{`def f() := <f/>; <x xmlns="urn:n">{f()}</x>`, `<x xmlns="urn:n"><f xmlns=""/></x>`},
+	}
+	for _, tt := range tests {
+		if got := nsOutcome(tt.src); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestDescendantAttributes(t *testing.T) {
+	input := `<r a="1" xml:lang="en" xmlns:q="urn:q"><e b="2" q:c="3"/><e b="4"/></r>`
+	tests := []struct{ src, want string }{
+		{`count(//@*)`, "5"},
+		{`count(/r/@*)`, "2"},
+		{`string(//@xml:lang)`, "en"},
+		{`join(//@b, ",")`, "2,4"},
+		{`count(/r/e//@*)`, "3"},
+		{`for r in /r return count(.//@*)`, "5"},
+		{`ns "q" = "urn:q"; string(//@q:c)`, "3"},
+		{`count(//@*[. = "2"])`, "1"},
+	}
+	for _, tt := range tests {
+		if got := run(t, tt.src, input); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package xform
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// NumberSymbols are the characters FormatNumber writes for the decimal
+// and grouping separators and the minus sign. Pictures always use . , and
+// -; the symbols only change the output.
+type NumberSymbols struct {
+	Decimal, Grouping, Minus string
+}
+
+// numberLocales holds the separators per language; others get en's.
+var numberLocales = map[string]NumberSymbols{
+	"en": {Decimal: ".", Grouping: ",", Minus: "-"},
+	"de": {Decimal: ",", Grouping: ".", Minus: "-"},
+	"fr": {Decimal: ",", Grouping: "\u202f", Minus: "-"},
+	"es": {Decimal: ",", Grouping: ".", Minus: "-"},
+	"it": {Decimal: ",", Grouping: ".", Minus: "-"},
+	"nl": {Decimal: ",", Grouping: ".", Minus: "-"},
+	"pt": {Decimal: ",", Grouping: ".", Minus: "-"},
+}
+
+// LocaleNumberSymbols returns the number symbols of locale; de-CH and
+// de-AT share de's.
+func LocaleNumberSymbols(locale string) NumberSymbols {
+	if s, ok := numberLocales[primaryLanguage(locale)]; ok {
+		return s
+	}
+	return numberLocales["en"]
+}
+
+// numberPicture is a parsed FormatNumber subpicture.
+type numberPicture struct {
+	prefix, suffix   string
+	minInt           int
+	minFrac, maxFrac int
+	groups           []int // digits from the decimal point to each grouping separator
+	scale            int   // 2 with %, 3 with ‰
+}
+
+// FormatNumber formats n with an XSLT format-number picture such as
+// "#,##0.00", "0.0%" or "#,##0.00 €;(#,##0.00 €)": 0 is a digit always
+// written, # one written when needed, . the decimal and , the grouping
+// separator; % and ‰ scale the number. Anything before or after the digits
+// is copied, and a second subpicture after ; is used for negative numbers,
+// which otherwise get a minus sign. Numbers are rounded half to even, and
+// the sign is that of n, as in XPath 3.1: a negative number that rounds to
+// zero, and negative zero, are written as negative (-0 for -0.4 with "0").
+func FormatNumber(n any, picture string, symbols NumberSymbols) (string, error) {
+	parts := strings.Split(picture, ";")
+	if len(parts) > 2 {
+		return "", fmt.Errorf("XFDY0002: picture %q has more than two subpictures", picture)
+	}
+	pics := make([]numberPicture, len(parts))
+	for i, part := range parts {
+		p, err := parseNumberPicture(part)
+		if err != nil {
+			return "", fmt.Errorf("XFDY0002: %v in picture %q", err, picture)
+		}
+		pics[i] = p
+	}
+	var r *big.Rat
+	negZero := false
+	switch v := n.(type) {
+	case int64:
+		r = new(big.Rat).SetInt64(v)
+	case Decimal:
+		r = v.r()
+	case float64:
+		switch {
+		case v == 0 && math.Signbit(v):
+			negZero = true
+		case math.IsNaN(v):
+			return "NaN", nil
+		case math.IsInf(v, 1):
+			return pics[0].prefix + "Infinity" + pics[0].suffix, nil
+		case math.IsInf(v, -1):
+			if len(pics) > 1 {
+				return pics[1].prefix + "Infinity" + pics[1].suffix, nil
+			}
+			return symbols.Minus + pics[0].prefix + "Infinity" + pics[0].suffix, nil
+		}
+		r, _ = new(big.Rat).SetString(strconv.FormatFloat(v, 'g', -1, 64))
+	default:
+		return "", fmt.Errorf("XFDY0002: formatNumber() expects a number, got %s", typeName(n))
+	}
+	p := pics[0]
+	for i := 0; i < p.scale; i++ {
+		r = new(big.Rat).Mul(r, big.NewRat(10, 1))
+	}
+	neg := r.Sign() < 0 || negZero
+	digits := roundHalfEven(new(big.Rat).Abs(r), p.maxFrac)
+	intPart, frac := digits[:len(digits)-p.maxFrac], digits[len(digits)-p.maxFrac:]
+	intPart = strings.TrimLeft(intPart, "0")
+	for len(intPart) < p.minInt {
+		intPart = "0" + intPart
+	}
+	for len(frac) > p.minFrac && frac[len(frac)-1] == '0' {
+		frac = frac[:len(frac)-1]
+	}
+	if intPart == "" && frac == "" {
+		// A number with no digit left, as 0.004 with #.##, is still 0.
+		intPart = "0"
+	}
+	b := &strings.Builder{}
+	prefix, suffix := p.prefix, p.suffix
+	if neg {
+		if len(pics) > 1 {
+			prefix, suffix = pics[1].prefix, pics[1].suffix
+		} else {
+			b.WriteString(symbols.Minus)
+		}
+	}
+	b.WriteString(prefix)
+	for i, c := range intPart {
+		if i > 0 && p.groupAt(len(intPart)-i) {
+			b.WriteString(symbols.Grouping)
+		}
+		b.WriteRune(c)
+	}
+	if frac != "" {
+		b.WriteString(symbols.Decimal)
+		b.WriteString(frac)
+	}
+	b.WriteString(suffix)
+	return b.String(), nil
+}
+
+// roundHalfEven returns the digits of r rounded to frac fractional
+// digits, without decimal point and with at least frac+1 digits.
+func roundHalfEven(r *big.Rat, frac int) string {
+	scaled := new(big.Rat).Mul(r, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(frac)), nil)))
+	q, rem := new(big.Int).QuoRem(scaled.Num(), scaled.Denom(), new(big.Int))
+	switch new(big.Int).Lsh(rem, 1).Cmp(scaled.Denom()) {
+	case 1:
+		q.Add(q, big.NewInt(1))
+	case 0:
+		if q.Bit(0) == 1 {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	s := q.String()
+	for len(s) < frac+1 {
+		s = "0" + s
+	}
+	return s
+}
+
+// groupAt reports whether a grouping separator goes before the digit
+// that has n digits from it to the decimal point, itself included. Evenly
+// spaced separators repeat, as in #,##0; others occur where written.
+func (p numberPicture) groupAt(n int) bool {
+	if len(p.groups) == 0 {
+		return false
+	}
+	regular := true
+	for i, g := range p.groups {
+		if g != (i+1)*p.groups[0] {
+			regular = false
+		}
+	}
+	if regular {
+		return n%p.groups[0] == 0
+	}
+	for _, g := range p.groups {
+		if g == n {
+			return true
+		}
+	}
+	return false
+}
+
+func parseNumberPicture(s string) (numberPicture, error) {
+	var p numberPicture
+	start := strings.IndexAny(s, "#0.,")
+	if start < 0 {
+		return p, fmt.Errorf("no digit")
+	}
+	end := strings.LastIndexAny(s, "#0.,") + 1
+	p.prefix, p.suffix = s[:start], s[end:]
+	for _, affix := range []string{p.prefix, p.suffix} {
+		if strings.ContainsAny(affix, "%‰") {
+			if p.scale != 0 || strings.Count(affix, "%")+strings.Count(affix, "‰") > 1 {
+				return p, fmt.Errorf("more than one %% or ‰")
+			}
+			p.scale = 2
+			if strings.Contains(affix, "‰") {
+				p.scale = 3
+			}
+		}
+	}
+	mantissa := s[start:end]
+	if strings.Count(mantissa, ".") > 1 {
+		return p, fmt.Errorf("more than one decimal separator")
+	}
+	intPart, frac, _ := strings.Cut(mantissa, ".")
+	if strings.Contains(mantissa, ",.") || strings.Contains(mantissa, ".,") || strings.Contains(mantissa, ",,") || strings.HasSuffix(intPart, ",") {
+		return p, fmt.Errorf("misplaced grouping separator")
+	}
+	if strings.Contains(frac, ",") {
+		return p, fmt.Errorf("grouping separator after the decimal separator")
+	}
+	if strings.Contains(strings.ReplaceAll(intPart, ",", ""), "0#") {
+		return p, fmt.Errorf("# after 0 before the decimal separator")
+	}
+	if strings.Contains(frac, "#0") {
+		return p, fmt.Errorf("0 after # after the decimal separator")
+	}
+	if strings.Trim(intPart+frac, ",") == "" {
+		return p, fmt.Errorf("no digit")
+	}
+	p.minInt = strings.Count(intPart, "0")
+	p.minFrac = strings.Count(frac, "0")
+	p.maxFrac = len(frac)
+	digits := 0
+	for i := len(intPart) - 1; i >= 0; i-- {
+		if intPart[i] == ',' {
+			p.groups = append(p.groups, digits)
+		} else {
+			digits++
+		}
+	}
+	if p.minInt == 0 && p.maxFrac == 0 {
+		p.minInt = 1
+	}
+	return p, nil
+}
+
+// fnFormatNumber is formatNumber(n, picture, locale?). The locale may
+// also be a map setting the symbols "decimal", "grouping" and "minus",
+// over those of the language of the number's node or context item.
+func fnFormatNumber(args [][]any, ctx Context) []any {
+	if len(args) == 0 || len(args[0]) == 0 {
+		return []any{}
+	}
+	if len(args) < 2 || len(args[1]) != 1 {
+		panic(fmt.Errorf("XFDY0002: formatNumber() expects a number and a picture"))
+	}
+	var symbols NumberSymbols
+	if len(args) > 2 && len(args[2]) == 1 {
+		if m, ok := args[2][0].(map[string][]any); ok {
+			symbols = LocaleNumberSymbols(localeArg(args, 3, ctx))
+			for key, value := range m {
+				s := ToString(value)
+				switch key {
+				case "decimal":
+					symbols.Decimal = s
+				case "grouping":
+					symbols.Grouping = s
+				case "minus":
+					symbols.Minus = s
+				default:
+					panic(fmt.Errorf("XFDY0002: unknown number symbol %q (want decimal, grouping or minus)", key))
+				}
+			}
+		}
+	}
+	if symbols == (NumberSymbols{}) {
+		symbols = LocaleNumberSymbols(localeArg(args, 2, ctx))
+	}
+	n := args[0][0]
+	switch v := n.(type) {
+	case *Node:
+		n = v.StringValue()
+	case int:
+		n = int64(v)
+	case bool:
+		n = ToNumeric([]any{v})
+	}
+	if s, ok := n.(string); ok {
+		var valid bool
+		if n, valid = parseNumeric(strings.TrimSpace(s)); !valid {
+			n = math.NaN()
+		}
+	}
+	out, err := FormatNumber(n, ToString(args[1]), symbols)
+	if err != nil {
+		panic(err)
+	}
+	return []any{out}
+}
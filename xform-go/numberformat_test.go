@@ -0,0 +1,43 @@
+package xform
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFormatNumberRounding(t *testing.T) {
+	en := LocaleNumberSymbols("en")
+	tests := []struct {
+		n       any
+		picture string
+		want    string
+	}{
+		{0.5, "0", "0"},
+		{1.5, "0", "2"},
+		{2.5, "0", "2"},
+		{-1.5, "0", "-2"},
+		{-2.5, "0", "-2"},
+		{-0.5, "0", "-0"},
+		{-0.4, "0", "-0"},
+		{-0.004, "0.00", "-0.00"},
+		{-0.004, "#.##", "-0"},
+		{0.004, "#.##", "0"},
+		{-0.5, "0;(0)", "(0)"},
+		{math.Copysign(0, -1), "0", "-0"},
+		{0.0, "0", "0"},
+		{int64(-3), "0", "-3"},
+		{-0.6, "0", "-1"},
+	}
+	for _, tt := range tests {
+		got, err := FormatNumber(tt.n, tt.picture, en)
+		if err != nil {
+			t.Fatalf("%v %q: %v", tt.n, tt.picture, err)
+		}
+		if got != tt.want {
+			t.Errorf("FormatNumber(%v, %q) = %q, want %q", tt.n, tt.picture, got, tt.want)
+		}
+	}
+	if got := run(t, `formatNumber(-0.5, "0")`, "<r/>"); got != "-0" {
+		t.Errorf(`formatNumber(-0.5, "0") = %q, want "-0"`, got)
+	}
+}
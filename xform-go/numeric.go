@@ -0,0 +1,347 @@
+package xform
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Numbers are integers (int64), decimals (Decimal) or doubles (float64).
+// Literals and number text such as attribute values or JSON numbers are
+// typed by their form: 42 is an integer, 19.99 a decimal and 1e3 a double.
+// Arithmetic keeps the most precise type both operands fit: integers stay
+// integers (div gives a decimal), decimals stay exact, and a double operand
+// makes the result a double. Integers that overflow int64 become decimals.
+// CompatDoubles computes with doubles only, as before.
+
+// Decimal is an exact decimal number, as made by decimal() and decimal
+// literals. The zero value is 0.
+type Decimal struct{ rat *big.Rat }
+
+// decimalDigits is the number of fractional digits kept by decimal
+// division, so that 1 div 3 is 0.333333333333333333.
+const decimalDigits = 18
+
+var decimalScale = new(big.Int).Exp(big.NewInt(10), big.NewInt(decimalDigits), nil)
+
+// ParseDecimal parses s, an integer or a decimal such as "-12.50".
+func ParseDecimal(s string) (Decimal, error) {
+	if isIntegerText(s) || isDecimalText(s) {
+		if r, ok := new(big.Rat).SetString(s); ok {
+			return Decimal{r}, nil
+		}
+	}
+	return Decimal{}, fmt.Errorf("invalid decimal %q", s)
+}
+
+func (d Decimal) r() *big.Rat {
+	if d.rat == nil {
+		return new(big.Rat)
+	}
+	return d.rat
+}
+
+// String formats d without exponent and without trailing zeros.
+func (d Decimal) String() string {
+	r := d.r()
+	// Decimals are finite, so the denominator has no prime factors but 2
+	// and 5; the larger count of either is the number of digits needed.
+	digits := 0
+	for _, p := range []int64{2, 5} {
+		n, prime := 0, big.NewInt(p)
+		q, rem := new(big.Int).Set(r.Denom()), new(big.Int)
+		for {
+			q.QuoRem(q, prime, rem)
+			if rem.Sign() != 0 {
+				break
+			}
+			n++
+		}
+		if n > digits {
+			digits = n
+		}
+	}
+	return r.FloatString(digits)
+}
+
+// Float64 returns the double nearest to d.
+func (d Decimal) Float64() float64 {
+	f, _ := d.r().Float64()
+	return f
+}
+
+func isNumeric(item any) bool {
+	switch item.(type) {
+	case int, int64, float64, Decimal:
+		return true
+	}
+	return false
+}
+
+// ToNumeric converts the first item of seq to a number: int64, Decimal or
+// float64. Booleans are 1 and 0, other items are typed by the form of their
+// string value; the empty sequence is 0. ToNumber is ToNumeric as a double.
+func ToNumeric(seq []any) any {
+	if len(seq) == 0 {
+		return int64(0)
+	}
+	item := seq[0]
+	if node, ok := item.(*Node); ok {
+		item = node.StringValue()
+	}
+	switch v := item.(type) {
+	case bool:
+		if v {
+			return int64(1)
+		}
+		return int64(0)
+	case int:
+		return int64(v)
+	case int64, float64, Decimal:
+		return v
+	case string:
+		if n, ok := parseNumeric(v); ok {
+			return n
+		}
+	}
+	panic(fmt.Errorf("XFDY0002: number conversion"))
+}
+
+// number is ToNumeric, or ToNumber under CompatDoubles.
+func (rt *Runtime) number(seq []any) any {
+	if rt.legacy(CompatDoubles) {
+		return ToNumber(seq)
+	}
+	return ToNumeric(seq)
+}
+
+// parseNumeric types number text by its form; everything but integers and
+// decimals is parsed as a double, so "1e3" and "NaN" are doubles.
+func parseNumeric(s string) (any, bool) {
+	if isIntegerText(s) {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, true
+		}
+	}
+	if d, err := ParseDecimal(s); err == nil {
+		return d, true
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil
+}
+
+// isIntegerText reports whether s is an optionally signed run of digits,
+// isDecimalText whether it is one with a decimal point such as "1.5", "5."
+// or ".5".
+func isIntegerText(s string) bool {
+	return isDigits(unsigned(s))
+}
+
+func isDecimalText(s string) bool {
+	whole, frac, ok := strings.Cut(unsigned(s), ".")
+	return ok && isDigits(whole+frac)
+}
+
+func isDigits(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
+
+func unsigned(s string) string {
+	if s != "" && (s[0] == '+' || s[0] == '-') {
+		return s[1:]
+	}
+	return s
+}
+
+// numberLiteral is the value of a number literal in transform source.
+func numberLiteral(s string) any {
+	n, ok := parseNumeric(s)
+	if !ok {
+		panic(fmt.Errorf("invalid number %q", s))
+	}
+	return n
+}
+
+func toFloat(n any) float64 {
+	switch v := n.(type) {
+	case int64:
+		return float64(v)
+	case Decimal:
+		return v.Float64()
+	}
+	return n.(float64)
+}
+
+func toRat(n any) *big.Rat {
+	if i, ok := n.(int64); ok {
+		return new(big.Rat).SetInt64(i)
+	}
+	return n.(Decimal).r()
+}
+
+func isZero(n any) bool {
+	switch v := n.(type) {
+	case int64:
+		return v == 0
+	case Decimal:
+		return v.r().Sign() == 0
+	}
+	return toFloat(n) == 0
+}
+
+// arithmetic applies +, -, *, div or mod to two numbers. Division by zero
+// gives a double (infinity or NaN), as before the numeric tower.
+func arithmetic(op string, a, b any) any {
+	_, afloat := a.(float64)
+	_, bfloat := b.(float64)
+	if afloat || bfloat || (op == "div" || op == "mod") && isZero(b) {
+		x, y := toFloat(a), toFloat(b)
+		switch op {
+		case "+":
+			return x + y
+		case "-":
+			return x - y
+		case "*":
+			return x * y
+		case "div":
+			return x / y
+		}
+		return math.Mod(x, y)
+	}
+	if x, ok := a.(int64); ok {
+		if y, ok := b.(int64); ok {
+			switch op {
+			case "+":
+				if z := x + y; (x^z)&(y^z) >= 0 {
+					return z
+				}
+			case "-":
+				if z := x - y; (x^y)&(x^z) >= 0 {
+					return z
+				}
+			case "*":
+				if z := x * y; x == 0 || z/x == y && !(x == -1 && y == math.MinInt64) {
+					return z
+				}
+			case "mod":
+				return x % y
+			}
+		}
+	}
+	p, q := toRat(a), toRat(b)
+	z := new(big.Rat)
+	switch op {
+	case "+":
+		z.Add(p, q)
+	case "-":
+		z.Sub(p, q)
+	case "*":
+		z.Mul(p, q)
+	case "div":
+		z = decimalQuo(p, q)
+	case "mod":
+		// p - q*trunc(p/q), which has the sign of p.
+		t := new(big.Int).Quo(new(big.Int).Mul(p.Num(), q.Denom()), new(big.Int).Mul(p.Denom(), q.Num()))
+		z.Sub(p, new(big.Rat).Mul(q, new(big.Rat).SetInt(t)))
+	}
+	return Decimal{z}
+}
+
+// decimalQuo divides p by q, rounding half away from zero to
+// decimalDigits fractional digits.
+func decimalQuo(p, q *big.Rat) *big.Rat {
+	num := new(big.Int).Mul(p.Num(), q.Denom())
+	num.Mul(num, decimalScale)
+	den := new(big.Int).Mul(p.Denom(), q.Num())
+	if den.Sign() < 0 {
+		num.Neg(num)
+		den.Neg(den)
+	}
+	quo, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if rem.Abs(rem).Lsh(rem, 1).Cmp(den) >= 0 {
+		quo.Add(quo, big.NewInt(int64(num.Sign())))
+	}
+	return new(big.Rat).SetFrac(quo, decimalScale)
+}
+
+func negate(n any) any {
+	switch v := n.(type) {
+	case int64:
+		if v != math.MinInt64 {
+			return -v
+		}
+	case float64:
+		return -v
+	}
+	return Decimal{new(big.Rat).Neg(toRat(n))}
+}
+
+// compareNumbers returns -1, 0 or 1 as a is less than, equal to or greater
+// than b; false when either is NaN.
+func compareNumbers(a, b any) (int, bool) {
+	_, afloat := a.(float64)
+	_, bfloat := b.(float64)
+	if afloat || bfloat {
+		x, y := toFloat(a), toFloat(b)
+		switch {
+		case math.IsNaN(x) || math.IsNaN(y):
+			return 0, false
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+	if x, ok := a.(int64); ok {
+		if y, ok := b.(int64); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	return toRat(a).Cmp(toRat(b)), true
+}
+
+// fnDecimal is decimal(x): x as an exact decimal. Doubles convert by their
+// shortest representation, so decimal(0.1e0) is exactly 0.1.
+func fnDecimal(args [][]any, _ Context) []any {
+	if len(args) == 0 || len(args[0]) == 0 {
+		return []any{}
+	}
+	if len(args[0]) > 1 {
+		panic(fmt.Errorf("XFDY0002: decimal() expects a single item, got a sequence of %d items", len(args[0])))
+	}
+	item := args[0][0]
+	if node, ok := item.(*Node); ok {
+		item = node.StringValue()
+	}
+	var n any
+	ok := false
+	switch v := item.(type) {
+	case string:
+		n, ok = parseNumeric(v)
+	case bool, int, int64, float64, Decimal:
+		n, ok = ToNumeric([]any{v}), true
+	}
+	if f, isFloat := n.(float64); isFloat && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		ok = false
+	}
+	if !ok {
+		panic(fmt.Errorf("XFDY0002: decimal() cannot convert %q", ToString([]any{item})))
+	}
+	switch v := n.(type) {
+	case int64:
+		return []any{Decimal{new(big.Rat).SetInt64(v)}}
+	case float64:
+		r, _ := new(big.Rat).SetString(strconv.FormatFloat(v, 'f', -1, 64))
+		return []any{Decimal{r}}
+	}
+	return []any{n}
+}
@@ -0,0 +1,132 @@
+package xform
+
+import (
+	"fmt"
+	"strings"
+)
+
+// htmlVoidElements are written without an end tag by the html output
+// method.
+var htmlVoidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+	"input": true, "link": true, "meta": true, "param": true, "source": true, "track": true, "wbr": true,
+}
+
+// SerializeOptions returns the serialization settings of the module's output
+// declaration, or the defaults when it has none. Callers may override
+// fields, e.g. from command-line flags.
+func (m *Module) SerializeOptions() SerializeOptions {
+	opts := SerializeOptions{Method: "xml"}
+	if m == nil || m.Output == nil {
+		return opts
+	}
+	o := m.Output
+	opts.Method = o.Method
+	opts.SortAttributes = o.SortAttributes
+	opts.DoctypeSystem = o.DoctypeSystem
+	opts.DoctypePublic = o.DoctypePublic
+	opts.XMLDeclaration = o.XMLDeclaration
+	opts.Encoding = o.Encoding
+	opts.BOM = o.BOM
+	opts.Newline = o.Newline
+	if o.Indent {
+		opts.Indent = "  "
+	}
+	return opts
+}
+
+// SerializeResult serializes the result of a transform as a document: the
+// XML declaration and doctype requested by opts come first, followed by
+// the items. The text method writes only the string values of the items.
+func SerializeResult(result []any, opts SerializeOptions) string {
+	opts.Limit.Truncate = true
+	out, _ := SerializeResultLimited(result, opts)
+	return out
+}
+
+// ParseNewline returns the line end of a newline style, lf or crlf.
+func ParseNewline(style string) (string, error) {
+	switch strings.ToLower(style) {
+	case "lf":
+		return "\n", nil
+	case "crlf":
+		return "\r\n", nil
+	}
+	return "", fmt.Errorf("unknown newline style %q (want lf or crlf)", style)
+}
+
+func writeResult(b *outputBuilder, result []any, opts SerializeOptions) {
+	if opts.BOM && isUTF8(opts.Encoding) {
+		b.WriteString("\uFEFF")
+	}
+	if opts.Method == "text" {
+		for _, item := range result {
+			if n, ok := item.(*Node); ok {
+				b.WriteString(n.StringValue())
+			} else {
+				b.WriteString(ToString([]any{item}))
+			}
+		}
+		return
+	}
+	if opts.XMLDeclaration && opts.Method != "html" {
+		encoding := opts.Encoding
+		if encoding == "" {
+			encoding = "UTF-8"
+		}
+		b.WriteString("<?xml version=\"1.0\" encoding=\"" + encoding + "\"?>\n")
+	}
+	if opts.DoctypeSystem != "" || opts.DoctypePublic != "" {
+		root := "html"
+		if opts.Method != "html" {
+			root = resultRootName(result)
+		}
+		b.WriteString("<!DOCTYPE " + root)
+		if opts.DoctypePublic != "" {
+			b.WriteString(" PUBLIC \"" + opts.DoctypePublic + "\"")
+			if opts.DoctypeSystem != "" {
+				b.WriteString(" \"" + opts.DoctypeSystem + "\"")
+			}
+		} else {
+			b.WriteString(" SYSTEM \"" + opts.DoctypeSystem + "\"")
+		}
+		b.WriteString(">\n")
+	}
+	for _, item := range result {
+		if node, ok := item.(*Node); ok {
+			writeTree(b, node, opts)
+		} else {
+			b.WriteString(ToString([]any{item}))
+		}
+	}
+}
+
+func resultRootName(result []any) string {
+	for _, item := range result {
+		n, ok := item.(*Node)
+		if !ok {
+			continue
+		}
+		if n.Kind == "document" {
+			for _, c := range n.Children {
+				if c.Kind == "element" {
+					return c.Name
+				}
+			}
+		}
+		if n.Kind == "element" {
+			return n.Name
+		}
+	}
+	return "html"
+}
+
+// rawTextElement reports whether text children of n are written unescaped
+// by the html output method.
+func rawTextElement(n *Node) bool {
+	if n == nil || n.Kind != "element" {
+		return false
+	}
+	name := strings.ToLower(n.Name)
+	return name == "script" || name == "style"
+}
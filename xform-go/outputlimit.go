@@ -0,0 +1,157 @@
+package xform
+
+import (
+	"fmt"
+	"strings"
+)
+
+// OutputLimit bounds what the serialization of a result writes, so that a
+// runaway transform cannot make the host build an unbounded string. Zero
+// fields mean no limit.
+type OutputLimit struct {
+	MaxBytes int64 // bytes of serialized output
+	MaxNodes int   // nodes written, not counting document nodes
+	// Truncate cuts output over a limit at the limit and appends the
+	// truncation marker, for previews, instead of failing with XFDY0013.
+	Truncate bool
+}
+
+// Truncation markers end truncated output: a comment for the xml and html
+// methods, a line for text.
+const (
+	TruncationMarker     = "<!-- output truncated -->"
+	TextTruncationMarker = "\n[output truncated]"
+)
+
+func (l OutputLimit) enabled() bool { return l.MaxBytes > 0 || l.MaxNodes > 0 }
+
+// outputLimitError is raised by an outputBuilder going over its limit.
+type outputLimitError struct {
+	limit string
+}
+
+func (e outputLimitError) Error() string {
+	return fmt.Sprintf("XFDY0013: output exceeds the limit of %s", e.limit)
+}
+
+// outputBuilder collects serialized output under a limit. Writing past it
+// panics with an outputLimitError; when truncating, the output is first
+// filled up to MaxBytes.
+type outputBuilder struct {
+	strings.Builder
+	limit    OutputLimit
+	nodes    int
+	encoding string // see SerializeOptions.Encoding
+	text     bool
+	newline  string // see SerializeOptions.Newline
+	lastCR   bool   // the last string written ended with \r
+}
+
+func (b *outputBuilder) WriteString(s string) (int, error) {
+	if b.newline != "" {
+		s = b.lineEnds(s)
+	}
+	if !isUTF8(b.encoding) {
+		s = encodable(s, b.encoding, b.text)
+	}
+	if max := b.limit.MaxBytes; max > 0 && int64(b.Len()+len(s)) > max {
+		if b.limit.Truncate {
+			b.Builder.WriteString(truncateUTF8(s, int(max)-b.Len()))
+		}
+		panic(outputLimitError{fmt.Sprintf("%d bytes", max)})
+	}
+	return b.Builder.WriteString(s)
+}
+
+// lineEnds writes the line ends of s, \r\n, \r or \n, as b.newline. A
+// \r\n split across two writes counts once.
+func (b *outputBuilder) lineEnds(s string) string {
+	if b.lastCR && strings.HasPrefix(s, "\n") {
+		s = s[1:]
+	}
+	b.lastCR = strings.HasSuffix(s, "\r")
+	if !strings.ContainsAny(s, "\r\n") {
+		return s
+	}
+	s = strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\r", "\n")
+	if b.newline != "\n" {
+		s = strings.ReplaceAll(s, "\n", b.newline)
+	}
+	return s
+}
+
+// node counts a node about to be written.
+func (b *outputBuilder) node() {
+	b.nodes++
+	if max := b.limit.MaxNodes; max > 0 && b.nodes > max {
+		panic(outputLimitError{fmt.Sprintf("%d nodes", max)})
+	}
+}
+
+// serialize runs write on a builder under opts.Limit and returns the
+// output; over the limit, the truncated output with its marker or the
+// XFDY0013 error.
+func serialize(opts SerializeOptions, write func(b *outputBuilder)) (out string, err error) {
+	b := &outputBuilder{limit: opts.Limit, encoding: opts.Encoding, text: opts.Method == "text", newline: opts.Newline}
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		e, ok := r.(outputLimitError)
+		if !ok {
+			panic(r)
+		}
+		if !opts.Limit.Truncate {
+			out, err = "", e
+			return
+		}
+		if opts.Method == "text" && opts.Newline != "" {
+			out = b.String() + strings.Replace(TextTruncationMarker, "\n", opts.Newline, 1)
+		} else if opts.Method == "text" {
+			out = b.String() + TextTruncationMarker
+		} else {
+			out = b.String() + TruncationMarker
+		}
+	}()
+	write(b)
+	return b.String(), nil
+}
+
+// SerializeResultLimited is SerializeResult under opts.Limit: output over
+// the limit is an XFDY0013 error, or with Truncate is cut at the limit and
+// ends with the truncation marker.
+func SerializeResultLimited(result []any, opts SerializeOptions) (string, error) {
+	return serialize(opts, func(b *outputBuilder) { writeResult(b, result, opts) })
+}
+
+// checkOutputNodes raises XFDY0013 when the result of an evaluation has
+// more nodes than EvalOptions.OutputLimit allows, before the caller
+// serializes it. Truncated output is left to the serialization.
+func (rt *Runtime) checkOutputNodes(result []any) {
+	limit := rt.Options.OutputLimit
+	if limit.MaxNodes <= 0 || limit.Truncate {
+		return
+	}
+	n := 0
+	var count func(node *Node) bool
+	count = func(node *Node) bool {
+		if node.Kind != "document" {
+			if n++; n > limit.MaxNodes {
+				return false
+			}
+		}
+		for _, c := range node.Children {
+			if !count(c) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, item := range result {
+		if node, ok := item.(*Node); ok && !count(node) {
+			rt.pos = Position{}
+			panic(outputLimitError{fmt.Sprintf("%d nodes", limit.MaxNodes)})
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package xform
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type BuiltinFunc func(args [][]any, ctx Context) []any
+
+type PackFunction struct {
+	Fn     BuiltinFunc
+	Params []string
+	Doc    string
+}
+
+// BuiltinPack is a coherent set of functions contributed by another Go
+// package. Its functions are called with the pack name as prefix, e.g.
+// crypto:sha256(.) for the function "sha256" of the pack "crypto".
+type BuiltinPack struct {
+	Name      string
+	Doc       string
+	Functions map[string]PackFunction
+}
+
+var (
+	packsMu sync.RWMutex
+	packs   = map[string]*BuiltinPack{}
+)
+
+func RegisterPack(pack *BuiltinPack) {
+	if err := validatePack(pack); err != nil {
+		panic(err)
+	}
+	packsMu.Lock()
+	defer packsMu.Unlock()
+	if _, ok := packs[pack.Name]; ok {
+		panic(fmt.Errorf("builtin pack %q registered twice", pack.Name))
+	}
+	packs[pack.Name] = pack
+}
+
+func RegisteredPacks() []*BuiltinPack {
+	packsMu.RLock()
+	defer packsMu.RUnlock()
+	out := make([]*BuiltinPack, 0, len(packs))
+	for _, p := range packs {
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func validatePack(pack *BuiltinPack) error {
+	if pack.Name == "" || strings.ContainsAny(pack.Name, ": ") {
+		return fmt.Errorf("invalid builtin pack name %q", pack.Name)
+	}
+	for name, fn := range pack.Functions {
+		if name == "" || strings.ContainsAny(name, ": ") || fn.Fn == nil {
+			return fmt.Errorf("invalid function %q in builtin pack %q", name, pack.Name)
+		}
+	}
+	return nil
+}
+
+func (p *BuiltinPack) FunctionNames() []string {
+	names := make([]string, 0, len(p.Functions))
+	for name := range p.Functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// packFunctions flattens the globally registered packs plus the per-evaluation
+// ones (which win on name clashes) into a lookup table keyed by prefixed name.
+func packFunctions(extra []*BuiltinPack) map[string]BuiltinFunc {
+	out := map[string]BuiltinFunc{}
+	add := func(p *BuiltinPack) {
+		for name, fn := range p.Functions {
+			out[p.Name+":"+name] = fn.Fn
+		}
+	}
+	for _, p := range RegisteredPacks() {
+		add(p)
+	}
+	for _, p := range extra {
+		add(p)
+	}
+	return out
+}
+
+// Function is a builtin implemented by the host program, such as a
+// database lookup. A returned error ends the evaluation; it is kept in the
+// Err of the XFormError.
+type Function func(args [][]any, ctx *Context) ([]any, error)
+
+var functions = map[string]Function{}
+
+// RegisterFunction makes fn callable as name() from every transform. Unlike
+// pack functions, registered functions have no prefix, so name must not be
+// a builtin. A function the module defines with def takes precedence.
+func RegisterFunction(name string, fn Function) {
+	if err := validateFunction(name, fn); err != nil {
+		panic(err)
+	}
+	packsMu.Lock()
+	defer packsMu.Unlock()
+	if _, ok := functions[name]; ok {
+		panic(fmt.Errorf("function %q registered twice", name))
+	}
+	functions[name] = fn
+}
+
+func validateFunction(name string, fn Function) error {
+	if name == "" || strings.ContainsAny(name, ": ") || fn == nil {
+		return fmt.Errorf("invalid function %q", name)
+	}
+	if _, ok := builtins[name]; ok {
+		return fmt.Errorf("function %q is a builtin", name)
+	}
+	return nil
+}
+
+// addFunctions adds the registered functions plus the per-evaluation ones
+// (which win on name clashes) to the lookup table out.
+func addFunctions(out map[string]BuiltinFunc, extra map[string]Function) {
+	add := func(name string, fn Function) {
+		out[name] = func(args [][]any, ctx Context) []any {
+			result, err := fn(args, &ctx)
+			if err != nil {
+				panic(err)
+			}
+			return result
+		}
+	}
+	packsMu.RLock()
+	for name, fn := range functions {
+		add(name, fn)
+	}
+	packsMu.RUnlock()
+	for name, fn := range extra {
+		add(name, fn)
+	}
+}
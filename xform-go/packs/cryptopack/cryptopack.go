@@ -0,0 +1,67 @@
+// Package cryptopack contributes the "crypto" builtin pack: hashing and
+// encoding helpers callable as crypto:sha256(.) and so on. Import it for its
+// side effect of registering the pack.
+package cryptopack
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+
+	xform "xform-go"
+)
+
+var Pack = &xform.BuiltinPack{
+	Name: "crypto",
+	Doc:  "Hashing and encoding of string values.",
+	Functions: map[string]xform.PackFunction{
+		"md5":          {Fn: hashFn(md5.New), Params: []string{"value"}, Doc: "Hex-encoded MD5 digest of the string value."},
+		"sha1":         {Fn: hashFn(sha1.New), Params: []string{"value"}, Doc: "Hex-encoded SHA-1 digest of the string value."},
+		"sha256":       {Fn: hashFn(sha256.New), Params: []string{"value"}, Doc: "Hex-encoded SHA-256 digest of the string value."},
+		"hmacSha256":   {Fn: hmacSHA256, Params: []string{"key", "value"}, Doc: "Hex-encoded HMAC-SHA256 of value keyed with key."},
+		"base64Encode": {Fn: base64Encode, Params: []string{"value"}, Doc: "Standard base64 encoding of the string value."},
+		"base64Decode": {Fn: base64Decode, Params: []string{"value"}, Doc: "Decodes standard base64; raises XFDY0002 on invalid input."},
+	},
+}
+
+func init() {
+	xform.RegisterPack(Pack)
+}
+
+func arg(args [][]any, i int) string {
+	if i >= len(args) {
+		return ""
+	}
+	return xform.ToString(args[i])
+}
+
+func hashFn(newHash func() hash.Hash) xform.BuiltinFunc {
+	return func(args [][]any, _ xform.Context) []any {
+		h := newHash()
+		h.Write([]byte(arg(args, 0)))
+		return []any{hex.EncodeToString(h.Sum(nil))}
+	}
+}
+
+func hmacSHA256(args [][]any, _ xform.Context) []any {
+	h := hmac.New(sha256.New, []byte(arg(args, 0)))
+	h.Write([]byte(arg(args, 1)))
+	return []any{hex.EncodeToString(h.Sum(nil))}
+}
+
+func base64Encode(args [][]any, _ xform.Context) []any {
+	return []any{base64.StdEncoding.EncodeToString([]byte(arg(args, 0)))}
+}
+
+func base64Decode(args [][]any, _ xform.Context) []any {
+	out, err := base64.StdEncoding.DecodeString(arg(args, 0))
+	if err != nil {
+		panic(fmt.Errorf("XFDY0002: invalid base64: %v", err))
+	}
+	return []any{string(out)}
+}
@@ -3,15 +3,35 @@ package xform
 import (
 	"fmt"
 	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 type Parser struct {
-	text  string
-	lexer *Lexer
+	text       string
+	lexer      *Lexer
+	whitespace string
+	strict     bool
+	output     *Output
+	compat     Compat
+	lineStarts []int
+	// tolerant parses record syntax errors in errs and go on, see
+	// ParseModuleTolerant.
+	tolerant bool
+	errs     []syntaxError
+	// declStarts are the offsets at which the module's top-level
+	// declarations start, an annotation counting as part of the
+	// declaration it precedes, followed by that of the body.
+	declStarts []int
+	declStart  int // of the declaration being parsed
+	// ctorScope is the Scope of constructors parsed in the contents of
+	// the current one.
+	ctorScope map[string]string
 }
 
 func NewParser(text string) *Parser {
-	return &Parser{text: text, lexer: NewLexer(text)}
+	return &Parser{text: text, lexer: NewLexer(text), whitespace: WhitespaceInline}
 }
 
 func (p *Parser) ParseModule() *Module {
@@ -20,59 +40,155 @@ func (p *Parser) ParseModule() *Module {
 	vars := map[string]Expr{}
 	namespaces := map[string]string{}
 	imports := [][2]*string{}
+	phases := []Phase{}
+	validations := []ValidationSet{}
+	params := []Param{}
+	varPos := map[string]Position{}
+	varDoc := map[string][]Comment{}
 
-	tok := p.lexer.Peek()
-	if tok.Kind == TokKW && tok.Val == "xform" {
-		p.lexer.Next()
-		p.lexer.Expect(TokKW, "version")
-		version := p.lexer.Expect(TokString, "").Val
-		if version != "2.0" {
-			panic(fmt.Errorf("XFST0005: unsupported version"))
+	p.recovering(func() bool {
+		tok := p.lexer.Peek()
+		if tok.Kind == TokKW && tok.Val == "xform" {
+			p.lexer.Next()
+			p.lexer.Expect(TokKW, "version")
+			version := p.lexer.Expect(TokString, "").Val
+			if version != "2.0" {
+				panic(fmt.Errorf("XFST0005: unsupported version"))
+			}
+			p.lexer.Expect(TokPunct, ";")
 		}
-		p.lexer.Expect(TokPunct, ";")
-	}
+		return false
+	}, p.synchronize)
 
-	for {
-		tok = p.lexer.Peek()
+	var deprecated *string
+	declaration := func() bool {
+		tok := p.lexer.Peek()
+		if deprecated == nil {
+			p.declStarts = append(p.declStarts, tok.Pos)
+			p.declStart = tok.Pos
+		}
+		if tok.Kind == TokAt {
+			deprecated = p.parseDeprecated()
+			return true
+		}
+		if deprecated != nil && !(tok.Kind == TokKW && (tok.Val == "def" || tok.Val == "rule")) {
+			deprecated = nil
+			p.report(fmt.Errorf("XFST0001: @deprecated must precede def or rule at %d", tok.Pos))
+		}
 		if tok.Kind == TokKW && tok.Val == "ns" {
 			p.parseNs(namespaces)
-			continue
+			return true
 		}
 		if tok.Kind == TokKW && tok.Val == "import" {
 			p.parseImport(&imports)
-			continue
+			return true
 		}
 		if tok.Kind == TokKW && tok.Val == "var" {
-			name, expr := p.parseVar()
+			doc := p.doc()
+			name, pos, expr := p.parseVar()
 			vars[name] = expr
-			continue
+			varPos[name] = pos
+			if doc != nil {
+				varDoc[name] = doc
+			}
+			return true
 		}
 		if tok.Kind == TokKW && tok.Val == "def" {
-			p.parseDef(functions)
-			continue
+			note := deprecated
+			deprecated = nil
+			p.parseDef(functions, note)
+			return true
 		}
 		if tok.Kind == TokKW && tok.Val == "rule" {
-			p.parseRule(rules)
-			continue
+			note := deprecated
+			deprecated = nil
+			p.parseRule(rules, note)
+			return true
 		}
-		break
+		if tok.Kind == TokIdent && tok.Val == "strict" && p.atStrictDecl() {
+			p.lexer.Next()
+			p.lexer.Expect(TokPunct, ";")
+			p.strict = true
+			return true
+		}
+		if tok.Kind == TokIdent && tok.Val == "compat" && p.atCompatDecl() {
+			p.lexer.Next()
+			level := p.lexer.Next()
+			compat, err := ParseCompat(level.Val)
+			if err != nil {
+				panic(fmt.Errorf("%v at %d", err, level.Pos))
+			}
+			p.lexer.Expect(TokPunct, ";")
+			p.compat = compat
+			return true
+		}
+		if tok.Kind == TokIdent && tok.Val == "output" && p.atOutputDecl() {
+			p.parseOutputDecl()
+			return true
+		}
+		if tok.Kind == TokIdent && tok.Val == "whitespace" && p.atWhitespaceDecl() {
+			p.parseWhitespaceDecl()
+			return true
+		}
+		if tok.Kind == TokIdent && tok.Val == "validate" && p.atValidateDecl() {
+			p.parseValidate(&validations)
+			return true
+		}
+		if tok.Kind == TokIdent && tok.Val == "param" && p.atParamDecl() {
+			params = p.parseParamDecl(params)
+			return true
+		}
+		if tok.Kind == TokIdent && tok.Val == "phase" && p.atPhaseDecl() {
+			phases = append(phases, p.parsePhase())
+			return true
+		}
+		return false
 	}
 
+	// A tolerant parse goes back to the declarations after an error in
+	// the body, which may have been a broken declaration.
 	var expr Expr
-	if p.lexer.Peek().Kind != TokEOF {
-		expr = p.parseExpr()
-		if p.lexer.Peek().Kind != TokEOF {
-			panic(fmt.Errorf("unexpected token at %d", p.lexer.Peek().Pos))
+	for {
+		for p.recovering(declaration, p.synchronize) {
+		}
+		if p.lexer.Peek().Kind == TokEOF {
+			break
+		}
+		start := p.lexer.Peek().Pos
+		if !p.recovering(func() bool {
+			body := p.parseExpr()
+			if expr == nil {
+				expr = body
+			}
+			if p.lexer.Peek().Kind != TokEOF {
+				panic(fmt.Errorf("XFST0001: unexpected token at %d", p.lexer.Peek().Pos))
+			}
+			return false
+		}, p.synchronize) {
+			break
+		}
+		if expr == nil {
+			expr = BadExpr{Pos: p.position(start)}
 		}
 	}
 
 	return &Module{
-		Functions:  functions,
-		Rules:      rules,
-		Vars:       vars,
-		Namespaces: namespaces,
-		Imports:    imports,
-		Expr:       expr,
+		Functions:   functions,
+		Rules:       rules,
+		Vars:        vars,
+		Params:      params,
+		VarPos:      varPos,
+		VarDoc:      varDoc,
+		Namespaces:  namespaces,
+		Imports:     imports,
+		Whitespace:  p.whitespace,
+		Strict:      p.strict,
+		Output:      p.output,
+		Compat:      p.compat,
+		Phases:      phases,
+		Validations: validations,
+		Expr:        expr,
+		Comments:    p.comments(),
 	}
 }
 
@@ -99,17 +215,262 @@ func (p *Parser) parseImport(imports *[][2]*string) {
 	*imports = append(*imports, [2]*string{&iriCopy, alias})
 }
 
-func (p *Parser) parseVar() (string, Expr) {
+func (p *Parser) parseVar() (string, Position, Expr) {
 	p.lexer.Expect(TokKW, "var")
+	pos := p.position(p.lexer.Peek().Pos)
+	name := p.parseVarName()
+	p.lexer.Expect(TokOp, ":=")
+	return name, pos, p.parseBody()
+}
+
+// atParamDecl tells a "param name;" declaration, possibly with a type or
+// a default, apart from a module body starting with an element named
+// param.
+func (p *Parser) atParamDecl() bool {
+	savedPos := p.lexer.Pos
+	savedBuf := p.lexer.Buffer
+	defer func() {
+		p.lexer.Pos = savedPos
+		p.lexer.Buffer = savedBuf
+	}()
+	p.lexer.Next()
+	if tok := p.lexer.Next(); tok.Kind != TokIdent && tok.Kind != TokVar {
+		return false
+	}
+	tok := p.lexer.Next()
+	return tok.Kind == TokPunct && (tok.Val == ";" || tok.Val == ":") || tok.Kind == TokOp && tok.Val == ":="
+}
+
+func (p *Parser) parseParamDecl(params []Param) []Param {
+	doc := p.doc()
+	pos := p.lexer.Expect(TokIdent, "param").Pos
+	param := p.parseParam()
+	param.Doc = doc
+	p.lexer.Expect(TokPunct, ";")
+	for _, other := range params {
+		if other.Name == param.Name {
+			panic(fmt.Errorf("XFST0001: duplicate parameter %s at %d", param.Name, pos))
+		}
+	}
+	return append(params, param)
+}
+
+// atPhaseDecl tells a "phase name :=" declaration apart from a module body
+// expression that merely starts with an element named phase.
+func (p *Parser) atPhaseDecl() bool {
+	savedPos := p.lexer.Pos
+	savedBuf := p.lexer.Buffer
+	defer func() {
+		p.lexer.Pos = savedPos
+		p.lexer.Buffer = savedBuf
+	}()
+	p.lexer.Next()
+	if p.lexer.Next().Kind != TokIdent {
+		return false
+	}
+	tok := p.lexer.Next()
+	return tok.Kind == TokOp && tok.Val == ":="
+}
+
+func (p *Parser) parsePhase() Phase {
+	doc := p.doc()
+	p.lexer.Expect(TokIdent, "phase")
 	name := p.lexer.Expect(TokIdent, "").Val
 	p.lexer.Expect(TokOp, ":=")
-	value := p.parseExpr()
+	return Phase{Name: name, Expr: p.parseBody(), Doc: doc}
+}
+
+// atWhitespaceDecl tells "whitespace preserve;" apart from a module body
+// starting with a path named whitespace.
+func (p *Parser) atWhitespaceDecl() bool {
+	savedPos := p.lexer.Pos
+	savedBuf := p.lexer.Buffer
+	defer func() {
+		p.lexer.Pos = savedPos
+		p.lexer.Buffer = savedBuf
+	}()
+	p.lexer.Next()
+	if p.lexer.Next().Kind != TokIdent {
+		return false
+	}
+	tok := p.lexer.Next()
+	return tok.Kind == TokPunct && tok.Val == ";"
+}
+
+// atStrictDecl tells the "strict;" pragma apart from a module body that is
+// just a reference to strict.
+func (p *Parser) atStrictDecl() bool {
+	savedPos := p.lexer.Pos
+	savedBuf := p.lexer.Buffer
+	defer func() {
+		p.lexer.Pos = savedPos
+		p.lexer.Buffer = savedBuf
+	}()
+	p.lexer.Next()
+	tok := p.lexer.Next()
+	return tok.Kind == TokPunct && tok.Val == ";"
+}
+
+func (p *Parser) atCompatDecl() bool {
+	savedPos := p.lexer.Pos
+	savedBuf := p.lexer.Buffer
+	defer func() {
+		p.lexer.Pos = savedPos
+		p.lexer.Buffer = savedBuf
+	}()
+	p.lexer.Next()
+	return p.lexer.Next().Kind == TokString
+}
+
+// atOutputDecl tells "output method ..." apart from a module body starting
+// with a path named output.
+func (p *Parser) atOutputDecl() bool {
+	savedPos := p.lexer.Pos
+	savedBuf := p.lexer.Buffer
+	defer func() {
+		p.lexer.Pos = savedPos
+		p.lexer.Buffer = savedBuf
+	}()
+	p.lexer.Next()
+	if p.lexer.Next().Kind != TokIdent {
+		return false
+	}
+	tok := p.lexer.Next()
+	return tok.Kind == TokString || tok.Kind == TokIdent || tok.Kind == TokNumber
+}
+
+// parseOutputDecl reads comma-separated serialization parameters. Several
+// declarations add up, later values winning.
+func (p *Parser) parseOutputDecl() {
+	p.lexer.Expect(TokIdent, "output")
+	if p.output == nil {
+		p.output = &Output{Method: "xml"}
+	}
+	for {
+		key := p.lexer.Expect(TokIdent, "")
+		tok := p.lexer.Next()
+		if tok.Kind != TokString && tok.Kind != TokIdent && tok.Kind != TokNumber {
+			panic(fmt.Errorf("XFST0001: expected a value for output parameter %s at %d", key.Val, tok.Pos))
+		}
+		flag := func() bool {
+			if tok.Val != "true" && tok.Val != "false" && tok.Val != "yes" && tok.Val != "no" {
+				panic(fmt.Errorf("XFST0001: output parameter %s wants true or false at %d", key.Val, tok.Pos))
+			}
+			return tok.Val == "true" || tok.Val == "yes"
+		}
+		switch key.Val {
+		case "method":
+			if tok.Val != "xml" && tok.Val != "html" && tok.Val != "text" {
+				panic(fmt.Errorf("XFST0001: unknown output method %q at %d", tok.Val, tok.Pos))
+			}
+			p.output.Method = tok.Val
+		case "indent":
+			p.output.Indent = flag()
+		case "doctype-system":
+			p.output.DoctypeSystem = tok.Val
+		case "doctype-public":
+			p.output.DoctypePublic = tok.Val
+		case "omit-xml-declaration":
+			p.output.XMLDeclaration = !flag()
+		case "sort-attributes":
+			p.output.SortAttributes = flag()
+		case "encoding":
+			enc, err := OutputEncoding(tok.Val)
+			if err != nil {
+				panic(fmt.Errorf("XFST0001: %v at %d", err, tok.Pos))
+			}
+			p.output.Encoding = enc
+		case "byte-order-mark":
+			p.output.BOM = flag()
+		case "newline":
+			nl, err := ParseNewline(tok.Val)
+			if err != nil {
+				panic(fmt.Errorf("XFST0001: %v at %d", err, tok.Pos))
+			}
+			p.output.Newline = nl
+		default:
+			panic(fmt.Errorf("XFST0001: unknown output parameter %s at %d", key.Val, key.Pos))
+		}
+		if p.lexer.Peek().Kind == TokPunct && p.lexer.Peek().Val == "," {
+			p.lexer.Next()
+			continue
+		}
+		p.lexer.Expect(TokPunct, ";")
+		return
+	}
+}
+
+func (p *Parser) parseWhitespaceDecl() {
+	p.lexer.Expect(TokIdent, "whitespace")
+	tok := p.lexer.Expect(TokIdent, "")
+	switch tok.Val {
+	case WhitespaceStrip, WhitespaceInline, WhitespacePreserve:
+		p.whitespace = tok.Val
+	default:
+		panic(fmt.Errorf("XFST0001: unknown whitespace policy %q at %d", tok.Val, tok.Pos))
+	}
 	p.lexer.Expect(TokPunct, ";")
-	return name, value
 }
 
-func (p *Parser) parseDef(functions map[string]FunctionDef) {
+// atValidateDecl tells "validate name match ..." apart from a module body
+// starting with a path named validate.
+func (p *Parser) atValidateDecl() bool {
+	savedPos := p.lexer.Pos
+	savedBuf := p.lexer.Buffer
+	defer func() {
+		p.lexer.Pos = savedPos
+		p.lexer.Buffer = savedBuf
+	}()
+	p.lexer.Next()
+	if p.lexer.Next().Kind != TokIdent {
+		return false
+	}
+	tok := p.lexer.Next()
+	return tok.Kind == TokKW && tok.Val == "match"
+}
+
+func (p *Parser) parseValidate(sets *[]ValidationSet) {
+	doc := p.doc()
+	line := p.line()
+	p.lexer.Expect(TokIdent, "validate")
+	name := p.parseQName()
+	p.lexer.Expect(TokKW, "match")
+	pattern := p.parsePattern()
+	p.lexer.Expect(TokOp, ":=")
+	body := p.parseBody()
+	rule := RuleDef{Name: name, Pattern: pattern, Body: body, Line: line, Doc: doc}
+	for i := range *sets {
+		if (*sets)[i].Name == name {
+			(*sets)[i].Rules = append((*sets)[i].Rules, rule)
+			return
+		}
+	}
+	*sets = append(*sets, ValidationSet{Name: name, Rules: []RuleDef{rule}})
+}
+
+// line returns the 1-based source line of the next token.
+func (p *Parser) line() int {
+	return p.position(p.lexer.Peek().Pos).Line
+}
+
+func (p *Parser) parseDeprecated() *string {
+	p.lexer.Expect(TokAt, "")
+	tok := p.lexer.Expect(TokIdent, "")
+	if tok.Val != "deprecated" {
+		panic(fmt.Errorf("XFST0001: unknown annotation @%s at %d", tok.Val, tok.Pos))
+	}
+	msg := ""
+	if p.lexer.Peek().Kind == TokString {
+		msg = p.lexer.Next().Val
+	}
+	return &msg
+}
+
+func (p *Parser) parseDef(functions map[string]FunctionDef, deprecated *string) {
+	doc := p.doc()
+	line := p.line()
 	p.lexer.Expect(TokKW, "def")
+	namePos := p.position(p.lexer.Peek().Pos)
 	name := p.parseQName()
 	p.lexer.Expect(TokPunct, "(")
 	params := []Param{}
@@ -122,13 +483,13 @@ func (p *Parser) parseDef(functions map[string]FunctionDef) {
 	}
 	p.lexer.Expect(TokPunct, ")")
 	p.lexer.Expect(TokOp, ":=")
-	body := p.parseExpr()
-	p.lexer.Expect(TokPunct, ";")
-	functions[name] = FunctionDef{Params: params, Body: body}
+	body := p.parseBody()
+	functions[name] = FunctionDef{Name: name, Params: params, Body: body, Deprecated: deprecated, Line: line, NamePos: namePos, Doc: doc}
 }
 
 func (p *Parser) parseParam() Param {
-	name := p.lexer.Expect(TokIdent, "").Val
+	pos := p.position(p.lexer.Peek().Pos)
+	name := p.parseVarName()
 	var typeRef *string
 	var def Expr
 	if p.lexer.Peek().Kind == TokPunct && p.lexer.Peek().Val == ":" {
@@ -140,7 +501,7 @@ func (p *Parser) parseParam() Param {
 		p.lexer.Next()
 		def = p.parseExpr()
 	}
-	return Param{Name: name, TypeRef: typeRef, Default: def}
+	return Param{Name: name, TypeRef: typeRef, Default: def, Pos: pos}
 }
 
 func (p *Parser) parseTypeRef() string {
@@ -153,15 +514,39 @@ func (p *Parser) parseTypeRef() string {
 	return p.parseQName()
 }
 
-func (p *Parser) parseRule(rules map[string][]RuleDef) {
+func (p *Parser) parseRule(rules map[string][]RuleDef, deprecated *string) {
+	doc := p.doc()
+	line := p.line()
 	p.lexer.Expect(TokKW, "rule")
 	name := p.parseQName()
+	mode := ""
+	if p.acceptWords("mode") {
+		mode = p.parseQName()
+	}
 	p.lexer.Expect(TokKW, "match")
 	pattern := p.parsePattern()
+	priority := 0.0
+	if p.acceptWords("priority") {
+		priority = p.parsePriority()
+	}
 	p.lexer.Expect(TokOp, ":=")
-	body := p.parseExpr()
-	p.lexer.Expect(TokPunct, ";")
-	rules[name] = append(rules[name], RuleDef{Pattern: pattern, Body: body})
+	body := p.parseBody()
+	rules[name] = append(rules[name], RuleDef{Name: name, Mode: mode, Pattern: pattern, Priority: priority, Body: body, Deprecated: deprecated, Line: line, Doc: doc})
+}
+
+// parsePriority reads the number after priority in a rule, which may be
+// negative.
+func (p *Parser) parsePriority() float64 {
+	sign := 1.0
+	if tok := p.lexer.Peek(); tok.Kind == TokOp && tok.Val == "-" {
+		p.lexer.Next()
+		sign = -1
+	}
+	tok := p.lexer.Next()
+	if tok.Kind != TokNumber {
+		panic(fmt.Errorf("XFST0001: expected a number after priority at %d", tok.Pos))
+	}
+	return sign * toFloat(numberLiteral(tok.Val))
 }
 
 func (p *Parser) parseExpr() Expr {
@@ -182,28 +567,28 @@ func (p *Parser) parseExpr() Expr {
 }
 
 func (p *Parser) parseIf() Expr {
-	p.lexer.Expect(TokKW, "if")
+	pos := p.position(p.lexer.Expect(TokKW, "if").Pos)
 	cond := p.parseExpr()
 	p.lexer.Expect(TokKW, "then")
 	thenExpr := p.parseExpr()
 	p.lexer.Expect(TokKW, "else")
 	elseExpr := p.parseExpr()
-	return IfExpr{Cond: cond, ThenExpr: thenExpr, ElseExpr: elseExpr}
+	return IfExpr{Cond: cond, ThenExpr: thenExpr, ElseExpr: elseExpr, Pos: pos}
 }
 
 func (p *Parser) parseLet() Expr {
-	p.lexer.Expect(TokKW, "let")
-	name := p.lexer.Expect(TokIdent, "").Val
+	pos := p.position(p.lexer.Expect(TokKW, "let").Pos)
+	name := p.parseVarName()
 	p.lexer.Expect(TokOp, ":=")
 	value := p.parseExpr()
 	p.lexer.Expect(TokKW, "in")
 	body := p.parseExpr()
-	return LetExpr{Name: name, Value: value, Body: body}
+	return LetExpr{Name: name, Value: value, Body: body, Pos: pos}
 }
 
 func (p *Parser) parseFor() Expr {
-	p.lexer.Expect(TokKW, "for")
-	name := p.lexer.Expect(TokIdent, "").Val
+	pos := p.position(p.lexer.Expect(TokKW, "for").Pos)
+	name := p.parseVarName()
 	p.lexer.Expect(TokKW, "in")
 	seq := p.parseExpr()
 	var where Expr
@@ -211,13 +596,85 @@ func (p *Parser) parseFor() Expr {
 		p.lexer.Next()
 		where = p.parseExpr()
 	}
+	var groupBy []GroupKey
+	if p.acceptWords("group", "by") {
+		groupBy = p.parseGroupBy()
+	}
+	var orderBy []OrderKey
+	if p.acceptWords("order", "by") {
+		orderBy = p.parseOrderBy()
+	}
 	p.lexer.Expect(TokKW, "return")
 	body := p.parseExpr()
-	return ForExpr{Name: name, Seq: seq, Where: where, Body: body}
+	return ForExpr{Name: name, Seq: seq, Where: where, GroupBy: groupBy, OrderBy: orderBy, Body: body, Pos: pos}
+}
+
+// parseGroupBy reads the keys after group by: $name := expr or $name,
+// separated by commas.
+func (p *Parser) parseGroupBy() []GroupKey {
+	keys := []GroupKey{}
+	for {
+		name := p.parseVarName()
+		var key Expr = VarRef{Name: name, Explicit: true}
+		if tok := p.lexer.Peek(); tok.Kind == TokOp && tok.Val == ":=" {
+			p.lexer.Next()
+			key = p.parseExpr()
+		}
+		keys = append(keys, GroupKey{Name: name, Expr: key})
+		if tok := p.lexer.Peek(); tok.Kind != TokPunct || tok.Val != "," {
+			return keys
+		}
+		p.lexer.Next()
+	}
+}
+
+// parseOrderBy reads the keys after order by, separated by commas, each
+// optionally followed by ascending or descending and numeric or string, in
+// either order.
+func (p *Parser) parseOrderBy() []OrderKey {
+	keys := []OrderKey{}
+	for {
+		key := OrderKey{Expr: p.parseExpr()}
+		direction, collation := false, false
+		for {
+			if !direction && p.acceptWords("ascending") {
+				direction = true
+			} else if !direction && p.acceptWords("descending") {
+				direction, key.Descending = true, true
+			} else if !collation && p.acceptWords("numeric") {
+				collation, key.Collation = true, "numeric"
+			} else if !collation && p.acceptWords("string") {
+				collation, key.Collation = true, "string"
+			} else {
+				break
+			}
+		}
+		keys = append(keys, key)
+		if tok := p.lexer.Peek(); tok.Kind != TokPunct || tok.Val != "," {
+			return keys
+		}
+		p.lexer.Next()
+	}
+}
+
+// acceptWords consumes the names words if they come next, as in the
+// clause "group by", which are not keywords so that elements may still
+// be called group.
+func (p *Parser) acceptWords(words ...string) bool {
+	savedPos := p.lexer.Pos
+	savedBuf := p.lexer.Buffer
+	for _, w := range words {
+		if tok := p.lexer.Next(); tok.Kind != TokIdent || tok.Val != w {
+			p.lexer.Pos = savedPos
+			p.lexer.Buffer = savedBuf
+			return false
+		}
+	}
+	return true
 }
 
 func (p *Parser) parseMatch() Expr {
-	p.lexer.Expect(TokKW, "match")
+	pos := p.position(p.lexer.Expect(TokKW, "match").Pos)
 	target := p.parseExpr()
 	p.lexer.Expect(TokPunct, ":")
 	cases := []MatchCase{}
@@ -244,15 +701,15 @@ func (p *Parser) parseMatch() Expr {
 		}
 		break
 	}
-	return MatchExpr{Target: target, Cases: cases, Default: def}
+	return MatchExpr{Target: target, Cases: cases, Default: def, Pos: pos}
 }
 
 func (p *Parser) parseOr() Expr {
 	expr := p.parseAnd()
 	for p.lexer.Peek().Kind == TokKW && p.lexer.Peek().Val == "or" {
-		p.lexer.Next()
+		pos := p.position(p.lexer.Next().Pos)
 		right := p.parseAnd()
-		expr = BinaryOp{Op: "or", Left: expr, Right: right}
+		expr = BinaryOp{Op: "or", Left: expr, Right: right, Pos: pos}
 	}
 	return expr
 }
@@ -260,33 +717,54 @@ func (p *Parser) parseOr() Expr {
 func (p *Parser) parseAnd() Expr {
 	expr := p.parseEq()
 	for p.lexer.Peek().Kind == TokKW && p.lexer.Peek().Val == "and" {
-		p.lexer.Next()
+		pos := p.position(p.lexer.Next().Pos)
 		right := p.parseEq()
-		expr = BinaryOp{Op: "and", Left: expr, Right: right}
+		expr = BinaryOp{Op: "and", Left: expr, Right: right, Pos: pos}
 	}
 	return expr
 }
 
+// parseEq parses = != === and the value comparisons eq and ne, which like
+// lt, le, gt and ge in parseRel are not reserved (see parseRange).
 func (p *Parser) parseEq() Expr {
 	expr := p.parseRel()
-	for p.lexer.Peek().Kind == TokOp && (p.lexer.Peek().Val == "=" || p.lexer.Peek().Val == "!=") {
-		op := p.lexer.Next().Val
+	for {
+		tok := p.lexer.Peek()
+		if !(tok.Kind == TokOp && (tok.Val == "=" || tok.Val == "!=" || tok.Val == "===") || tok.Kind == TokIdent && (tok.Val == "eq" || tok.Val == "ne")) {
+			break
+		}
+		p.lexer.Next()
+		op := tok.Val
 		right := p.parseRel()
-		expr = BinaryOp{Op: op, Left: expr, Right: right}
+		expr = BinaryOp{Op: op, Left: expr, Right: right, Pos: p.position(tok.Pos)}
 	}
 	return expr
 }
 
 func (p *Parser) parseRel() Expr {
-	expr := p.parseAdd()
-	for p.lexer.Peek().Kind == TokOp {
-		op := p.lexer.Peek().Val
-		if op != "<" && op != "<=" && op != ">" && op != ">=" {
+	expr := p.parseRange()
+	for {
+		tok := p.lexer.Peek()
+		op := tok.Val
+		if !(tok.Kind == TokOp && (op == "<" || op == "<=" || op == ">" || op == ">=") || tok.Kind == TokIdent && (op == "lt" || op == "le" || op == "gt" || op == "ge")) {
 			break
 		}
+		pos := p.position(p.lexer.Next().Pos)
+		right := p.parseRange()
+		expr = BinaryOp{Op: op, Left: expr, Right: right, Pos: pos}
+	}
+	return expr
+}
+
+// parseRange parses a to b. "to" is not reserved: a name right after an
+// operand can only be the operator, so elements and variables named to
+// keep working.
+func (p *Parser) parseRange() Expr {
+	expr := p.parseAdd()
+	if tok := p.lexer.Peek(); tok.Kind == TokIdent && tok.Val == "to" {
 		p.lexer.Next()
 		right := p.parseAdd()
-		expr = BinaryOp{Op: op, Left: expr, Right: right}
+		expr = BinaryOp{Op: "to", Left: expr, Right: right, Pos: p.position(tok.Pos)}
 	}
 	return expr
 }
@@ -294,9 +772,10 @@ func (p *Parser) parseRel() Expr {
 func (p *Parser) parseAdd() Expr {
 	expr := p.parseMul()
 	for p.lexer.Peek().Kind == TokOp && (p.lexer.Peek().Val == "+" || p.lexer.Peek().Val == "-") {
-		op := p.lexer.Next().Val
+		tok := p.lexer.Next()
+		op := tok.Val
 		right := p.parseMul()
-		expr = BinaryOp{Op: op, Left: expr, Right: right}
+		expr = BinaryOp{Op: op, Left: expr, Right: right, Pos: p.position(tok.Pos)}
 	}
 	return expr
 }
@@ -308,13 +787,13 @@ func (p *Parser) parseMul() Expr {
 		if tok.Kind == TokOp && tok.Val == "*" {
 			p.lexer.Next()
 			right := p.parseUnary()
-			expr = BinaryOp{Op: "*", Left: expr, Right: right}
+			expr = BinaryOp{Op: "*", Left: expr, Right: right, Pos: p.position(tok.Pos)}
 			continue
 		}
 		if tok.Kind == TokKW && (tok.Val == "div" || tok.Val == "mod") {
 			op := p.lexer.Next().Val
 			right := p.parseUnary()
-			expr = BinaryOp{Op: op, Left: expr, Right: right}
+			expr = BinaryOp{Op: op, Left: expr, Right: right, Pos: p.position(tok.Pos)}
 			continue
 		}
 		break
@@ -326,20 +805,52 @@ func (p *Parser) parseUnary() Expr {
 	tok := p.lexer.Peek()
 	if tok.Kind == TokOp && tok.Val == "-" {
 		p.lexer.Next()
-		return UnaryOp{Op: "-", Expr: p.parseUnary()}
+		return UnaryOp{Op: "-", Expr: p.parseUnary(), Pos: p.position(tok.Pos)}
 	}
 	if tok.Kind == TokKW && tok.Val == "not" {
 		p.lexer.Next()
-		return UnaryOp{Op: "not", Expr: p.parseUnary()}
+		return UnaryOp{Op: "not", Expr: p.parseUnary(), Pos: p.position(tok.Pos)}
 	}
-	return p.parsePrimary()
+	return p.parseLookups(p.parsePrimary())
+}
+
+// parseLookups reads the .name and [key] lookups following a primary
+// expression.
+func (p *Parser) parseLookups(expr Expr) Expr {
+	for {
+		tok := p.lexer.Peek()
+		switch {
+		case p.atDotLookup():
+			p.lexer.Next()
+			name := p.lexer.Next()
+			expr = Lookup{Expr: expr, Key: Literal{Value: name.Val}, Pos: p.position(tok.Pos)}
+		case tok.Kind == TokPunct && tok.Val == "[":
+			p.lexer.Next()
+			key := p.parseExpr()
+			p.lexer.Expect(TokPunct, "]")
+			expr = Lookup{Expr: expr, Key: key, Bracket: true, Pos: p.position(tok.Pos)}
+		default:
+			return expr
+		}
+	}
+}
+
+// atDotLookup reports whether the next token is a "." directly followed by
+// a name, as in $m.key. A path starting with . reads .name as ./name.
+func (p *Parser) atDotLookup() bool {
+	tok := p.lexer.Peek()
+	if tok.Kind != TokDot || tok.Val != "." {
+		return false
+	}
+	r, _ := utf8.DecodeRuneInString(p.text[tok.Pos+1:])
+	return unicode.IsLetter(r) || r == '_'
 }
 
 func (p *Parser) parsePrimary() Expr {
 	tok := p.lexer.Peek()
 	if tok.Kind == TokNumber {
 		p.lexer.Next()
-		return Literal{Value: mustParseFloat(tok.Val)}
+		return Literal{Value: numberLiteral(tok.Val)}
 	}
 	if tok.Kind == TokString {
 		p.lexer.Next()
@@ -347,9 +858,22 @@ func (p *Parser) parsePrimary() Expr {
 	}
 	if tok.Kind == TokPunct && tok.Val == "(" {
 		p.lexer.Next()
+		if next := p.lexer.Peek(); next.Kind == TokPunct && next.Val == ")" {
+			p.lexer.Next()
+			return Sequence{Items: []Expr{}}
+		}
 		expr := p.parseExpr()
+		if next := p.lexer.Peek(); next.Kind != TokPunct || next.Val != "," {
+			p.lexer.Expect(TokPunct, ")")
+			return expr
+		}
+		items := []Expr{expr}
+		for p.lexer.Peek().Kind == TokPunct && p.lexer.Peek().Val == "," {
+			p.lexer.Next()
+			items = append(items, p.parseExpr())
+		}
 		p.lexer.Expect(TokPunct, ")")
-		return expr
+		return Sequence{Items: items}
 	}
 	if tok.Kind == TokIdent && tok.Val == "text" {
 		savedPos := p.lexer.Pos
@@ -364,26 +888,112 @@ func (p *Parser) parsePrimary() Expr {
 		p.lexer.Pos = savedPos
 		p.lexer.Buffer = savedBuf
 	}
+	if tok.Kind == TokIdent && (tok.Val == "comment" || tok.Val == "document") {
+		if expr, ok := p.parseNodeConstructor(); ok {
+			return expr
+		}
+	}
+	if tok.Kind == TokIdent && tok.Val == "pi" {
+		if expr, ok := p.parsePIConstructor(); ok {
+			return expr
+		}
+	}
+	if tok.Kind == TokIdent && tok.Val == "textJoin" {
+		if expr, ok := p.parseTextJoin(); ok {
+			return expr
+		}
+	}
+	if tok.Kind == TokIdent && tok.Val == "try" {
+		if expr, ok := p.parseTry(); ok {
+			return expr
+		}
+	}
+	if tok.Kind == TokIdent && tok.Val == "fn" {
+		if expr, ok := p.parseFunctionExpr(); ok {
+			return expr
+		}
+	}
+	if tok.Kind == TokIdent && tok.Val == "map" {
+		if expr, ok := p.parseMapConstructor(); ok {
+			return expr
+		}
+	}
+	if tok.Kind == TokPunct && tok.Val == "[" {
+		return p.parseArrayConstructor()
+	}
 	if tok.Kind == TokOp && tok.Val == "<" {
 		return p.parseConstructor()
 	}
 	if tok.Kind == TokDot || tok.Kind == TokSlash {
 		return p.parsePath(nil)
 	}
+	if tok.Kind == TokAt {
+		// @name abbreviates ./@name, as in rule and assertion bodies.
+		return p.parsePath(&PathStart{Kind: "context"})
+	}
+	if tok.Kind == TokIdent && p.atAxis() {
+		// axis::test steps from the context item; child::name selects child
+		// elements explicitly, which is what an undefined name falls back
+		// to outside strict mode.
+		return p.parsePath(&PathStart{Kind: "context"})
+	}
+	if tok.Kind == TokVar {
+		name := p.lexer.Next().Val
+		if p.pathContinues() {
+			return p.parsePath(&PathStart{Kind: "var", Name: &name, Explicit: true, Pos: p.position(tok.Pos)})
+		}
+		return VarRef{Name: name, Explicit: true, Pos: p.position(tok.Pos)}
+	}
 	if tok.Kind == TokIdent {
 		name := p.lexer.Next().Val
 		if p.lexer.Peek().Kind == TokPunct && p.lexer.Peek().Val == "(" {
-			return p.parseFuncCall(name)
+			return p.parseFuncCall(name, p.position(tok.Pos))
 		}
 		if p.pathContinues() {
-			return p.parsePath(&PathStart{Kind: "var", Name: &name})
+			return p.parsePath(&PathStart{Kind: "var", Name: &name, Pos: p.position(tok.Pos)})
 		}
-		return VarRef{Name: name}
+		return VarRef{Name: name, Pos: p.position(tok.Pos)}
+	}
+	panic(fmt.Errorf("XFST0001: unexpected token at %d", tok.Pos))
+}
+
+// axes maps the axis names of axis::test steps to PathStep axes.
+var axes = map[string]string{
+	"child":              "child",
+	"self":               "self",
+	"parent":             "parent",
+	"attribute":          "attr",
+	"descendant":         "desc",
+	"descendant-or-self": "desc_or_self",
+	"ancestor":           "ancestor",
+	"ancestor-or-self":   "ancestor_or_self",
+	"following-sibling":  "following_sibling",
+	"preceding-sibling":  "preceding_sibling",
+	"following":          "following",
+	"preceding":          "preceding",
+}
+
+// atAxis reports whether the next tokens are an axis name and "::".
+func (p *Parser) atAxis() bool {
+	if tok := p.lexer.Peek(); tok.Kind != TokIdent || axes[tok.Val] == "" {
+		return false
+	}
+	savedPos := p.lexer.Pos
+	savedBuf := p.lexer.Buffer
+	defer func() {
+		p.lexer.Pos = savedPos
+		p.lexer.Buffer = savedBuf
+	}()
+	p.lexer.Next()
+	first := p.lexer.Next()
+	if first.Kind != TokPunct || first.Val != ":" {
+		return false
 	}
-	panic(fmt.Errorf("unexpected token at %d", tok.Pos))
+	second := p.lexer.Next()
+	return second.Kind == TokPunct && second.Val == ":" && second.Pos == first.Pos+1
 }
 
-func (p *Parser) parseFuncCall(name string) Expr {
+func (p *Parser) parseFuncCall(name string, pos Position) Expr {
 	p.lexer.Expect(TokPunct, "(")
 	args := []Expr{}
 	if !(p.lexer.Peek().Kind == TokPunct && p.lexer.Peek().Val == ")") {
@@ -394,15 +1004,208 @@ func (p *Parser) parseFuncCall(name string) Expr {
 		}
 	}
 	p.lexer.Expect(TokPunct, ")")
-	return FuncCall{Name: name, Args: args}
+	return FuncCall{Name: name, Args: args, Pos: pos}
+}
+
+// parseAttrTest parses the name test after @: a QName or * for all
+// attributes.
+func (p *Parser) parseAttrTest() StepTest {
+	if tok := p.lexer.Peek(); tok.Kind == TokOp && tok.Val == "*" {
+		p.lexer.Next()
+		return StepTest{Kind: "wildcard"}
+	}
+	return StepTest{Kind: "name", Name: strPtr(p.parseQName())}
+}
+
+// parseTextJoin parses textJoin { expr } and textJoin(sep) { expr }. Without
+// the braces it restores the lexer so textJoin(...) stays a function call.
+func (p *Parser) parseTextJoin() (Expr, bool) {
+	savedPos := p.lexer.Pos
+	savedBuf := p.lexer.Buffer
+	p.lexer.Next()
+	var sep Expr
+	if tok := p.lexer.Peek(); tok.Kind == TokPunct && tok.Val == "(" {
+		p.lexer.Next()
+		sep = p.parseExpr()
+		p.lexer.Expect(TokPunct, ")")
+	}
+	if tok := p.lexer.Peek(); tok.Kind != TokPunct || tok.Val != "{" {
+		p.lexer.Pos = savedPos
+		p.lexer.Buffer = savedBuf
+		return nil, false
+	}
+	p.lexer.Next()
+	expr := p.parseExpr()
+	p.lexer.Expect(TokPunct, "}")
+	return TextJoin{Sep: sep, Expr: expr}, true
+}
+
+// parseNodeConstructor reads comment { expr } or document { expr }. Like
+// parseTextJoin it restores the lexer when no brace follows.
+func (p *Parser) parseNodeConstructor() (Expr, bool) {
+	savedPos := p.lexer.Pos
+	savedBuf := p.lexer.Buffer
+	kind := p.lexer.Next().Val
+	if tok := p.lexer.Peek(); tok.Kind != TokPunct || tok.Val != "{" {
+		p.lexer.Pos = savedPos
+		p.lexer.Buffer = savedBuf
+		return nil, false
+	}
+	p.lexer.Next()
+	expr := p.parseExpr()
+	p.lexer.Expect(TokPunct, "}")
+	if kind == "comment" {
+		return CommentConstructor{Expr: expr}, true
+	}
+	return DocumentConstructor{Expr: expr}, true
+}
+
+// parsePIConstructor reads pi(name) { expr }; pi() without a name or a
+// brace is left to be read as a kind test or call.
+func (p *Parser) parsePIConstructor() (Expr, bool) {
+	savedPos := p.lexer.Pos
+	savedBuf := p.lexer.Buffer
+	pos := p.position(p.lexer.Next().Pos)
+	restore := func() (Expr, bool) {
+		p.lexer.Pos = savedPos
+		p.lexer.Buffer = savedBuf
+		return nil, false
+	}
+	if tok := p.lexer.Peek(); tok.Kind != TokPunct || tok.Val != "(" {
+		return restore()
+	}
+	p.lexer.Next()
+	if tok := p.lexer.Peek(); tok.Kind == TokPunct && tok.Val == ")" {
+		return restore()
+	}
+	name := p.parseExpr()
+	p.lexer.Expect(TokPunct, ")")
+	if tok := p.lexer.Peek(); tok.Kind != TokPunct || tok.Val != "{" {
+		return restore()
+	}
+	p.lexer.Next()
+	expr := p.parseExpr()
+	p.lexer.Expect(TokPunct, "}")
+	return PIConstructor{Name: name, Expr: expr, Pos: pos}, true
+}
+
+// parseTry reads try { expr } catch $err { expr }, where $err is optional.
+// Like parseTextJoin it restores the lexer when no brace follows, so try
+// stays a name.
+func (p *Parser) parseTry() (Expr, bool) {
+	savedPos := p.lexer.Pos
+	savedBuf := p.lexer.Buffer
+	pos := p.position(p.lexer.Next().Pos)
+	if tok := p.lexer.Peek(); tok.Kind != TokPunct || tok.Val != "{" {
+		p.lexer.Pos = savedPos
+		p.lexer.Buffer = savedBuf
+		return nil, false
+	}
+	p.lexer.Next()
+	body := p.parseExpr()
+	p.lexer.Expect(TokPunct, "}")
+	p.lexer.Expect(TokIdent, "catch")
+	name := ""
+	if tok := p.lexer.Peek(); tok.Kind == TokVar || tok.Kind == TokIdent {
+		name = p.parseVarName()
+	}
+	p.lexer.Expect(TokPunct, "{")
+	handler := p.parseExpr()
+	p.lexer.Expect(TokPunct, "}")
+	return TryExpr{Body: body, Var: name, Catch: handler, Pos: pos}, true
+}
+
+// parseFunctionExpr parses an inline function, fn($x, $y) := body, its
+// parameters written as in def. When no := follows the parentheses it
+// restores the lexer, so fn(...) stays a call of a function named fn.
+func (p *Parser) parseFunctionExpr() (Expr, bool) {
+	savedPos := p.lexer.Pos
+	savedBuf := p.lexer.Buffer
+	pos := p.position(p.lexer.Next().Pos)
+	if tok := p.lexer.Next(); tok.Kind != TokPunct || tok.Val != "(" {
+		p.lexer.Pos = savedPos
+		p.lexer.Buffer = savedBuf
+		return nil, false
+	}
+	for depth := 1; depth > 0; {
+		tok := p.lexer.Next()
+		switch {
+		case tok.Kind == TokEOF:
+			depth = 0
+		case tok.Kind == TokPunct && tok.Val == "(":
+			depth++
+		case tok.Kind == TokPunct && tok.Val == ")":
+			depth--
+		}
+	}
+	arrow := p.lexer.Peek()
+	p.lexer.Pos = savedPos
+	p.lexer.Buffer = savedBuf
+	if arrow.Kind != TokOp || arrow.Val != ":=" {
+		return nil, false
+	}
+	p.lexer.Next()
+	p.lexer.Expect(TokPunct, "(")
+	params := []Param{}
+	if !(p.lexer.Peek().Kind == TokPunct && p.lexer.Peek().Val == ")") {
+		params = append(params, p.parseParam())
+		for p.lexer.Peek().Kind == TokPunct && p.lexer.Peek().Val == "," {
+			p.lexer.Next()
+			params = append(params, p.parseParam())
+		}
+	}
+	p.lexer.Expect(TokPunct, ")")
+	p.lexer.Expect(TokOp, ":=")
+	return FunctionExpr{Params: params, Body: p.parseExpr(), Pos: pos}, true
+}
+
+// parseMapConstructor parses map { key: value, ... }. Like parseTextJoin
+// it restores the lexer when no brace follows, so map(...) stays a call of
+// the builtin.
+func (p *Parser) parseMapConstructor() (Expr, bool) {
+	savedPos := p.lexer.Pos
+	savedBuf := p.lexer.Buffer
+	pos := p.position(p.lexer.Next().Pos)
+	if tok := p.lexer.Peek(); tok.Kind != TokPunct || tok.Val != "{" {
+		p.lexer.Pos = savedPos
+		p.lexer.Buffer = savedBuf
+		return nil, false
+	}
+	p.lexer.Next()
+	entries := []MapEntry{}
+	for !(p.lexer.Peek().Kind == TokPunct && p.lexer.Peek().Val == "}") {
+		if len(entries) > 0 {
+			p.lexer.Expect(TokPunct, ",")
+		}
+		key := p.parseExpr()
+		p.lexer.Expect(TokPunct, ":")
+		entries = append(entries, MapEntry{Key: key, Value: p.parseExpr()})
+	}
+	p.lexer.Expect(TokPunct, "}")
+	return MapConstructor{Entries: entries, Pos: pos}, true
+}
+
+func (p *Parser) parseArrayConstructor() Expr {
+	pos := p.position(p.lexer.Expect(TokPunct, "[").Pos)
+	items := []Expr{}
+	if !(p.lexer.Peek().Kind == TokPunct && p.lexer.Peek().Val == "]") {
+		items = append(items, p.parseExpr())
+		for p.lexer.Peek().Kind == TokPunct && p.lexer.Peek().Val == "," {
+			p.lexer.Next()
+			items = append(items, p.parseExpr())
+		}
+	}
+	p.lexer.Expect(TokPunct, "]")
+	return ArrayConstructor{Items: items, Pos: pos}
 }
 
 func (p *Parser) pathContinues() bool {
 	tok := p.lexer.Peek()
-	return tok.Kind == TokSlash || tok.Kind == TokDot || tok.Kind == TokAt
+	return tok.Kind == TokSlash || tok.Kind == TokDot && !p.atDotLookup() || tok.Kind == TokAt
 }
 
 func (p *Parser) parsePath(start *PathStart) Expr {
+	pos := p.position(p.lexer.Peek().Pos)
 	actualStart := start
 	if actualStart == nil {
 		tok := p.lexer.Next()
@@ -419,33 +1222,21 @@ func (p *Parser) parsePath(start *PathStart) Expr {
 				actualStart = &PathStart{Kind: "root"}
 			}
 		} else {
-			panic(fmt.Errorf("invalid path start at %d", tok.Pos))
+			panic(fmt.Errorf("XFST0001: invalid path start at %d", tok.Pos))
 		}
 	}
 
 	steps := []PathStep{}
 	if actualStart.Kind == "root" || actualStart.Kind == "context" || actualStart.Kind == "var" {
 		tok := p.lexer.Peek()
-		if tok.Kind == TokAt {
-			p.lexer.Next()
-			test := StepTest{Kind: "name", Name: strPtr(p.parseQName())}
-			steps = append(steps, PathStep{Axis: "attr", Test: test, Predicates: []Expr{}})
-		} else if tok.Kind == TokOp && tok.Val == "*" {
-			test := p.parseStepTest()
-			preds := p.parsePredicates()
-			steps = append(steps, PathStep{Axis: "child", Test: test, Predicates: preds})
-		} else if tok.Kind == TokIdent {
-			test := p.parseStepTest()
-			preds := p.parsePredicates()
-			steps = append(steps, PathStep{Axis: "child", Test: test, Predicates: preds})
+		if tok.Kind == TokAt || (tok.Kind == TokOp && tok.Val == "*") || tok.Kind == TokIdent || p.keywordStep(tok) {
+			steps = p.parseStep(steps, "child")
 		}
 	}
 	if actualStart.Kind == "desc" || actualStart.Kind == "desc_root" {
 		tok := p.lexer.Peek()
-		if tok.Kind == TokIdent || tok.Kind == TokOp {
-			test := p.parseStepTest()
-			preds := p.parsePredicates()
-			steps = append(steps, PathStep{Axis: "desc_or_self", Test: test, Predicates: preds})
+		if tok.Kind == TokAt || tok.Kind == TokIdent || tok.Kind == TokOp || p.keywordStep(tok) {
+			steps = p.parseStep(steps, "desc_or_self")
 		}
 	}
 
@@ -457,25 +1248,15 @@ func (p *Parser) parsePath(start *PathStart) Expr {
 				axis = "desc"
 			}
 			p.lexer.Next()
-			var test StepTest
-			preds := []Expr{}
-			if p.lexer.Peek().Kind == TokAt {
-				p.lexer.Next()
-				test = StepTest{Kind: "name", Name: strPtr(p.parseQName())}
-				axis = "attr"
-			} else {
-				test = p.parseStepTest()
-				preds = p.parsePredicates()
-			}
-			steps = append(steps, PathStep{Axis: axis, Test: test, Predicates: preds})
+			steps = p.parseStep(steps, axis)
 			continue
 		}
-		if tok.Kind == TokDot {
+		if tok.Kind == TokDot && !p.atDotLookup() {
 			if tok.Val == "." {
 				p.lexer.Next()
 				if p.lexer.Peek().Kind == TokAt {
 					p.lexer.Next()
-					test := StepTest{Kind: "name", Name: strPtr(p.parseQName())}
+					test := p.parseAttrTest()
 					steps = append(steps, PathStep{Axis: "attr", Test: test, Predicates: []Expr{}})
 				} else {
 					steps = append(steps, PathStep{Axis: "self", Test: StepTest{Kind: "node"}, Predicates: []Expr{}})
@@ -490,14 +1271,49 @@ func (p *Parser) parsePath(start *PathStart) Expr {
 		}
 		if tok.Kind == TokAt {
 			p.lexer.Next()
-			test := StepTest{Kind: "name", Name: strPtr(p.parseQName())}
+			test := p.parseAttrTest()
 			steps = append(steps, PathStep{Axis: "attr", Test: test, Predicates: []Expr{}})
 			continue
 		}
 		break
 	}
 
-	return PathExpr{Start: *actualStart, Steps: steps}
+	return PathExpr{Start: *actualStart, Steps: steps, Pos: pos}
+}
+
+// parseStep appends the step after a '/' (axis child), '//' (desc) or at
+// the start of a path: @name, an explicit axis::test or a name test, with
+// its predicates. An explicit axis or @ after '//' applies to every node
+// below, as a//parent::x = a/descendant-or-self::node()/parent::x.
+func (p *Parser) parseStep(steps []PathStep, axis string) []PathStep {
+	if p.lexer.Peek().Kind == TokAt {
+		p.lexer.Next()
+		if axis != "child" {
+			steps = append(steps, PathStep{Axis: "desc_or_self", Test: StepTest{Kind: "node"}, Predicates: []Expr{}})
+		}
+		return append(steps, PathStep{Axis: "attr", Test: p.parseAttrTest(), Predicates: []Expr{}})
+	}
+	explicit := p.atAxis()
+	if explicit {
+		name := p.lexer.Next().Val
+		p.lexer.Next()
+		p.lexer.Next()
+		switch {
+		case name == "child":
+			// child:: is the default, also below //.
+		case axis == "child":
+			axis = axes[name]
+		default:
+			steps = append(steps, PathStep{Axis: "desc_or_self", Test: StepTest{Kind: "node"}, Predicates: []Expr{}})
+			axis = axes[name]
+		}
+		if axis == "attr" {
+			return append(steps, PathStep{Axis: "attr", Test: p.parseAttrTest(), Predicates: []Expr{}})
+		}
+	}
+	siblings := (axis == "desc" || axis == "desc_or_self") && !explicit
+	test := p.parseStepTest()
+	return append(steps, PathStep{Axis: axis, Test: test, Predicates: p.parsePredicates(), Siblings: siblings})
 }
 
 func (p *Parser) parseStepTest() StepTest {
@@ -506,17 +1322,18 @@ func (p *Parser) parseStepTest() StepTest {
 		p.lexer.Next()
 		return StepTest{Kind: "wildcard"}
 	}
-	if tok.Kind == TokIdent {
-		if tok.Val == "text" || tok.Val == "node" || tok.Val == "comment" || tok.Val == "pi" {
+	if tok.Kind == TokIdent || tok.Kind == TokKW {
+		name := p.parseQName()
+		// text, node, comment and pi are kind tests only with parentheses,
+		// so //text selects <text> elements.
+		if next := p.lexer.Peek(); next.Kind == TokPunct && next.Val == "(" && (name == "text" || name == "node" || name == "comment" || name == "pi") {
 			p.lexer.Next()
-			p.lexer.Expect(TokPunct, "(")
 			p.lexer.Expect(TokPunct, ")")
-			return StepTest{Kind: tok.Val}
+			return StepTest{Kind: name}
 		}
-		name := p.parseQName()
 		return StepTest{Kind: "name", Name: strPtr(name)}
 	}
-	panic(fmt.Errorf("invalid step test at %d", tok.Pos))
+	panic(fmt.Errorf("XFST0001: invalid step test at %d", tok.Pos))
 }
 
 func (p *Parser) parsePredicates() []Expr {
@@ -529,8 +1346,32 @@ func (p *Parser) parsePredicates() []Expr {
 	return preds
 }
 
+// parseVarName reads the name a declaration, parameter, let, for or
+// pattern binds: name or $name, which may also be a keyword.
+func (p *Parser) parseVarName() string {
+	tok := p.lexer.Next()
+	if tok.Kind != TokIdent && tok.Kind != TokVar {
+		panic(fmt.Errorf("XFST0001: expected a variable name at %d", tok.Pos))
+	}
+	return tok.Val
+}
+
+// parseQName reads an element or attribute name. Keywords are names here,
+// so vocabularies with elements such as <for> or <if> can be constructed
+// and matched.
 func (p *Parser) parseQName() string {
-	return p.lexer.Expect(TokIdent, "").Val
+	tok := p.lexer.Next()
+	if tok.Kind != TokIdent && tok.Kind != TokKW {
+		panic(fmt.Errorf("XFST0001: expected a name at %d", tok.Pos))
+	}
+	return tok.Val
+}
+
+// keywordStep reports whether keyword tok starts a step: it must follow
+// '/' or "::" directly, as in /for or child::if, since a keyword after a
+// space may be an operator (. and x).
+func (p *Parser) keywordStep(tok Token) bool {
+	return tok.Kind == TokKW && tok.Pos > 0 && strings.IndexByte("/:", p.text[tok.Pos-1]) >= 0
 }
 
 func (p *Parser) parsePattern() Pattern {
@@ -553,29 +1394,38 @@ func (p *Parser) parsePattern() Pattern {
 	if tok.Kind == TokOp && tok.Val == "<" {
 		p.lexer.Next()
 		name := p.parseQName()
+		if p.lexer.Peek().Kind == TokSlash {
+			p.lexer.Next()
+			p.lexer.Expect(TokOp, ">")
+			return ElementPattern{Name: name}
+		}
 		p.lexer.Expect(TokOp, ">")
+		if tok := p.lexer.Peek(); (tok.Kind == TokOp && tok.Val == ":=") || (tok.Kind == TokIdent && tok.Val == "priority") {
+			// <name> without content matches the element regardless of content.
+			return ElementPattern{Name: name}
+		}
 		varName := (*string)(nil)
 		var child Pattern
 		if p.lexer.Peek().Kind == TokPunct && p.lexer.Peek().Val == "{" {
 			p.lexer.Next()
-			v := p.lexer.Expect(TokIdent, "").Val
+			v := p.parseVarName()
 			varName = &v
 			p.lexer.Expect(TokPunct, "}")
 		} else if p.lexer.Peek().Kind == TokOp && p.lexer.Peek().Val == "<" {
 			child = p.parsePattern()
 		} else {
-			panic(fmt.Errorf("invalid element pattern content"))
+			panic(fmt.Errorf("XFST0001: invalid element pattern content"))
 		}
 		p.lexer.Expect(TokOp, "<")
 		p.lexer.Expect(TokSlash, "/")
 		end := p.parseQName()
 		if end != name {
-			panic(fmt.Errorf("mismatched pattern end tag"))
+			panic(fmt.Errorf("XFST0001: mismatched pattern end tag"))
 		}
 		p.lexer.Expect(TokOp, ">")
 		return ElementPattern{Name: name, Var: varName, Child: child}
 	}
-	panic(fmt.Errorf("invalid pattern at %d", tok.Pos))
+	panic(fmt.Errorf("XFST0001: invalid pattern at %d", tok.Pos))
 }
 
 func (p *Parser) parseConstructor() Expr {
@@ -584,121 +1434,230 @@ func (p *Parser) parseConstructor() Expr {
 	attrs := []AttrConstructor{}
 	for {
 		tok := p.lexer.Peek()
-		if tok.Kind == TokOp && tok.Val == ">" {
-			p.lexer.Next()
+		if p.atTagClose(tok) {
 			break
 		}
 		if tok.Kind == TokSlash && tok.Val == "/" {
 			p.lexer.Next()
-			p.lexer.Expect(TokOp, ">")
-			return Constructor{Name: name, Attrs: attrs, Contents: []Expr{}}
+			if !p.atTagClose(p.lexer.Peek()) {
+				p.lexer.Expect(TokOp, ">")
+			}
+			return Constructor{Name: name, Attrs: attrs, Contents: []Expr{}, Scope: p.ctorScope}
 		}
 		attrName := p.parseQName()
 		p.lexer.Expect(TokOp, "=")
+		if value, ok := p.parseAttrLiteral(); ok {
+			attrs = append(attrs, AttrConstructor{Name: attrName, Expr: Literal{Value: value}})
+			continue
+		}
 		p.lexer.Expect(TokPunct, "{")
-		expr := p.parseExpr()
-		p.lexer.Expect(TokPunct, "}")
+		expr := p.braced(func() Expr {
+			expr := p.parseExpr()
+			p.lexer.Expect(TokPunct, "}")
+			return expr
+		})
 		attrs = append(attrs, AttrConstructor{Name: attrName, Expr: expr})
 	}
 
-	contents := []Expr{}
-	p.lexer.ClearBuffer()
-	for {
-		if p.lexer.Pos >= len(p.text) {
-			panic(fmt.Errorf("unterminated constructor"))
+	scope := p.ctorScope
+	defer func() { p.ctorScope = scope }()
+	copied := false
+	for _, attr := range attrs {
+		lit, ok := attr.Expr.(Literal)
+		if !ok || !isNamespaceDecl(attr.Name) {
+			continue
 		}
-		if p.text[p.lexer.Pos:] != "" && len(p.text[p.lexer.Pos:]) >= 2 && p.text[p.lexer.Pos:p.lexer.Pos+2] == "</" {
-			endName, newPos := p.readEndTag()
-			if endName != name {
-				panic(fmt.Errorf("mismatched end tag"))
+		if !copied {
+			copied = true
+			p.ctorScope = make(map[string]string, len(scope)+1)
+			for k, v := range scope {
+				p.ctorScope[k] = v
 			}
-			p.lexer.Pos = newPos
-			p.lexer.ClearBuffer()
-			break
 		}
-		if len(p.text[p.lexer.Pos:]) >= 5 && p.text[p.lexer.Pos:p.lexer.Pos+5] == "text{" {
-			p.lexer.Pos += 4
-			p.lexer.ClearBuffer()
+		p.ctorScope[declaredPrefix(attr.Name)] = ToString([]any{lit.Value})
+	}
+	contents := []Expr{}
+	for {
+		tok := p.lexer.NextContent()
+		switch tok.Kind {
+		case TokEOF:
+			p.report(fmt.Errorf("XFST0001: unterminated constructor <%s> at %d", name, tok.Pos))
+			return Constructor{Name: name, Attrs: attrs, Contents: contents, Scope: scope}
+		case TokEndTag:
+			if tok.Val != name {
+				p.report(fmt.Errorf("XFST0001: mismatched end tag </%s> for <%s> at %d", tok.Val, name, tok.Pos))
+			}
+			return Constructor{Name: name, Attrs: attrs, Contents: contents, Scope: scope}
+		case TokStartTag:
+			contents = append(contents, p.parseConstructor())
+		case TokTextCtor:
 			p.lexer.Expect(TokPunct, "{")
-			expr := p.parseExpr()
-			p.lexer.Expect(TokPunct, "}")
+			expr := p.braced(func() Expr {
+				expr := p.parseExpr()
+				p.lexer.Expect(TokPunct, "}")
+				return expr
+			})
 			contents = append(contents, TextConstructor{Expr: expr})
-			continue
-		}
-		ch := p.text[p.lexer.Pos]
-		if ch == '<' {
-			p.lexer.ClearBuffer()
-			contents = append(contents, p.parseConstructor())
-			continue
-		}
-		if ch == '{' {
-			p.lexer.Pos++
-			p.lexer.ClearBuffer()
-			expr := p.parseExpr()
-			p.lexer.Expect(TokPunct, "}")
+		case TokInterp:
+			if tok.Val == "{-" {
+				contents = trimTrailingSpace(contents)
+			}
+			expr := p.braced(func() Expr {
+				expr := p.parseExpr()
+				end := p.lexer.Next()
+				if end.Kind != TokPunct || (end.Val != "}" && end.Val != "-}") {
+					panic(fmt.Errorf("XFST0001: expected PUNCT } at %d", end.Pos))
+				}
+				if end.Val == "-}" {
+					p.lexer.SkipSpace()
+				}
+				return expr
+			})
 			contents = append(contents, Interp{Expr: expr})
-			continue
-		}
-		text := p.parseCharData()
-		if len(text) > 0 {
-			if len(stripSpace(text)) > 0 {
-				contents = append(contents, Text{Value: text})
+		case TokCData:
+			contents = appendText(contents, tok.Val)
+		case TokText:
+			if len(stripSpace(tok.Val)) > 0 {
+				contents = appendText(contents, tok.Val)
+			} else if ws, ok := p.boundarySpace(tok.Val, len(contents) == 0); ok {
+				contents = appendText(contents, ws)
 			}
 		}
 	}
-	return Constructor{Name: name, Attrs: attrs, Contents: contents}
 }
 
-func (p *Parser) parseCharData() string {
-	out := []byte{}
-	for {
-		if p.lexer.Pos >= len(p.text) {
-			break
-		}
-		ch := p.text[p.lexer.Pos]
-		if ch == '<' || ch == '{' {
-			break
+// appendText adds literal text to constructor content, joining it to text
+// before it that a comment or CDATA section split off.
+func appendText(contents []Expr, text string) []Expr {
+	if n := len(contents); n > 0 {
+		if t, ok := contents[n-1].(Text); ok {
+			contents[n-1] = Text{Value: t.Value + text}
+			return contents
 		}
-		out = append(out, ch)
-		p.lexer.Pos++
 	}
-	return string(out)
+	return append(contents, Text{Value: text})
 }
 
-func (p *Parser) readEndTag() (string, int) {
+// atTagClose consumes the '>' ending a start tag. The lexer reads ">=" as
+// one operator, so content starting with '=' is split off again here.
+func (p *Parser) atTagClose(tok Token) bool {
+	if tok.Kind != TokOp || (tok.Val != ">" && tok.Val != ">=") {
+		return false
+	}
+	p.lexer.Pos = tok.Pos + 1
+	p.lexer.ClearBuffer()
+	return true
+}
+
+// trimTrailingSpace removes the whitespace at the end of the text content
+// before a "{-" marker, dropping the text if nothing else is left.
+func trimTrailingSpace(contents []Expr) []Expr {
+	if len(contents) == 0 {
+		return contents
+	}
+	t, ok := contents[len(contents)-1].(Text)
+	if !ok {
+		return contents
+	}
+	t.Value = strings.TrimRight(t.Value, " \t\r\n")
+	if t.Value == "" {
+		return contents[:len(contents)-1]
+	}
+	contents[len(contents)-1] = t
+	return contents
+}
+
+// parseAttrLiteral reads a quoted attribute value written as in XML,
+// href="a.html" or title='x &amp; y': the text is taken as is, without
+// backslash escapes, and only the predefined entities and character
+// references are decoded.
+func (p *Parser) parseAttrLiteral() (string, bool) {
+	if p.lexer.Buffer != nil {
+		return "", false
+	}
 	pos := p.lexer.Pos
-	if pos+2 > len(p.text) || p.text[pos:pos+2] != "</" {
-		panic(fmt.Errorf("expected end tag"))
-	}
-	pos += 2
-	start := pos
-	for pos < len(p.text) {
-		c := p.text[pos]
-		if !(c >= '0' && c <= '9') && !(c >= 'A' && c <= 'Z') && !(c >= 'a' && c <= 'z') && c != '_' && c != ':' && c != '-' {
-			break
-		}
+	for pos < len(p.text) && strings.IndexByte(" \t\r\n", p.text[pos]) >= 0 {
 		pos++
 	}
-	name := p.text[start:pos]
-	for pos < len(p.text) && (p.text[pos] == ' ' || p.text[pos] == '\n' || p.text[pos] == '\t' || p.text[pos] == '\r') {
-		pos++
+	if pos >= len(p.text) || (p.text[pos] != '"' && p.text[pos] != '\'') {
+		return "", false
 	}
-	if pos >= len(p.text) || p.text[pos] != '>' {
-		panic(fmt.Errorf("unterminated end tag"))
+	quote := p.text[pos]
+	end := strings.IndexByte(p.text[pos+1:], quote)
+	if end < 0 {
+		panic(fmt.Errorf("XFST0001: unterminated attribute value at %d", pos))
 	}
-	return name, pos + 1
+	raw := p.text[pos+1 : pos+1+end]
+	if i := strings.IndexByte(raw, '<'); i >= 0 {
+		panic(fmt.Errorf("XFST0001: '<' in attribute value at %d", pos+1+i))
+	}
+	p.lexer.Pos = pos + end + 2
+	return decodeEntities(raw, pos+1), true
 }
 
-func mustParseFloat(s string) float64 {
-	f, err := strconv.ParseFloat(s, 64)
-	if err != nil {
-		panic(err)
+func decodeEntities(s string, offset int) string {
+	if !strings.Contains(s, "&") {
+		return s
+	}
+	b := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '&' {
+			b.WriteByte(s[i])
+			continue
+		}
+		end := strings.IndexByte(s[i:], ';')
+		if end < 0 {
+			panic(fmt.Errorf("XFST0001: unterminated entity reference at %d", offset+i))
+		}
+		name := s[i+1 : i+end]
+		switch name {
+		case "amp":
+			b.WriteByte('&')
+		case "lt":
+			b.WriteByte('<')
+		case "gt":
+			b.WriteByte('>')
+		case "quot":
+			b.WriteByte('"')
+		case "apos":
+			b.WriteByte('\'')
+		default:
+			var n uint64
+			var err error = fmt.Errorf("unknown")
+			if strings.HasPrefix(name, "#x") {
+				n, err = strconv.ParseUint(name[2:], 16, 32)
+			} else if strings.HasPrefix(name, "#") {
+				n, err = strconv.ParseUint(name[1:], 10, 32)
+			}
+			if err != nil || !utf8.ValidRune(rune(n)) {
+				panic(fmt.Errorf("XFST0001: unknown entity reference &%s; at %d", name, offset+i))
+			}
+			b.WriteRune(rune(n))
+		}
+		i += end
 	}
-	return f
+	return b.String()
 }
 
 func strPtr(s string) *string { return &s }
 
+// boundarySpace applies the module's whitespace policy to whitespace-only
+// text in constructor content. Under the inline policy a run without line
+// breaks between two content items, as in <b>{x}</b> <i>{y}</i>, becomes a
+// single space; indentation and leading or trailing space are dropped.
+func (p *Parser) boundarySpace(text string, first bool) (string, bool) {
+	switch p.whitespace {
+	case WhitespacePreserve:
+		return text, true
+	case WhitespaceInline:
+		last := strings.HasPrefix(p.text[p.lexer.Pos:], "</")
+		if !first && !last && !strings.ContainsAny(text, "\n\r") {
+			return " ", true
+		}
+	}
+	return "", false
+}
+
 func stripSpace(s string) string {
 	out := make([]rune, 0, len(s))
 	for _, r := range s {
@@ -708,3 +1667,41 @@ func stripSpace(s string) string {
 	}
 	return string(out)
 }
+
+// comments returns the comments the lexer has skipped.
+func (p *Parser) comments() []Comment {
+	var out []Comment
+	for _, tok := range p.lexer.Comments {
+		line := strings.LastIndexByte(p.text[:tok.Pos], '\n') + 1
+		trailing := strings.TrimSpace(p.text[line:tok.Pos]) != ""
+		out = append(out, Comment{Text: tok.Val, Pos: p.position(tok.Pos), Trailing: trailing})
+	}
+	return out
+}
+
+// doc returns the comments on the lines directly above the declaration
+// being parsed, or nil.
+func (p *Parser) doc() []Comment {
+	start := p.declStart
+	var doc []Comment
+	for i := len(p.lexer.Comments) - 1; i >= 0; i-- {
+		tok := p.lexer.Comments[i]
+		if tok.Pos >= start {
+			continue
+		}
+		// The comment must end in the line break before start, with only
+		// indentation after it.
+		line := strings.LastIndexByte(p.text[:start], '\n')
+		end := tok.Pos + len(tok.Val)
+		if line < end || strings.TrimRight(p.text[end:line], " \t\r") != "" || strings.TrimSpace(p.text[line:start]) != "" {
+			break
+		}
+		bol := strings.LastIndexByte(p.text[:tok.Pos], '\n') + 1
+		if strings.TrimSpace(p.text[bol:tok.Pos]) != "" {
+			break
+		}
+		doc = append([]Comment{{Text: tok.Val, Pos: p.position(tok.Pos)}}, doc...)
+		start = tok.Pos
+	}
+	return doc
+}
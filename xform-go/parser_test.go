@@ -0,0 +1,63 @@
+package xform
+
+import "testing"
+
+func TestConstructorContent(t *testing.T) {
+	tests := []struct{ src, want string }{
+		{`<a>x<!-- note -->y</a>`, `<a>xy</a>`},
+		{`<a><!-- {1} <b> --><b/></a>`, `<a><b/></a>`},
+		{`<a>x <!-- a -- b? --> y</a>`, `<a>x  y</a>`},
+		{`<code><![CDATA[if (a < b) { f(&x) }]]></code>`, `<code>if (a &lt; b) { f(&amp;x) }</code>`},
+		{`<a><![CDATA[<b/> {x}]]>{1}</a>`, `<a>&lt;b/&gt; {x}1</a>`},
+		{`<a><![CDATA[]]></a>`, `<a></a>`},
+		{`<a>text { "t" }</a>`, `<a>t</a>`},
+		{`<a>text{"t"}</a>`, `<a>t</a>`},
+		{`<a>context text</a>`, `<a>context text</a>`},
+		{`<a>{ "{" }</a>`, `<a>{</a>`},
+		{`<a>{ let $m := map { "k": map { "j": 2 } } in $m.k.j }</a>`, `<a>2</a>`},
+		{`<a>{ <b>{ <c>{ 1 + 1 }</c> }</b> }</a>`, `<a><b><c>2</c></b></a>`},
+		{`<a><br/>=<br />x</a>`, `<a><br/>=<br/>x</a>`},
+	}
+	for _, tt := range tests {
+		if got := run(t, tt.src, "<r/>"); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestConstructorContentErrors(t *testing.T) {
+	for _, src := range []string{
+		`<a>x<!-- never closed </a>`,
+		`<a><![CDATA[never closed</a>`,
+		`<a>{ 1 </a>`,
+		`<a><b></a>`,
+	} {
+		if _, err := Compile(src); err == nil {
+			t.Errorf("Compile(%q) succeeded, want an error", src)
+		}
+	}
+}
+
+func TestParseModuleErrorCodes(t *testing.T) {
+	for _, src := range []string{
+		`1 + )`,
+		`def f( { 1 };`,
+		`<a x="1></a>`,
+		`<a x="&bogus;"/>`,
+		`"never closed`,
+		`1 ~ 2`,
+		`/child::`,
+	} {
+		func() {
+			defer func() {
+				if code := ErrorCode(recover()); code != "XFST0001" {
+					t.Errorf("ParseModule(%q) panicked with code %s, want XFST0001", src, code)
+				}
+			}()
+			NewParser(src).ParseModule()
+		}()
+		if _, err := Compile(src); ErrorCode(err) != "XFST0001" {
+			t.Errorf("Compile(%q) = %v, want XFST0001", src, err)
+		}
+	}
+}
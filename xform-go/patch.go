@@ -0,0 +1,490 @@
+package xform
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Patch returns a copy of doc with a change list applied. The change list
+// is a <diff> element (or a document holding one) containing entries as
+// produced by Diff — delete, insert, change and attribute — and/or the XML
+// Patch (RFC 5261) operations add, replace and remove. Diff entries are
+// located in the original document before anything is changed, so their
+// paths stay valid however many entries precede them; RFC 5261 operations
+// are applied in order, each selector evaluated against the current state.
+//
+// Selectors are absolute location paths (/doc/p[2], /doc/p[@id='x']/text(),
+// /doc/@lang) with name, *, text(), comment() and node() steps, numeric and
+// attribute predicates and a final @attribute step.
+func Patch(doc, changes *Node) (*Node, error) {
+	return patchDocument(doc, changes, nil)
+}
+
+func patchDocument(doc, changes *Node, rt *Runtime) (out *Node, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			perr, ok := r.(patchError)
+			if !ok {
+				panic(r)
+			}
+			out, err = nil, perr
+		}
+	}()
+	root := DeepCopy(doc, true)
+	if doc.Kind != "document" {
+		// Patch a detached element through a document wrapper so that selectors
+		// start above it, as they do for Diff paths.
+		root = &Node{Kind: "document", Attrs: map[string]string{}, Children: []*Node{root}}
+		root.Children[0].Parent = root
+	}
+	p := &patcher{root: root, rt: rt, after: map[[2]*Node]*Node{}}
+	ops := patchOps(changes)
+	targets := make([]patchTarget, len(ops))
+	for i, op := range ops {
+		switch op.Name {
+		case "delete", "change", "attribute":
+			targets[i].node = p.selectOne(op, op.Attrs["path"])
+		case "insert":
+			targets[i].node = p.selectOne(op, op.Attrs["parent"])
+			if after, ok := op.Attrs["after"]; ok {
+				targets[i].after = p.selectOne(op, after)
+			}
+		case "add", "replace", "remove":
+		default:
+			p.fail(op, "unknown patch operation <%s>", op.Name)
+		}
+	}
+	for i, op := range ops {
+		p.apply(op, targets[i])
+	}
+	if doc.Kind != "document" {
+		for _, c := range p.root.Children {
+			if c.Kind == "element" {
+				c.Parent = nil
+				return c, nil
+			}
+		}
+	}
+	return p.root, nil
+}
+
+type patchError struct{ msg string }
+
+func (e patchError) Error() string { return e.msg }
+
+type patchTarget struct {
+	node, after *Node
+}
+
+type patcher struct {
+	root  *Node
+	rt    *Runtime
+	after map[[2]*Node]*Node
+}
+
+func patchOps(changes *Node) []*Node {
+	if changes.Kind == "document" {
+		for _, c := range changes.Children {
+			if c.Kind == "element" {
+				changes = c
+				break
+			}
+		}
+	}
+	switch changes.Name {
+	case "delete", "insert", "change", "attribute", "add", "replace", "remove":
+		return []*Node{changes}
+	}
+	ops := []*Node{}
+	for _, c := range changes.Children {
+		if c.Kind == "element" {
+			ops = append(ops, c)
+		}
+	}
+	return ops
+}
+
+func (p *patcher) fail(op *Node, format string, args ...any) {
+	panic(patchError{fmt.Sprintf("XFDY0006: patch <%s>: %s", op.Name, fmt.Sprintf(format, args...))})
+}
+
+// selection is the result of a selector: nodes, or a single attribute of
+// an element when the path ends in @name.
+type selection struct {
+	nodes []*Node
+	attr  string
+}
+
+func (p *patcher) selectOne(op *Node, sel string) *Node {
+	s := p.selectPath(op, sel)
+	if s.attr != "" {
+		p.fail(op, "%s selects an attribute", sel)
+	}
+	if len(s.nodes) != 1 {
+		p.fail(op, "%s matches %d nodes, expected exactly one", sel, len(s.nodes))
+	}
+	return s.nodes[0]
+}
+
+func (p *patcher) selectPath(op *Node, sel string) selection {
+	if !strings.HasPrefix(sel, "/") {
+		p.fail(op, "selector %q must be an absolute path", sel)
+	}
+	current := []*Node{p.root}
+	rest := strings.TrimPrefix(sel, "/")
+	for rest != "" {
+		step, tail := splitPatchStep(rest)
+		if strings.HasPrefix(step, "@") {
+			if tail != "" || len(current) != 1 || current[0].Kind != "element" {
+				p.fail(op, "invalid attribute step in %s", sel)
+			}
+			name := step[1:]
+			if _, ok := current[0].Attrs[name]; !ok {
+				p.fail(op, "%s matches no attribute", sel)
+			}
+			return selection{nodes: current, attr: name}
+		}
+		next := []*Node{}
+		for _, n := range current {
+			next = append(next, p.step(op, n, step, sel)...)
+		}
+		current = next
+		rest = tail
+	}
+	return selection{nodes: current}
+}
+
+func splitPatchStep(path string) (string, string) {
+	depth, quote := 0, byte(0)
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case c == '/' && depth == 0:
+			return path[:i], path[i+1:]
+		}
+	}
+	return path, ""
+}
+
+func (p *patcher) step(op *Node, n *Node, step, sel string) []*Node {
+	test := step
+	preds := []string{}
+	if i := strings.IndexByte(step, '['); i >= 0 {
+		test = step[:i]
+		for rest := step[i:]; rest != ""; {
+			end := strings.IndexByte(rest, ']')
+			if !strings.HasPrefix(rest, "[") || end < 0 {
+				p.fail(op, "invalid predicate in %s", sel)
+			}
+			preds = append(preds, rest[1:end])
+			rest = rest[end+1:]
+		}
+	}
+	matched := []*Node{}
+	for _, c := range n.Children {
+		if patchTest(c, test) {
+			matched = append(matched, c)
+		}
+	}
+	for _, pred := range preds {
+		pred = strings.TrimSpace(pred)
+		if pos, err := strconv.Atoi(pred); err == nil {
+			if pos >= 1 && pos <= len(matched) {
+				matched = []*Node{matched[pos-1]}
+			} else {
+				matched = nil
+			}
+			continue
+		}
+		if !strings.HasPrefix(pred, "@") {
+			p.fail(op, "unsupported predicate [%s] in %s", pred, sel)
+		}
+		name, value, hasValue := strings.Cut(pred[1:], "=")
+		name = strings.TrimSpace(name)
+		value = strings.Trim(strings.TrimSpace(value), `'"`)
+		kept := []*Node{}
+		for _, c := range matched {
+			if v, ok := c.Attrs[name]; ok && (!hasValue || v == value) {
+				kept = append(kept, c)
+			}
+		}
+		matched = kept
+	}
+	return matched
+}
+
+func patchTest(n *Node, test string) bool {
+	switch test {
+	case "node()":
+		return true
+	case "text()":
+		return n.Kind == "text"
+	case "comment()":
+		return n.Kind == "comment"
+	case "*":
+		return n.Kind == "element"
+	}
+	return n.Kind == "element" && n.Name == test
+}
+
+func (p *patcher) apply(op *Node, t patchTarget) {
+	switch op.Name {
+	case "delete":
+		p.detach(t.node)
+	case "change":
+		t.node.Value = childText(op, "new")
+	case "attribute":
+		if v, ok := op.Attrs["new"]; !ok {
+			removeAttr(t.node, op.Attrs["name"])
+		} else if after, ok := op.Attrs["after"]; ok {
+			insertAttr(t.node, op.Attrs["name"], v, after)
+		} else {
+			setAttr(t.node, op.Attrs["name"], v)
+		}
+	case "insert":
+		key := [2]*Node{t.node, t.after}
+		anchor := t.after
+		if last, ok := p.after[key]; ok {
+			anchor = last
+		}
+		for _, c := range p.content(op) {
+			p.insertAfter(t.node, anchor, c)
+			anchor = c
+		}
+		p.after[key] = anchor
+	case "add":
+		p.add(op)
+	case "replace":
+		p.replace(op)
+	case "remove":
+		s := p.selectPath(op, op.Attrs["sel"])
+		if s.attr != "" {
+			removeAttr(s.nodes[0], s.attr)
+			return
+		}
+		if len(s.nodes) != 1 {
+			p.fail(op, "%s matches %d nodes, expected exactly one", op.Attrs["sel"], len(s.nodes))
+		}
+		p.removeWhitespace(s.nodes[0], op.Attrs["ws"])
+		p.detach(s.nodes[0])
+	}
+}
+
+// removeWhitespace implements the ws attribute of RFC 5261 remove: the
+// whitespace-only text node before and/or after the removed node goes too.
+func (p *patcher) removeWhitespace(n *Node, ws string) {
+	if n.Parent == nil || ws == "" {
+		return
+	}
+	siblings := n.Parent.Children
+	for i, c := range siblings {
+		if c != n {
+			continue
+		}
+		if (ws == "after" || ws == "both") && i+1 < len(siblings) && siblings[i+1].Kind == "text" && isWhitespace(siblings[i+1].Value) {
+			p.detach(siblings[i+1])
+		}
+		if (ws == "before" || ws == "both") && i > 0 && siblings[i-1].Kind == "text" && isWhitespace(siblings[i-1].Value) {
+			p.detach(siblings[i-1])
+		}
+		return
+	}
+}
+
+func (p *patcher) add(op *Node) {
+	target := p.selectOne(op, op.Attrs["sel"])
+	if typ := op.Attrs["type"]; strings.HasPrefix(typ, "@") {
+		if target.Kind != "element" {
+			p.fail(op, "cannot add an attribute to a %s node", target.Kind)
+		}
+		setAttr(target, typ[1:], op.StringValue())
+		return
+	}
+	content := p.content(op)
+	switch pos := op.Attrs["pos"]; pos {
+	case "", "append":
+		var anchor *Node
+		if len(target.Children) > 0 {
+			anchor = target.Children[len(target.Children)-1]
+		}
+		for _, c := range content {
+			p.insertAfter(target, anchor, c)
+			anchor = c
+		}
+	case "prepend":
+		var anchor *Node
+		for _, c := range content {
+			p.insertAfter(target, anchor, c)
+			anchor = c
+		}
+	case "before", "after":
+		if target.Parent == nil {
+			p.fail(op, "cannot add a sibling of the document node")
+		}
+		anchor := target
+		if pos == "before" {
+			anchor = previousSibling(target)
+		}
+		for _, c := range content {
+			p.insertAfter(target.Parent, anchor, c)
+			anchor = c
+		}
+	default:
+		p.fail(op, "invalid pos %q", pos)
+	}
+}
+
+func (p *patcher) replace(op *Node) {
+	s := p.selectPath(op, op.Attrs["sel"])
+	if s.attr != "" {
+		setAttr(s.nodes[0], s.attr, op.StringValue())
+		return
+	}
+	if len(s.nodes) != 1 {
+		p.fail(op, "%s matches %d nodes, expected exactly one", op.Attrs["sel"], len(s.nodes))
+	}
+	target := s.nodes[0]
+	if target.Kind != "element" {
+		target.Value = op.StringValue()
+		return
+	}
+	content := p.content(op)
+	if len(content) != 1 || content[0].Kind != "element" {
+		p.fail(op, "replacing an element requires exactly one element")
+	}
+	anchor := previousSibling(target)
+	parent := target.Parent
+	p.detach(target)
+	p.insertAfter(parent, anchor, content[0])
+}
+
+// content copies the operation's children, dropping whitespace-only text
+// when element content is present.
+func (p *patcher) content(op *Node) []*Node {
+	hasElement := false
+	for _, c := range op.Children {
+		hasElement = hasElement || c.Kind == "element"
+	}
+	out := []*Node{}
+	for _, c := range op.Children {
+		if hasElement && c.Kind == "text" && isWhitespace(c.Value) {
+			continue
+		}
+		out = append(out, DeepCopy(c, true))
+		p.rt.nodeCreated()
+	}
+	return out
+}
+
+func (p *patcher) insertAfter(parent, anchor, n *Node) {
+	idx := 0
+	if anchor != nil {
+		for i, c := range parent.Children {
+			if c == anchor {
+				idx = i + 1
+				break
+			}
+		}
+	}
+	n.Parent = parent
+	parent.Children = append(parent.Children, nil)
+	copy(parent.Children[idx+1:], parent.Children[idx:])
+	parent.Children[idx] = n
+}
+
+func (p *patcher) detach(n *Node) {
+	if n.Parent == nil {
+		return
+	}
+	kept := []*Node{}
+	for _, c := range n.Parent.Children {
+		if c != n {
+			kept = append(kept, c)
+		}
+	}
+	n.Parent.Children = kept
+	n.Parent = nil
+}
+
+func previousSibling(n *Node) *Node {
+	var prev *Node
+	for _, c := range n.Parent.Children {
+		if c == n {
+			return prev
+		}
+		prev = c
+	}
+	return nil
+}
+
+func childText(n *Node, name string) string {
+	for _, c := range n.Children {
+		if c.Kind == "element" && c.Name == name {
+			return c.StringValue()
+		}
+	}
+	return ""
+}
+
+func setAttr(n *Node, name, value string) {
+	if _, ok := n.Attrs[name]; !ok {
+		n.AttrOrder = append(n.AttrOrder, name)
+	}
+	n.Attrs[name] = value
+}
+
+// insertAttr sets a new attribute of n after the attribute named after,
+// first when after is empty; an existing attribute keeps its place, and
+// one whose after is missing goes last.
+func insertAttr(n *Node, name, value, after string) {
+	if _, ok := n.Attrs[name]; ok {
+		n.Attrs[name] = value
+		return
+	}
+	names := n.AttrNames()
+	at := len(names)
+	if after == "" {
+		at = 0
+	}
+	for i, k := range names {
+		if k == after {
+			at = i + 1
+		}
+	}
+	n.Attrs[name] = value
+	n.AttrOrder = append(append(append([]string{}, names[:at]...), name), names[at:]...)
+}
+
+func removeAttr(n *Node, name string) {
+	delete(n.Attrs, name)
+	order := []string{}
+	for _, a := range n.AttrOrder {
+		if a != name {
+			order = append(order, a)
+		}
+	}
+	n.AttrOrder = order
+}
+
+func fnPatch(args [][]any, ctx Context) []any {
+	doc, changes := nodeArg(args, 0), nodeArg(args, 1)
+	if doc == nil || changes == nil {
+		panic(fmt.Errorf("XFDY0002: patch() expects a node and a change list"))
+	}
+	out, err := patchDocument(doc, changes, ctx.Runtime)
+	if err != nil {
+		panic(err)
+	}
+	return []any{out}
+}
@@ -0,0 +1,57 @@
+package xform
+
+import "testing"
+
+func TestPatchAttributeOrder(t *testing.T) {
+	tests := []struct{ a, b string }{
+		{`<doc lang="en"/>`, `<doc id="d1" lang="en"/>`},
+		{`<doc a="1" c="3"/>`, `<doc a="1" b="2" c="3"/>`},
+		{`<doc a="1"/>`, `<doc a="1" z="26"/>`},
+		{`<doc a="1" b="2"/>`, `<doc x="0" y="0" b="3"/>`},
+		{`<doc><p z="1"/></doc>`, `<doc><p y="2" z="1" a="3"/></doc>`},
+	}
+	for _, tt := range tests {
+		a, err := ParseXML(tt.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ParseXML(tt.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patched, err := Patch(a, Diff(a, b))
+		if err != nil {
+			t.Fatalf("%s -> %s: %v", tt.a, tt.b, err)
+		}
+		if got := Serialize(patched); got != tt.b {
+			t.Errorf("patch(%s, diff) = %s, want %s", tt.a, got, tt.b)
+		}
+	}
+}
+
+func TestPatchAttributeAfter(t *testing.T) {
+	tests := []struct{ entry, want string }{
+		{`<attribute path="/doc[1]" name="n" new="v"/>`, `<doc a="1" b="2" n="v"/>`},
+		{`<attribute path="/doc[1]" name="n" after="" new="v"/>`, `<doc n="v" a="1" b="2"/>`},
+		{`<attribute path="/doc[1]" name="n" after="a" new="v"/>`, `<doc a="1" n="v" b="2"/>`},
+		{`<attribute path="/doc[1]" name="n" after="missing" new="v"/>`, `<doc a="1" b="2" n="v"/>`},
+		{`<attribute path="/doc[1]" name="b" after="" old="2" new="v"/>`, `<doc a="1" b="v"/>`},
+	}
+	for _, tt := range tests {
+		doc, err := ParseXML(`<doc a="1" b="2"/>`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		changes, err := ParseXML(`<diff>` + tt.entry + `</diff>`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patched, err := Patch(doc, changes)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.entry, err)
+		}
+		if got := Serialize(patched); got != tt.want {
+			t.Errorf("%s: %s, want %s", tt.entry, got, tt.want)
+		}
+	}
+}
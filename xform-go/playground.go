@@ -0,0 +1,257 @@
+package xform
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// The defaults of PlaygroundOptions, meant for untrusted transforms typed
+// into a web page.
+const (
+	DefaultPlaygroundMemory  = 16 << 20
+	DefaultPlaygroundTimeout = time.Second
+	DefaultPlaygroundFirings = 50
+	DefaultPlaygroundOutput  = 64 << 10
+)
+
+// PlaygroundOptions limits a Playground evaluation. Zero fields take the
+// defaults.
+type PlaygroundOptions struct {
+	MaxMemory  int64         // bytes, see EvalOptions.MaxMemory
+	Timeout    time.Duration // see EvalOptions.Timeout
+	MaxFirings int           // rule firings kept in the snapshot
+	MaxOutput  int           // bytes of serialized output kept
+	Params     map[string][]any
+	// Documents are what doc() may load, by URI; nothing else is read.
+	Documents map[string]string
+	// AllowFunctions, when not nil, restricts the built-in functions as
+	// EvalOptions.AllowFunctions does.
+	AllowFunctions []string
+}
+
+const (
+	playgroundValueItems = 10  // items shown per variable
+	playgroundTextLimit  = 256 // bytes shown per item or firing output
+)
+
+// PlaygroundResult is the result of a Playground evaluation together with
+// a snapshot of what happened, ready to be sent as JSON. Error is set when
+// the transform did not compile or the evaluation failed; the snapshot
+// then covers what ran before. ResultDocuments holds the documents written
+// with resultDocument(), by href, each cut to MaxOutput bytes.
+type PlaygroundResult struct {
+	Output          string                     `json:"output"`
+	OutputTruncated bool                       `json:"outputTruncated,omitempty"`
+	ResultDocuments map[string]string          `json:"resultDocuments,omitempty"`
+	Error           *PlaygroundError           `json:"error,omitempty"`
+	Warnings        []string                   `json:"warnings,omitempty"`
+	Variables       map[string]PlaygroundValue `json:"variables"`
+	Firings         []PlaygroundFiring         `json:"firings"`
+	TotalFirings    int                        `json:"totalFirings"`
+	NodesCreated    int                        `json:"nodesCreated"`
+	Memory          int64                      `json:"memory"`
+	Timing          PlaygroundTiming           `json:"timing"`
+}
+
+type PlaygroundError struct {
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+}
+
+// PlaygroundValue is a variable's value: its number of items, their type
+// ("mixed" when they differ) and the first items serialized.
+type PlaygroundValue struct {
+	Items  int      `json:"items"`
+	Type   string   `json:"type,omitempty"`
+	Values []string `json:"values"`
+}
+
+// PlaygroundFiring is a rule firing, in firing order. Parent is the Seq of
+// the enclosing firing, 0 at the top; AtMicros is the time since evaluation
+// started.
+type PlaygroundFiring struct {
+	Seq       int    `json:"seq"`
+	Parent    int    `json:"parent,omitempty"`
+	Rule      string `json:"rule"`
+	Pattern   string `json:"pattern"`
+	Line      int    `json:"line"`
+	Input     string `json:"input,omitempty"`
+	Output    string `json:"output"`
+	AtMicros  int64  `json:"atMicros"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// PlaygroundTiming is where the time went, in microseconds.
+type PlaygroundTiming struct {
+	CompileMicros   int64 `json:"compileMicros"`
+	ParseMicros     int64 `json:"parseMicros"`
+	EvalMicros      int64 `json:"evalMicros"`
+	SerializeMicros int64 `json:"serializeMicros"`
+}
+
+// Playground compiles src, evaluates it on the XML document input under
+// the limits of opts and returns the output with a snapshot of the
+// module's variables, the first rule firings, warnings and timing. It
+// never reads files or the network: doc() only sees opts.Documents.
+func Playground(src, input string, opts PlaygroundOptions) PlaygroundResult {
+	if opts.MaxMemory <= 0 {
+		opts.MaxMemory = DefaultPlaygroundMemory
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultPlaygroundTimeout
+	}
+	if opts.MaxFirings <= 0 {
+		opts.MaxFirings = DefaultPlaygroundFirings
+	}
+	if opts.MaxOutput <= 0 {
+		opts.MaxOutput = DefaultPlaygroundOutput
+	}
+	res := PlaygroundResult{Variables: map[string]PlaygroundValue{}, Firings: []PlaygroundFiring{}}
+
+	start := time.Now()
+	prog, err := Compile(src)
+	res.Timing.CompileMicros = time.Since(start).Microseconds()
+	if err != nil {
+		res.Error = playgroundError(err)
+		return res
+	}
+	start = time.Now()
+	doc, err := ParseXMLBytes([]byte(input))
+	res.Timing.ParseMicros = time.Since(start).Microseconds()
+	if err != nil {
+		res.Error = &PlaygroundError{Code: "input", Message: err.Error()}
+		return res
+	}
+
+	tracer := &playgroundTracer{res: &res, max: opts.MaxFirings}
+	rt := newRuntime(EvalOptions{
+		Params:         opts.Params,
+		MaxMemory:      opts.MaxMemory,
+		Timeout:        opts.Timeout,
+		AllowFunctions: opts.AllowFunctions,
+		Tracer:         tracer,
+		Resolver:       playgroundResolver(opts.Documents),
+		Diagnostics:    func(d Diagnostic) { res.Warnings = append(res.Warnings, d.String()) },
+		ResultDocuments: ResultWriterFunc(func(href string, data []byte) error {
+			if res.ResultDocuments == nil {
+				res.ResultDocuments = map[string]string{}
+			}
+			res.ResultDocuments[href] = truncateUTF8(string(data), opts.MaxOutput)
+			return nil
+		}),
+	})
+	start = time.Now()
+	tracer.start = start
+	var result []any
+	func() {
+		defer recoverError(&err, rt)
+		result = evalModule(prog.Module, doc, rt)
+	}()
+	res.Timing.EvalMicros = time.Since(start).Microseconds()
+	res.NodesCreated = rt.NodesCreated
+	res.Memory = rt.memory
+	for name, value := range rt.globals {
+		res.Variables[name] = playgroundValue(value)
+	}
+	if err != nil {
+		res.Error = playgroundError(err)
+		return res
+	}
+
+	start = time.Now()
+	out := SerializeResult(result, prog.Module.SerializeOptions())
+	res.Timing.SerializeMicros = time.Since(start).Microseconds()
+	if len(out) > opts.MaxOutput {
+		out = truncateUTF8(out, opts.MaxOutput)
+		res.OutputTruncated = true
+	}
+	res.Output = out
+	return res
+}
+
+func playgroundError(err error) *PlaygroundError {
+	xe := newXFormError(err, Position{})
+	return &PlaygroundError{Code: xe.Code, Message: xe.Message, Line: xe.Pos.Line, Column: xe.Pos.Column}
+}
+
+func playgroundResolver(docs map[string]string) Resolver {
+	return ResolverFunc(func(uri string) (io.ReadCloser, error) {
+		if src, ok := docs[uri]; ok {
+			return io.NopCloser(strings.NewReader(src)), nil
+		}
+		return nil, fmt.Errorf("the playground has no document %s", uri)
+	})
+}
+
+func playgroundValue(value []any) PlaygroundValue {
+	v := PlaygroundValue{Items: len(value), Values: []string{}}
+	for i, item := range value {
+		t := typeName(item)
+		switch {
+		case i == 0:
+			v.Type = t
+		case t != v.Type:
+			v.Type = "mixed"
+		}
+		if i < playgroundValueItems {
+			v.Values = append(v.Values, truncateUTF8(SerializeItem(item), playgroundTextLimit))
+		}
+	}
+	return v
+}
+
+// playgroundTracer records the first max rule firings of an evaluation
+// and counts the others.
+type playgroundTracer struct {
+	res   *PlaygroundResult
+	max   int
+	start time.Time
+	open  []int // index in res.Firings of the active frames, -1 for functions and unrecorded firings
+	seqs  []int // Seq of the active rule firings
+}
+
+func (t *playgroundTracer) Enter(stack []*Frame) {
+	f := stack[len(stack)-1]
+	if f.Kind != "rule" {
+		t.open = append(t.open, -1)
+		return
+	}
+	t.res.TotalFirings++
+	parent := 0
+	if len(t.seqs) > 0 {
+		parent = t.seqs[len(t.seqs)-1]
+	}
+	t.seqs = append(t.seqs, t.res.TotalFirings)
+	if len(t.res.Firings) >= t.max {
+		t.open = append(t.open, -1)
+		return
+	}
+	firing := PlaygroundFiring{Seq: t.res.TotalFirings, Parent: parent, Rule: f.Name, Pattern: f.Pattern, Line: f.Line, AtMicros: time.Since(t.start).Microseconds()}
+	if n, ok := f.Context.ContextItem.(*Node); ok {
+		firing.Input = NodePath(n)
+	}
+	t.open = append(t.open, len(t.res.Firings))
+	t.res.Firings = append(t.res.Firings, firing)
+}
+
+func (t *playgroundTracer) Leave(stack []*Frame, result []any) {
+	i := t.open[len(t.open)-1]
+	t.open = t.open[:len(t.open)-1]
+	if stack[len(stack)-1].Kind == "rule" {
+		t.seqs = t.seqs[:len(t.seqs)-1]
+	}
+	if i < 0 {
+		return
+	}
+	out := &strings.Builder{}
+	for _, item := range result {
+		out.WriteString(SerializeItem(item))
+	}
+	firing := &t.res.Firings[i]
+	firing.Output = truncateUTF8(out.String(), playgroundTextLimit)
+	firing.Truncated = len(firing.Output) < out.Len()
+}
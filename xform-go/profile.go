@@ -0,0 +1,195 @@
+package xform
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Profile classifies element names of a document vocabulary as inline,
+// block or whitespace-preserving. It drives whitespace stripping of the
+// input, indentation on output and the isInline/isBlock builtins.
+type Profile struct {
+	Name     string
+	Inline   map[string]bool
+	Preserve map[string]bool
+}
+
+func NewProfile(name string, inline, preserve []string) *Profile {
+	p := &Profile{Name: name, Inline: map[string]bool{}, Preserve: map[string]bool{}}
+	for _, n := range inline {
+		p.Inline[n] = true
+	}
+	for _, n := range preserve {
+		p.Preserve[n] = true
+	}
+	return p
+}
+
+func (p *Profile) IsInline(name string) bool {
+	return p != nil && p.Inline[name]
+}
+
+func (p *Profile) IsPreserve(name string) bool {
+	return p != nil && p.Preserve[name]
+}
+
+func (p *Profile) IsBlock(name string) bool {
+	return !p.IsInline(name) && !p.IsPreserve(name)
+}
+
+var Profiles = map[string]*Profile{
+	"docbook": NewProfile("docbook", []string{
+		"abbrev", "acronym", "anchor", "application", "citetitle", "classname", "code", "command",
+		"computeroutput", "email", "emphasis", "envar", "filename", "firstterm", "footnoteref",
+		"foreignphrase", "function", "glossterm", "guibutton", "guilabel", "guimenu", "inlinemediaobject",
+		"keycap", "link", "literal", "markup", "methodname", "option", "parameter", "phrase",
+		"productname", "quote", "replaceable", "subscript", "superscript", "systemitem", "tag",
+		"trademark", "ulink", "uri", "userinput", "varname", "wordasword", "xref",
+	}, []string{"address", "literallayout", "programlisting", "screen", "synopsis"}),
+	"dita": NewProfile("dita", []string{
+		"apiname", "b", "cite", "cmdname", "codeph", "filepath", "i", "indexterm", "keyword",
+		"menucascade", "msgph", "option", "parmname", "ph", "q", "sub", "sup", "synph",
+		"systemoutput", "term", "tm", "tt", "u", "uicontrol", "userinput", "varname", "wintitle", "xref",
+	}, []string{"codeblock", "lines", "msgblock", "pre", "screen"}),
+	"xhtml": NewProfile("xhtml", []string{
+		"a", "abbr", "b", "bdi", "bdo", "br", "button", "cite", "code", "data", "del", "dfn", "em",
+		"i", "img", "input", "ins", "kbd", "label", "mark", "q", "s", "samp", "select", "small",
+		"span", "strong", "sub", "sup", "time", "u", "var", "wbr",
+	}, []string{"pre", "script", "style", "textarea"}),
+}
+
+func ProfileNames() []string {
+	names := make([]string, 0, len(Profiles))
+	for n := range Profiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type profileFile struct {
+	Extends  string   `json:"extends"`
+	Inline   []string `json:"inline"`
+	Preserve []string `json:"preserve"`
+}
+
+// LoadProfile returns a preset by name, or reads a JSON profile file of the
+// form {"extends": "docbook", "inline": [...], "preserve": [...]}.
+func LoadProfile(nameOrPath string) (*Profile, error) {
+	if p, ok := Profiles[nameOrPath]; ok {
+		return p, nil
+	}
+	data, err := os.ReadFile(nameOrPath)
+	if err != nil {
+		return nil, fmt.Errorf("unknown profile %q (presets: %s)", nameOrPath, strings.Join(ProfileNames(), ", "))
+	}
+	var pf profileFile
+	if err := json.Unmarshal(data, &pf); err != nil {
+		return nil, fmt.Errorf("profile %s: %v", nameOrPath, err)
+	}
+	p := NewProfile(nameOrPath, pf.Inline, pf.Preserve)
+	if pf.Extends != "" {
+		base, ok := Profiles[pf.Extends]
+		if !ok {
+			return nil, fmt.Errorf("profile %s: unknown base profile %q", nameOrPath, pf.Extends)
+		}
+		for n := range base.Inline {
+			p.Inline[n] = true
+		}
+		for n := range base.Preserve {
+			p.Preserve[n] = true
+		}
+	}
+	return p, nil
+}
+
+// StripWhitespace removes whitespace-only text nodes that only separate
+// block-level content. Whitespace next to inline elements and everything
+// inside preserving elements is kept.
+func StripWhitespace(node *Node, p *Profile) {
+	if node.Kind == "element" && p.IsPreserve(node.Name) {
+		return
+	}
+	kept := node.Children[:0]
+	for i, c := range node.Children {
+		if c.Kind == "text" && isWhitespace(c.Value) && node.Kind != "document" {
+			prevInline := i > 0 && inlineNode(node.Children[i-1], p)
+			nextInline := i+1 < len(node.Children) && inlineNode(node.Children[i+1], p)
+			if !prevInline && !nextInline {
+				continue
+			}
+		}
+		kept = append(kept, c)
+	}
+	node.Children = kept
+	for _, c := range node.Children {
+		if c.Kind == "element" {
+			StripWhitespace(c, p)
+		}
+	}
+}
+
+// strippedCopy copies the tree of n and strips it with p, returning the
+// copy of n. Attributes, which have no whitespace to strip, are returned
+// as they are.
+func strippedCopy(n *Node, p *Profile) *Node {
+	if n.Kind == "attribute" {
+		return n
+	}
+	path := []int{}
+	root := n
+	for root.Parent != nil {
+		for i, c := range root.Parent.Children {
+			if c == root {
+				path = append(path, i)
+				break
+			}
+		}
+		root = root.Parent
+	}
+	copied := DeepCopy(root, true)
+	at := copied
+	for i := len(path) - 1; i >= 0; i-- {
+		at = at.Children[path[i]]
+	}
+	StripWhitespace(copied, p)
+	numberNodes(copied)
+	return at
+}
+
+func inlineNode(n *Node, p *Profile) bool {
+	if n.Kind == "text" {
+		return !isWhitespace(n.Value)
+	}
+	return n.Kind == "element" && p.IsInline(n.Name)
+}
+
+func isWhitespace(s string) bool {
+	return strings.TrimLeft(s, " \t\r\n") == ""
+}
+
+func profileOf(ctx Context) *Profile {
+	if ctx.Runtime == nil {
+		return nil
+	}
+	return ctx.Runtime.Options.Profile
+}
+
+func fnIsInline(args [][]any, ctx Context) []any {
+	if len(args) == 0 || len(args[0]) == 0 {
+		return []any{false}
+	}
+	node, ok := args[0][0].(*Node)
+	return []any{ok && node.Kind == "element" && profileOf(ctx).IsInline(node.Name)}
+}
+
+func fnIsBlock(args [][]any, ctx Context) []any {
+	if len(args) == 0 || len(args[0]) == 0 {
+		return []any{false}
+	}
+	node, ok := args[0][0].(*Node)
+	return []any{ok && node.Kind == "element" && profileOf(ctx).IsBlock(node.Name)}
+}
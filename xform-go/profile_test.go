@@ -0,0 +1,108 @@
+package xform
+
+import "testing"
+
+const docbookXML = "<article>\n  <para>See <emphasis>this</emphasis> <code>x</code>.</para>\n  <programlisting>\n  <emphasis>keep</emphasis>\n  </programlisting>\n</article>"
+
+func TestProfileStripsInput(t *testing.T) {
+	opts := EvalOptions{Profile: Profiles["docbook"]}
+	want := "<article><para>See <emphasis>this</emphasis> <code>x</code>.</para><programlisting>\n  <emphasis>keep</emphasis>\n  </programlisting></article>"
+	if got := runWith(t, `/`, docbookXML, opts); got != want {
+		t.Errorf("stripped = %q, want %q", got, want)
+	}
+	if got := runWith(t, `count(/article/node())`, docbookXML, EvalOptions{}); got != "5" {
+		t.Errorf("without a profile count = %s, want 5", got)
+	}
+}
+
+func TestProfileLeavesInputUnchanged(t *testing.T) {
+	prog, err := Compile(`count(//node())`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := ParseXML(docbookXML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		profile *Profile
+		want    string
+	}{{Profiles["docbook"], "15"}, {nil, "18"}, {Profiles["xhtml"], "13"}, {nil, "18"}} {
+		result, err := prog.Eval(doc, EvalOptions{Profile: tt.profile})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := SerializeResult(result, SerializeOptions{}); got != tt.want {
+			t.Errorf("profile %v: count = %s, want %s", tt.profile != nil, got, tt.want)
+		}
+	}
+	if got := Serialize(doc); got != docbookXML {
+		t.Errorf("input modified: %q", got)
+	}
+	para := doc.Children[0].Children[1]
+	result, err := prog.Eval(para, EvalOptions{Profile: Profiles["docbook"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := SerializeResult(result, SerializeOptions{}); got != "15" {
+		t.Errorf("from an element: count = %s, want 15", got)
+	}
+	if c := strippedCopy(para, Profiles["docbook"]); c == para || c.Name != "para" || c.Parent == nil || c.Parent.Parent.Kind != "document" {
+		t.Errorf("strippedCopy(para) = %+v, want the copy of para in the copied document", c)
+	}
+	if got := runWith(t, `for p in //para return count(p/preceding-sibling::node())`, docbookXML, EvalOptions{Profile: Profiles["docbook"]}); got != "0" {
+		t.Errorf("preceding whitespace of para = %s, want 0", got)
+	}
+}
+
+func TestProfileStripsSelectedCopy(t *testing.T) {
+	prog, err := Compile(`/`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := ParseXML(docbookXML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := prog.EvalSelected(doc, "//para", EvalOptions{Profile: Profiles["docbook"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "<article><para>See <emphasis>this</emphasis> <code>x</code>.</para><programlisting>\n  <emphasis>keep</emphasis>\n  </programlisting></article>"
+	if got := Serialize(out); got != want {
+		t.Errorf("selected = %q, want %q", got, want)
+	}
+	if got := Serialize(doc); got != docbookXML {
+		t.Errorf("input modified: %q", got)
+	}
+}
+
+func TestProfileDefaultRules(t *testing.T) {
+	opts := EvalOptions{Profile: Profiles["docbook"]}
+	tests := []struct{ src, want string }{
+		{`rule main match <emphasis>{c}</emphasis> := <em>{apply(c)}</em>; apply(/)`,
+			"<article><para>See <em>this</em> <code>x</code>.</para><programlisting>\n  <emphasis>keep</emphasis>\n  </programlisting></article>"},
+		{`rule main match <emphasis>{c}</emphasis> := <em>{applyDeep(c)}</em>; applyDeep(/)`,
+			"See <em>this</em> x.\n  keep\n  "},
+		{`rule main match <programlisting>{c}</programlisting> := <pre/>; apply(/)`,
+			"<article><para>See <emphasis>this</emphasis> <code>x</code>.</para><pre/></article>"},
+	}
+	for _, tt := range tests {
+		if got := runWith(t, tt.src, docbookXML, opts); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+	want := "<article>\n  <para>See <em>this</em> <code>x</code>.</para>\n  <programlisting>\n  <em>keep</em>\n  </programlisting>\n</article>"
+	if got := runWith(t, tests[0].src, docbookXML, EvalOptions{}); got != want {
+		t.Errorf("without a profile = %q, want %q", got, want)
+	}
+}
+
+func TestProfileClassification(t *testing.T) {
+	opts := EvalOptions{Profile: Profiles["docbook"]}
+	src := `for e in //* return concat(name(e), ":", isInline(e), "/", isBlock(e), " ")`
+	want := "article:false/true para:false/true emphasis:true/false code:true/false programlisting:false/false emphasis:true/false "
+	if got := runWith(t, src, docbookXML, opts); got != want {
+		t.Errorf("classification = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,171 @@
+package xform
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Program is a parsed main module together with the modules it imports,
+// loaded from a filesystem so that imports and relative doc() references
+// resolve against the same tree (a directory, a bundle or an embed.FS).
+// Module is the main module with its imports linked in (see link);
+// Modules holds every module as parsed, by path.
+type Program struct {
+	Module  *Module
+	Main    string
+	Modules map[string]*Module
+	FS      fs.FS
+	Packs   []*BuiltinPack
+	Catalog *Catalog // rewrites import locations, see CompileFileWith
+	hooks   resultHooks
+}
+
+// Compile parses a standalone module. Imports need a location to resolve
+// against, so modules with imports are rejected; use CompileFile or
+// CompileFS for them.
+func Compile(src string) (*Program, error) {
+	module, err := parseModuleSafe(src)
+	if err != nil {
+		return nil, err
+	}
+	if len(module.Imports) > 0 {
+		return nil, fmt.Errorf("XFST0004: cannot resolve import %s without a module location (use CompileFile)", *module.Imports[0][0])
+	}
+	return &Program{Module: module, Modules: map[string]*Module{}}, nil
+}
+
+func CompileFS(fsys fs.FS, name string) (*Program, error) {
+	prog := &Program{Main: path.Clean(name), Modules: map[string]*Module{}, FS: fsys}
+	return prog, prog.compile()
+}
+
+// CompileFile loads the transform at filename from the operating system's
+// filesystem, resolving imports relative to the importing file.
+func CompileFile(filename string) (*Program, error) {
+	prog := &Program{Main: filepath.ToSlash(filepath.Clean(filename)), Modules: map[string]*Module{}}
+	return prog, prog.compile()
+}
+
+// CompileFileWith is CompileFile with the import locations rewritten by
+// catalog, so that import "https://example.com/lib.xform" can load a local
+// copy. The catalog's uri and system entries apply.
+func CompileFileWith(filename string, catalog *Catalog) (*Program, error) {
+	prog := &Program{Main: filepath.ToSlash(filepath.Clean(filename)), Modules: map[string]*Module{}, Catalog: catalog}
+	return prog, prog.compile()
+}
+
+// LoadModule is CompileFile for callers that evaluate the module directly,
+// e.g. with EvalModuleWithOptions.
+func LoadModule(filename string) (*Module, error) {
+	prog, err := CompileFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return prog.Module, nil
+}
+
+func (p *Program) compile() error {
+	if err := p.load(p.Main, nil); err != nil {
+		return err
+	}
+	p.Module = p.link(p.Main, map[string]*Module{})
+	return nil
+}
+
+func (p *Program) readModule(name string) ([]byte, error) {
+	if p.FS == nil {
+		return os.ReadFile(filepath.FromSlash(name))
+	}
+	return fs.ReadFile(p.FS, name)
+}
+
+func importPath(from, iri string) string {
+	return path.Clean(path.Join(path.Dir(from), iri))
+}
+
+// importPath returns the module an import of iri in module from loads: the
+// catalog's rewrite of iri or of the path it resolves to, else that path.
+func (p *Program) importPath(from, iri string) string {
+	if mapped, ok := p.Catalog.LookupURI(iri); ok {
+		return filepath.ToSlash(filepath.Clean(mapped))
+	}
+	if URIScheme(iri) != "" {
+		return iri
+	}
+	name := importPath(from, iri)
+	if mapped, ok := p.Catalog.LookupURI(name); ok {
+		return filepath.ToSlash(filepath.Clean(mapped))
+	}
+	return name
+}
+
+func MustCompileFS(fsys fs.FS, name string) *Program {
+	prog, err := CompileFS(fsys, name)
+	if err != nil {
+		panic(err)
+	}
+	return prog
+}
+
+// load parses name and the modules it imports; chain is the import path
+// that led to name, for reporting cycles.
+func (p *Program) load(name string, chain []string) error {
+	for i, c := range chain {
+		if c == name {
+			return fmt.Errorf("XFST0004: import cycle %s", strings.Join(append(chain[i:], name), " -> "))
+		}
+	}
+	if _, ok := p.Modules[name]; ok {
+		return nil
+	}
+	src, err := p.readModule(name)
+	if err != nil {
+		return fmt.Errorf("XFST0004: cannot load module %s: %v", name, err)
+	}
+	module, err := parseModuleSafe(string(src))
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	p.Modules[name] = module
+	for _, imp := range module.Imports {
+		iri := *imp[0]
+		target := p.importPath(name, iri)
+		if URIScheme(target) != "" {
+			return fmt.Errorf("XFST0004: %s: remote import %s is not supported (map it to a local file with a catalog)", name, iri)
+		}
+		if err := p.load(target, append(chain, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Program) Use(packs ...*BuiltinPack) *Program {
+	p.Packs = append(p.Packs, packs...)
+	return p
+}
+
+func (p *Program) Eval(doc *Node, opts EvalOptions) ([]any, error) {
+	return p.EvalItem(doc, opts)
+}
+
+// EvalItem is Eval with any item as the context item, such as the result
+// of ParseJSONBytes.
+func (p *Program) EvalItem(item any, opts EvalOptions) ([]any, error) {
+	if len(p.Packs) > 0 {
+		opts.Packs = append(append([]*BuiltinPack{}, p.Packs...), opts.Packs...)
+	}
+	if opts.Resolver == nil && p.FS != nil {
+		opts.Resolver = FSResolver{FS: p.FS, Dir: path.Dir(p.Main)}
+	}
+	opts.Diagnostics = p.hooks.diagnostics(opts.Diagnostics)
+	result, err := EvalModuleItem(p.Module, item, opts)
+	if err != nil {
+		return nil, err
+	}
+	return p.hooks.apply(result), nil
+}
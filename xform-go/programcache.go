@@ -0,0 +1,102 @@
+package xform
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+)
+
+// ProgramCache holds compiled transforms keyed by a hash of their source,
+// for servers that receive the transform with each request: a transform
+// sent again is compiled once. It is safe for concurrent use, and the
+// least recently used programs are dropped beyond the limit.
+type ProgramCache struct {
+	mu          sync.Mutex
+	maxPrograms int
+	entries     map[string]*cachedProgram
+	lru         *list.List
+}
+
+type cachedProgram struct {
+	id    string
+	elem  *list.Element
+	ready chan struct{}
+	prog  *Program
+	err   error
+}
+
+// NewProgramCache returns a cache of at most maxPrograms programs.
+func NewProgramCache(maxPrograms int) *ProgramCache {
+	return &ProgramCache{maxPrograms: maxPrograms, entries: map[string]*cachedProgram{}, lru: list.New()}
+}
+
+// ProgramID returns the id ProgramCache keys source under: its SHA-256,
+// in hex.
+func ProgramID(source string) string {
+	sum := sha256.Sum256([]byte(source))
+	return hex.EncodeToString(sum[:])
+}
+
+// Compile returns the program compiled from source and its id, compiling
+// it unless cached. Concurrent compiles of the same source share one;
+// failures are not cached.
+func (c *ProgramCache) Compile(source string) (*Program, string, error) {
+	id := ProgramID(source)
+	c.mu.Lock()
+	if e, ok := c.entries[id]; ok {
+		c.lru.MoveToFront(e.elem)
+		c.mu.Unlock()
+		<-e.ready
+		return e.prog, id, e.err
+	}
+	e := &cachedProgram{id: id, ready: make(chan struct{})}
+	e.elem = c.lru.PushFront(e)
+	c.entries[id] = e
+	c.mu.Unlock()
+
+	prog, err := Compile(source)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.prog, e.err = prog, err
+	close(e.ready)
+	if err != nil {
+		c.remove(e)
+		return nil, id, err
+	}
+	for c.lru.Len() > c.maxPrograms && c.lru.Len() > 1 {
+		c.remove(c.lru.Back().Value.(*cachedProgram))
+	}
+	return prog, id, nil
+}
+
+// Get returns the cached program with id, as returned by Compile.
+func (c *ProgramCache) Get(id string) (*Program, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[id]
+	if ok {
+		c.lru.MoveToFront(e.elem)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	<-e.ready
+	return e.prog, e.err == nil
+}
+
+// Len returns the number of cached programs.
+func (c *ProgramCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// remove drops e if it is still the entry for its id; c.mu is held.
+func (c *ProgramCache) remove(e *cachedProgram) {
+	if c.entries[e.id] != e {
+		return
+	}
+	delete(c.entries, e.id)
+	c.lru.Remove(e.elem)
+}
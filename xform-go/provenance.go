@@ -0,0 +1,56 @@
+package xform
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ProvenanceAttr is the attribute EvalOptions.Provenance puts on every
+// element a rule constructs, e.g. data-xform-src="/doc[1]/sec[2] rule main
+// line 12". The innermost rule wins; elements copied from the input are
+// left alone. SerializeOptions.ProvenanceComments writes it as a comment
+// before the element instead.
+const ProvenanceAttr = "data-xform-src"
+
+const provenanceCommentPrefix = " xform-src: "
+
+func (rt *Runtime) annotating() bool {
+	return rt != nil && rt.Options.Provenance
+}
+
+func annotateProvenance(result []any, source any, ruleset string, rule RuleDef) {
+	src := "(atomic)"
+	if n, ok := source.(*Node); ok {
+		src = NodePath(n)
+	}
+	value := src + " rule " + ruleset
+	if rule.Line > 0 {
+		value += " line " + strconv.Itoa(rule.Line)
+	}
+	for _, item := range result {
+		// Constructed elements have no parent until they are added to one;
+		// anything else belongs to an input document.
+		if n, ok := item.(*Node); ok && n.Kind == "element" && n.Parent == nil {
+			if _, done := n.Attrs[ProvenanceAttr]; !done {
+				setAttr(n, ProvenanceAttr, value)
+			}
+		}
+	}
+}
+
+// StripProvenance removes provenance annotations, as attributes or
+// comments, from n and its descendants.
+func StripProvenance(n *Node) {
+	if _, ok := n.Attrs[ProvenanceAttr]; ok {
+		removeAttr(n, ProvenanceAttr)
+	}
+	children := n.Children[:0]
+	for _, c := range n.Children {
+		if c.Kind == "comment" && strings.HasPrefix(c.Value, provenanceCommentPrefix) {
+			continue
+		}
+		StripProvenance(c)
+		children = append(children, c)
+	}
+	n.Children = children
+}
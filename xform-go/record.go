@@ -0,0 +1,193 @@
+package xform
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const recordMagic = "XFREC1\n"
+
+// RecordInputLimit caps the bytes of the input fragment kept per rule
+// firing; a rule matching near the root would otherwise store the whole
+// document again for every firing. Output fragments are kept in full so
+// that they can be searched.
+const RecordInputLimit = 1024
+
+// Record is one rule firing of a recorded evaluation.
+type Record struct {
+	Seq     int // firing order, from 1
+	Parent  int // Seq of the enclosing rule firing, 0 at the top
+	Depth   int // nesting of rule and function frames
+	Rule    string
+	Pattern string
+	Line    int
+	Input   string // path of the matched node
+	Source  string // serialized matched node, truncated to RecordInputLimit
+	Output  string // serialized result of the rule body
+}
+
+// Recorder is a Tracer that writes every rule firing to a compact,
+// gzip-compressed log that ReadRecording reads back. Records are written
+// when a rule returns, so a firing that fails is missing from the log.
+type Recorder struct {
+	w    *bufio.Writer
+	gz   *gzip.Writer
+	seq  int
+	open []int // Seq of the active frames, 0 for functions
+	err  error
+}
+
+// NewRecorder writes the log header to w and returns a Recorder for it.
+// Close must be called to flush the log.
+func NewRecorder(w io.Writer) (*Recorder, error) {
+	if _, err := io.WriteString(w, recordMagic); err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(w)
+	return &Recorder{w: bufio.NewWriter(gz), gz: gz}, nil
+}
+
+func (r *Recorder) Enter(stack []*Frame) {
+	if stack[len(stack)-1].Kind != "rule" {
+		r.open = append(r.open, 0)
+		return
+	}
+	r.seq++
+	r.open = append(r.open, r.seq)
+}
+
+func (r *Recorder) Leave(stack []*Frame, result []any) {
+	seq := r.open[len(r.open)-1]
+	r.open = r.open[:len(r.open)-1]
+	if seq == 0 || r.err != nil {
+		return
+	}
+	parent := 0
+	for i := len(r.open) - 1; i >= 0; i-- {
+		if r.open[i] != 0 {
+			parent = r.open[i]
+			break
+		}
+	}
+	f := stack[len(stack)-1]
+	rec := Record{Seq: seq, Parent: parent, Depth: len(stack), Rule: f.Name, Pattern: f.Pattern, Line: f.Line}
+	if n, ok := f.Context.ContextItem.(*Node); ok {
+		rec.Input = NodePath(n)
+	}
+	rec.Source = truncateUTF8(SerializeItem(f.Context.ContextItem), RecordInputLimit)
+	out := &strings.Builder{}
+	for _, item := range result {
+		out.WriteString(SerializeItem(item))
+	}
+	rec.Output = out.String()
+	r.err = r.write(rec)
+}
+
+func (r *Recorder) write(rec Record) error {
+	buf := make([]byte, 0, 64+len(rec.Source)+len(rec.Output))
+	for _, n := range []int{rec.Seq, rec.Parent, rec.Depth, rec.Line} {
+		buf = binary.AppendUvarint(buf, uint64(n))
+	}
+	for _, s := range []string{rec.Rule, rec.Pattern, rec.Input, rec.Source, rec.Output} {
+		buf = binary.AppendUvarint(buf, uint64(len(s)))
+		buf = append(buf, s...)
+	}
+	_, err := r.w.Write(buf)
+	return err
+}
+
+// Close flushes the log and reports the first write error, if any. It does
+// not close the underlying writer.
+func (r *Recorder) Close() error {
+	if r.err != nil {
+		return r.err
+	}
+	if err := r.w.Flush(); err != nil {
+		return err
+	}
+	return r.gz.Close()
+}
+
+// ReadRecording reads a log written by a Recorder, in the order the rules
+// returned (innermost firings first).
+func ReadRecording(rd io.Reader) ([]Record, error) {
+	br := bufio.NewReader(rd)
+	head := make([]byte, len(recordMagic))
+	if _, err := io.ReadFull(br, head); err != nil || string(head) != recordMagic {
+		return nil, fmt.Errorf("not an xform recording")
+	}
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(gz)
+	out := []Record{}
+	for {
+		var rec Record
+		ints := []*int{&rec.Seq, &rec.Parent, &rec.Depth, &rec.Line}
+		strs := []*string{&rec.Rule, &rec.Pattern, &rec.Input, &rec.Source, &rec.Output}
+		for i, p := range ints {
+			v, err := binary.ReadUvarint(r)
+			if i == 0 && err == io.EOF {
+				return out, nil
+			}
+			if err != nil {
+				return out, truncatedRecording(err)
+			}
+			*p = int(v)
+		}
+		for _, p := range strs {
+			n, err := binary.ReadUvarint(r)
+			if err != nil {
+				return out, truncatedRecording(err)
+			}
+			data := make([]byte, n)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return out, truncatedRecording(err)
+			}
+			*p = string(data)
+		}
+		out = append(out, rec)
+	}
+}
+
+func truncatedRecording(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("recording is truncated")
+	}
+	return err
+}
+
+// Producers returns the firings whose output contains fragment and that are
+// not merely enclosing another such firing: the rules that produced it.
+// Each is followed by its chain of enclosing firings, outermost last, and
+// the chains are in firing order.
+func Producers(records []Record, fragment string) [][]Record {
+	bySeq := map[int]Record{}
+	hasMatchingChild := map[int]bool{}
+	for _, rec := range records {
+		bySeq[rec.Seq] = rec
+		if strings.Contains(rec.Output, fragment) {
+			hasMatchingChild[rec.Parent] = true
+		}
+	}
+	out := [][]Record{}
+	for _, rec := range records {
+		if !strings.Contains(rec.Output, fragment) || hasMatchingChild[rec.Seq] {
+			continue
+		}
+		chain := []Record{rec}
+		for p, ok := bySeq[rec.Parent]; ok; p, ok = bySeq[p.Parent] {
+			chain = append(chain, p)
+		}
+		out = append(out, chain)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i][0].Seq < out[j][0].Seq })
+	return out
+}
@@ -0,0 +1,215 @@
+package xform
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// BadExpr stands for source that did not parse, in the modules
+// ParseModuleTolerant returns.
+type BadExpr struct {
+	Pos Position
+}
+
+// ParseModuleTolerant parses src like ParseModule but does not stop at the
+// first syntax error, for editors and formatters that need a module for
+// code that is being typed. It returns the declarations that parsed, with a
+// BadExpr for each body or constructor expression that did not, and an
+// error Diagnostic for each syntax error in source order; none means src
+// parses. The module must not be evaluated when there are diagnostics.
+//
+// After an error the parser skips to the end of the declaration, the next
+// ";" or the keyword of the next declaration, or, inside an element
+// constructor, to the "}" closing the braces.
+func ParseModuleTolerant(src string) (*Module, []Diagnostic) {
+	p := NewParser(src)
+	p.tolerant = true
+	module := p.ParseModule()
+	sort.SliceStable(p.errs, func(i, j int) bool { return p.errs[i].offset < p.errs[j].offset })
+	var diags []Diagnostic
+	for _, e := range p.errs {
+		diags = append(diags, e.diag)
+	}
+	return module, diags
+}
+
+// syntaxError is a Diagnostic of a tolerant parse with its byte offset.
+type syntaxError struct {
+	offset int
+	diag   Diagnostic
+}
+
+// errorOffset finds the offset parse errors end their message with, as in
+// "expected PUNCT ; at 42" or "invalid escape \q at 7: ...".
+var errorOffset = regexp.MustCompile(` at (\d+)`)
+
+// declKeywords start top-level declarations and never occur in
+// expressions, so a tolerant parse resumes at them.
+var declKeywords = map[string]bool{"def": true, "rule": true, "var": true, "ns": true, "import": true}
+
+// recovering runs parse, which reports whether there is more to parse. In
+// a tolerant parse a syntax error in it is recorded, sync skips the rest of
+// the broken construct from the error's offset (parse started at before)
+// and recovering reports true; otherwise the error propagates.
+func (p *Parser) recovering(parse func() bool, sync func(from, before int)) (more bool) {
+	if !p.tolerant {
+		return parse()
+	}
+	before := p.offset()
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		from := p.syntaxError(r)
+		if from < before {
+			from = before
+		}
+		sync(from, before)
+		more = true
+	}()
+	return parse()
+}
+
+// report raises err, or records it in a tolerant parse, whose caller then
+// goes on as if the source were right.
+func (p *Parser) report(err error) {
+	if !p.tolerant {
+		panic(err)
+	}
+	p.syntaxError(err)
+}
+
+// syntaxError records the error r of a tolerant parse and returns the
+// offset it occurred at. A second error at the same offset, a consequence
+// of the first, is dropped.
+func (p *Parser) syntaxError(r any) int {
+	msg := fmt.Sprint(r)
+	code := ErrorCode(r)
+	if code == "unknown" {
+		code = "XFST0001"
+	} else {
+		msg = strings.TrimSpace(strings.TrimPrefix(msg, code+":"))
+	}
+	offset := p.offset()
+	if m := errorOffset.FindAllStringSubmatchIndex(msg, -1); m != nil {
+		last := m[len(m)-1]
+		if n, err := strconv.Atoi(msg[last[2]:last[3]]); err == nil && n <= len(p.text) {
+			offset = n
+			msg = msg[:last[0]] + msg[last[1]:]
+		}
+	}
+	if n := len(p.errs); n > 0 && p.errs[n-1].offset == offset {
+		return offset
+	}
+	p.errs = append(p.errs, syntaxError{offset: offset, diag: Diagnostic{Severity: SeverityError, Code: code, Message: msg, Pos: p.position(offset)}})
+	return offset
+}
+
+// offset is the offset of the next token.
+func (p *Parser) offset() int {
+	if p.lexer.Buffer != nil {
+		return p.lexer.Buffer.Pos
+	}
+	return p.lexer.Pos
+}
+
+// skipToken reads the next token at the lexer's position; where there is
+// no valid token it skips a character and reports false.
+func (p *Parser) skipToken() (tok Token, ok bool) {
+	l := p.lexer
+	l.Buffer = nil
+	l.skipWsComments()
+	start := l.Pos
+	defer func() {
+		if recover() != nil {
+			_, size := utf8.DecodeRuneInString(l.Text[start:])
+			l.Pos = start + size
+			tok, ok = Token{}, false
+		}
+	}()
+	return l.nextToken(), true
+}
+
+// synchronize skips a broken top-level declaration from offset from: up to
+// and including the next ";", or up to the keyword of a declaration after
+// the one started at before.
+func (p *Parser) synchronize(from, before int) {
+	p.lexer.Pos, p.lexer.Buffer = from, nil
+	for {
+		tok, ok := p.skipToken()
+		switch {
+		case !ok:
+		case tok.Kind == TokEOF:
+			p.lexer.Pos = tok.Pos
+			return
+		case tok.Kind == TokPunct && tok.Val == ";":
+			return
+		case tok.Kind == TokKW && declKeywords[tok.Val] && tok.Pos > before:
+			p.lexer.Pos = tok.Pos
+			return
+		}
+	}
+}
+
+// syncBrace skips a broken expression in the braces of a constructor, up
+// to and including the "}" that closes them. It counts the braces from the
+// start of the expression, since the failed parse may have read some, and
+// stops before an end tag, so that the constructor still finds its end.
+func (p *Parser) syncBrace(_, before int) {
+	p.lexer.Pos, p.lexer.Buffer = before, nil
+	depth := 1
+	for {
+		tok, ok := p.skipToken()
+		switch {
+		case !ok:
+		case tok.Kind == TokEOF:
+			p.lexer.Pos = tok.Pos
+			return
+		case tok.Kind == TokOp && tok.Val == "<" && strings.HasPrefix(p.text[tok.Pos:], "</"):
+			p.lexer.Pos = tok.Pos
+			return
+		case tok.Kind == TokPunct && tok.Val == "{":
+			depth++
+		case tok.Kind == TokPunct && (tok.Val == "}" || tok.Val == "-}"):
+			if depth--; depth == 0 {
+				return
+			}
+		}
+	}
+}
+
+// parseBody reads the expression and the ";" ending a declaration. In a
+// tolerant parse the declaration is kept with a BadExpr body when the
+// expression does not parse.
+func (p *Parser) parseBody() Expr {
+	start := p.offset()
+	var body Expr
+	if p.recovering(func() bool {
+		body = p.parseExpr()
+		p.lexer.Expect(TokPunct, ";")
+		return false
+	}, p.synchronize) {
+		body = BadExpr{Pos: p.position(start)}
+	}
+	return body
+}
+
+// braced reads the expression of a {...} in a constructor with parse,
+// which consumes the closing brace too. In a tolerant parse an expression
+// that does not parse becomes a BadExpr.
+func (p *Parser) braced(parse func() Expr) Expr {
+	start := p.offset()
+	var expr Expr
+	if p.recovering(func() bool {
+		expr = parse()
+		return false
+	}, p.syncBrace) {
+		expr = BadExpr{Pos: p.position(start)}
+	}
+	return expr
+}
@@ -0,0 +1,577 @@
+package xform
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Rename renames the function, module variable or parameter that old names
+// in the main module of p to new, at its declaration and at every
+// reference in the modules of p that see it: under its own name through
+// plain imports, as alias:old through "import ... as alias". Local
+// bindings of the same name are left alone, and names in strings, such as
+// the rule sets passed to apply(), are not references. It returns the
+// rewritten source of each module that changed, by path.
+func (p *Program) Rename(old, new string) (map[string]string, error) {
+	if p.Modules[p.Main] == nil {
+		return nil, fmt.Errorf("rename needs a program loaded from files (CompileFile or CompileFS)")
+	}
+	fn, isFunction := p.resolveSymbol(p.Main, old, true)
+	v, isVariable := p.resolveSymbol(p.Main, old, false)
+	var sym symbol
+	switch {
+	case isFunction && isVariable:
+		return nil, fmt.Errorf("%s names both a function and a variable", old)
+	case isFunction:
+		sym = fn
+	case isVariable:
+		sym = v
+	default:
+		return nil, fmt.Errorf("%s is not a function, variable or parameter of %s", old, p.Main)
+	}
+	if i := strings.LastIndexByte(new, ':'); i >= 0 {
+		if !strings.HasPrefix(old, new[:i+1]) {
+			return nil, fmt.Errorf("%s cannot move to another prefix than that of %s", new, old)
+		}
+		new = new[i+1:]
+	}
+	if !isPlainName(new) {
+		return nil, fmt.Errorf("%q is not a valid name", new)
+	}
+	if new == sym.name {
+		return map[string]string{}, nil
+	}
+	if _, ok := builtins[new]; ok && sym.function {
+		return nil, fmt.Errorf("%s is a built-in function", new)
+	}
+
+	memo := map[string][]string{}
+	out := map[string]string{}
+	for module, m := range p.Modules {
+		names := map[string]string{}
+		for _, name := range p.visibleNames(module, sym, memo) {
+			to := name[:len(name)-len(sym.name)] + new
+			if other, ok := p.resolveSymbol(module, to, sym.function); ok {
+				return nil, fmt.Errorf("%s already names a %s in %s", to, other.kind(), other.module)
+			}
+			names[name] = to
+		}
+		if len(names) == 0 {
+			continue
+		}
+		edits := []textEdit{}
+		if module == sym.module {
+			edits = append(edits, textEdit{pos: declarationPos(m, sym), old: sym.name, new: new})
+		}
+		var err error
+		walkModule(m, func(expr Expr, bound map[string]bool) {
+			name, explicit, pos, ok := reference(expr, sym.function)
+			to, renamed := names[name]
+			// Calls always name functions; other references may be
+			// shadowed by local variables.
+			_, call := expr.(FuncCall)
+			if !ok || !renamed || !call && (bound[name] || explicit && bound["$"+name]) {
+				return
+			}
+			switch {
+			case err != nil:
+			case !pos.IsValid():
+				err = fmt.Errorf("%s: cannot rename the reference to %s in a group by key", module, name)
+			case !call && bound[to]:
+				err = fmt.Errorf("%s:%d:%d: %s would refer to the local %s", module, pos.Line, pos.Column, name, to)
+			case explicit:
+				edits = append(edits, textEdit{pos: pos, old: "$" + name, new: "$" + to})
+			default:
+				edits = append(edits, textEdit{pos: pos, old: name, new: to})
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		src, err := p.readModule(module)
+		if err != nil {
+			return nil, err
+		}
+		text, err := applyEdits(string(src), edits)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", module, err)
+		}
+		if text != string(src) {
+			out[module] = text
+		}
+	}
+	return out, nil
+}
+
+// symbol is a function (or a variable or parameter) as named in the
+// module defining it.
+type symbol struct {
+	module   string
+	name     string
+	function bool
+}
+
+func (s symbol) kind() string {
+	if s.function {
+		return "function"
+	}
+	return "variable"
+}
+
+// resolveSymbol finds what name refers to in module the way link merges
+// imports: the module's own definitions first, then those of its imports
+// in order, an aliased import only for names with its prefix.
+func (p *Program) resolveSymbol(module, name string, function bool) (symbol, bool) {
+	m := p.Modules[module]
+	if m == nil {
+		return symbol{}, false
+	}
+	if function {
+		if _, ok := m.Functions[name]; ok {
+			return symbol{module, name, true}, true
+		}
+	} else if _, ok := m.Vars[name]; ok || hasParam(m.Params, name) {
+		return symbol{module, name, false}, true
+	}
+	for _, imp := range m.Imports {
+		local := name
+		if imp[1] != nil {
+			if !strings.HasPrefix(name, *imp[1]+":") {
+				continue
+			}
+			local = name[len(*imp[1])+1:]
+		}
+		if sym, ok := p.resolveSymbol(p.importPath(module, *imp[0]), local, function); ok {
+			return sym, true
+		}
+	}
+	return symbol{}, false
+}
+
+// visibleNames returns the names under which module refers to sym.
+func (p *Program) visibleNames(module string, sym symbol, memo map[string][]string) []string {
+	if names, ok := memo[module]; ok {
+		return names
+	}
+	memo[module] = nil
+	var names []string
+	if module == sym.module {
+		names = append(names, sym.name)
+	}
+	for _, imp := range p.Modules[module].Imports {
+		for _, name := range p.visibleNames(p.importPath(module, *imp[0]), sym, memo) {
+			if imp[1] != nil {
+				name = *imp[1] + ":" + name
+			}
+			if found, ok := p.resolveSymbol(module, name, sym.function); ok && found == sym && !containsString(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	memo[module] = names
+	return names
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func declarationPos(m *Module, sym symbol) Position {
+	if sym.function {
+		return m.Functions[sym.name].NamePos
+	}
+	if pos, ok := m.VarPos[sym.name]; ok {
+		return pos
+	}
+	for _, param := range m.Params {
+		if param.Name == sym.name {
+			return param.Pos
+		}
+	}
+	return Position{}
+}
+
+// reference returns the name expr refers to when it is a reference to a
+// function (a call, or a bare name used as a function item) or otherwise
+// to a variable.
+func reference(expr Expr, function bool) (name string, explicit bool, pos Position, ok bool) {
+	switch e := expr.(type) {
+	case FuncCall:
+		return e.Name, false, e.Pos, function
+	case VarRef:
+		return e.Name, e.Explicit, e.Pos, !function || !e.Explicit
+	case PathExpr:
+		if e.Start.Kind == "var" && e.Start.Name != nil {
+			return *e.Start.Name, e.Start.Explicit, e.Start.Pos, !function
+		}
+	}
+	return "", false, Position{}, false
+}
+
+func isPlainName(name string) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	lexer := NewLexer(name)
+	tok := lexer.Next()
+	return tok.Kind == TokIdent && tok.Val == name && !strings.Contains(name, ":") && lexer.Next().Kind == TokEOF
+}
+
+// walkModule calls walkScoped for every expression of m with the variables
+// its declaration binds.
+func walkModule(m *Module, visit func(Expr, map[string]bool)) {
+	none := map[string]bool{}
+	for _, fn := range m.Functions {
+		bound := map[string]bool{}
+		for _, param := range fn.Params {
+			walkScoped(param.Default, none, visit)
+			bound[param.Name] = true
+		}
+		walkScoped(fn.Body, bound, visit)
+	}
+	for _, v := range m.Vars {
+		walkScoped(v, none, visit)
+	}
+	for _, param := range m.Params {
+		walkScoped(param.Default, none, visit)
+	}
+	rules := []RuleDef{}
+	for _, set := range m.Rules {
+		rules = append(rules, set...)
+	}
+	for _, set := range m.Validations {
+		rules = append(rules, set.Rules...)
+	}
+	for _, rule := range rules {
+		bound := map[string]bool{}
+		for _, name := range ruleVariables {
+			bound["$"+name] = true
+		}
+		patternVars(rule.Pattern, bound)
+		walkScoped(rule.Body, bound, visit)
+	}
+	for _, phase := range m.Phases {
+		walkScoped(phase.Expr, none, visit)
+	}
+	walkScoped(m.Expr, none, visit)
+}
+
+// walkScoped calls visit for expr and every expression in it with the
+// local variables bound there, rule variables such as $node under "$node".
+// visit must not modify bound.
+func walkScoped(expr Expr, bound map[string]bool, visit func(Expr, map[string]bool)) {
+	if expr == nil {
+		return
+	}
+	visit(expr, bound)
+	switch e := expr.(type) {
+	case LetExpr:
+		walkScoped(e.Value, bound, visit)
+		walkScoped(e.Body, extend(bound, e.Name), visit)
+	case ForExpr:
+		walkScoped(e.Seq, bound, visit)
+		inner := extend(bound, e.Name)
+		walkScoped(e.Where, inner, visit)
+		for _, k := range e.GroupBy {
+			walkScoped(k.Expr, inner, visit)
+		}
+		for _, k := range e.GroupBy {
+			inner = extend(inner, k.Name)
+		}
+		for _, k := range e.OrderBy {
+			walkScoped(k.Expr, inner, visit)
+		}
+		walkScoped(e.Body, inner, visit)
+	case TryExpr:
+		walkScoped(e.Body, bound, visit)
+		walkScoped(e.Catch, extend(bound, e.Var), visit)
+	case MatchExpr:
+		walkScoped(e.Target, bound, visit)
+		for _, mc := range e.Cases {
+			inner := extend(bound)
+			patternVars(mc.Pattern, inner)
+			walkScoped(mc.Expr, inner, visit)
+		}
+		walkScoped(e.Default, bound, visit)
+	case FunctionExpr:
+		inner := extend(bound)
+		for _, param := range e.Params {
+			walkScoped(param.Default, bound, visit)
+			inner[param.Name] = true
+		}
+		walkScoped(e.Body, inner, visit)
+	default:
+		for _, sub := range subExprs(expr) {
+			walkScoped(sub, bound, visit)
+		}
+	}
+}
+
+// textEdit replaces old, which must be found at pos, by new.
+type textEdit struct {
+	pos      Position
+	old, new string
+}
+
+func applyEdits(src string, edits []textEdit) (string, error) {
+	type span struct {
+		at   int
+		edit textEdit
+	}
+	spans := make([]span, 0, len(edits))
+	for _, e := range edits {
+		at, ok := offsetOf(src, e.pos)
+		if !ok || !strings.HasPrefix(src[at:], e.old) {
+			return "", fmt.Errorf("%d:%d: expected %s", e.pos.Line, e.pos.Column, e.old)
+		}
+		spans = append(spans, span{at, e})
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].at > spans[j].at })
+	last := -1
+	for _, s := range spans {
+		if s.at == last {
+			continue
+		}
+		src = src[:s.at] + s.edit.new + src[s.at+len(s.edit.old):]
+		last = s.at
+	}
+	return src, nil
+}
+
+// offsetOf converts pos, with its column counted in runes, to a byte
+// offset into src. The column just past the end of a line is valid.
+func offsetOf(src string, pos Position) (int, bool) {
+	if !pos.IsValid() {
+		return 0, false
+	}
+	at := 0
+	for line := 1; line < pos.Line; line++ {
+		i := strings.IndexByte(src[at:], '\n')
+		if i < 0 {
+			return 0, false
+		}
+		at += i + 1
+	}
+	for col := 1; col < pos.Column; col++ {
+		if at >= len(src) || src[at] == '\n' {
+			return 0, false
+		}
+		_, size := utf8.DecodeRuneInString(src[at:])
+		at += size
+	}
+	return at, true
+}
+
+// ExtractFunction moves the expression of src from from up to (not
+// including) to into a new function name, declared before the declaration
+// containing it, and calls the function in its place. The variables the
+// expression uses that are bound locally where it stands become the
+// parameters; module variables and the context item (paths, position())
+// are seen by the function as they were. The selection must be a whole
+// expression: one that means the same when parenthesized, so 2 * 3 in
+// 1 + 2 * 3 can be extracted but 1 + 2 cannot.
+func ExtractFunction(src string, from, to Position, name string) (string, error) {
+	start, ok := offsetOf(src, from)
+	if !ok {
+		return "", fmt.Errorf("%d:%d is not a position in the source", from.Line, from.Column)
+	}
+	end, ok := offsetOf(src, to)
+	if !ok {
+		return "", fmt.Errorf("%d:%d is not a position in the source", to.Line, to.Column)
+	}
+	for start < end && isSpace(src[start]) {
+		start++
+	}
+	for end > start && isSpace(src[end-1]) {
+		end--
+	}
+	if start >= end {
+		return "", fmt.Errorf("the selection is empty")
+	}
+	if !isPlainName(name) {
+		return "", fmt.Errorf("%q is not a valid function name", name)
+	}
+	module, starts, err := parseModuleStarts(src)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := module.Functions[name]; ok {
+		return "", fmt.Errorf("function %s is already defined", name)
+	}
+	if _, ok := builtins[name]; ok {
+		return "", fmt.Errorf("%s is a built-in function", name)
+	}
+	selection := src[start:end]
+	grouped, err := parseModuleSafe(src[:start] + "(" + selection + ")" + src[end:])
+	if err != nil || !sameIgnoringPositions(reflect.ValueOf(module), reflect.ValueOf(grouped)) {
+		return "", fmt.Errorf("the selection %q is not a whole expression", selection)
+	}
+	expr, err := parseExprSafe(selection)
+	if err != nil {
+		return "", err
+	}
+
+	// The variables bound where the call will stand.
+	probe, err := parseModuleSafe(src[:start] + name + "()" + src[end:])
+	if err != nil {
+		return "", err
+	}
+	var local map[string]bool
+	walkModule(probe, func(e Expr, bound map[string]bool) {
+		if call, ok := e.(FuncCall); ok && call.Name == name && local == nil {
+			local = bound
+		}
+	})
+
+	params, args := []string{}, []string{}
+	walkScoped(expr, map[string]bool{}, func(e Expr, bound map[string]bool) {
+		ref, explicit, _, ok := reference(e, false)
+		if !ok || bound[ref] || explicit && bound["$"+ref] || containsString(params, ref) {
+			return
+		}
+		if local[ref] || explicit && local["$"+ref] {
+			params = append(params, ref)
+			if explicit {
+				ref = "$" + ref
+			}
+			args = append(args, ref)
+		}
+	})
+
+	at := insertionPoint(src, starts, start)
+	def := "def " + name + "(" + strings.Join(params, ", ") + ") := " + selection + ";\n\n"
+	call := name + "(" + strings.Join(args, ", ") + ")"
+	out := src[:at] + def + src[at:start] + call + src[end:]
+	if _, err := parseModuleSafe(out); err != nil {
+		return "", fmt.Errorf("the extracted module does not parse: %v", err)
+	}
+	return out, nil
+}
+
+// parseModuleStarts is parseModuleSafe that also returns the offsets at
+// which the top-level declarations start.
+func parseModuleStarts(src string) (module *Module, starts []int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	p := NewParser(src)
+	module = p.ParseModule()
+	return module, p.declStarts, nil
+}
+
+func parseExprSafe(src string) (expr Expr, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	p := NewParser(src)
+	expr = p.parseExpr()
+	if tok := p.lexer.Peek(); tok.Kind != TokEOF {
+		return nil, fmt.Errorf("XFST0001: unexpected token at %d", tok.Pos)
+	}
+	return expr, nil
+}
+
+// insertionPoint returns where a declaration goes to precede the one
+// containing offset: at the start of its line, above the comments
+// directly on top of it, unless something else precedes it on that line.
+func insertionPoint(src string, starts []int, offset int) int {
+	at := 0
+	for _, s := range starts {
+		if s <= offset {
+			at = s
+		}
+	}
+	line := strings.LastIndexByte(src[:at], '\n') + 1
+	if strings.TrimSpace(src[line:at]) != "" {
+		return at
+	}
+	for line > 0 {
+		prev := strings.LastIndexByte(src[:line-1], '\n') + 1
+		if !strings.HasPrefix(strings.TrimSpace(src[prev:line]), "#") {
+			break
+		}
+		line = prev
+	}
+	return line
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// sameIgnoringPositions compares two parse results field by field,
+// skipping positions.
+func sameIgnoringPositions(a, b reflect.Value) bool {
+	if a.IsValid() != b.IsValid() {
+		return false
+	}
+	if !a.IsValid() {
+		return true
+	}
+	if a.Type() != b.Type() {
+		return false
+	}
+	if a.Type() == reflect.TypeOf(Position{}) {
+		return true
+	}
+	switch a.Kind() {
+	case reflect.Interface, reflect.Pointer:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		return sameIgnoringPositions(a.Elem(), b.Elem())
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			if !sameIgnoringPositions(a.Field(i), b.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Slice, reflect.Array:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for i := 0; i < a.Len(); i++ {
+			if !sameIgnoringPositions(a.Index(i), b.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Map:
+		if a.Len() != b.Len() {
+			return false
+		}
+		iter := a.MapRange()
+		for iter.Next() {
+			if !sameIgnoringPositions(iter.Value(), b.MapIndex(iter.Key())) {
+				return false
+			}
+		}
+		return true
+	case reflect.Bool:
+		return a.Bool() == b.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() == b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() == b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() == b.Float()
+	case reflect.String:
+		return a.String() == b.String()
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+package xform
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// compileRegexp compiles pattern with XPath-style flags: i (case
+// insensitive), m (^ and $ match at line breaks), s (. matches newlines)
+// and x (whitespace in the pattern is ignored, except in character
+// classes). Compiled patterns are cached per evaluation.
+func (rt *Runtime) compileRegexp(pattern, flags string) *regexp.Regexp {
+	key := flags + "/" + pattern
+	if rt != nil {
+		if re, ok := rt.regexps[key]; ok {
+			return re
+		}
+	}
+	prefix := ""
+	for _, f := range flags {
+		switch f {
+		case 'i', 'm', 's':
+			if !strings.ContainsRune(prefix, f) {
+				prefix += string(f)
+			}
+		case 'x':
+			pattern = stripPatternSpace(pattern)
+		default:
+			panic(fmt.Errorf("XFDY0002: unknown regular expression flag %q (want i, m, s or x)", f))
+		}
+	}
+	if prefix != "" {
+		pattern = "(?" + prefix + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		panic(fmt.Errorf("XFDY0002: invalid regular expression %q: %v", pattern, err))
+	}
+	if rt != nil {
+		if rt.regexps == nil {
+			rt.regexps = map[string]*regexp.Regexp{}
+		}
+		rt.regexps[key] = re
+	}
+	return re
+}
+
+func stripPatternSpace(pattern string) string {
+	b := &strings.Builder{}
+	inClass, escaped := false, false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '[':
+			inClass = true
+		case r == ']':
+			inClass = false
+		case unicode.IsSpace(r) && !inClass:
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// regexpArgs returns the input string, the compiled pattern at args[1] and
+// the flags at args[flagsAt].
+func regexpArgs(args [][]any, flagsAt int, ctx Context, fn string) (string, *regexp.Regexp) {
+	if len(args) < 2 {
+		panic(fmt.Errorf("XFDY0002: %s() expects a string and a pattern", fn))
+	}
+	flags := ""
+	if len(args) > flagsAt {
+		flags = ToString(args[flagsAt])
+	}
+	return ToString(args[0]), ctx.Runtime.compileRegexp(ToString(args[1]), flags)
+}
+
+// fnMatches is matches(s, pattern, flags?): whether pattern matches
+// anywhere in s.
+func fnMatches(args [][]any, ctx Context) []any {
+	s, re := regexpArgs(args, 2, ctx, "matches")
+	return []any{re.MatchString(s)}
+}
+
+// fnReplace is replace(s, pattern, replacement, flags?). $0 to $9 in the
+// replacement insert the match and its groups; \$ and \\ are a literal $
+// and backslash.
+func fnReplace(args [][]any, ctx Context) []any {
+	s, re := regexpArgs(args, 3, ctx, "replace")
+	if re.MatchString("") {
+		panic(fmt.Errorf("XFDY0002: replace() pattern %q matches the empty string", re.String()))
+	}
+	replacement := ""
+	if len(args) > 2 {
+		replacement = ToString(args[2])
+	}
+	return []any{re.ReplaceAllString(s, goReplacement(replacement))}
+}
+
+// goReplacement translates an XPath replacement string to the template
+// syntax of regexp.Expand.
+func goReplacement(s string) string {
+	b := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s) && (s[i+1] == '$' || s[i+1] == '\\'):
+			i++
+			if s[i] == '$' {
+				b.WriteString("$$")
+			} else {
+				b.WriteByte('\\')
+			}
+		case c == '$' && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9':
+			i++
+			b.WriteString("${" + string(s[i]) + "}")
+		case c == '$':
+			panic(fmt.Errorf("XFDY0002: invalid replacement %q: $ must be followed by a digit (write \\$ for a dollar sign)", s))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// fnTokenize is tokenize(s, pattern?, flags?): the parts of s between the
+// matches of pattern. Without a pattern s is split at whitespace runs,
+// ignoring leading and trailing whitespace.
+func fnTokenize(args [][]any, ctx Context) []any {
+	out := []any{}
+	if len(args) < 2 {
+		for _, f := range strings.Fields(ToString(firstOrEmpty(args))) {
+			out = append(out, f)
+		}
+		return out
+	}
+	s, re := regexpArgs(args, 2, ctx, "tokenize")
+	if re.MatchString("") {
+		panic(fmt.Errorf("XFDY0002: tokenize() pattern %q matches the empty string", re.String()))
+	}
+	if s == "" {
+		return out
+	}
+	for _, part := range re.Split(s, -1) {
+		out = append(out, part)
+	}
+	return out
+}
@@ -0,0 +1,322 @@
+package xform
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Resolver interface {
+	Open(uri string) (io.ReadCloser, error)
+}
+
+type ResolverFunc func(uri string) (io.ReadCloser, error)
+
+func (f ResolverFunc) Open(uri string) (io.ReadCloser, error) { return f(uri) }
+
+// Resolvers dispatches on the URI scheme. URIs without a scheme (plain paths)
+// are handed to the "file" resolver.
+type Resolvers struct {
+	mu      sync.RWMutex
+	schemes map[string]Resolver
+}
+
+func NewResolvers() *Resolvers {
+	return &Resolvers{schemes: map[string]Resolver{}}
+}
+
+func (r *Resolvers) Register(scheme string, res Resolver) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.schemes[strings.ToLower(scheme)] = res
+}
+
+func (r *Resolvers) Open(uri string) (io.ReadCloser, error) {
+	res, err := r.resolver(uri)
+	if err != nil {
+		return nil, err
+	}
+	return res.Open(uri)
+}
+
+// resolver returns the resolver registered for the scheme of uri.
+func (r *Resolvers) resolver(uri string) (Resolver, error) {
+	scheme := URIScheme(uri)
+	if scheme == "" {
+		scheme = "file"
+	}
+	r.mu.RLock()
+	res, ok := r.schemes[scheme]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no resolver for scheme %q", scheme)
+	}
+	return res, nil
+}
+
+var DefaultResolvers = NewResolvers()
+
+func RegisterResolver(scheme string, res Resolver) {
+	DefaultResolvers.Register(scheme, res)
+}
+
+func init() {
+	RegisterResolver("file", FileResolver{})
+	httpResolver := HTTPResolver{Client: &http.Client{Timeout: 30 * time.Second}}
+	RegisterResolver("http", httpResolver)
+	RegisterResolver("https", httpResolver)
+}
+
+// URIScheme returns the lower-cased scheme of uri, or "" for plain paths.
+// Single-letter schemes are treated as Windows drive letters.
+func URIScheme(uri string) string {
+	idx := strings.Index(uri, ":")
+	if idx < 2 {
+		return ""
+	}
+	for i := 0; i < idx; i++ {
+		c := uri[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && (c >= '0' && c <= '9' || c == '+' || c == '-' || c == '.')) {
+			return ""
+		}
+	}
+	return strings.ToLower(uri[:idx])
+}
+
+// ResolveURI resolves ref against base, which may be a directory path or a
+// URI with a scheme.
+func ResolveURI(base, ref string) string {
+	if base == "" || URIScheme(ref) != "" || filepath.IsAbs(ref) {
+		return ref
+	}
+	if URIScheme(base) != "" {
+		b, err := url.Parse(strings.TrimSuffix(base, "/") + "/")
+		if err != nil {
+			return ref
+		}
+		r, err := url.Parse(ref)
+		if err != nil {
+			return ref
+		}
+		return b.ResolveReference(r).String()
+	}
+	return filepath.Join(base, ref)
+}
+
+type FileResolver struct{}
+
+func (FileResolver) Open(uri string) (io.ReadCloser, error) {
+	p, err := filePath(uri)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+// filePath is the local path of a plain path or file: URI.
+func filePath(uri string) (string, error) {
+	if URIScheme(uri) != "file" {
+		return uri, nil
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	return filepath.FromSlash(u.Path), nil
+}
+
+type HTTPResolver struct {
+	Client *http.Client
+	// Allow, when set, is asked about the target of every redirect the
+	// client would follow; an error ends the request with it.
+	Allow func(uri string) error
+}
+
+func (h HTTPResolver) Open(uri string) (io.ReadCloser, error) {
+	client := h.client()
+	resp, err := client.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", uri, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// client is Client, or http.DefaultClient, checking redirects with Allow.
+func (h HTTPResolver) client() *http.Client {
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if h.Allow == nil {
+		return client
+	}
+	checked := *client
+	check := client.CheckRedirect
+	checked.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if err := h.Allow(req.URL.String()); err != nil {
+			return err
+		}
+		if check != nil {
+			return check(req, via)
+		}
+		if len(via) >= 10 {
+			return fmt.Errorf("stopped after 10 redirects")
+		}
+		return nil
+	}
+	return &checked
+}
+
+// FSResolver serves relative references from an fs.FS (a bundle or an
+// embed.FS) and delegates everything else to Next.
+type FSResolver struct {
+	FS   fs.FS
+	Dir  string
+	Next Resolver
+}
+
+func (r FSResolver) Open(uri string) (io.ReadCloser, error) {
+	if URIScheme(uri) == "" && !filepath.IsAbs(uri) {
+		name := path.Clean(path.Join(r.Dir, filepath.ToSlash(uri)))
+		if f, err := r.FS.Open(name); err == nil {
+			return f, nil
+		}
+	}
+	next := r.Next
+	if next == nil {
+		next = DefaultResolvers
+	}
+	return next.Open(uri)
+}
+
+// RestrictedResolver opens the URIs it allows with Next (DefaultResolvers
+// when nil) and refuses the others: local files only when Files is set,
+// and then only below one of Dirs unless Dirs is nil; other URIs only when
+// their host is one of Hosts, "*.x" matching the subdomains of x, or any
+// host when Hosts is nil.
+type RestrictedResolver struct {
+	Next  Resolver
+	Files bool
+	Dirs  []string
+	Hosts []string
+}
+
+func (r RestrictedResolver) Open(uri string) (io.ReadCloser, error) {
+	next, err := r.next(uri)
+	if err != nil {
+		return nil, err
+	}
+	return next.Open(uri)
+}
+
+// next is the resolver that opens uri once Allow has accepted it. With
+// Hosts, an HTTPResolver, also when registered in Resolvers, checks
+// redirects as uri was, so that an allowed host cannot send the request on
+// to another.
+func (r RestrictedResolver) next(uri string) (Resolver, error) {
+	if err := r.Allow(uri); err != nil {
+		return nil, err
+	}
+	next := r.Next
+	if next == nil {
+		next = DefaultResolvers
+	}
+	if r.Hosts == nil {
+		return next, nil
+	}
+	if rs, ok := next.(*Resolvers); ok {
+		res, err := rs.resolver(uri)
+		if err != nil {
+			return nil, err
+		}
+		next = res
+	}
+	if h, ok := next.(HTTPResolver); ok {
+		allow := h.Allow
+		h.Allow = func(target string) error {
+			if allow != nil {
+				if err := allow(target); err != nil {
+					return err
+				}
+			}
+			return r.Allow(target)
+		}
+		next = h
+	}
+	return next, nil
+}
+
+// Allow reports why uri may not be opened, or nil if it may.
+func (r RestrictedResolver) Allow(uri string) error {
+	scheme := URIScheme(uri)
+	if scheme == "" || scheme == "file" {
+		if !r.Files {
+			return fmt.Errorf("reading files is not allowed")
+		}
+		if r.Dirs == nil {
+			return nil
+		}
+		p, err := filePath(uri)
+		if err != nil {
+			return err
+		}
+		if p, err = realPath(p); err != nil {
+			return err
+		}
+		for _, dir := range r.Dirs {
+			dir, err := realPath(dir)
+			if err != nil {
+				continue
+			}
+			if rel, err := filepath.Rel(dir, p); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return nil
+			}
+		}
+		return fmt.Errorf("reading %s is not allowed", p)
+	}
+	if r.Hosts == nil {
+		return nil
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range r.Hosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("host %q is not allowed", host)
+}
+
+// realPath is the absolute path of p with symbolic links resolved, so that
+// a link below an allowed directory cannot lead out of it. For a path that
+// does not exist, the links of its directory are resolved.
+func realPath(p string) (string, error) {
+	p, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	if real, err := filepath.EvalSymlinks(p); err == nil {
+		return real, nil
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(p))
+	if err != nil {
+		return p, nil
+	}
+	return filepath.Join(dir, filepath.Base(p)), nil
+}
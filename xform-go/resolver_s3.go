@@ -0,0 +1,157 @@
+//go:build s3
+
+package xform
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// S3Resolver fetches s3://bucket/key URIs with SigV4-signed GET requests.
+// Credentials and region come from the standard AWS_* environment variables;
+// AWS_ENDPOINT_URL switches to path-style requests against S3-compatible
+// stores such as MinIO. Build with -tags s3 to register it.
+type S3Resolver struct {
+	Client       *http.Client
+	Region       string
+	Endpoint     string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+func init() {
+	RegisterResolver("s3", NewS3ResolverFromEnv())
+}
+
+func NewS3ResolverFromEnv() *S3Resolver {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3Resolver{
+		Client:       &http.Client{Timeout: 60 * time.Second},
+		Region:       region,
+		Endpoint:     os.Getenv("AWS_ENDPOINT_URL"),
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+func (s *S3Resolver) Open(uri string) (io.ReadCloser, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	bucket := u.Host
+	key := strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("invalid s3 uri %s", uri)
+	}
+	var host, path, scheme string
+	if s.Endpoint != "" {
+		ep, err := url.Parse(s.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		scheme, host = ep.Scheme, ep.Host
+		path = "/" + s3Escape(bucket) + "/" + s3EscapePath(key)
+	} else {
+		scheme = "https"
+		host = bucket + ".s3." + s.Region + ".amazonaws.com"
+		path = "/" + s3EscapePath(key)
+	}
+	req, err := http.NewRequest(http.MethodGet, scheme+"://"+host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawPath = path
+	if s.AccessKey != "" {
+		s.sign(req, host, path, time.Now().UTC())
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", uri, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (s *S3Resolver) sign(req *http.Request, host, path string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", emptyPayloadHash)
+	headers := []string{"host:" + host, "x-amz-content-sha256:" + emptyPayloadHash, "x-amz-date:" + amzDate}
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	if s.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.SessionToken)
+		headers = append(headers, "x-amz-security-token:"+s.SessionToken)
+		signed += ";x-amz-security-token"
+	}
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		path,
+		"",
+		strings.Join(headers, "\n") + "\n",
+		signed,
+		emptyPayloadHash,
+	}, "\n")
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+", SignedHeaders="+signed+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func s3EscapePath(key string) string {
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		parts[i] = s3Escape(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+func s3Escape(s string) string {
+	out := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			out.WriteByte(c)
+		} else {
+			fmt.Fprintf(out, "%%%02X", c)
+		}
+	}
+	return out.String()
+}
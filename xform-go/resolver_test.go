@@ -0,0 +1,109 @@
+package xform
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRestrictedResolverRedirects(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "<secret/>")
+	}))
+	defer other.Close()
+	elsewhere := strings.Replace(other.URL, "127.0.0.1", "localhost", 1)
+	allowed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/away":
+			http.Redirect(w, r, elsewhere+"/", http.StatusFound)
+		case "/here":
+			http.Redirect(w, r, "/doc", http.StatusFound)
+		default:
+			io.WriteString(w, "<doc/>")
+		}
+	}))
+	defer allowed.Close()
+	r := RestrictedResolver{Hosts: []string{"127.0.0.1"}}
+
+	f, err := r.Open(allowed.URL + "/here")
+	if err != nil {
+		t.Fatalf("redirect to the same host: %v", err)
+	}
+	body, _ := io.ReadAll(f)
+	f.Close()
+	if string(body) != "<doc/>" {
+		t.Errorf("redirect to the same host read %q", body)
+	}
+	if f, err := r.Open(allowed.URL + "/away"); err == nil {
+		f.Close()
+		t.Fatal("redirect to another host was followed")
+	} else if !strings.Contains(err.Error(), `host "localhost" is not allowed`) {
+		t.Errorf("redirect error = %v", err)
+	}
+	if _, err := r.Version(allowed.URL + "/away"); err == nil {
+		t.Error("HEAD redirect to another host was followed")
+	}
+}
+
+func TestRestrictedResolverSymlinks(t *testing.T) {
+	root := t.TempDir()
+	allowed := filepath.Join(root, "allowed")
+	if err := os.Mkdir(allowed, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	secret := filepath.Join(root, "secret.xml")
+	if err := os.WriteFile(secret, []byte("<secret/>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(allowed, "ok.xml"), []byte("<ok/>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(secret, filepath.Join(allowed, "link.xml")); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	if err := os.Symlink(root, filepath.Join(allowed, "up")); err != nil {
+		t.Fatal(err)
+	}
+	r := RestrictedResolver{Files: true, Dirs: []string{allowed}}
+	if err := r.Allow(filepath.Join(allowed, "ok.xml")); err != nil {
+		t.Errorf("file in an allowed directory: %v", err)
+	}
+	for _, p := range []string{"link.xml", "up/secret.xml", "up/missing.xml"} {
+		if err := r.Allow(filepath.Join(allowed, p)); err == nil {
+			t.Errorf("%s escapes the allowed directory but was allowed", p)
+		}
+	}
+}
+
+func TestCollectionRestricted(t *testing.T) {
+	root := t.TempDir()
+	for f, content := range map[string]string{"allowed/a.xml": "<a/>", "denied/b.xml": "<b/>"} {
+		p := filepath.Join(root, f)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := EvalOptions{Resolver: RestrictedResolver{Files: true, Dirs: []string{filepath.Join(root, "allowed")}}}
+	src := func(pattern string) string {
+		return `join(for d in collection("` + filepath.ToSlash(filepath.Join(root, pattern)) + `") return name(d/*), ",")`
+	}
+	if got := runWith(t, src("allowed"), "<r/>", opts); got != "a" {
+		t.Errorf("allowed collection = %q, want a", got)
+	}
+	if got := runWith(t, src("allowed/*.xml"), "<r/>", opts); got != "a" {
+		t.Errorf("allowed pattern = %q, want a", got)
+	}
+	for _, pattern := range []string{"denied", "denied/*.xml", "*/*.xml", "missing/*"} {
+		_, err := tryRun(src(pattern), "<r/>", opts)
+		if err == nil || !strings.Contains(err.Error(), "not allowed") {
+			t.Errorf("collection %s: err = %v, want a refusal", pattern, err)
+		}
+	}
+}
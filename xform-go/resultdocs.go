@@ -0,0 +1,100 @@
+package xform
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ResultWriter receives the documents a transform writes with
+// resultDocument(), serialized with the module's output declaration.
+// They are handed over in call order once the evaluation has succeeded, so
+// a failed evaluation writes none.
+type ResultWriter interface {
+	WriteResult(href string, data []byte) error
+}
+
+type ResultWriterFunc func(href string, data []byte) error
+
+func (f ResultWriterFunc) WriteResult(href string, data []byte) error { return f(href, data) }
+
+// DirResultWriter writes result documents to files below Dir, creating
+// directories as needed. hrefs are slash-separated relative paths; absolute
+// ones and ones leaving Dir are refused.
+type DirResultWriter struct {
+	Dir string
+}
+
+func (w DirResultWriter) WriteResult(href string, data []byte) error {
+	path, err := w.Path(href)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// Path returns the file href is written to.
+func (w DirResultWriter) Path(href string) (string, error) {
+	if href == "" || URIScheme(href) != "" || strings.HasPrefix(href, "/") || filepath.IsAbs(href) {
+		return "", fmt.Errorf("result document %q must be a relative path", href)
+	}
+	dir := w.Dir
+	if dir == "" {
+		dir = "."
+	}
+	rel := filepath.Clean(filepath.FromSlash(href))
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("result document %q is outside %s", href, dir)
+	}
+	return filepath.Join(dir, rel), nil
+}
+
+// resultDoc is a document written by resultDocument(), kept until the
+// evaluation has succeeded.
+type resultDoc struct {
+	href string
+	data []byte
+}
+
+// fnResultDocument serializes content as a separate output document named
+// href and returns the empty sequence.
+func fnResultDocument(args [][]any, ctx Context) []any {
+	if len(args) < 2 {
+		panic(fmt.Errorf("XFDY0002: resultDocument() expects an href and the content"))
+	}
+	rt := ctx.Runtime
+	if rt == nil || rt.Options.ResultDocuments == nil {
+		panic(fmt.Errorf("XFDY0010: resultDocument() is not enabled for this evaluation"))
+	}
+	href := ToString(args[0])
+	if href == "" {
+		panic(fmt.Errorf("XFDY0010: resultDocument() needs an href"))
+	}
+	for _, d := range rt.results {
+		if d.href == href {
+			panic(fmt.Errorf("XFDY0010: result document %s is written twice", href))
+		}
+	}
+	data, err := SerializeResultLimited(args[1], rt.output)
+	if err != nil {
+		panic(err)
+	}
+	rt.charge(int64(len(data)))
+	rt.results = append(rt.results, resultDoc{href: href, data: EncodeOutput(data, rt.output.Encoding)})
+	return []any{}
+}
+
+// writeResults hands the documents of resultDocument() to the writer once
+// the evaluation has succeeded.
+func (rt *Runtime) writeResults() {
+	for _, d := range rt.results {
+		if err := rt.Options.ResultDocuments.WriteResult(d.href, d.data); err != nil {
+			panic(fmt.Errorf("XFDY0010: cannot write result document %s: %v", d.href, err))
+		}
+	}
+	rt.results = nil
+}
@@ -0,0 +1,147 @@
+package xform
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// asciiFold maps Latin letters with diacritics and ligatures to ASCII.
+var asciiFold = map[rune]string{}
+
+func init() {
+	for base, chars := range map[string]string{
+		"a": "àáâãäåāăąǎǟǡȁȃȧ", "c": "çćĉċč", "d": "ďđ", "e": "èéêëēĕėęěȅȇȩ",
+		"g": "ĝğġģǧ", "h": "ĥħ", "i": "ìíîïĩīĭįıǐȉȋ", "j": "ĵ", "k": "ķǩ",
+		"l": "ĺļľŀł", "n": "ñńņňŉ", "o": "òóôõöøōŏőǒǫȍȏȯ", "r": "ŕŗřȑȓ",
+		"s": "śŝşšș", "t": "ţťŧț", "u": "ùúûüũūŭůűųǔǖǘǚǜȕȗ", "w": "ŵ",
+		"y": "ýÿŷ", "z": "źżž", "ss": "ß", "ae": "æǽ", "oe": "œ", "th": "þ",
+	} {
+		for _, r := range chars {
+			asciiFold[r] = base
+			asciiFold[unicode.ToUpper(r)] = strings.ToUpper(base)
+		}
+	}
+	asciiFold['ð'], asciiFold['Ð'] = "d", "D"
+}
+
+// Slugify turns s into a lowercase ASCII identifier made of letters, digits
+// and single hyphens, suitable for HTML anchors and file names. Latin
+// diacritics are folded (é -> e, ß -> ss); other characters act as
+// separators.
+func Slugify(s string) string {
+	b := &strings.Builder{}
+	pending := false
+	for _, r := range s {
+		chunk := ""
+		switch {
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			chunk = string(r)
+		case asciiFold[r] != "":
+			chunk = asciiFold[r]
+		}
+		if chunk == "" {
+			pending = b.Len() > 0
+			continue
+		}
+		if pending {
+			b.WriteByte('-')
+			pending = false
+		}
+		b.WriteString(strings.ToLower(chunk))
+	}
+	return b.String()
+}
+
+// Levenshtein returns the edit distance between a and b in user-perceived
+// characters (see Graphemes), so an accented letter or an emoji sequence is
+// one edit.
+func Levenshtein(a, b string) int {
+	ra, rb := Graphemes(a), Graphemes(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+var soundexCodes = map[rune]byte{
+	'b': '1', 'f': '1', 'p': '1', 'v': '1',
+	'c': '2', 'g': '2', 'j': '2', 'k': '2', 'q': '2', 's': '2', 'x': '2', 'z': '2',
+	'd': '3', 't': '3', 'l': '4', 'm': '5', 'n': '5', 'r': '6',
+}
+
+// Soundex returns the American Soundex code of s (e.g. "Robert" -> "R163"),
+// or "" when s contains no letters. Diacritics are folded first.
+func Soundex(s string) string {
+	letters := []rune{}
+	for _, r := range strings.ToLower(Slugify(s)) {
+		if r >= 'a' && r <= 'z' {
+			letters = append(letters, r)
+		}
+	}
+	if len(letters) == 0 {
+		return ""
+	}
+	out := []byte{byte(unicode.ToUpper(letters[0]))}
+	last := soundexCodes[letters[0]]
+	for _, r := range letters[1:] {
+		code, ok := soundexCodes[r]
+		switch {
+		case ok && code != last:
+			out = append(out, code)
+			last = code
+		case !ok && r != 'h' && r != 'w':
+			last = 0
+		}
+		if len(out) == 4 {
+			break
+		}
+	}
+	for len(out) < 4 {
+		out = append(out, '0')
+	}
+	return string(out)
+}
+
+func fnSlugify(args [][]any, _ Context) []any {
+	return []any{Slugify(ToString(firstOrEmpty(args)))}
+}
+
+func fnLevenshtein(args [][]any, _ Context) []any {
+	if len(args) < 2 {
+		panic(fmt.Errorf("XFDY0002: wrong arity"))
+	}
+	return []any{int64(Levenshtein(ToString(args[0]), ToString(args[1])))}
+}
+
+func fnSoundex(args [][]any, _ Context) []any {
+	return []any{Soundex(ToString(firstOrEmpty(args)))}
+}
+
+func fnSoundsLike(args [][]any, _ Context) []any {
+	if len(args) < 2 {
+		panic(fmt.Errorf("XFDY0002: wrong arity"))
+	}
+	a := Soundex(ToString(args[0]))
+	return []any{a != "" && a == Soundex(ToString(args[1]))}
+}
@@ -0,0 +1,272 @@
+package xform
+
+import (
+	"strconv"
+	"strings"
+)
+
+// RefsPack is the "refs" standard pack for footnotes and cross-references.
+// The first call against a document scans it once (ids, references in
+// document order) and caches the result for the rest of the evaluation, so
+// numbering by first reference works without a hand-written pre-pass.
+var RefsPack = &BuiltinPack{
+	Name: "refs",
+	Doc:  "Cross-reference resolution and numbering backed by a per-document reference index.",
+	Functions: map[string]PackFunction{
+		"resolveRef":  {Fn: fnRefsResolve, Params: []string{"idrefs"}, Doc: "Elements whose id is listed in the whitespace-separated idrefs (a leading # is ignored)."},
+		"collectRefs": {Fn: fnRefsCollect, Params: []string{"attrs?"}, Doc: "Referencing elements in document order; attrs overrides the reference attributes (default: linkend idref idrefs rid href target)."},
+		"referrers":   {Fn: fnRefsReferrers, Params: []string{"target", "attrs?"}, Doc: "Elements referencing target, in document order."},
+		"refNumber":   {Fn: fnRefsRefNumber, Params: []string{"target", "attrs?"}, Doc: "1-based number of target in order of first reference, or 0 when unreferenced."},
+		"number":      {Fn: fnRefsNumber, Params: []string{"node", "scope?"}, Doc: "1-based position among same-named elements, restarting inside the nearest ancestor named scope."},
+		"format":      {Fn: fnRefsFormat, Params: []string{"n", "style"}, Doc: "Formats n as 1, a, A, i, I or * (footnote symbols)."},
+	},
+}
+
+func init() {
+	RegisterPack(RefsPack)
+}
+
+var defaultRefAttrs = []string{"linkend", "idref", "idrefs", "rid", "href", "target"}
+
+type refIndex struct {
+	ids       map[string]*Node
+	refs      []*Node
+	referrers map[*Node][]*Node
+	number    map[*Node]int
+}
+
+func refAttrs(args [][]any, i int) []string {
+	if i < len(args) && len(args[i]) > 0 {
+		if fields := strings.Fields(ToString(args[i])); len(fields) > 0 {
+			return fields
+		}
+	}
+	return defaultRefAttrs
+}
+
+func refTargets(value string) []string {
+	out := []string{}
+	for _, f := range strings.Fields(value) {
+		if strings.Contains(f, "#") {
+			f = f[strings.Index(f, "#")+1:]
+		} else if strings.Contains(f, "/") || strings.Contains(f, ":") {
+			continue
+		}
+		if f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func idIndex(root *Node, rt *Runtime) map[string]*Node {
+	return refIndexFor(root, defaultRefAttrs, rt).ids
+}
+
+func refIndexFor(root *Node, attrs []string, rt *Runtime) *refIndex {
+	key := strings.Join(attrs, " ")
+	if rt != nil {
+		if idx, ok := rt.refIndexes[root][key]; ok {
+			return idx
+		}
+	}
+	idx := &refIndex{ids: map[string]*Node{}, referrers: map[*Node][]*Node{}, number: map[*Node]int{}}
+	all := IterDescendants(root)
+	for _, n := range all {
+		if n.Kind != "element" {
+			continue
+		}
+		for _, id := range nodeIDs(n, root.DTD, rt) {
+			if _, dup := idx.ids[id]; !dup {
+				idx.ids[id] = n
+			}
+		}
+	}
+	for _, n := range all {
+		if n.Kind != "element" {
+			continue
+		}
+		referenced := false
+		for _, a := range attrs {
+			v, ok := n.Attrs[a]
+			if !ok {
+				continue
+			}
+			if a == "href" && !strings.HasPrefix(v, "#") {
+				continue
+			}
+			for _, id := range refTargets(v) {
+				target, ok := idx.ids[id]
+				if !ok {
+					continue
+				}
+				referenced = true
+				idx.referrers[target] = append(idx.referrers[target], n)
+				if _, seen := idx.number[target]; !seen {
+					idx.number[target] = len(idx.number) + 1
+				}
+			}
+		}
+		if referenced {
+			idx.refs = append(idx.refs, n)
+		}
+	}
+	if rt != nil {
+		if rt.refIndexes == nil {
+			rt.refIndexes = map[*Node]map[string]*refIndex{}
+		}
+		if rt.refIndexes[root] == nil {
+			rt.refIndexes[root] = map[string]*refIndex{}
+		}
+		rt.refIndexes[root][key] = idx
+	}
+	return idx
+}
+
+func contextRoot(ctx Context) *Node {
+	if r := rootOf(ctx.ContextItem); len(r) > 0 {
+		return r[0].(*Node)
+	}
+	return nil
+}
+
+func nodeArg(args [][]any, i int) *Node {
+	if i < len(args) && len(args[i]) > 0 {
+		if n, ok := args[i][0].(*Node); ok {
+			return n
+		}
+	}
+	return nil
+}
+
+func fnRefsResolve(args [][]any, ctx Context) []any {
+	root := contextRoot(ctx)
+	out := []any{}
+	if root == nil || len(args) == 0 {
+		return out
+	}
+	ids := idIndex(root, ctx.Runtime)
+	for _, item := range args[0] {
+		for _, id := range refTargets(ToString([]any{item})) {
+			if n, ok := ids[id]; ok {
+				out = append(out, n)
+			}
+		}
+	}
+	return out
+}
+
+func fnRefsCollect(args [][]any, ctx Context) []any {
+	root := contextRoot(ctx)
+	out := []any{}
+	if root == nil {
+		return out
+	}
+	for _, n := range refIndexFor(root, refAttrs(args, 0), ctx.Runtime).refs {
+		out = append(out, n)
+	}
+	return out
+}
+
+func fnRefsReferrers(args [][]any, ctx Context) []any {
+	target := nodeArg(args, 0)
+	out := []any{}
+	if target == nil {
+		return out
+	}
+	root := rootOf(target)[0].(*Node)
+	for _, n := range refIndexFor(root, refAttrs(args, 1), ctx.Runtime).referrers[target] {
+		out = append(out, n)
+	}
+	return out
+}
+
+func fnRefsRefNumber(args [][]any, ctx Context) []any {
+	target := nodeArg(args, 0)
+	if target == nil {
+		return []any{int64(0)}
+	}
+	root := rootOf(target)[0].(*Node)
+	return []any{int64(refIndexFor(root, refAttrs(args, 1), ctx.Runtime).number[target])}
+}
+
+func fnRefsNumber(args [][]any, _ Context) []any {
+	node := nodeArg(args, 0)
+	if node == nil || node.Kind != "element" {
+		return []any{int64(0)}
+	}
+	scope := rootOf(node)[0].(*Node)
+	if len(args) > 1 && len(args[1]) > 0 {
+		name := ToString(args[1])
+		for p := node.Parent; p != nil; p = p.Parent {
+			if p.Kind == "element" && p.Name == name {
+				scope = p
+				break
+			}
+		}
+	}
+	count := 0
+	for _, n := range IterDescendants(scope) {
+		if n.Kind == "element" && n.Name == node.Name {
+			count++
+		}
+		if n == node {
+			return []any{int64(count)}
+		}
+	}
+	return []any{int64(0)}
+}
+
+var footnoteSymbols = []string{"*", "†", "‡", "§", "‖", "¶"}
+
+func fnRefsFormat(args [][]any, _ Context) []any {
+	n := 0
+	if len(args) > 0 {
+		n = int(ToNumber(args[0]))
+	}
+	style := "1"
+	if len(args) > 1 && len(args[1]) > 0 {
+		style = ToString(args[1])
+	}
+	return []any{formatNumberStyle(n, style)}
+}
+
+func formatNumberStyle(n int, style string) string {
+	if n <= 0 {
+		return strconv.Itoa(n)
+	}
+	switch style {
+	case "a", "A":
+		s := ""
+		for m := n; m > 0; m = (m - 1) / 26 {
+			s = string(rune('a'+(m-1)%26)) + s
+		}
+		if style == "A" {
+			s = strings.ToUpper(s)
+		}
+		return s
+	case "i", "I":
+		s := toRoman(n)
+		if style == "i" {
+			s = strings.ToLower(s)
+		}
+		return s
+	case "*":
+		sym := footnoteSymbols[(n-1)%len(footnoteSymbols)]
+		return strings.Repeat(sym, (n-1)/len(footnoteSymbols)+1)
+	}
+	return strconv.Itoa(n)
+}
+
+func toRoman(n int) string {
+	vals := []int{1000, 900, 500, 400, 100, 90, 50, 40, 10, 9, 5, 4, 1}
+	syms := []string{"M", "CM", "D", "CD", "C", "XC", "L", "XL", "X", "IX", "V", "IV", "I"}
+	b := &strings.Builder{}
+	for i, v := range vals {
+		for n >= v {
+			b.WriteString(syms[i])
+			n -= v
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,249 @@
+package xform
+
+import (
+	"strconv"
+)
+
+// TablePack is the "table" standard pack: logical-grid helpers for HTML
+// (table/tr/td/th) and CALS (table/tgroup/row/entry) tables.
+var TablePack = &BuiltinPack{
+	Name: "table",
+	Doc:  "HTML and CALS table helpers working on the logical cell grid.",
+	Functions: map[string]PackFunction{
+		"rows":           {Fn: fnTableRows, Params: []string{"table"}, Doc: "Row elements of the table in document order, across head, body and foot."},
+		"cells":          {Fn: fnTableCells, Params: []string{"row"}, Doc: "Cell elements (td, th or entry) of a row."},
+		"colCount":       {Fn: fnTableColCount, Params: []string{"table"}, Doc: "Number of logical columns, taking spans into account."},
+		"rowCount":       {Fn: fnTableRowCount, Params: []string{"table"}, Doc: "Number of logical rows."},
+		"cell":           {Fn: fnTableCell, Params: []string{"table", "row", "col"}, Doc: "The cell element covering the 1-based logical position, or empty."},
+		"normalizeSpans": {Fn: fnTableNormalizeSpans, Params: []string{"table"}, Doc: "A grid element with one cell per logical slot; slots covered by a span point back to their origin cell."},
+	},
+}
+
+func init() {
+	RegisterPack(TablePack)
+}
+
+type gridCell struct {
+	node             *Node
+	row, col         int
+	rowspan, colspan int
+}
+
+type tableGrid struct {
+	rows  int
+	cols  int
+	slots map[[2]int]*gridCell
+	cells []*gridCell
+}
+
+func tableRoot(n *Node) *Node {
+	if n.Name == "table" {
+		for _, c := range n.Children {
+			if c.Kind == "element" && c.Name == "tgroup" {
+				return c
+			}
+		}
+	}
+	return n
+}
+
+func tableRows(table *Node) []*Node {
+	out := []*Node{}
+	for _, c := range tableRoot(table).Children {
+		if c.Kind != "element" {
+			continue
+		}
+		switch c.Name {
+		case "tr", "row":
+			out = append(out, c)
+		case "thead", "tbody", "tfoot":
+			for _, r := range c.Children {
+				if r.Kind == "element" && (r.Name == "tr" || r.Name == "row") {
+					out = append(out, r)
+				}
+			}
+		}
+	}
+	return out
+}
+
+func rowCells(row *Node) []*Node {
+	out := []*Node{}
+	for _, c := range row.Children {
+		if c.Kind == "element" && (c.Name == "td" || c.Name == "th" || c.Name == "entry") {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func calsColumns(group *Node) map[string]int {
+	cols := map[string]int{}
+	next := 1
+	for _, c := range group.Children {
+		if c.Kind != "element" || c.Name != "colspec" {
+			continue
+		}
+		num := next
+		if v, err := strconv.Atoi(c.Attrs["colnum"]); err == nil && v > 0 {
+			num = v
+		}
+		if name := c.Attrs["colname"]; name != "" {
+			cols[name] = num
+		}
+		next = num + 1
+	}
+	return cols
+}
+
+func attrInt(n *Node, name string, def int) int {
+	if v, err := strconv.Atoi(n.Attrs[name]); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+func buildGrid(table *Node) *tableGrid {
+	root := tableRoot(table)
+	colnames := calsColumns(root)
+	g := &tableGrid{slots: map[[2]int]*gridCell{}}
+	rows := tableRows(table)
+	for r, row := range rows {
+		rowIdx := r + 1
+		col := 1
+		for _, cell := range rowCells(row) {
+			if name := cell.Attrs["namest"]; name != "" && colnames[name] > 0 {
+				col = colnames[name]
+			} else if name := cell.Attrs["colname"]; name != "" && colnames[name] > 0 {
+				col = colnames[name]
+			}
+			for g.slots[[2]int{rowIdx, col}] != nil {
+				col++
+			}
+			colspan := attrInt(cell, "colspan", 1)
+			if st, end := colnames[cell.Attrs["namest"]], colnames[cell.Attrs["nameend"]]; st > 0 && end >= st {
+				colspan = end - st + 1
+			}
+			rowspan := attrInt(cell, "rowspan", 1)
+			if v, err := strconv.Atoi(cell.Attrs["morerows"]); err == nil && v > 0 {
+				rowspan = v + 1
+			}
+			gc := &gridCell{node: cell, row: rowIdx, col: col, rowspan: rowspan, colspan: colspan}
+			g.cells = append(g.cells, gc)
+			for dr := 0; dr < rowspan; dr++ {
+				for dc := 0; dc < colspan; dc++ {
+					g.slots[[2]int{rowIdx + dr, col + dc}] = gc
+					if col+dc > g.cols {
+						g.cols = col + dc
+					}
+				}
+			}
+			col += colspan
+		}
+	}
+	g.rows = len(rows)
+	if v := attrInt(root, "cols", 0); v > g.cols {
+		g.cols = v
+	}
+	return g
+}
+
+func tableArg(args [][]any) *Node {
+	if len(args) == 0 || len(args[0]) == 0 {
+		return nil
+	}
+	if n, ok := args[0][0].(*Node); ok && n.Kind == "element" {
+		return n
+	}
+	return nil
+}
+
+func fnTableRows(args [][]any, _ Context) []any {
+	out := []any{}
+	if t := tableArg(args); t != nil {
+		for _, r := range tableRows(t) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func fnTableCells(args [][]any, _ Context) []any {
+	out := []any{}
+	if r := tableArg(args); r != nil {
+		for _, c := range rowCells(r) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func fnTableColCount(args [][]any, _ Context) []any {
+	t := tableArg(args)
+	if t == nil {
+		return []any{int64(0)}
+	}
+	return []any{int64(buildGrid(t).cols)}
+}
+
+func fnTableRowCount(args [][]any, _ Context) []any {
+	t := tableArg(args)
+	if t == nil {
+		return []any{int64(0)}
+	}
+	return []any{int64(buildGrid(t).rows)}
+}
+
+func fnTableCell(args [][]any, _ Context) []any {
+	t := tableArg(args)
+	if t == nil || len(args) < 3 {
+		return []any{}
+	}
+	g := buildGrid(t)
+	if gc := g.slots[[2]int{int(ToNumber(args[1])), int(ToNumber(args[2]))}]; gc != nil {
+		return []any{gc.node}
+	}
+	return []any{}
+}
+
+func fnTableNormalizeSpans(args [][]any, ctx Context) []any {
+	t := tableArg(args)
+	if t == nil {
+		return []any{}
+	}
+	g := buildGrid(t)
+	grid := &Node{Kind: "element", Name: "grid", Attrs: map[string]string{"rows": strconv.Itoa(g.rows), "cols": strconv.Itoa(g.cols)}, AttrOrder: []string{"rows", "cols"}}
+	ctx.Runtime.nodeCreated()
+	for r := 1; r <= g.rows; r++ {
+		row := &Node{Kind: "element", Name: "row", Attrs: map[string]string{"index": strconv.Itoa(r)}, AttrOrder: []string{"index"}, Parent: grid}
+		ctx.Runtime.nodeCreated()
+		grid.Children = append(grid.Children, row)
+		for c := 1; c <= g.cols; c++ {
+			cell := &Node{Kind: "element", Name: "cell", Attrs: map[string]string{"row": strconv.Itoa(r), "col": strconv.Itoa(c)}, AttrOrder: []string{"row", "col"}, Parent: row}
+			ctx.Runtime.nodeCreated()
+			row.Children = append(row.Children, cell)
+			gc := g.slots[[2]int{r, c}]
+			switch {
+			case gc == nil:
+				cell.Attrs["empty"] = "true"
+				cell.AttrOrder = append(cell.AttrOrder, "empty")
+			case gc.row == r && gc.col == c:
+				cell.Attrs["rowspan"] = strconv.Itoa(gc.rowspan)
+				cell.Attrs["colspan"] = strconv.Itoa(gc.colspan)
+				cell.Attrs["name"] = gc.node.Name
+				cell.AttrOrder = append(cell.AttrOrder, "rowspan", "colspan", "name")
+				for _, child := range gc.node.Children {
+					cp := DeepCopy(child, true)
+					cp.Parent = cell
+					cell.Children = append(cell.Children, cp)
+				}
+			default:
+				cell.Attrs["spanned"] = "true"
+				cell.Attrs["origin-row"] = strconv.Itoa(gc.row)
+				cell.Attrs["origin-col"] = strconv.Itoa(gc.col)
+				cell.AttrOrder = append(cell.AttrOrder, "spanned", "origin-row", "origin-col")
+			}
+		}
+	}
+	return []any{grid}
+}
@@ -0,0 +1,332 @@
+package xform
+
+import (
+	"strconv"
+	"strings"
+)
+
+// TocPack is the "toc" standard pack for tables of contents. Headings are
+// either named elements ranked by position in a list (h1..h6 by default) or,
+// with the section option, nested section elements and their title child.
+// Anchors and numbers are computed once per document and evaluation, so the
+// table of contents and the rendered headings agree on them.
+var TocPack = &BuiltinPack{
+	Name: "toc",
+	Doc:  "Tables of contents with generated anchors and hierarchical numbering.",
+	Functions: map[string]PackFunction{
+		"toc":      {Fn: fnTocToc, Params: []string{"doc?", "options?"}, Doc: "Nested ul (or ol) list of links to the headings of doc, down to the depth option."},
+		"headings": {Fn: fnTocHeadings, Params: []string{"doc?", "options?"}, Doc: "Heading (or section) elements of doc in document order, down to the depth option."},
+		"anchor":   {Fn: fnTocAnchor, Params: []string{"heading", "options?"}, Doc: "The heading's id, or a unique id generated from its text."},
+		"number":   {Fn: fnTocNumber, Params: []string{"heading", "options?"}, Doc: "Hierarchical number of the heading such as 2.1, formatted with the number option (default 1)."},
+	},
+}
+
+func init() {
+	RegisterPack(TocPack)
+}
+
+var defaultTocHeadings = []string{"h1", "h2", "h3", "h4", "h5", "h6"}
+
+type tocOptions struct {
+	depth    int
+	headings []string
+	section  string
+	title    string
+	number   string
+	list     string
+}
+
+type tocEntry struct {
+	node   *Node
+	text   string
+	level  int
+	depth  int
+	number []int
+	id     string
+}
+
+type tocIndex struct {
+	entries []*tocEntry
+	byNode  map[*Node]*tocEntry
+}
+
+// tocOptionsArg reads options from the attributes of an element such as
+// <toc depth="2" headings="h2 h3"/> or from a map.
+func tocOptionsArg(args [][]any, i int) tocOptions {
+	opts := tocOptions{depth: 3, headings: defaultTocHeadings, title: "title", list: "ul"}
+	get := func(string) (string, bool) { return "", false }
+	if i < len(args) && len(args[i]) > 0 {
+		switch v := args[i][0].(type) {
+		case *Node:
+			get = func(name string) (string, bool) {
+				s, ok := v.Attrs[name]
+				return s, ok
+			}
+		case map[string][]any:
+			get = func(name string) (string, bool) {
+				s, ok := v[name]
+				return ToString(s), ok
+			}
+		}
+	}
+	if s, ok := get("depth"); ok {
+		if n, err := strconv.Atoi(strings.TrimSpace(s)); err == nil {
+			opts.depth = n
+		}
+	}
+	if s, ok := get("headings"); ok && len(strings.Fields(s)) > 0 {
+		opts.headings = strings.Fields(s)
+	}
+	if s, ok := get("section"); ok {
+		opts.section = s
+	}
+	if s, ok := get("title"); ok && s != "" {
+		opts.title = s
+	}
+	if s, ok := get("number"); ok {
+		opts.number = s
+	}
+	if s, ok := get("list"); ok && s != "" {
+		opts.list = s
+	}
+	return opts
+}
+
+func (o tocOptions) key() string {
+	if o.section != "" {
+		return "section " + o.section + " " + o.title
+	}
+	return strings.Join(o.headings, " ")
+}
+
+func tocIndexFor(root *Node, opts tocOptions, rt *Runtime) *tocIndex {
+	key := opts.key()
+	if rt != nil {
+		if idx, ok := rt.tocIndexes[root][key]; ok {
+			return idx
+		}
+	}
+	idx := &tocIndex{byNode: map[*Node]*tocEntry{}}
+	for _, n := range IterDescendants(root) {
+		if n.Kind != "element" {
+			continue
+		}
+		if e := tocEntryFor(n, opts); e != nil {
+			idx.entries = append(idx.entries, e)
+			idx.byNode[n] = e
+		}
+	}
+	type frame struct{ level, count int }
+	frames := []frame{}
+	for _, e := range idx.entries {
+		if len(frames) == 0 {
+			frames = append(frames, frame{level: e.level})
+		}
+		for len(frames) > 1 && frames[len(frames)-1].level > e.level {
+			frames = frames[:len(frames)-1]
+		}
+		if frames[len(frames)-1].level < e.level {
+			frames = append(frames, frame{level: e.level})
+		}
+		frames[len(frames)-1].count++
+		e.depth = len(frames)
+		for _, f := range frames {
+			e.number = append(e.number, f.count)
+		}
+	}
+	used := map[string]bool{}
+	for id := range idIndex(root, rt) {
+		used[id] = true
+	}
+	for _, e := range idx.entries {
+		if ids := nodeIDs(e.node, root.DTD, rt); len(ids) > 0 && ids[0] != "" {
+			e.id = ids[0]
+			continue
+		}
+		base := Slugify(e.text)
+		if base == "" {
+			base = "section-" + joinNumber(e.number, "1", "-")
+		}
+		id := base
+		for n := 2; used[id]; n++ {
+			id = base + "-" + strconv.Itoa(n)
+		}
+		used[id] = true
+		e.id = id
+	}
+	if rt != nil {
+		if rt.tocIndexes == nil {
+			rt.tocIndexes = map[*Node]map[string]*tocIndex{}
+		}
+		if rt.tocIndexes[root] == nil {
+			rt.tocIndexes[root] = map[string]*tocIndex{}
+		}
+		rt.tocIndexes[root][key] = idx
+	}
+	return idx
+}
+
+func tocEntryFor(n *Node, opts tocOptions) *tocEntry {
+	if opts.section == "" {
+		for i, name := range opts.headings {
+			if n.Name == name {
+				return &tocEntry{node: n, text: strings.Join(strings.Fields(n.StringValue()), " "), level: i + 1}
+			}
+		}
+		return nil
+	}
+	if n.Name != opts.section {
+		return nil
+	}
+	for _, c := range n.Children {
+		if c.Kind == "element" && c.Name == opts.title {
+			level := 1
+			for p := n.Parent; p != nil; p = p.Parent {
+				if p.Kind == "element" && p.Name == opts.section {
+					level++
+				}
+			}
+			return &tocEntry{node: n, text: strings.Join(strings.Fields(c.StringValue()), " "), level: level}
+		}
+	}
+	return nil
+}
+
+func joinNumber(number []int, style, sep string) string {
+	parts := make([]string, len(number))
+	for i, n := range number {
+		parts[i] = formatNumberStyle(n, style)
+	}
+	return strings.Join(parts, sep)
+}
+
+// tocScope returns the entries of the headings inside scope that lie within
+// the depth option, counted from the shallowest of them.
+func tocScope(args [][]any, ctx Context) ([]*tocEntry, tocOptions) {
+	scope := contextRoot(ctx)
+	if n := nodeArg(args, 0); n != nil {
+		scope = n
+	}
+	opts := tocOptionsArg(args, 1)
+	if scope == nil {
+		return nil, opts
+	}
+	inside := []*tocEntry{}
+	top := 0
+	for _, e := range tocIndexFor(documentOf(scope), opts, ctx.Runtime).entries {
+		for p := e.node; p != nil; p = p.Parent {
+			if p == scope {
+				inside = append(inside, e)
+				if top == 0 || e.depth < top {
+					top = e.depth
+				}
+				break
+			}
+		}
+	}
+	out := []*tocEntry{}
+	for _, e := range inside {
+		if e.depth-top < opts.depth {
+			out = append(out, e)
+		}
+	}
+	return out, opts
+}
+
+func fnTocToc(args [][]any, ctx Context) []any {
+	entries, opts := tocScope(args, ctx)
+	rt := ctx.Runtime
+	elem := func(name string, parent *Node) *Node {
+		n := &Node{Kind: "element", Name: name, Attrs: map[string]string{}, Parent: parent}
+		rt.nodeCreated()
+		if parent != nil {
+			parent.Children = append(parent.Children, n)
+		}
+		return n
+	}
+	root := elem(opts.list, nil)
+	setAttr(root, "class", "toc")
+	if len(entries) == 0 {
+		return []any{root}
+	}
+	top := entries[0].depth
+	for _, e := range entries {
+		if e.depth < top {
+			top = e.depth
+		}
+	}
+	lists := []*Node{root}
+	for _, e := range entries {
+		d := e.depth - top + 1
+		for len(lists) > d {
+			lists = lists[:len(lists)-1]
+		}
+		for len(lists) < d {
+			parent := lists[len(lists)-1]
+			if len(parent.Children) > 0 {
+				parent = parent.Children[len(parent.Children)-1]
+			}
+			lists = append(lists, elem(opts.list, parent))
+		}
+		li := elem("li", lists[len(lists)-1])
+		a := elem("a", li)
+		setAttr(a, "href", "#"+e.id)
+		label := e.text
+		if opts.number != "" {
+			label = joinNumber(e.number, opts.number, ".") + " " + label
+		}
+		a.Children = append(a.Children, &Node{Kind: "text", Value: label, Attrs: map[string]string{}, Parent: a})
+		rt.nodeCreated()
+	}
+	return []any{root}
+}
+
+func fnTocHeadings(args [][]any, ctx Context) []any {
+	entries, _ := tocScope(args, ctx)
+	out := []any{}
+	for _, e := range entries {
+		out = append(out, e.node)
+	}
+	return out
+}
+
+// tocEntryArg finds the entry of a heading, or of the section whose title
+// is the given node.
+func tocEntryArg(args [][]any, ctx Context) (*tocEntry, tocOptions) {
+	opts := tocOptionsArg(args, 1)
+	n := nodeArg(args, 0)
+	if n == nil {
+		n, _ = ctx.ContextItem.(*Node)
+	}
+	if n == nil {
+		return nil, opts
+	}
+	idx := tocIndexFor(documentOf(n), opts, ctx.Runtime)
+	if e, ok := idx.byNode[n]; ok {
+		return e, opts
+	}
+	if n.Parent != nil && n.Name == opts.title {
+		return idx.byNode[n.Parent], opts
+	}
+	return nil, opts
+}
+
+func fnTocAnchor(args [][]any, ctx Context) []any {
+	e, _ := tocEntryArg(args, ctx)
+	if e == nil {
+		return []any{""}
+	}
+	return []any{e.id}
+}
+
+func fnTocNumber(args [][]any, ctx Context) []any {
+	e, opts := tocEntryArg(args, ctx)
+	if e == nil {
+		return []any{""}
+	}
+	style := opts.number
+	if style == "" {
+		style = "1"
+	}
+	return []any{joinNumber(e.number, style, ".")}
+}
@@ -0,0 +1,234 @@
+package xform
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// EvalModuleStreaming is EvalSelected for inputs too large to hold in
+// memory: the XML read from r is decoded incrementally and written to w,
+// and only the subtrees selected by path are built as trees and
+// transformed, one at a time, each as the single child of a document.
+//
+// The path must be streamable: absolute child and descendant steps with
+// name or * tests and no predicates, such as /catalog/item or //record.
+// Subtrees are serialized with ser; the rest of the input is copied as
+// compact XML, without comments, processing instructions or doctype, as
+// Serialize writes a parsed document.
+func EvalModuleStreaming(module *Module, r io.Reader, w io.Writer, path string, opts EvalOptions, ser SerializeOptions) error {
+	return evalStreaming(module, r, w, path, opts, ser, func(sub *Node) ([]any, error) { return EvalModuleWithOptions(module, sub, opts) })
+}
+
+// EvalStreaming is EvalModuleStreaming for the program's main module.
+func (p *Program) EvalStreaming(r io.Reader, w io.Writer, path string, opts EvalOptions, ser SerializeOptions) error {
+	return evalStreaming(p.Module, r, w, path, opts, ser, func(sub *Node) ([]any, error) { return p.Eval(sub, opts) })
+}
+
+// streamStep is a step of a streamable path; desc steps may skip levels.
+type streamStep struct {
+	desc bool
+	name string // "" for *
+}
+
+func parseStreamPath(path string) ([]streamStep, error) {
+	expr, err := parsePathSafe(path)
+	if err != nil {
+		return nil, err
+	}
+	invalid := fmt.Errorf("XFST0001: select path %q cannot be streamed (want absolute child and descendant steps without predicates, e.g. //record)", path)
+	pe, ok := expr.(PathExpr)
+	if !ok || (pe.Start.Kind != "root" && pe.Start.Kind != "desc_root") || len(pe.Steps) == 0 {
+		return nil, invalid
+	}
+	steps := make([]streamStep, len(pe.Steps))
+	for i, step := range pe.Steps {
+		if len(step.Predicates) > 0 || (step.Test.Kind != "name" && step.Test.Kind != "wildcard") {
+			return nil, invalid
+		}
+		switch step.Axis {
+		case "child":
+		case "desc", "desc_or_self":
+			steps[i].desc = true
+		default:
+			return nil, invalid
+		}
+		if step.Test.Kind == "name" {
+			steps[i].name = *step.Test.Name
+		}
+	}
+	return steps, nil
+}
+
+// streamMatches reports whether the open elements, outermost first, are
+// selected by steps[i:] placed from open[j] on.
+func streamMatches(steps []streamStep, i int, open []*Node, j int, rt *Runtime) bool {
+	if i == len(steps) {
+		return j == len(open)
+	}
+	for at := j; at < len(open); at++ {
+		if (steps[i].name == "" || rt.nameMatches(steps[i].name, open[at])) && streamMatches(steps, i+1, open, at+1, rt) {
+			return true
+		}
+		if !steps[i].desc {
+			break
+		}
+	}
+	return false
+}
+
+func evalStreaming(module *Module, r io.Reader, w io.Writer, path string, opts EvalOptions, ser SerializeOptions, eval func(*Node) ([]any, error)) (err error) {
+	steps, err := parseStreamPath(path)
+	if err != nil {
+		return err
+	}
+	rt := newRuntime(opts)
+	defer recoverError(&err, rt)
+	rt.bindModule(module)
+
+	if !opts.Parse.Fidelity {
+		r = &attrNormalizingReader{r: r}
+	}
+	decoder := xml.NewDecoder(r)
+	decoder.Entity = namedEntities
+	decoder.CharsetReader = streamCharsetReader
+	out := bufio.NewWriter(w)
+	// tb builds the selected subtrees; its document only holds the doctype,
+	// for the attribute types it declares.
+	tb := &treeBuilder{doc: &Node{Kind: "document", Attrs: map[string]string{}}, fidelity: opts.Parse.Fidelity, catalog: opts.Parse.Catalog}
+	if tb.catalog == nil {
+		tb.catalog = opts.Catalog
+	}
+	// open holds the start tags being copied, without children; pending
+	// is the last one while it is not known whether it is empty.
+	var open []*Node
+	pending := false
+	flush := func() {
+		if pending {
+			out.WriteString(">")
+			pending = false
+		}
+	}
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			flush()
+			var parent *Node
+			if len(open) > 0 {
+				parent = open[len(open)-1]
+			}
+			n := tb.element(t, parent)
+			if !streamMatches(steps, 0, append(open, n), 0, rt) {
+				writeStreamedStartTag(out, n)
+				open = append(open, n)
+				pending = true
+				continue
+			}
+			tb.stack = []*Node{n}
+			for len(tb.stack) > 0 {
+				tok, err := decoder.Token()
+				if err != nil {
+					if err == io.EOF {
+						err = io.ErrUnexpectedEOF
+					}
+					return err
+				}
+				tb.add(tok)
+			}
+			seq, err := eval(resultDocument([]any{n}, nil))
+			if err != nil {
+				return err
+			}
+			// The result is written inside the copied start tags, whose
+			// declarations are in scope for it.
+			inner := ser
+			for _, o := range open {
+				for k, v := range o.Attrs {
+					if isNamespaceDecl(k) {
+						inner.scope = &nsScope{prefix: declaredPrefix(k), uri: v, next: inner.scope}
+					}
+				}
+			}
+			out.WriteString(SerializeWith(resultDocument(seq, nil), inner))
+		case xml.EndElement:
+			if len(open) == 0 {
+				continue
+			}
+			n := open[len(open)-1]
+			open = open[:len(open)-1]
+			if pending {
+				out.WriteString("/>")
+				pending = false
+			} else {
+				out.WriteString("</" + n.Name + ">")
+			}
+		case xml.Directive:
+			if len(open) == 0 {
+				tb.add(t)
+				if tb.err != nil {
+					return tb.err
+				}
+			}
+		case xml.CharData:
+			if len(open) > 0 {
+				flush()
+				out.WriteString(escapeText(string(t)))
+			}
+		}
+	}
+	return out.Flush()
+}
+
+// writeStreamedStartTag writes the start tag of n without its closing '>'.
+// The tag is copied with its own namespace declarations, which are in
+// scope for the rest of the input.
+func writeStreamedStartTag(out *bufio.Writer, n *Node) {
+	out.WriteString("<" + n.Name)
+	for _, k := range n.AttrNames() {
+		out.WriteString(" " + k + "=\"" + escapeAttr(n.Attrs[k]) + "\"")
+	}
+}
+
+// streamCharsetReader accepts ISO-8859-1 input besides UTF-8, as
+// ParseXMLBytes does.
+func streamCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1":
+		return &latin1Reader{r: bufio.NewReader(input)}, nil
+	}
+	return nil, fmt.Errorf("unsupported input encoding %q", charset)
+}
+
+type latin1Reader struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func (l *latin1Reader) Read(p []byte) (int, error) {
+	for len(l.buf) < len(p) {
+		b, err := l.r.ReadByte()
+		if err != nil {
+			if len(l.buf) > 0 {
+				break
+			}
+			return 0, err
+		}
+		if b < 0x80 {
+			l.buf = append(l.buf, b)
+		} else {
+			l.buf = append(l.buf, 0xc0|b>>6, 0x80|b&0x3f)
+		}
+	}
+	n := copy(p, l.buf)
+	l.buf = l.buf[n:]
+	return n, nil
+}
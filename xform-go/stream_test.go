@@ -0,0 +1,40 @@
+package xform
+
+import (
+	"strings"
+	"testing"
+)
+
+func evalStreamed(t *testing.T, src, input, path string) string {
+	t.Helper()
+	prog, err := Compile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := prog.EvalStreaming(strings.NewReader(input), &out, path, EvalOptions{}, SerializeOptions{}); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return out.String()
+}
+
+func TestStreamNestedChildren(t *testing.T) {
+	input := `<export><record id="1"><f>x</f><g><h>y</h></g></record><other/><record id="2"><f>z</f></record></export>`
+	tests := []struct{ src, want string }{
+		{`/`, input},
+		{`<r n={string(/record/@id)}>{string(/record/f)}</r>`, `<export><r n="1">x</r><other/><r n="2">z</r></export>`},
+	}
+	for _, tt := range tests {
+		if got := evalStreamed(t, tt.src, input, "//record"); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestStreamDoctype(t *testing.T) {
+	input := `<!DOCTYPE export [<!ATTLIST record refs IDREFS #IMPLIED>]><export><record refs=" a   b "><f>x</f></record></export>`
+	want := `<export><record refs="a b"><f>x</f></record></export>`
+	if got := evalStreamed(t, `/`, input, "/export/record"); got != want {
+		t.Errorf("streamed = %q, want %q", got, want)
+	}
+}
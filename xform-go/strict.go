@@ -0,0 +1,245 @@
+package xform
+
+import (
+	"fmt"
+	"sort"
+)
+
+// CheckStrict reports the first reference to an undefined variable in
+// module. Outside strict mode such a name selects the child elements of the
+// context item, which hides typos; strict modules write child::name for
+// that instead. params are the externally supplied parameters. Evaluation
+// runs the check itself for modules declaring "strict;" and with
+// EvalOptions.Strict.
+func CheckStrict(module *Module, params map[string][]any) error {
+	globals := map[string]bool{}
+	for name := range module.Vars {
+		globals[name] = true
+	}
+	for name := range module.Functions {
+		globals[name] = true
+	}
+	for name := range params {
+		globals[name] = true
+	}
+	for _, phase := range module.Phases {
+		globals[phase.Name] = true
+	}
+	for _, param := range module.Params {
+		globals[param.Name] = true
+	}
+	c := &strictChecker{}
+	for _, param := range module.Params {
+		if param.Default != nil {
+			c.where = "parameter " + param.Name
+			c.expr(param.Default, globals)
+		}
+	}
+	names := make([]string, 0, len(module.Vars))
+	for name := range module.Vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c.where = "variable " + name
+		c.expr(module.Vars[name], globals)
+	}
+	names = names[:0]
+	for name := range module.Functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fn := module.Functions[name]
+		c.where = fmt.Sprintf("function %s (line %d)", name, fn.Line)
+		scope := extend(globals)
+		for _, param := range fn.Params {
+			if param.Default != nil {
+				c.expr(param.Default, globals)
+			}
+			scope[param.Name] = true
+		}
+		c.expr(fn.Body, scope)
+	}
+	rules := []RuleDef{}
+	names = names[:0]
+	for name := range module.Rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rules = append(rules, module.Rules[name]...)
+	}
+	for _, set := range module.Validations {
+		rules = append(rules, set.Rules...)
+	}
+	for _, rule := range rules {
+		c.where = fmt.Sprintf("rule %s (line %d)", rule.Name, rule.Line)
+		scope := extend(globals)
+		for _, name := range ruleVariables {
+			scope["$"+name] = true
+		}
+		patternVars(rule.Pattern, scope)
+		c.expr(rule.Body, scope)
+	}
+	for _, phase := range module.Phases {
+		c.where = "phase " + phase.Name
+		c.expr(phase.Expr, globals)
+	}
+	if module.Expr != nil {
+		c.where = "the module body"
+		c.expr(module.Expr, globals)
+	}
+	return c.err
+}
+
+type strictChecker struct {
+	where string
+	err   error
+}
+
+func extend(scope map[string]bool, names ...string) map[string]bool {
+	out := make(map[string]bool, len(scope)+len(names))
+	for k := range scope {
+		out[k] = true
+	}
+	for _, name := range names {
+		out[name] = true
+	}
+	return out
+}
+
+func patternVars(p Pattern, scope map[string]bool) {
+	if e, ok := p.(ElementPattern); ok {
+		if e.Var != nil {
+			scope[*e.Var] = true
+		}
+		if e.Child != nil {
+			patternVars(e.Child, scope)
+		}
+	}
+}
+
+func undefinedVariable(name string) error {
+	return fmt.Errorf("XFST0006: undefined variable $%s", name)
+}
+
+func (c *strictChecker) undefined(name string) {
+	if c.err == nil {
+		c.err = fmt.Errorf("XFST0006: undefined variable %s in %s (write child::%s to select child elements)", name, c.where, name)
+	}
+}
+
+func (c *strictChecker) expr(expr Expr, scope map[string]bool) {
+	if c.err != nil {
+		return
+	}
+	switch e := expr.(type) {
+	case VarRef:
+		if !scope[e.Name] && !(e.Explicit && scope["$"+e.Name]) {
+			c.undefined(e.Name)
+		}
+	case IfExpr:
+		c.expr(e.Cond, scope)
+		c.expr(e.ThenExpr, scope)
+		c.expr(e.ElseExpr, scope)
+	case LetExpr:
+		c.expr(e.Value, scope)
+		c.expr(e.Body, extend(scope, e.Name))
+	case ForExpr:
+		c.expr(e.Seq, scope)
+		inner := extend(scope, e.Name)
+		if e.Where != nil {
+			c.expr(e.Where, inner)
+		}
+		for _, k := range e.GroupBy {
+			c.expr(k.Expr, inner)
+		}
+		for _, k := range e.GroupBy {
+			inner = extend(inner, k.Name)
+		}
+		for _, k := range e.OrderBy {
+			c.expr(k.Expr, inner)
+		}
+		c.expr(e.Body, inner)
+	case TryExpr:
+		c.expr(e.Body, scope)
+		c.expr(e.Catch, extend(scope, e.Var))
+	case MatchExpr:
+		c.expr(e.Target, scope)
+		for _, mc := range e.Cases {
+			inner := extend(scope)
+			patternVars(mc.Pattern, inner)
+			c.expr(mc.Expr, inner)
+		}
+		if e.Default != nil {
+			c.expr(e.Default, scope)
+		}
+	case FunctionExpr:
+		inner := extend(scope)
+		for _, param := range e.Params {
+			if param.Default != nil {
+				c.expr(param.Default, scope)
+			}
+			inner[param.Name] = true
+		}
+		c.expr(e.Body, inner)
+	case FuncCall:
+		for _, arg := range e.Args {
+			c.expr(arg, scope)
+		}
+	case UnaryOp:
+		c.expr(e.Expr, scope)
+	case BinaryOp:
+		c.expr(e.Left, scope)
+		c.expr(e.Right, scope)
+	case PathExpr:
+		if e.Start.Kind == "var" && e.Start.Name != nil && !scope[*e.Start.Name] && !(e.Start.Explicit && scope["$"+*e.Start.Name]) {
+			c.undefined(*e.Start.Name)
+		}
+		for _, step := range e.Steps {
+			for _, pred := range step.Predicates {
+				c.expr(pred, scope)
+			}
+		}
+	case Constructor:
+		for _, a := range e.Attrs {
+			c.expr(a.Expr, scope)
+		}
+		for _, content := range e.Contents {
+			c.expr(content, scope)
+		}
+	case TextJoin:
+		if e.Sep != nil {
+			c.expr(e.Sep, scope)
+		}
+		c.expr(e.Expr, scope)
+	case Sequence:
+		for _, item := range e.Items {
+			c.expr(item, scope)
+		}
+	case MapConstructor:
+		for _, entry := range e.Entries {
+			c.expr(entry.Key, scope)
+			c.expr(entry.Value, scope)
+		}
+	case ArrayConstructor:
+		for _, item := range e.Items {
+			c.expr(item, scope)
+		}
+	case Lookup:
+		c.expr(e.Expr, scope)
+		c.expr(e.Key, scope)
+	case TextConstructor:
+		c.expr(e.Expr, scope)
+	case CommentConstructor:
+		c.expr(e.Expr, scope)
+	case PIConstructor:
+		c.expr(e.Name, scope)
+		c.expr(e.Expr, scope)
+	case DocumentConstructor:
+		c.expr(e.Expr, scope)
+	case Interp:
+		c.expr(e.Expr, scope)
+	}
+}
@@ -0,0 +1,160 @@
+package xform
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// The string functions count and slice text in grapheme clusters (see
+// Graphemes), so an accented letter or an emoji flag is one character.
+// Their string arguments take one item; an empty sequence is "".
+
+// stringArg returns the string value of args[i], "" when it is missing or
+// empty. A sequence of several items is an error, as in XPath.
+func stringArg(args [][]any, i int, fn string) string {
+	if i >= len(args) || len(args[i]) == 0 {
+		return ""
+	}
+	if len(args[i]) > 1 {
+		panic(fmt.Errorf("XFDY0002: %s() expects a single string, got a sequence of %d items (use join() or for)", fn, len(args[i])))
+	}
+	return ToString(args[i])
+}
+
+// contextStringArg is stringArg with the context item's string value as
+// the default, for stringLength() and normalizeSpace().
+func contextStringArg(args [][]any, ctx Context, fn string) string {
+	if len(args) == 0 {
+		if ctx.ContextItem == nil {
+			return ""
+		}
+		return ToString([]any{ctx.ContextItem})
+	}
+	return stringArg(args, 0, fn)
+}
+
+// xpathRound rounds half up, as XPath's round() and substring() do.
+func xpathRound(f float64) float64 {
+	return math.Floor(f + 0.5)
+}
+
+// fnSubstring is substring(s, start, length?): the characters of s from
+// position start (1-based), length of them or up to the end. Positions are
+// rounded, so substring("abc", 1.5) is "bc".
+func fnSubstring(args [][]any, _ Context) []any {
+	chars := Graphemes(stringArg(args, 0, "substring"))
+	if len(args) < 2 || len(args[1]) == 0 {
+		panic(fmt.Errorf("XFDY0002: substring() expects a start position"))
+	}
+	from := xpathRound(ToNumber(args[1]))
+	to := math.Inf(1)
+	if len(args) > 2 && len(args[2]) > 0 {
+		to = from + xpathRound(ToNumber(args[2]))
+	}
+	b := &strings.Builder{}
+	for i, c := range chars {
+		if pos := float64(i + 1); pos >= from && pos < to {
+			b.WriteString(c)
+		}
+	}
+	return []any{b.String()}
+}
+
+func fnStringLength(args [][]any, ctx Context) []any {
+	return []any{int64(len(Graphemes(contextStringArg(args, ctx, "stringLength"))))}
+}
+
+func fnContains(args [][]any, _ Context) []any {
+	return []any{strings.Contains(stringArg(args, 0, "contains"), stringArg(args, 1, "contains"))}
+}
+
+func fnStartsWith(args [][]any, _ Context) []any {
+	return []any{strings.HasPrefix(stringArg(args, 0, "startsWith"), stringArg(args, 1, "startsWith"))}
+}
+
+func fnEndsWith(args [][]any, _ Context) []any {
+	return []any{strings.HasSuffix(stringArg(args, 0, "endsWith"), stringArg(args, 1, "endsWith"))}
+}
+
+// fnNormalizeSpace is normalizeSpace(s?): s without leading and trailing
+// whitespace and with inner runs of whitespace replaced by one space.
+func fnNormalizeSpace(args [][]any, ctx Context) []any {
+	return []any{strings.Join(strings.Fields(contextStringArg(args, ctx, "normalizeSpace")), " ")}
+}
+
+func fnTrim(args [][]any, _ Context) []any {
+	return []any{strings.TrimSpace(stringArg(args, 0, "trim"))}
+}
+
+// fnSplit is split(s, separator): the parts of s between occurrences of
+// the literal separator (see tokenize() for patterns). An empty separator
+// splits s into characters; an empty s gives the empty sequence.
+func fnSplit(args [][]any, _ Context) []any {
+	s := stringArg(args, 0, "split")
+	out := []any{}
+	if s == "" {
+		return out
+	}
+	sep := stringArg(args, 1, "split")
+	parts := Graphemes(s)
+	if sep != "" {
+		parts = strings.Split(s, sep)
+	}
+	for _, p := range parts {
+		out = append(out, p)
+	}
+	return out
+}
+
+// fnJoin is join(seq, separator?): the string values of all items of seq,
+// separated by separator ("" by default).
+func fnJoin(args [][]any, _ Context) []any {
+	if len(args) == 0 {
+		return []any{""}
+	}
+	sep := stringArg(args, 1, "join")
+	parts := make([]string, len(args[0]))
+	for i, item := range args[0] {
+		parts[i] = ToString([]any{item})
+	}
+	return []any{strings.Join(parts, sep)}
+}
+
+func fnPadLeft(args [][]any, _ Context) []any {
+	s, pad := padding(args, "padLeft")
+	return []any{pad + s}
+}
+
+func fnPadRight(args [][]any, _ Context) []any {
+	s, pad := padding(args, "padRight")
+	return []any{s + pad}
+}
+
+// padding reads the arguments of padLeft/padRight(s, width, pad?) and
+// returns s and the padding that brings it to width characters: pad
+// (default " ") repeated and cut to fit. Strings already that wide are
+// not shortened.
+func padding(args [][]any, fn string) (string, string) {
+	s := stringArg(args, 0, fn)
+	if len(args) < 2 || len(args[1]) == 0 {
+		panic(fmt.Errorf("XFDY0002: %s() expects a width", fn))
+	}
+	pad := " "
+	if len(args) > 2 {
+		pad = stringArg(args, 2, fn)
+	}
+	missing := int(ToNumber(args[1])) - len(Graphemes(s))
+	if missing <= 0 {
+		return s, ""
+	}
+	if pad == "" {
+		panic(fmt.Errorf("XFDY0002: %s() needs a non-empty padding string", fn))
+	}
+	padChars := Graphemes(pad)
+	b := &strings.Builder{}
+	for i := 0; i < missing; i++ {
+		b.WriteString(padChars[i%len(padChars)])
+	}
+	return s, b.String()
+}
@@ -0,0 +1,72 @@
+package xform
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// Graphemes splits s into user-perceived characters: a base character with
+// the combining marks, variation selectors and emoji modifiers that follow
+// it, emoji joined by ZERO WIDTH JOINER, and pairs of regional indicators
+// (flags). It approximates Unicode extended grapheme clusters closely
+// enough for counting and slicing text in any script; CR LF is one
+// cluster. Invalid UTF-8 bytes are clusters of their own.
+func Graphemes(s string) []string {
+	out := []string{}
+	for len(s) > 0 {
+		n := graphemeLen(s)
+		out = append(out, s[:n])
+		s = s[n:]
+	}
+	return out
+}
+
+func graphemeLen(s string) int {
+	r, n := utf8.DecodeRuneInString(s)
+	if r == '\r' && len(s) > 1 && s[1] == '\n' {
+		return 2
+	}
+	regional := isRegionalIndicator(r)
+	for n < len(s) {
+		next, size := utf8.DecodeRuneInString(s[n:])
+		switch {
+		case isGraphemeExtend(next):
+			n += size
+		case next == 0x200D: // zero width joiner
+			n += size
+			if n < len(s) {
+				_, size = utf8.DecodeRuneInString(s[n:])
+				n += size
+			}
+		case regional && isRegionalIndicator(next):
+			n += size
+			regional = false
+		default:
+			return n
+		}
+	}
+	return n
+}
+
+func isGraphemeExtend(r rune) bool {
+	return unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc) ||
+		r >= 0xFE00 && r <= 0xFE0F || // variation selectors
+		r >= 0x1F3FB && r <= 0x1F3FF || // emoji skin tone modifiers
+		r >= 0xE0020 && r <= 0xE007F // emoji tag sequences
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a
+// character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,69 @@
+package xform
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGraphemes(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"abc", []string{"a", "b", "c"}},
+		{"日本語", []string{"日", "本", "語"}},
+		{"café", []string{"c", "a", "f", "é"}},
+		{"नमस्ते", []string{"न", "म", "स्", "ते"}},
+		{"👍🏽!", []string{"👍🏽", "!"}},
+		{"🇩🇪🇫🇷", []string{"🇩🇪", "🇫🇷"}},
+		{"👩‍💻x", []string{"👩‍💻", "x"}},
+		{"a\r\nb", []string{"a", "\r\n", "b"}},
+		{"", []string{}},
+	}
+	for _, tt := range tests {
+		got := Graphemes(tt.in)
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("Graphemes(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	if got := truncateUTF8("日本語", 4); got != "日" {
+		t.Errorf("truncateUTF8 = %q, want %q", got, "日")
+	}
+}
+
+func TestUnicodeStringFunctions(t *testing.T) {
+	tests := []struct{ src, want string }{
+		{`stringLength("日本語のテキスト")`, "8"},
+		{`stringLength("café")`, "4"},
+		{`stringLength("🇩🇪👍🏽")`, "2"},
+		{`substring("日本語のテキスト", 4, 1)`, "の"},
+		{`substring("Здравствуйте", 1, 6)`, "Здравс"},
+		{`substring("مرحبا بالعالم", 7)`, "بالعالم"},
+		{`substring("नमस्ते", 3)`, "स्ते"},
+		{`padLeft("日本", 4, "＊")`, "＊＊日本"},
+		{"levenshtein(\"caf\u00e9\", \"cafe\")", "1"},
+		{"levenshtein(\"cafe\u0301\", \"cafe\")", "1"},
+		{`levenshtein("Straße", "Strasse")`, "2"},
+	}
+	for _, tt := range tests {
+		if got := run(t, tt.src, "<r/>"); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestUnicodeNames(t *testing.T) {
+	tests := []struct{ src, input, want string }{
+		{`def grüße($名前) := concat("Hallo ", $名前); grüße("Welt")`, "<r/>", "Hallo Welt"},
+		{`<übersicht>{count(//項目)}</übersicht>`, "<r><項目/><項目/></r>", "<übersicht>2</übersicht>"},
+		{`let $καλημέρα := "γεια" in $καλημέρα`, "<r/>", "γεια"},
+	}
+	for _, tt := range tests {
+		if got := run(t, tt.src, tt.input); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package xform
+
+import "strings"
+
+// textWriter collects the pieces of a textJoin, writing the separator
+// between them.
+type textWriter struct {
+	b       strings.Builder
+	sep     string
+	written bool
+}
+
+func (w *textWriter) write(item any) {
+	if w.written {
+		w.b.WriteString(w.sep)
+	}
+	w.written = true
+	if n, ok := item.(*Node); ok {
+		w.b.WriteString(n.StringValue())
+		return
+	}
+	w.b.WriteString(ToString([]any{item}))
+}
+
+func evalTextJoin(e TextJoin, ctx Context) string {
+	w := &textWriter{}
+	if e.Sep != nil {
+		w.sep = ToString(evalExpr(e.Sep, ctx))
+	}
+	streamText(w, e.Expr, ctx)
+	return w.b.String()
+}
+
+// streamText writes the items of expr to w. for, let and if are walked
+// directly so each iteration's pieces go to the builder as they are
+// produced; other expressions are evaluated and written item by item.
+func streamText(w *textWriter, expr Expr, ctx Context) {
+	switch e := expr.(type) {
+	case ForExpr:
+		if len(e.GroupBy) > 0 || len(e.OrderBy) > 0 {
+			for _, item := range evalForClauses(e, ctx) {
+				w.write(item)
+			}
+			return
+		}
+		seq := evalExpr(e.Seq, ctx)
+		total := len(seq)
+		for idx, item := range seq {
+			newVars := copyVars(ctx.Variables)
+			newVars[e.Name] = []any{item}
+			pos := idx + 1
+			last := total
+			newCtx := Context{ContextItem: item, Variables: newVars, Functions: ctx.Functions, Rules: ctx.Rules, Position: &pos, Last: &last, Runtime: ctx.Runtime}
+			if e.Where != nil && !ToBoolean(evalExpr(e.Where, newCtx)) {
+				continue
+			}
+			streamText(w, e.Body, newCtx)
+		}
+	case LetExpr:
+		newVars := copyVars(ctx.Variables)
+		newVars[e.Name] = evalExpr(e.Value, ctx)
+		streamText(w, e.Body, Context{ContextItem: ctx.ContextItem, Variables: newVars, Functions: ctx.Functions, Rules: ctx.Rules, Position: ctx.Position, Last: ctx.Last, Runtime: ctx.Runtime})
+	case IfExpr:
+		if ToBoolean(evalExpr(e.Cond, ctx)) {
+			streamText(w, e.ThenExpr, ctx)
+		} else {
+			streamText(w, e.ElseExpr, ctx)
+		}
+	case FuncCall:
+		if e.Name == "seq" || e.Name == "concat" {
+			if _, user := ctx.Functions[e.Name]; !user {
+				for _, a := range e.Args {
+					streamText(w, a, ctx)
+				}
+				return
+			}
+		}
+		for _, item := range evalExpr(e, ctx) {
+			w.write(item)
+		}
+	default:
+		for _, item := range evalExpr(e, ctx) {
+			w.write(item)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package xform
+
+import "fmt"
+
+// Frame is an active rule or user function, as reported to a Tracer.
+type Frame struct {
+	Kind    string // "rule" or "function"
+	Name    string // rule set or function name
+	Line    int    // source line of the declaration
+	Pattern string // the matched pattern, for rules
+	Context Context
+}
+
+func (f *Frame) String() string {
+	if f.Kind == "rule" {
+		return fmt.Sprintf("rule %s match %s (line %d)", f.Name, f.Pattern, f.Line)
+	}
+	return fmt.Sprintf("function %s (line %d)", f.Name, f.Line)
+}
+
+// Tracer observes rule firings and user function calls. stack holds the
+// active frames, innermost last; Leave is called with the frame's result
+// before it is popped. Evaluation stops while a method runs, which is what
+// the debugger builds on.
+type Tracer interface {
+	Enter(stack []*Frame)
+	Leave(stack []*Frame, result []any)
+}
+
+func (rt *Runtime) tracing() bool {
+	return rt != nil && rt.Options.Tracer != nil
+}
+
+func (rt *Runtime) enter(f *Frame) {
+	rt.stack = append(rt.stack, f)
+	rt.Options.Tracer.Enter(rt.stack)
+}
+
+func (rt *Runtime) leave(result []any) {
+	rt.Options.Tracer.Leave(rt.stack, result)
+	rt.stack = rt.stack[:len(rt.stack)-1]
+}
+
+// EvalIn parses src as an expression and evaluates it in ctx, e.g. the
+// context of a Frame.
+func EvalIn(src string, ctx Context) (result []any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	p := NewParser(src)
+	expr := p.parseExpr()
+	if tok := p.lexer.Peek(); tok.Kind != TokEOF {
+		return nil, fmt.Errorf("XFST0001: unexpected token at %d", tok.Pos)
+	}
+	return evalExpr(expr, ctx), nil
+}
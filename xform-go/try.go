@@ -0,0 +1,71 @@
+package xform
+
+import (
+	"runtime"
+	"strings"
+)
+
+// evalTry evaluates try { body } catch $err { handler }: the body's result,
+// or, when the body raises a dynamic error, the handler's with $err bound
+// to a map of the error's code, message, line and column. Static errors
+// (XFST*), the memory, time and call depth limits and Go runtime panics
+// are not caught.
+func evalTry(e TryExpr, ctx Context) (result []any) {
+	rt := ctx.Runtime
+	depth := 0
+	if rt != nil {
+		depth = len(rt.stack)
+	}
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		xe, ok := caughtError(r, rt)
+		if !ok {
+			panic(r)
+		}
+		if rt != nil {
+			rt.stack = rt.stack[:depth]
+		}
+		vars := copyVars(ctx.Variables)
+		if e.Var != "" {
+			vars[e.Var] = []any{errorItem(xe)}
+		}
+		result = evalExpr(e.Catch, Context{ContextItem: ctx.ContextItem, Variables: vars, Functions: ctx.Functions, Rules: ctx.Rules, Position: ctx.Position, Last: ctx.Last, Runtime: rt})
+	}()
+	return evalExpr(e.Body, ctx)
+}
+
+// caughtError converts the panic r to the error try catches, or reports
+// false for panics that must end the evaluation.
+func caughtError(r any, rt *Runtime) (*XFormError, bool) {
+	err, ok := r.(error)
+	if !ok {
+		return nil, false
+	}
+	if _, ok := err.(runtime.Error); ok {
+		return nil, false
+	}
+	var pos Position
+	if rt != nil {
+		pos = rt.pos
+	}
+	xe := newXFormError(err, pos)
+	if strings.HasPrefix(xe.Code, "XFST") || xe.Code == "XFDY0007" || xe.Code == "XFDY0008" || xe.Code == "XFDY0011" {
+		return nil, false
+	}
+	return xe, true
+}
+
+// errorItem is the map bound by catch $err: $err/code, $err/message and,
+// when known, $err/line and $err/column. Errors of host functions have an
+// empty code.
+func errorItem(xe *XFormError) map[string][]any {
+	item := map[string][]any{"code": {xe.Code}, "message": {xe.Message}}
+	if xe.Pos.IsValid() {
+		item["line"] = []any{int64(xe.Pos.Line)}
+		item["column"] = []any{int64(xe.Pos.Column)}
+	}
+	return item
+}
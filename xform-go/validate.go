@@ -0,0 +1,152 @@
+package xform
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// SVRLNamespace is the namespace of the Schematron validation report
+// language used by Validate reports.
+const SVRLNamespace = "http://purl.oclc.org/dsdl/svrl"
+
+// Validate runs the validate rules of module against doc and returns an
+// SVRL-like report:
+//
+//	<svrl:schematron-output xmlns:svrl="..." failed="1">
+//	  <svrl:active-pattern name="checks"/>
+//	  <svrl:fired-rule context="&lt;order/&gt;"/>
+//	  <svrl:failed-assert location="/order[1]">
+//	    <svrl:text>total mismatch</svrl:text>
+//	  </svrl:failed-assert>
+//	</svrl:schematron-output>
+//
+// For every validate set, each node of doc in document order is checked by
+// the first rule of the set whose pattern matches it. Rule bodies report
+// through assert() and report(); other items they return are added as text.
+// Transformation rules, phases and the module body are not evaluated.
+func Validate(module *Module, doc *Node, opts EvalOptions) *Node {
+	rt := newRuntime(opts)
+	rt.bindModule(module)
+	ctx := moduleContext(module, doc, rt)
+	report := svrlElement("schematron-output", rt)
+	setAttr(report, "xmlns:svrl", SVRLNamespace)
+	nodes := append([]*Node{doc}, IterDescendants(doc)...)
+	for _, set := range module.Validations {
+		active := svrlElement("active-pattern", rt)
+		setAttr(active, "name", set.Name)
+		appendChild(report, active)
+		for _, n := range nodes {
+			for _, rule := range set.Rules {
+				ok, bindings := matchPattern(rule.Pattern, n, rt)
+				if !ok {
+					continue
+				}
+				fired := svrlElement("fired-rule", rt)
+				setAttr(fired, "context", patternString(rule.Pattern))
+				appendChild(report, fired)
+				vars := copyVars(ctx.Variables)
+				for k, v := range bindings {
+					vars[k] = v
+				}
+				ruleCtx := Context{ContextItem: n, Variables: vars, Functions: ctx.Functions, Rules: ctx.Rules, Runtime: rt}
+				for _, item := range evalExpr(rule.Body, ruleCtx) {
+					child, ok := item.(*Node)
+					if !ok {
+						child = &Node{Kind: "text", Value: ToString([]any{item}), Attrs: map[string]string{}}
+						rt.nodeCreated()
+					} else if child.Parent != nil {
+						child = DeepCopy(child, true)
+					}
+					appendChild(report, child)
+				}
+				break
+			}
+		}
+	}
+	setAttr(report, "failed", strconv.Itoa(FailedAsserts(report)))
+	return report
+}
+
+// Validate runs the validate rules of the program's main module.
+func (p *Program) Validate(doc *Node, opts EvalOptions) *Node {
+	if len(p.Packs) > 0 {
+		opts.Packs = append(append([]*BuiltinPack{}, p.Packs...), opts.Packs...)
+	}
+	return Validate(p.Module, doc, opts)
+}
+
+// FailedAsserts counts the failed-assert entries of a Validate report.
+func FailedAsserts(report *Node) int {
+	count := 0
+	for _, c := range report.Children {
+		if c.Kind == "element" && c.Name == "svrl:failed-assert" {
+			count++
+		}
+	}
+	return count
+}
+
+func svrlElement(name string, rt *Runtime) *Node {
+	rt.nodeCreated()
+	return &Node{Kind: "element", Name: "svrl:" + name, Namespace: SVRLNamespace, Attrs: map[string]string{}}
+}
+
+func appendChild(parent, child *Node) {
+	child.Parent = parent
+	parent.Children = append(parent.Children, child)
+}
+
+func patternString(p Pattern) string {
+	switch p := p.(type) {
+	case WildcardPattern:
+		return "_"
+	case AttributePattern:
+		return "@" + p.Name
+	case TypedPattern:
+		return p.Kind + "()"
+	case ElementPattern:
+		switch {
+		case p.Var != nil:
+			return "<" + p.Name + ">{" + *p.Var + "}</" + p.Name + ">"
+		case p.Child != nil:
+			return "<" + p.Name + ">" + patternString(p.Child) + "</" + p.Name + ">"
+		}
+		return "<" + p.Name + "/>"
+	}
+	return ""
+}
+
+// svrlResult builds a failed-assert or successful-report entry located at
+// the context item.
+func svrlResult(name string, args [][]any, ctx Context) []any {
+	if len(args) < 2 {
+		panic(fmt.Errorf("XFDY0002: %s() expects a condition and a message", name))
+	}
+	fire := ToBoolean(args[0])
+	if name == "assert" {
+		fire = !fire
+	}
+	if !fire {
+		return []any{}
+	}
+	kind := "successful-report"
+	if name == "assert" {
+		kind = "failed-assert"
+	}
+	out := svrlElement(kind, ctx.Runtime)
+	if n, ok := ctx.ContextItem.(*Node); ok {
+		setAttr(out, "location", NodePath(n))
+	}
+	msg := ""
+	for _, item := range args[1] {
+		msg += ToString([]any{item})
+	}
+	text := svrlElement("text", ctx.Runtime)
+	appendChild(text, &Node{Kind: "text", Value: msg, Attrs: map[string]string{}})
+	ctx.Runtime.nodeCreated()
+	appendChild(out, text)
+	return []any{out}
+}
+
+func fnAssert(args [][]any, ctx Context) []any { return svrlResult("assert", args, ctx) }
+func fnReport(args [][]any, ctx Context) []any { return svrlResult("report", args, ctx) }
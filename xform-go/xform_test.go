@@ -0,0 +1,56 @@
+package xform
+
+import (
+	"strings"
+	"testing"
+)
+
+// run compiles src, evaluates it against the document input and returns
+// the serialized result.
+func run(t *testing.T, src, input string) string {
+	t.Helper()
+	return runWith(t, src, input, EvalOptions{})
+}
+
+func runWith(t *testing.T, src, input string, opts EvalOptions) string {
+	t.Helper()
+	out, err := tryRun(src, input, opts)
+	if err != nil {
+		t.Fatalf("%s: %v", src, err)
+	}
+	return out
+}
+
+func tryRun(src, input string, opts EvalOptions) (string, error) {
+	prog, err := Compile(src)
+	if err != nil {
+		return "", err
+	}
+	doc, err := ParseXML(input)
+	if err != nil {
+		return "", err
+	}
+	result, err := prog.Eval(doc, opts)
+	if err != nil {
+		return "", err
+	}
+	return SerializeResult(result, SerializeOptions{}), nil
+}
+
+// runError evaluates src against input and returns the error it fails
+// with.
+func runError(t *testing.T, src, input string) error {
+	t.Helper()
+	out, err := tryRun(src, input, EvalOptions{})
+	if err == nil {
+		t.Fatalf("%s: got %q, want an error", src, out)
+	}
+	return err
+}
+
+func wantErrorCode(t *testing.T, err error, code string) {
+	t.Helper()
+	if !strings.Contains(err.Error(), code) {
+		t.Fatalf("got error %v, want %s", err, code)
+	}
+}
@@ -8,13 +8,20 @@ import (
 )
 
 type Node struct {
-	Kind      string
+	Kind string
+	// Name is the qualified name as written, prefix included; Namespace is
+	// the URI of an element's name.
 	Name      string
+	Namespace string
 	Value     string
 	Children  []*Node
 	Attrs     map[string]string
 	AttrOrder []string
 	Parent    *Node
+	DTD       *DTD
+	// ordinal is the node's number in document order when its tree was
+	// numbered as parsed, else 0; see numberNodes.
+	ordinal int
 }
 
 func (n *Node) StringValue() string {
@@ -32,15 +39,46 @@ func (n *Node) StringValue() string {
 	}
 }
 
+// ParseOptions control how XML is parsed.
+type ParseOptions struct {
+	// Fidelity keeps attribute values as written. By default they are
+	// normalized as the XML spec requires: a literal tab or line end reads
+	// as a space, and attributes the DTD declares with a type other than
+	// CDATA are trimmed, with runs of spaces collapsed.
+	Fidelity bool
+	// Catalog maps the system or public identifier of the doctype to a
+	// local copy of the external DTD subset, whose attribute declarations
+	// then count like those of the internal subset. External subsets are
+	// not read otherwise.
+	Catalog *Catalog
+	// Prolog keeps what surrounds the root element besides the doctype:
+	// the XML declaration, as a processing instruction named xml, other
+	// processing instructions, comments and the whitespace between them,
+	// so that the document serializes as it was written. Whitespace after
+	// the last of them is dropped.
+	Prolog bool
+}
+
 func ParseXML(text string) (*Node, error) {
 	return ParseXMLBytes([]byte(text))
 }
 
 func ParseXMLBytes(data []byte) (*Node, error) {
+	return ParseXMLBytesWith(data, ParseOptions{})
+}
+
+// ParseXMLBytesWith is ParseXMLBytes with options.
+func ParseXMLBytesWith(data []byte, opts ParseOptions) (*Node, error) {
 	text := normalizeXMLBytes(data)
+	if !opts.Fidelity {
+		text = normalizeAttributeText(text)
+	}
+	return parseDecoder(xml.NewDecoder(strings.NewReader(text)), opts)
+}
+
+func parseDecoder(decoder *xml.Decoder, opts ParseOptions) (*Node, error) {
 	doc := &Node{Kind: "document", Attrs: map[string]string{}}
-	decoder := xml.NewDecoder(strings.NewReader(text))
-	var stack []*Node
+	tb := &treeBuilder{doc: doc, fidelity: opts.Fidelity, catalog: opts.Catalog, prolog: opts.Prolog}
 	for {
 		tok, err := decoder.Token()
 		if err == io.EOF {
@@ -49,66 +87,152 @@ func ParseXMLBytes(data []byte) (*Node, error) {
 		if err != nil {
 			return nil, err
 		}
-		switch t := tok.(type) {
-		case xml.StartElement:
-			order := make([]string, 0, len(t.Attr))
-			n := &Node{Kind: "element", Name: t.Name.Local, Attrs: map[string]string{}}
-			for _, a := range t.Attr {
-				n.Attrs[a.Name.Local] = a.Value
-				order = append(order, a.Name.Local)
-			}
-			n.AttrOrder = order
-			if len(stack) == 0 {
-				n.Parent = doc
-				doc.Children = append(doc.Children, n)
-			} else {
-				parent := stack[len(stack)-1]
-				n.Parent = parent
-				parent.Children = append(parent.Children, n)
-			}
-			stack = append(stack, n)
-		case xml.EndElement:
-			if len(stack) > 0 {
-				stack = stack[:len(stack)-1]
-			}
-		case xml.CharData:
-			if len(stack) == 0 {
-				continue
-			}
-			txt := string(t)
-			n := &Node{Kind: "text", Value: txt, Attrs: map[string]string{}}
-			parent := stack[len(stack)-1]
-			n.Parent = parent
-			parent.Children = append(parent.Children, n)
-		case xml.Comment:
-			if len(stack) == 0 {
-				continue
-			}
-			n := &Node{Kind: "comment", Value: string(t), Attrs: map[string]string{}}
-			parent := stack[len(stack)-1]
-			n.Parent = parent
-			parent.Children = append(parent.Children, n)
-		case xml.ProcInst:
-			if len(stack) == 0 {
-				continue
-			}
-			n := &Node{Kind: "pi", Value: string(t.Inst), Attrs: map[string]string{}}
-			parent := stack[len(stack)-1]
-			n.Parent = parent
-			parent.Children = append(parent.Children, n)
+		tb.add(tok)
+		if tb.err != nil {
+			return nil, tb.err
 		}
 	}
+	for len(doc.Children) > 0 && doc.Children[len(doc.Children)-1].Kind == "text" {
+		doc.Children = doc.Children[:len(doc.Children)-1]
+	}
+	numberNodes(doc)
 	return doc, nil
 }
 
+// treeBuilder adds decoded tokens to a tree: below the open elements on
+// stack, or to doc at the top level, where only elements and the doctype
+// are kept unless prolog is set.
+type treeBuilder struct {
+	doc      *Node
+	stack    []*Node
+	fidelity bool     // see ParseOptions
+	catalog  *Catalog // see ParseOptions
+	prolog   bool     // see ParseOptions
+	err      error
+}
+
+func (tb *treeBuilder) add(tok xml.Token) {
+	var parent *Node
+	if len(tb.stack) > 0 {
+		parent = tb.stack[len(tb.stack)-1]
+	}
+	var n *Node
+	switch t := tok.(type) {
+	case xml.StartElement:
+		if parent == nil {
+			parent = tb.doc
+		}
+		n = tb.element(t, parent)
+		parent.Children = append(parent.Children, n)
+		tb.stack = append(tb.stack, n)
+		return
+	case xml.EndElement:
+		if len(tb.stack) > 0 {
+			tb.stack = tb.stack[:len(tb.stack)-1]
+		}
+		return
+	case xml.CharData:
+		n = &Node{Kind: "text", Value: string(t), Attrs: map[string]string{}}
+	case xml.Comment:
+		n = &Node{Kind: "comment", Value: string(t), Attrs: map[string]string{}}
+	case xml.ProcInst:
+		n = &Node{Kind: "pi", Name: t.Target, Value: string(t.Inst), Attrs: map[string]string{}}
+	case xml.Directive:
+		if d := strings.TrimSpace(string(t)); parent == nil && tb.doc != nil && strings.HasPrefix(d, "DOCTYPE") {
+			tb.doc.DTD = ParseDoctype(d)
+			if tb.catalog != nil {
+				tb.err = tb.doc.DTD.addExternalSubset(d, tb.catalog)
+			}
+		}
+		return
+	}
+	if parent == nil && tb.prolog {
+		parent = tb.doc
+	}
+	if n == nil || parent == nil {
+		return
+	}
+	n.Parent = parent
+	parent.Children = append(parent.Children, n)
+}
+
+// element is decodedElement with the tokenized attributes the doctype of
+// doc declares normalized, unless fidelity is set.
+func (tb *treeBuilder) element(t xml.StartElement, parent *Node) *Node {
+	n := decodedElement(t, parent)
+	if tb.doc == nil || tb.doc.DTD == nil || tb.fidelity {
+		return n
+	}
+	for _, name := range tb.doc.DTD.Tokenized[n.Name] {
+		if v, ok := n.Attrs[name]; ok {
+			n.Attrs[name] = normalizeTokenized(v)
+		}
+	}
+	return n
+}
+
+// decodedElement makes the element of a start tag. parent is set so that
+// prefixes resolve against the declarations in scope; the element is not
+// added to its children.
+func decodedElement(t xml.StartElement, parent *Node) *Node {
+	n := &Node{Kind: "element", Attrs: map[string]string{}, Parent: parent}
+	// Declarations first: the decoder has already resolved the prefixes of
+	// the names to URIs, which are mapped back to the prefixes in scope.
+	for _, a := range t.Attr {
+		if a.Name.Space == "xmlns" {
+			n.Attrs["xmlns:"+a.Name.Local] = a.Value
+		} else if a.Name.Space == "" && a.Name.Local == "xmlns" {
+			n.Attrs["xmlns"] = a.Value
+		}
+	}
+	n.Name, n.Namespace = decodedName(n, t.Name, true)
+	order := make([]string, 0, len(t.Attr))
+	for _, a := range t.Attr {
+		name, _ := decodedName(n, a.Name, false)
+		if _, dup := n.Attrs[name]; !dup || isNamespaceDecl(name) {
+			order = append(order, name)
+		}
+		n.Attrs[name] = a.Value
+	}
+	n.AttrOrder = order
+	return n
+}
+
+// decodedName turns a name from the decoder into a qualified name and
+// namespace URI. A prefix without declaration is kept as written, in no
+// namespace.
+func decodedName(n *Node, name xml.Name, element bool) (string, string) {
+	switch {
+	case name.Space == "":
+		return name.Local, ""
+	case name.Space == "xmlns":
+		return "xmlns:" + name.Local, ""
+	}
+	if prefix, ok := prefixFor(n, name.Space, element); ok {
+		if prefix == "" {
+			return name.Local, name.Space
+		}
+		return prefix + ":" + name.Local, name.Space
+	}
+	return name.Space + ":" + name.Local, ""
+}
+
+// DeepCopy copies node, and with recurse its subtree. Namespace
+// declarations of ancestors that the copy needs are added to it.
 func DeepCopy(node *Node, recurse bool) *Node {
-	copied := &Node{Kind: node.Kind, Name: node.Name, Value: node.Value, Attrs: map[string]string{}, AttrOrder: append([]string{}, node.AttrOrder...)}
+	copied := deepCopy(node, recurse)
+	fixupNamespaces(copied, node)
+	return copied
+}
+
+func deepCopy(node *Node, recurse bool) *Node {
+	copied := &Node{Kind: node.Kind, Name: node.Name, Namespace: node.Namespace, Value: node.Value, Attrs: map[string]string{}, AttrOrder: append([]string{}, node.AttrOrder...), DTD: node.DTD}
 	for k, v := range node.Attrs {
 		copied.Attrs[k] = v
 	}
 	if recurse {
 		for _, c := range node.Children {
-			child := DeepCopy(c, true)
+			child := deepCopy(c, true)
 			child.Parent = copied
 			copied.Children = append(copied.Children, child)
 		}
@@ -116,6 +240,49 @@ func DeepCopy(node *Node, recurse bool) *Node {
 	return copied
 }
 
+// AttrNames returns the attribute names of n in source (or construction)
+// order. Names missing from AttrOrder, as left by code that fills Attrs
+// directly, follow in sorted order so the result is always deterministic.
+func (n *Node) AttrNames() []string {
+	names := make([]string, 0, len(n.Attrs))
+	seen := make(map[string]bool, len(n.Attrs))
+	for _, k := range n.AttrOrder {
+		if _, ok := n.Attrs[k]; ok && !seen[k] {
+			seen[k] = true
+			names = append(names, k)
+		}
+	}
+	if len(names) == len(n.Attrs) {
+		return names
+	}
+	rest := []string{}
+	for k := range n.Attrs {
+		if !seen[k] {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+	return append(names, rest...)
+}
+
+// canonicalAttrNames orders attributes for SerializeOptions.SortAttributes:
+// namespace declarations first, then all others by name.
+func canonicalAttrNames(n *Node) []string {
+	names := n.AttrNames()
+	sort.SliceStable(names, func(i, j int) bool {
+		ni, nj := isNamespaceDecl(names[i]), isNamespaceDecl(names[j])
+		if ni != nj {
+			return ni
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+func isNamespaceDecl(name string) bool {
+	return name == "xmlns" || strings.HasPrefix(name, "xmlns:")
+}
+
 func IterDescendants(node *Node) []*Node {
 	out := []*Node{}
 	for _, child := range node.Children {
@@ -126,41 +293,84 @@ func IterDescendants(node *Node) []*Node {
 }
 
 func Serialize(item *Node) string {
+	b := &outputBuilder{}
+	writeNode(b, item, SerializeOptions{})
+	return b.String()
+}
+
+func writeNode(b *outputBuilder, item *Node, opts SerializeOptions) {
+	if item.Kind != "document" {
+		b.node()
+	}
 	switch item.Kind {
 	case "document":
-		out := ""
 		for _, c := range item.Children {
-			out += Serialize(c)
+			writeNode(b, c, opts)
 		}
-		return out
 	case "text":
-		return escapeText(item.Value)
-	case "attribute":
-		return escapeAttr(item.Value)
-	case "element":
-		attrs := ""
-		keys := item.AttrOrder
-		if len(keys) == 0 {
-			keys = make([]string, 0, len(item.Attrs))
-			for k := range item.Attrs {
-				keys = append(keys, k)
-			}
-			sort.Strings(keys)
+		if opts.Method == "html" && rawTextElement(item.Parent) {
+			b.WriteString(item.Value)
+		} else {
+			b.WriteString(escapeText(item.Value))
 		}
-		for _, k := range keys {
-			attrs += " " + k + "=\"" + escapeAttr(item.Attrs[k]) + "\""
+	case "attribute":
+		b.WriteString(escapeAttr(item.Value))
+	case "comment":
+		b.WriteString("<!--" + item.Value + "-->")
+	case "pi":
+		if item.Value == "" {
+			b.WriteString("<?" + item.Name + "?>")
+		} else {
+			b.WriteString("<?" + item.Name + " " + item.Value + "?>")
 		}
+	case "element":
+		inner := writeStartTag(b, item, opts)
 		if len(item.Children) == 0 {
-			return "<" + item.Name + attrs + "/>"
+			return
 		}
-		inner := ""
 		for _, c := range item.Children {
-			inner += Serialize(c)
+			writeNode(b, c, inner)
 		}
-		return "<" + item.Name + attrs + ">" + inner + "</" + item.Name + ">"
+		b.WriteString("</" + item.Name + ">")
+	}
+}
+
+// writeStartTag writes <name attrs> (or <name attrs/> for an empty element;
+// the html method writes <br> and <p></p> instead), declaring the
+// namespaces its names use that are not in scope yet. It returns the
+// options for the children.
+func writeStartTag(b *outputBuilder, item *Node, opts SerializeOptions) SerializeOptions {
+	names := item.AttrNames()
+	if opts.SortAttributes {
+		names = canonicalAttrNames(item)
+	}
+	src, annotated := item.Attrs[ProvenanceAttr]
+	if annotated && opts.ProvenanceComments {
+		b.WriteString("<!--" + provenanceCommentPrefix + strings.ReplaceAll(src, "--", "- -") + " -->")
+	}
+	b.WriteString("<" + item.Name)
+	decls, scope := namespaceFixup(item, opts.scope)
+	for _, d := range decls {
+		b.WriteString(" " + d[0] + "=\"" + escapeAttr(d[1]) + "\"")
+	}
+	opts.scope = scope
+	for _, k := range names {
+		if k == ProvenanceAttr && opts.ProvenanceComments {
+			continue
+		}
+		b.WriteString(" " + k + "=\"" + escapeAttr(item.Attrs[k]) + "\"")
+	}
+	switch {
+	case len(item.Children) > 0:
+		b.WriteString(">")
+	case opts.Method != "html":
+		b.WriteString("/>")
+	case htmlVoidElements[strings.ToLower(item.Name)]:
+		b.WriteString(">")
 	default:
-		return ""
+		b.WriteString("></" + item.Name + ">")
 	}
+	return opts
 }
 
 func escapeText(text string) string {
@@ -168,8 +378,10 @@ func escapeText(text string) string {
 	return replacer.Replace(text)
 }
 
+// escapeAttr also writes tabs and line ends as references, which
+// attribute-value normalization keeps when the output is parsed again.
 func escapeAttr(text string) string {
-	replacer := strings.NewReplacer("\"", "&quot;")
+	replacer := strings.NewReplacer("\"", "&quot;", "\t", "&#9;", "\n", "&#10;", "\r", "&#13;")
 	return replacer.Replace(escapeText(text))
 }
 
@@ -188,11 +400,117 @@ func normalizeXMLBytes(data []byte) string {
 	return replaceNamedEntities(text)
 }
 
+// namedEntities are the HTML entities accepted in XML input without a
+// declaration.
+var namedEntities = map[string]string{
+	"mdash":  "—",
+	"hellip": "…",
+	"nbsp":   "\u00a0",
+}
+
 func replaceNamedEntities(text string) string {
-	replacer := strings.NewReplacer(
-		"&mdash;", "—",
-		"&hellip;", "…",
-		"&nbsp;", "\u00a0",
-	)
-	return replacer.Replace(text)
+	pairs := make([]string, 0, 2*len(namedEntities))
+	for name, value := range namedEntities {
+		pairs = append(pairs, "&"+name+";", value)
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+type SerializeOptions struct {
+	Indent  string
+	Profile *Profile
+	// SortAttributes writes attributes in canonical order (namespace
+	// declarations first, then by name) instead of source order.
+	SortAttributes bool
+	// ProvenanceComments writes ProvenanceAttr annotations as comments
+	// before their element rather than as attributes.
+	ProvenanceComments bool
+	// Method is "xml" (also when empty), "html" or "text". See
+	// SerializeResult for the prolog and text output.
+	Method         string
+	DoctypeSystem  string
+	DoctypePublic  string
+	XMLDeclaration bool
+	// Encoding is the encoding the output is meant for: UTF-8 (also when
+	// empty), ISO-8859-1, windows-1252 or US-ASCII. Characters it lacks
+	// are written as character references, or as ? by the text method;
+	// EncodeOutput converts the result to its bytes.
+	Encoding string
+	// BOM starts a UTF-8 result with a byte order mark.
+	BOM bool
+	// Newline, when set, is written for every line end of the output, in
+	// text nodes too: "\n" or "\r\n".
+	Newline string
+	// Limit bounds the output. SerializeWith and SerializeResult cut it
+	// at the limit as with Truncate; SerializeResultLimited can fail
+	// instead.
+	Limit OutputLimit
+
+	scope *nsScope
+}
+
+// SerializeWith is Serialize with pretty-printing: element-only content is
+// indented, while mixed content, inline elements and whitespace-preserving
+// elements of the profile are written verbatim.
+func SerializeWith(item *Node, opts SerializeOptions) string {
+	opts.Limit.Truncate = true
+	out, _ := serialize(opts, func(b *outputBuilder) { writeTree(b, item, opts) })
+	return out
+}
+
+func writeTree(b *outputBuilder, item *Node, opts SerializeOptions) {
+	if opts.Indent == "" {
+		writeNode(b, item, opts)
+		return
+	}
+	writeIndented(b, item, 0, opts)
+}
+
+func writeIndented(b *outputBuilder, item *Node, depth int, opts SerializeOptions) {
+	switch item.Kind {
+	case "document":
+		first := true
+		for _, c := range item.Children {
+			if c.Kind == "text" && isWhitespace(c.Value) {
+				continue
+			}
+			if !first {
+				b.WriteString("\n")
+			}
+			first = false
+			writeIndented(b, c, depth, opts)
+		}
+	case "element":
+		if len(item.Children) == 0 || opts.Profile.IsPreserve(item.Name) || opts.Profile.IsInline(item.Name) || hasMixedContent(item, opts.Profile) {
+			writeNode(b, item, opts)
+			return
+		}
+		b.node()
+		inner := writeStartTag(b, item, opts)
+		for _, c := range item.Children {
+			if c.Kind == "text" && isWhitespace(c.Value) {
+				continue
+			}
+			b.WriteString("\n")
+			b.WriteString(strings.Repeat(opts.Indent, depth+1))
+			writeIndented(b, c, depth+1, inner)
+		}
+		b.WriteString("\n")
+		b.WriteString(strings.Repeat(opts.Indent, depth))
+		b.WriteString("</" + item.Name + ">")
+	default:
+		writeNode(b, item, opts)
+	}
+}
+
+func hasMixedContent(n *Node, p *Profile) bool {
+	for _, c := range n.Children {
+		if c.Kind == "text" && !isWhitespace(c.Value) {
+			return true
+		}
+		if c.Kind == "element" && p.IsInline(c.Name) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,65 @@
+package xform
+
+import "testing"
+
+const attrsXML = `<r><e z="1" a="2" xmlns:p="urn:p" m="3" p:q="4"/></r>`
+
+func TestAttributeOrderRoundTrip(t *testing.T) {
+	want := attrsXML
+	for i := 0; i < 3; i++ {
+		doc, err := ParseXML(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := Serialize(doc); got != attrsXML {
+			t.Fatalf("round trip %d = %q, want %q", i, got, attrsXML)
+		}
+	}
+}
+
+func TestAttributeOrderInTransforms(t *testing.T) {
+	tests := []struct{ src, want string }{
+		{`/r`, attrsXML},
+		{`for a in //e/@* return name(a)`, "zamp:q"},
+		{`copy(//e)`, `<e z="1" a="2" xmlns:p="urn:p" m="3" p:q="4"/>`},
+		{`<x b="1" a="2" b="3"/>`, `<x b="3" a="2"/>`},
+	}
+	for _, tt := range tests {
+		if got := run(t, tt.src, attrsXML); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestSortAttributes(t *testing.T) {
+	doc, err := ParseXML(attrsXML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<r><e xmlns:p="urn:p" a="2" m="3" p:q="4" z="1"/></r>`
+	if got := SerializeWith(doc, SerializeOptions{SortAttributes: true}); got != want {
+		t.Errorf("sorted = %q, want %q", got, want)
+	}
+	prog, err := Compile(`output sort-attributes "yes"; /r`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := prog.Eval(doc, EvalOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := SerializeResult(result, prog.Module.SerializeOptions()); got != want {
+		t.Errorf("output sort-attributes = %q, want %q", got, want)
+	}
+}
+
+func TestAttributesWithoutOrder(t *testing.T) {
+	n := &Node{Kind: "element", Name: "e", Attrs: map[string]string{"c": "3", "a": "1"}, AttrOrder: []string{"c"}}
+	n.Attrs["b"] = "2"
+	want := `<e c="3" a="1" b="2"/>`
+	for i := 0; i < 5; i++ {
+		if got := Serialize(n); got != want {
+			t.Fatalf("Serialize = %q, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,851 @@
+package xform
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+)
+
+// A Zstandard (RFC 8878) decoder, so that .zst inputs read the same for
+// embedders as for the command line without a third-party package or the
+// zstd executable. Frames with a dictionary are not supported.
+
+var errZstdCorrupt = errors.New("zstd: corrupt input")
+
+const (
+	zstdMagic          = 0xFD2FB528
+	zstdSkippableMagic = 0x184D2A50 // to 0x184D2A5F
+	zstdMaxAccuracyLL  = 9
+	zstdMaxAccuracyML  = 9
+	zstdMaxAccuracyOF  = 8
+	zstdMaxHuffmanBits = 11
+)
+
+func unzstd(r io.Reader) (io.Reader, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	out, err := decodeZstd(data)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(out), nil
+}
+
+// decodeZstd decodes the frames of data in turn, skipping skippable ones.
+func decodeZstd(data []byte) ([]byte, error) {
+	out := []byte{}
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, errZstdCorrupt
+		}
+		magic := binary.LittleEndian.Uint32(data)
+		if magic&0xFFFFFFF0 == zstdSkippableMagic {
+			if len(data) < 8 {
+				return nil, errZstdCorrupt
+			}
+			size := int64(binary.LittleEndian.Uint32(data[4:]))
+			if int64(len(data)-8) < size {
+				return nil, errZstdCorrupt
+			}
+			data = data[8+size:]
+			continue
+		}
+		if magic != zstdMagic {
+			return nil, errors.New("zstd: not a Zstandard frame")
+		}
+		d := &zstdFrame{}
+		rest, err := d.decode(data[4:], out)
+		if err != nil {
+			return nil, err
+		}
+		out = d.out
+		data = rest
+	}
+	return out, nil
+}
+
+// zstdFrame holds the state that carries over between the blocks of a
+// frame: the output so far, which matches refer back into, the repeat
+// offsets and the tables a block may repeat.
+type zstdFrame struct {
+	out      []byte
+	start    int // of the frame's output in out
+	rep      [3]int
+	huffman  *huffmanTable
+	ll, ml   *fseTable
+	of       *fseTable
+	literals []byte
+}
+
+func (d *zstdFrame) decode(data []byte, out []byte) ([]byte, error) {
+	if len(data) < 1 {
+		return nil, errZstdCorrupt
+	}
+	desc := data[0]
+	data = data[1:]
+	fcsFlag := desc >> 6
+	single := desc&0x20 != 0
+	checksum := desc&0x04 != 0
+	if desc&0x08 != 0 {
+		return nil, errZstdCorrupt
+	}
+	if !single {
+		if len(data) < 1 {
+			return nil, errZstdCorrupt
+		}
+		data = data[1:] // window descriptor: the whole output is kept
+	}
+	dictSize := [4]int{0, 1, 2, 4}[desc&0x03]
+	if len(data) < dictSize {
+		return nil, errZstdCorrupt
+	}
+	for _, b := range data[:dictSize] {
+		if b != 0 {
+			return nil, errors.New("zstd: frames with a dictionary are not supported")
+		}
+	}
+	data = data[dictSize:]
+	fcsSize := [4]int{0, 2, 4, 8}[fcsFlag]
+	if fcsFlag == 0 && single {
+		fcsSize = 1
+	}
+	if len(data) < fcsSize {
+		return nil, errZstdCorrupt
+	}
+	data = data[fcsSize:]
+
+	d.out, d.start = out, len(out)
+	d.rep = [3]int{1, 4, 8}
+	for {
+		if len(data) < 3 {
+			return nil, errZstdCorrupt
+		}
+		header := int(data[0]) | int(data[1])<<8 | int(data[2])<<16
+		data = data[3:]
+		last := header&1 != 0
+		size := header >> 3
+		switch (header >> 1) & 3 {
+		case 0: // raw
+			if len(data) < size {
+				return nil, errZstdCorrupt
+			}
+			d.out = append(d.out, data[:size]...)
+			data = data[size:]
+		case 1: // RLE: one byte repeated size times
+			if len(data) < 1 {
+				return nil, errZstdCorrupt
+			}
+			for i := 0; i < size; i++ {
+				d.out = append(d.out, data[0])
+			}
+			data = data[1:]
+		case 2:
+			if len(data) < size {
+				return nil, errZstdCorrupt
+			}
+			if err := d.block(data[:size]); err != nil {
+				return nil, err
+			}
+			data = data[size:]
+		default:
+			return nil, errZstdCorrupt
+		}
+		if last {
+			break
+		}
+	}
+	if checksum {
+		if len(data) < 4 {
+			return nil, errZstdCorrupt
+		}
+		if uint32(xxhash64(d.out[d.start:])) != binary.LittleEndian.Uint32(data) {
+			return nil, errors.New("zstd: checksum mismatch")
+		}
+		data = data[4:]
+	}
+	return data, nil
+}
+
+// block decodes a compressed block: its literals, then the sequences
+// that interleave them with matches.
+func (d *zstdFrame) block(data []byte) error {
+	n, err := d.readLiterals(data)
+	if err != nil {
+		return err
+	}
+	return d.sequences(data[n:])
+}
+
+// readLiterals decodes the literals section into d.literals and returns
+// its size.
+func (d *zstdFrame) readLiterals(data []byte) (int, error) {
+	if len(data) < 1 {
+		return 0, errZstdCorrupt
+	}
+	kind := data[0] & 3
+	format := (data[0] >> 2) & 3
+	if kind < 2 {
+		var size, header int
+		switch format {
+		case 0, 2:
+			size, header = int(data[0]>>3), 1
+		case 1:
+			if len(data) < 2 {
+				return 0, errZstdCorrupt
+			}
+			size, header = int(data[0]>>4)|int(data[1])<<4, 2
+		case 3:
+			if len(data) < 3 {
+				return 0, errZstdCorrupt
+			}
+			size, header = int(data[0]>>4)|int(data[1])<<4|int(data[2])<<12, 3
+		}
+		if kind == 0 {
+			if len(data) < header+size {
+				return 0, errZstdCorrupt
+			}
+			d.literals = data[header : header+size]
+			return header + size, nil
+		}
+		if len(data) < header+1 {
+			return 0, errZstdCorrupt
+		}
+		lit := make([]byte, size)
+		for i := range lit {
+			lit[i] = data[header]
+		}
+		d.literals = lit
+		return header + 1, nil
+	}
+
+	var regen, comp, header int
+	streams := 4
+	switch format {
+	case 0, 1:
+		if len(data) < 3 {
+			return 0, errZstdCorrupt
+		}
+		v := int(data[0]) | int(data[1])<<8 | int(data[2])<<16
+		regen, comp, header = (v>>4)&0x3FF, (v>>14)&0x3FF, 3
+		if format == 0 {
+			streams = 1
+		}
+	case 2:
+		if len(data) < 4 {
+			return 0, errZstdCorrupt
+		}
+		v := int(binary.LittleEndian.Uint32(data))
+		regen, comp, header = (v>>4)&0x3FFF, (v>>18)&0x3FFF, 4
+	case 3:
+		if len(data) < 5 {
+			return 0, errZstdCorrupt
+		}
+		v := int(binary.LittleEndian.Uint32(data)) | int(data[4])<<32
+		regen, comp, header = (v>>4)&0x3FFFF, (v>>22)&0x3FFFF, 5
+	}
+	if len(data) < header+comp {
+		return 0, errZstdCorrupt
+	}
+	src := data[header : header+comp]
+	if kind == 2 {
+		table, n, err := readHuffmanTable(src)
+		if err != nil {
+			return 0, err
+		}
+		d.huffman = table
+		src = src[n:]
+	} else if d.huffman == nil {
+		return 0, errZstdCorrupt
+	}
+	lit := make([]byte, 0, regen)
+	if streams == 1 {
+		var err error
+		if lit, err = d.huffman.decode(lit, src, regen); err != nil {
+			return 0, err
+		}
+	} else {
+		if len(src) < 6 {
+			return 0, errZstdCorrupt
+		}
+		sizes := [4]int{int(binary.LittleEndian.Uint16(src)), int(binary.LittleEndian.Uint16(src[2:])), int(binary.LittleEndian.Uint16(src[4:]))}
+		src = src[6:]
+		sizes[3] = len(src) - sizes[0] - sizes[1] - sizes[2]
+		if sizes[3] < 0 {
+			return 0, errZstdCorrupt
+		}
+		each := (regen + 3) / 4
+		for i, size := range sizes {
+			count := each
+			if i == 3 {
+				count = regen - 3*each
+			}
+			if count < 0 {
+				return 0, errZstdCorrupt
+			}
+			var err error
+			if lit, err = d.huffman.decode(lit, src[:size], count); err != nil {
+				return 0, err
+			}
+			src = src[size:]
+		}
+	}
+	d.literals = lit
+	return header + comp, nil
+}
+
+// sequences decodes the sequences section and executes the sequences,
+// copying literals and matches to d.out.
+func (d *zstdFrame) sequences(data []byte) error {
+	if len(data) < 1 {
+		return errZstdCorrupt
+	}
+	count := int(data[0])
+	switch {
+	case count == 0:
+		d.out = append(d.out, d.literals...)
+		return nil
+	case count < 128:
+		data = data[1:]
+	case count < 255:
+		if len(data) < 2 {
+			return errZstdCorrupt
+		}
+		count = (count-128)<<8 | int(data[1])
+		data = data[2:]
+	default:
+		if len(data) < 3 {
+			return errZstdCorrupt
+		}
+		count = (int(data[1]) | int(data[2])<<8) + 0x7F00
+		data = data[3:]
+	}
+	if len(data) < 1 {
+		return errZstdCorrupt
+	}
+	modes := data[0]
+	data = data[1:]
+	var err error
+	var n int
+	if d.ll, n, err = sequenceTable(modes>>6, data, d.ll, llDefault, zstdMaxAccuracyLL, 35); err != nil {
+		return err
+	}
+	data = data[n:]
+	if d.of, n, err = sequenceTable((modes>>4)&3, data, d.of, ofDefault, zstdMaxAccuracyOF, 31); err != nil {
+		return err
+	}
+	data = data[n:]
+	if d.ml, n, err = sequenceTable((modes>>2)&3, data, d.ml, mlDefault, zstdMaxAccuracyML, 52); err != nil {
+		return err
+	}
+	data = data[n:]
+
+	br, err := newBackwardReader(data)
+	if err != nil {
+		return err
+	}
+	llState := br.bits(d.ll.accuracy)
+	ofState := br.bits(d.of.accuracy)
+	mlState := br.bits(d.ml.accuracy)
+	lit := d.literals
+	for i := 0; i < count; i++ {
+		ofCode := d.of.entries[ofState].symbol
+		mlCode := d.ml.entries[mlState].symbol
+		llCode := d.ll.entries[llState].symbol
+		if ofCode > 31 || mlCode > 52 || llCode > 35 {
+			return errZstdCorrupt
+		}
+		offset := 1<<ofCode + int(br.bits(uint(ofCode)))
+		ml := mlBase[mlCode] + int(br.bits(mlBits[mlCode]))
+		ll := llBase[llCode] + int(br.bits(llBits[llCode]))
+		if i < count-1 {
+			llState = d.ll.next(llState, br)
+			mlState = d.ml.next(mlState, br)
+			ofState = d.of.next(ofState, br)
+		}
+		if br.overflow() {
+			return errZstdCorrupt
+		}
+
+		if offset > 3 {
+			offset -= 3
+			d.rep = [3]int{offset, d.rep[0], d.rep[1]}
+		} else {
+			if ll == 0 {
+				offset++
+			}
+			switch offset {
+			case 1:
+				offset = d.rep[0]
+			case 2:
+				offset = d.rep[1]
+				d.rep = [3]int{offset, d.rep[0], d.rep[2]}
+			case 3:
+				offset = d.rep[2]
+				d.rep = [3]int{offset, d.rep[0], d.rep[1]}
+			default:
+				offset = d.rep[0] - 1
+				d.rep = [3]int{offset, d.rep[0], d.rep[1]}
+			}
+		}
+
+		if ll > len(lit) {
+			return errZstdCorrupt
+		}
+		d.out = append(d.out, lit[:ll]...)
+		lit = lit[ll:]
+		if offset <= 0 || offset > len(d.out)-d.start {
+			return errZstdCorrupt
+		}
+		from := len(d.out) - offset
+		for j := 0; j < ml; j++ {
+			d.out = append(d.out, d.out[from+j])
+		}
+	}
+	if br.remaining() != 0 {
+		return errZstdCorrupt
+	}
+	d.out = append(d.out, lit...)
+	return nil
+}
+
+// sequenceTable returns the table a sequences section uses for one kind
+// of code, and the bytes its description takes: mode 0 is the predefined
+// distribution, 1 a single symbol, 2 a description that follows and 3 the
+// table of the previous block.
+func sequenceTable(mode byte, data []byte, previous *fseTable, predefined []int16, maxAccuracy uint, maxSymbol int) (*fseTable, int, error) {
+	switch mode {
+	case 0:
+		accuracy := uint(6)
+		if maxSymbol == 31 {
+			accuracy = 5
+		}
+		t, err := buildFSETable(predefined, accuracy)
+		return t, 0, err
+	case 1:
+		if len(data) < 1 || int(data[0]) > maxSymbol {
+			return nil, 0, errZstdCorrupt
+		}
+		return &fseTable{entries: []fseEntry{{symbol: data[0]}}}, 1, nil
+	case 2:
+		counts, accuracy, n, err := readFSECounts(data, maxSymbol)
+		if err != nil {
+			return nil, 0, err
+		}
+		if accuracy > maxAccuracy {
+			return nil, 0, errZstdCorrupt
+		}
+		t, err := buildFSETable(counts, accuracy)
+		return t, n, err
+	}
+	if previous == nil {
+		return nil, 0, errZstdCorrupt
+	}
+	return previous, 0, nil
+}
+
+// Predefined distributions and the baselines and extra bits of the
+// literal length and match length codes.
+var (
+	llDefault = []int16{4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1, -1, -1, -1, -1}
+	mlDefault = []int16{1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1, -1, -1}
+	ofDefault = []int16{1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1}
+
+	llBase = [36]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536}
+	llBits = [36]uint{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	mlBase = [53]int{3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34, 35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051, 4099, 8195, 16387, 32771, 65539}
+	mlBits = [53]uint{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+)
+
+// fseTable is a finite state entropy decoding table; the state is an index
+// into entries.
+type fseTable struct {
+	accuracy uint
+	entries  []fseEntry
+}
+
+type fseEntry struct {
+	symbol byte
+	bits   uint
+	base   uint64
+}
+
+func (t *fseTable) next(state uint64, br *backwardReader) uint64 {
+	e := t.entries[state]
+	return e.base + br.bits(e.bits)
+}
+
+// readFSECounts reads the normalized symbol counts of an FSE table
+// description and returns them with the accuracy log and the bytes read.
+// A count of -1 marks a symbol of less than one state.
+func readFSECounts(data []byte, maxSymbol int) ([]int16, uint, int, error) {
+	fr := &forwardReader{data: data}
+	accuracy := uint(fr.bits(4)) + 5
+	remaining := 1<<accuracy + 1
+	threshold := 1 << accuracy
+	width := accuracy + 1
+	counts := []int16{}
+	for remaining > 1 {
+		if len(counts) > maxSymbol {
+			return nil, 0, 0, errZstdCorrupt
+		}
+		max := 2*threshold - 1 - remaining
+		var count int
+		if low := int(fr.peek(width - 1)); low < max {
+			count = low
+			fr.skip(width - 1)
+		} else {
+			count = int(fr.peek(width))
+			if count >= threshold {
+				count -= max
+			}
+			fr.skip(width)
+		}
+		count--
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		counts = append(counts, int16(count))
+		if count == 0 {
+			for {
+				repeat := int(fr.bits(2))
+				for i := 0; i < repeat; i++ {
+					counts = append(counts, 0)
+				}
+				if repeat != 3 {
+					break
+				}
+			}
+		}
+		for remaining < threshold && threshold > 1 {
+			width--
+			threshold >>= 1
+		}
+	}
+	if remaining != 1 || len(counts) > maxSymbol+1 || fr.pos > len(data)*8 {
+		return nil, 0, 0, errZstdCorrupt
+	}
+	return counts, accuracy, (fr.pos + 7) / 8, nil
+}
+
+// buildFSETable spreads the symbols over the states as RFC 8878 section
+// 4.1.1 describes.
+func buildFSETable(counts []int16, accuracy uint) (*fseTable, error) {
+	size := 1 << accuracy
+	t := &fseTable{accuracy: accuracy, entries: make([]fseEntry, size)}
+	next := make([]int, len(counts))
+	high := size - 1
+	for s, c := range counts {
+		if c == -1 {
+			if high < 0 {
+				return nil, errZstdCorrupt
+			}
+			t.entries[high].symbol = byte(s)
+			high--
+			next[s] = 1
+		} else {
+			next[s] = int(c)
+		}
+	}
+	step := size>>1 + size>>3 + 3
+	pos := 0
+	for s, c := range counts {
+		for i := 0; i < int(c); i++ {
+			t.entries[pos].symbol = byte(s)
+			pos = (pos + step) & (size - 1)
+			for pos > high {
+				pos = (pos + step) & (size - 1)
+			}
+		}
+	}
+	if pos != 0 {
+		return nil, errZstdCorrupt
+	}
+	for i := range t.entries {
+		s := t.entries[i].symbol
+		state := next[s]
+		next[s]++
+		if state == 0 {
+			return nil, errZstdCorrupt
+		}
+		nbits := accuracy - uint(bits.Len(uint(state))-1)
+		t.entries[i].bits = nbits
+		t.entries[i].base = uint64(state<<nbits - size)
+	}
+	return t, nil
+}
+
+// huffmanTable decodes literals: peeking maxBits bits yields the symbol
+// and the length of its code.
+type huffmanTable struct {
+	maxBits uint
+	entries []huffmanEntry
+}
+
+type huffmanEntry struct {
+	symbol byte
+	bits   uint
+}
+
+// readHuffmanTable reads a Huffman tree description and returns the table
+// and the bytes read.
+func readHuffmanTable(data []byte) (*huffmanTable, int, error) {
+	if len(data) < 1 {
+		return nil, 0, errZstdCorrupt
+	}
+	header := int(data[0])
+	var weights []byte
+	var n int
+	if header >= 128 {
+		count := header - 127
+		n = 1 + (count+1)/2
+		if len(data) < n {
+			return nil, 0, errZstdCorrupt
+		}
+		for i := 0; i < count; i++ {
+			b := data[1+i/2]
+			if i%2 == 0 {
+				weights = append(weights, b>>4)
+			} else {
+				weights = append(weights, b&0x0F)
+			}
+		}
+	} else {
+		n = 1 + header
+		if len(data) < n {
+			return nil, 0, errZstdCorrupt
+		}
+		var err error
+		if weights, err = fseWeights(data[1:n]); err != nil {
+			return nil, 0, err
+		}
+	}
+	t, err := buildHuffmanTable(weights)
+	return t, n, err
+}
+
+// fseWeights decodes FSE-compressed Huffman weights, read with two states
+// taking turns until the bitstream is used up.
+func fseWeights(data []byte) ([]byte, error) {
+	counts, accuracy, n, err := readFSECounts(data, 255)
+	if err != nil {
+		return nil, err
+	}
+	if accuracy > 6 {
+		return nil, errZstdCorrupt
+	}
+	t, err := buildFSETable(counts, accuracy)
+	if err != nil {
+		return nil, err
+	}
+	br, err := newBackwardReader(data[n:])
+	if err != nil {
+		return nil, err
+	}
+	states := [2]uint64{br.bits(accuracy), br.bits(accuracy)}
+	weights := []byte{}
+	for i := 0; ; i = 1 - i {
+		if len(weights) > 254 {
+			return nil, errZstdCorrupt
+		}
+		weights = append(weights, t.entries[states[i]].symbol)
+		states[i] = t.next(states[i], br)
+		if br.overflow() {
+			weights = append(weights, t.entries[states[1-i]].symbol)
+			return weights, nil
+		}
+	}
+}
+
+// buildHuffmanTable completes the weights with the implied last one and
+// fills the decoding table.
+func buildHuffmanTable(weights []byte) (*huffmanTable, error) {
+	total := 0
+	for _, w := range weights {
+		if w > zstdMaxHuffmanBits {
+			return nil, errZstdCorrupt
+		}
+		if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+	if total == 0 {
+		return nil, errZstdCorrupt
+	}
+	maxBits := uint(bits.Len(uint(total)))
+	left := 1<<maxBits - total
+	if left&(left-1) != 0 || maxBits > zstdMaxHuffmanBits {
+		return nil, errZstdCorrupt
+	}
+	weights = append(weights, byte(bits.Len(uint(left))))
+	rank := make([]int, maxBits+2)
+	for _, w := range weights {
+		if w > 0 {
+			rank[w] += 1 << (w - 1)
+		}
+	}
+	start := make([]int, maxBits+2)
+	for w := 1; w <= int(maxBits); w++ {
+		start[w+1] = start[w] + rank[w]
+	}
+	t := &huffmanTable{maxBits: maxBits, entries: make([]huffmanEntry, 1<<maxBits)}
+	for s, w := range weights {
+		if w == 0 {
+			continue
+		}
+		length := 1 << (w - 1)
+		for i := 0; i < length; i++ {
+			t.entries[start[w]+i] = huffmanEntry{symbol: byte(s), bits: maxBits + 1 - uint(w)}
+		}
+		start[w] += length
+	}
+	return t, nil
+}
+
+// decode appends the count symbols of one Huffman-coded stream to out.
+func (t *huffmanTable) decode(out, data []byte, count int) ([]byte, error) {
+	br, err := newBackwardReader(data)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < count; i++ {
+		e := t.entries[br.peek(t.maxBits)]
+		br.skip(e.bits)
+		out = append(out, e.symbol)
+	}
+	if br.remaining() != 0 {
+		return nil, errZstdCorrupt
+	}
+	return out, nil
+}
+
+// forwardReader reads a little-endian bitstream from its first bit on.
+type forwardReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *forwardReader) peek(n uint) uint64 {
+	var v uint64
+	for i := uint(0); i < n; i++ {
+		p := r.pos + int(i)
+		if p/8 < len(r.data) && r.data[p/8]>>(p%8)&1 != 0 {
+			v |= 1 << i
+		}
+	}
+	return v
+}
+
+func (r *forwardReader) skip(n uint) { r.pos += int(n) }
+
+func (r *forwardReader) bits(n uint) uint64 {
+	v := r.peek(n)
+	r.skip(n)
+	return v
+}
+
+// backwardReader reads a bitstream from its end towards its start, as
+// entropy-coded zstd streams are written. The last byte's highest set bit
+// marks where the stream ends. Reading past the start yields zeros and
+// leaves pos negative, see overflow.
+type backwardReader struct {
+	data []byte
+	pos  int // the number of unread bits
+}
+
+func newBackwardReader(data []byte) (*backwardReader, error) {
+	if len(data) == 0 || data[len(data)-1] == 0 {
+		return nil, errZstdCorrupt
+	}
+	return &backwardReader{data: data, pos: (len(data)-1)*8 + bits.Len8(data[len(data)-1]) - 1}, nil
+}
+
+// peek returns the next n bits, n at most 56, the first of them highest.
+func (r *backwardReader) peek(n uint) uint64 {
+	if n == 0 {
+		return 0
+	}
+	start, width, shift := r.pos-int(n), int(n), 0
+	if start < 0 {
+		width, shift, start = r.pos, -start, 0
+		if width <= 0 {
+			return 0
+		}
+	}
+	var chunk uint64
+	for i := 0; i < 8 && start/8+i < len(r.data); i++ {
+		chunk |= uint64(r.data[start/8+i]) << (8 * i)
+	}
+	return (chunk >> (start % 8) & (1<<width - 1)) << shift
+}
+
+func (r *backwardReader) skip(n uint) { r.pos -= int(n) }
+
+func (r *backwardReader) bits(n uint) uint64 {
+	v := r.peek(n)
+	r.skip(n)
+	return v
+}
+
+func (r *backwardReader) remaining() int { return r.pos }
+
+func (r *backwardReader) overflow() bool { return r.pos < 0 }
+
+// xxhash64 is XXH64 with seed 0, whose low 32 bits are a frame's content
+// checksum.
+func xxhash64(b []byte) uint64 {
+	// Variables rather than constants, so that the sums wrap around.
+	var (
+		p1 uint64 = 11400714785074694791
+		p2 uint64 = 14029467366897019727
+		p3 uint64 = 1609587929392839161
+		p4 uint64 = 9650029242287828579
+		p5 uint64 = 2870177450012600261
+	)
+	round := func(acc, in uint64) uint64 {
+		return bits.RotateLeft64(acc+in*p2, 31) * p1
+	}
+	n := len(b)
+	var h uint64
+	if n >= 32 {
+		v1, v2, v3, v4 := p1+p2, p2, uint64(0), -p1
+		for len(b) >= 32 {
+			v1 = round(v1, binary.LittleEndian.Uint64(b))
+			v2 = round(v2, binary.LittleEndian.Uint64(b[8:]))
+			v3 = round(v3, binary.LittleEndian.Uint64(b[16:]))
+			v4 = round(v4, binary.LittleEndian.Uint64(b[24:]))
+			b = b[32:]
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		for _, v := range []uint64{v1, v2, v3, v4} {
+			h = (h^round(0, v))*p1 + p4
+		}
+	} else {
+		h = p5
+	}
+	h += uint64(n)
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= round(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*p1 + p4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * p1
+		h = bits.RotateLeft64(h, 23)*p2 + p3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * p5
+		h = bits.RotateLeft64(h, 11) * p1
+	}
+	h ^= h >> 33
+	h *= p2
+	h ^= h >> 29
+	h *= p3
+	h ^= h >> 32
+	return h
+}
@@ -0,0 +1,97 @@
+package xform
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// zstdSample is sampleXML() compressed with zstd -19, which uses Huffman
+// coded literals, FSE coded sequences and a content checksum.
+var zstdSample = mustHex(
+	"28b52ffd643b1715110036db3b17604d720cd4f95e7d1704016bec2545482403560110e4394200360029009585756555" +
+		"45754d2d2925211d1915114d43bb9ee3b75df42765564b2605cf1086a454a1d1282492428508037148ca824141f16014" +
+		"923285e0080012480311590c02b4efecaa6a2aeaa96929e93abaa9998979695949794e2e2a26221e1a16128e837b7a79" +
+		"7877767574dfdc9a5a1ada995919d936b6a501dbb66ddbb65dd7755dd7755dd7344dd3344dd334fdffffffff3fcff33c" +
+		"cff33ccfbbbab9b8b7b6b5018004b2efb9b8bb6d2dedbbebaaba7e6aaa93aea39b798e99e79594f9e4a262228e1be2f8" +
+		"3878dff77ddff77ddfb66d0180d3a820c4565876030025101191090f1240300830081a08c109822008822199020c0272" +
+		"8e09ec03631ab54c4ccfec7fcaf7892e7163153e475d9832c82db525cb9e91ad8d5dc5ae844d80cdbee6798dd335e79a" +
+		"b735a635cd9a84357635b59a523541359b9a27354ed41c6aded398d3b46912d3d8d254694ad204d2ec689ed1384573a2" +
+		"79436342d3a04940633f539f293d133cb39d793ae3e4cc71e6dd8cd94c6b26d18ccd4c65a6c44cc0cc5ee6b98cd33267" +
+		"99b732a6b2eab5c1bb2aaec3df66f9bb2aaec3df66f9bb2aaec3df66f9bb2aaec3df66f9bb2aaec3df66f9bb2aaec3df" +
+		"66f9dbc58de046bccddcc66d036cf3d746b5319a36451b117f3df79a119b9dc4e10a44aedf05577ef3e49da2f9e49f82" +
+		"fbb97abd415d99d77bdf361e03f247068f014093e453047580d49465ec8fafed")
+
+// zstdTiny is "<r>hi</r>" as written by zstd -1: a single raw block.
+var zstdTiny = mustHex("28b52ffd04484900003c723e68693c2f723ed8a0b410")
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func sampleXML() string {
+	b := &strings.Builder{}
+	b.WriteString("<items>\n")
+	names := []string{"alpha", "beta", "gamma", "delta"}
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(b, "<item n=\"%d\">%s</item>\n", i, strings.Repeat(names[i*7%4], i%3+1))
+	}
+	b.WriteString("</items>\n")
+	return b.String()
+}
+
+func TestDecodeZstd(t *testing.T) {
+	got, err := decodeZstd(zstdSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != sampleXML() {
+		t.Errorf("decoded %d bytes that differ from the %d of the sample", len(got), len(sampleXML()))
+	}
+	got, err = decodeZstd(zstdTiny)
+	if err != nil || string(got) != "<r>hi</r>" {
+		t.Errorf("tiny = %q, %v", got, err)
+	}
+}
+
+func TestDecodeZstdFrames(t *testing.T) {
+	skippable := []byte{0x50, 0x2a, 0x4d, 0x18, 3, 0, 0, 0, 'a', 'b', 'c'}
+	data := bytes.Join([][]byte{zstdTiny, skippable, zstdTiny}, nil)
+	got, err := decodeZstd(data)
+	if err != nil || string(got) != "<r>hi</r><r>hi</r>" {
+		t.Errorf("concatenated frames = %q, %v", got, err)
+	}
+}
+
+func TestDecodeZstdErrors(t *testing.T) {
+	corrupt := append([]byte{}, zstdSample...)
+	corrupt[len(corrupt)/2] ^= 0xFF
+	badSum := append([]byte{}, zstdTiny...)
+	badSum[len(badSum)-1] ^= 1
+	for name, data := range map[string][]byte{
+		"corrupt":   corrupt,
+		"checksum":  badSum,
+		"truncated": zstdSample[:len(zstdSample)/2],
+		"magic":     []byte("not zstd"),
+	} {
+		if _, err := decodeZstd(data); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestZstdInput(t *testing.T) {
+	doc, err := ParseInput("items.xml.zst", zstdSample, FormatAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(doc.Children[0].Children); got != 401 {
+		t.Errorf("got %d children of <items>, want 401", got)
+	}
+}